@@ -18,9 +18,9 @@ package binanceex
 import (
 	"fmt"
 	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/decimal"
 	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/types"
-	"gitlab.com/crankykernel/maker/go/util"
 )
 
 type BinancePriceService struct {
@@ -37,45 +37,45 @@ func NewBinancePriceService(exchangeInfoService *ExchangeInfoService) *BinancePr
 
 // GetLastPrice gets the most current close price from Binance using the REST
 // API.
-func (s *BinancePriceService) GetLastPrice(symbol string) (float64, error) {
+func (s *BinancePriceService) GetLastPrice(symbol string) (decimal.Decimal, error) {
 	ticker, err := s.client.GetPriceTicker(symbol)
 	if err != nil {
-		return 0, err
+		return decimal.Zero, err
 	}
-	return ticker.Price, nil
+	return decimal.NewFromFloatChecked(ticker.Price)
 }
 
 // GetBestBidPrice gets the most current best bid price from Binance using
 // the REST API.
-func (s *BinancePriceService) GetBestBidPrice(symbol string) (float64, error) {
+func (s *BinancePriceService) GetBestBidPrice(symbol string) (decimal.Decimal, error) {
 	ticker, err := s.client.GetBookTicker(symbol)
 	if err != nil {
-		return 0, err
+		return decimal.Zero, err
 	}
-	return ticker.BidPrice, nil
+	return decimal.NewFromFloatChecked(ticker.BidPrice)
 }
 
 // GetBestBidPrice gets the most current best bid price from Binance using
 // the REST API.
-func (s *BinancePriceService) GetBestAskPrice(symbol string) (float64, error) {
+func (s *BinancePriceService) GetBestAskPrice(symbol string) (decimal.Decimal, error) {
 	ticker, err := s.client.GetBookTicker(symbol)
 	if err != nil {
-		return 0, err
+		return decimal.Zero, err
 	}
-	return ticker.AskPrice, nil
+	return decimal.NewFromFloatChecked(ticker.AskPrice)
 }
 
-func (s *BinancePriceService) AdjustPriceByTicks(symbol string, price float64, ticks int64) float64 {
+func (s *BinancePriceService) AdjustPriceByTicks(symbol string, price decimal.Decimal, ticks int64) decimal.Decimal {
 	tickSize, err := s.exchangeInfoService.GetTickSize(symbol)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"symbol": symbol,
 		}).Errorf("Failed to lookup tick size")
 	}
-	return util.Round8(price + (tickSize * float64(ticks)))
+	return price.Add(tickSize.Mul(decimal.NewFromInt(ticks)))
 }
 
-func (s *BinancePriceService) GetPrice(symbol string, priceSource types.PriceSource) (float64, error) {
+func (s *BinancePriceService) GetPrice(symbol string, priceSource types.PriceSource) (decimal.Decimal, error) {
 	switch priceSource {
 	case types.PriceSourceLast:
 		return s.GetLastPrice(symbol)
@@ -84,6 +84,6 @@ func (s *BinancePriceService) GetPrice(symbol string, priceSource types.PriceSou
 	case types.PriceSourceBestAsk:
 		return s.GetBestAskPrice(symbol)
 	default:
-		return 0, fmt.Errorf("unknown price source: %s", priceSource)
+		return decimal.Zero, fmt.Errorf("unknown price source: %s", priceSource)
 	}
 }
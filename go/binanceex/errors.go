@@ -0,0 +1,68 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"strings"
+)
+
+// Binance REST API error codes.
+const (
+	BinanceErrorCodeFilterFailure    = -1013
+	BinanceErrorCodeNewOrderRejected = -2010
+	BinanceErrorCodeNoSuchOrder      = -2013
+)
+
+// BinanceError is the error body of a failed Binance REST API request.
+type BinanceError struct {
+	Code    int    `json:"code"`
+	Message string `json:"msg"`
+}
+
+func (e *BinanceError) Error() string {
+	return fmt.Sprintf("binance error %d: %s", e.Code, e.Message)
+}
+
+// ParseBinanceError returns the Binance error body of a REST client error, or
+// nil if the error did not come from the Binance API.
+func ParseBinanceError(err error) *BinanceError {
+	restApiError, ok := err.(*binanceapi.RestApiError)
+	if !ok {
+		return nil
+	}
+	var binanceError BinanceError
+	if err := json.Unmarshal(restApiError.Body, &binanceError); err != nil {
+		return nil
+	}
+	return &binanceError
+}
+
+func (e *BinanceError) IsInsufficientBalance() bool {
+	return e.Code == BinanceErrorCodeNewOrderRejected &&
+		strings.Contains(strings.ToLower(e.Message), "insufficient balance")
+}
+
+func (e *BinanceError) IsMinNotional() bool {
+	return e.Code == BinanceErrorCodeFilterFailure &&
+		strings.Contains(e.Message, "MIN_NOTIONAL")
+}
+
+func (e *BinanceError) IsNoSuchOrder() bool {
+	return e.Code == BinanceErrorCodeNoSuchOrder
+}
@@ -27,14 +27,25 @@ package binanceex
 import (
 	"fmt"
 	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/decimal"
 	"gitlab.com/crankykernel/maker/go/log"
+	"strconv"
 	"sync"
 )
 
 type SymbolInfo struct {
-	TickSize    float64
-	StepSize    float64
-	MinNotional float64
+	// The trading status of the symbol, TRADING if it can be traded.
+	Status      string
+	BaseAsset   string
+	QuoteAsset  string
+	TickSize    decimal.Decimal
+	StepSize    decimal.Decimal
+	MinNotional decimal.Decimal
+
+	// The PERCENT_PRICE filter, an order price must be within these
+	// multiples of the average price.
+	MultiplierUp   decimal.Decimal
+	MultiplierDown decimal.Decimal
 }
 
 type ExchangeInfoService struct {
@@ -56,17 +67,37 @@ func (s *ExchangeInfoService) Update() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	for _, symbol := range exchangeInfo.Symbols {
-		symbolInfo := SymbolInfo{}
+		symbolInfo := SymbolInfo{
+			Status:     symbol.Status,
+			BaseAsset:  symbol.BaseAsset,
+			QuoteAsset: symbol.QuoteAsset,
+		}
+		var err error
 		for _, filter := range symbol.Filters {
+			if err != nil {
+				break
+			}
 			switch filter.FilterType {
 			case "PRICE_FILTER":
-				symbolInfo.TickSize = filter.TickSize
+				symbolInfo.TickSize, err = decimal.NewFromFloatChecked(filter.TickSize)
 			case "MIN_NOTIONAL":
-				symbolInfo.MinNotional = filter.MinNotional
+				symbolInfo.MinNotional, err = decimal.NewFromFloatChecked(filter.MinNotional)
 			case "LOT_SIZE":
-				symbolInfo.StepSize = filter.StepSize
+				symbolInfo.StepSize, err = decimal.NewFromFloatChecked(filter.StepSize)
+			case "PERCENT_PRICE":
+				symbolInfo.MultiplierUp, err = decimal.NewFromFloatChecked(filter.MultiplierUp)
+				if err == nil {
+					symbolInfo.MultiplierDown, err = decimal.NewFromFloatChecked(
+						filter.MultiplierDown)
+				}
 			}
 		}
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": symbol.Symbol,
+			}).Warnf("Skipping symbol with an invalid filter")
+			continue
+		}
 		s.Symbols[symbol.Symbol] = symbolInfo
 	}
 	log.WithFields(log.Fields{
@@ -87,34 +118,59 @@ func (s *ExchangeInfoService) GetSymbol(symbol string) (info SymbolInfo, err err
 }
 
 // GetTickSize returns the tick size for the requested symbol.
-func (s *ExchangeInfoService) GetTickSize(symbol string) (float64, error) {
+func (s *ExchangeInfoService) GetTickSize(symbol string) (decimal.Decimal, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 	symbolInfo, ok := s.Symbols[symbol]
 	if !ok {
-		return 0, fmt.Errorf("symbol not found")
+		return decimal.Zero, fmt.Errorf("symbol not found")
 	}
 	return symbolInfo.TickSize, nil
 }
 
 // GetMinNotional returns the minimum notional value for the requested symbol.
-func (s *ExchangeInfoService) GetMinNotional(symbol string) (float64, error) {
+func (s *ExchangeInfoService) GetMinNotional(symbol string) (decimal.Decimal, error) {
 	s.lock.RLock()
-	defer s.lock.Unlock()
+	defer s.lock.RUnlock()
 	symbolInfo, ok := s.Symbols[symbol]
 	if !ok {
-		return 0, fmt.Errorf("symbol not found")
+		return decimal.Zero, fmt.Errorf("symbol not found")
 	}
 	return symbolInfo.MinNotional, nil
 }
 
 // GetStepSize returns the step size for the requested symbol.
-func (s *ExchangeInfoService) GetStepSize(symbol string) (float64, error) {
+func (s *ExchangeInfoService) GetStepSize(symbol string) (decimal.Decimal, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 	symbolInfo, ok := s.Symbols[symbol]
 	if !ok {
-		return 0, fmt.Errorf("symbol not found")
+		return decimal.Zero, fmt.Errorf("symbol not found")
 	}
 	return symbolInfo.StepSize, nil
 }
+
+// QuantityParameter returns a quantity for an order on the symbol, rounded
+// down to the step size. The API client takes floats, so the quantity is
+// formatted to the step size precision and parsed back. The float nearest to
+// the formatted value is sent with those same digits, where arithmetic on
+// the float could have landed one step off.
+func (s *ExchangeInfoService) QuantityParameter(symbol string, quantity decimal.Decimal) (float64, error) {
+	stepSize, err := s.GetStepSize(symbol)
+	if err != nil {
+		return 0, err
+	}
+	quantity = quantity.RoundDown(stepSize)
+	return strconv.ParseFloat(quantity.StringFixed(stepSize.DecimalPlaces()), 64)
+}
+
+// PriceParameter returns a price for an order on the symbol, rounded to the
+// tick size and formatted to its precision like QuantityParameter.
+func (s *ExchangeInfoService) PriceParameter(symbol string, price decimal.Decimal) (float64, error) {
+	tickSize, err := s.GetTickSize(symbol)
+	if err != nil {
+		return 0, err
+	}
+	price = price.Round(tickSize)
+	return strconv.ParseFloat(price.StringFixed(tickSize.DecimalPlaces()), 64)
+}
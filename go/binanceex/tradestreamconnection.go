@@ -0,0 +1,306 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/gorilla/websocket"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/util"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BinanceCombinedStreamUrl = "wss://stream.binance.com:9443/stream"
+
+const (
+	// How long a connection may go without receiving anything, including
+	// pongs, before it is considered stalled and reconnected.
+	tradeStreamReadTimeout = 60 * time.Second
+
+	// How often to ping Binance. Must be less than the read timeout.
+	tradeStreamPingInterval = 20 * time.Second
+
+	tradeStreamWriteTimeout = 10 * time.Second
+)
+
+type combinedStreamMessage struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type streamCommand struct {
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	ID     uint64   `json:"id"`
+}
+
+// streamConn is the part of a websocket connection used by the trade stream.
+type streamConn interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+func dialTradeStream() (streamConn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(BinanceCombinedStreamUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tradeStreamConnection is a single websocket connection to the Binance
+// combined stream endpoint. Symbols are added and removed with SUBSCRIBE and
+// UNSUBSCRIBE messages so one connection can carry many symbols.
+type tradeStreamConnection struct {
+	id      int
+	manager *TradeStreamManager
+
+	// Opens the websocket, and the delay between attempts.
+	dial    func() (streamConn, error)
+	backoff *util.Backoff
+
+	lock      sync.Mutex
+	symbols   map[string]bool
+	conn      streamConn
+	commandId uint64
+	closed    bool
+}
+
+func newTradeStreamConnection(id int, manager *TradeStreamManager) *tradeStreamConnection {
+	return &tradeStreamConnection{
+		id:      id,
+		manager: manager,
+		dial:    dialTradeStream,
+		backoff: util.NewBackoff(time.Second, time.Minute),
+		symbols: make(map[string]bool),
+	}
+}
+
+func streamNameForSymbol(symbol string) string {
+	return fmt.Sprintf("%s@aggTrade", strings.ToLower(symbol))
+}
+
+func (c *tradeStreamConnection) subscribe(symbols []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, symbol := range symbols {
+		c.symbols[symbol] = true
+	}
+	if c.conn != nil {
+		c.sendCommand("SUBSCRIBE", symbols)
+	}
+}
+
+func (c *tradeStreamConnection) unsubscribe(symbol string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.symbols, symbol)
+	if c.conn != nil {
+		c.sendCommand("UNSUBSCRIBE", []string{symbol})
+	}
+}
+
+func (c *tradeStreamConnection) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *tradeStreamConnection) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// Must be called with the lock held.
+func (c *tradeStreamConnection) sendCommand(method string, symbols []string) {
+	if len(symbols) == 0 {
+		return
+	}
+	c.commandId++
+	command := streamCommand{
+		Method: method,
+		ID:     c.commandId,
+	}
+	for _, symbol := range symbols {
+		command.Params = append(command.Params, streamNameForSymbol(symbol))
+	}
+	buf, err := json.Marshal(command)
+	if err != nil {
+		log.WithError(err).Errorf("Failed to encode trade stream command")
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(tradeStreamWriteTimeout))
+	if err := c.conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+		// The read loop will notice the broken connection and reconnect,
+		// resubscribing to all symbols.
+		log.WithError(err).WithFields(log.Fields{
+			"connection": c.id,
+			"method":     method,
+		}).Errorf("Failed to send trade stream command")
+		c.conn.Close()
+	}
+}
+
+func (c *tradeStreamConnection) run() {
+	backoff := c.backoff
+	reconnect := false
+	for {
+		if c.isClosed() {
+			return
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			delay := backoff.Next()
+			log.WithError(err).WithFields(log.Fields{
+				"connection": c.id,
+				"retryIn":    delay,
+			}).Errorf("Failed to open Binance trade stream")
+			time.Sleep(delay)
+			continue
+		}
+
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			conn.Close()
+			return
+		}
+		c.conn = conn
+		symbols := []string{}
+		for symbol := range c.symbols {
+			symbols = append(symbols, symbol)
+		}
+		c.sendCommand("SUBSCRIBE", symbols)
+		c.lock.Unlock()
+
+		log.WithFields(log.Fields{
+			"connection": c.id,
+			"symbols":    len(symbols),
+		}).Infof("Connected to Binance combined trade stream")
+
+		if reconnect {
+			go c.manager.resyncPrices(symbols)
+		}
+		reconnect = true
+
+		if c.readLoop(conn) {
+			backoff.Reset()
+		}
+
+		c.lock.Lock()
+		c.conn = nil
+		c.lock.Unlock()
+		conn.Close()
+
+		if c.isClosed() {
+			log.WithFields(log.Fields{
+				"connection": c.id,
+			}).Infof("Binance trade stream connection closed")
+			return
+		}
+
+		delay := backoff.Next()
+		log.WithFields(log.Fields{
+			"connection": c.id,
+			"retryIn":    delay,
+		}).Warnf("Binance trade stream disconnected, reconnecting")
+		time.Sleep(delay)
+	}
+}
+
+// readLoop reads messages until the connection fails or stalls. Returns true
+// if at least one trade was received, which is taken as a sign the
+// connection was healthy and the backoff can be reset.
+func (c *tradeStreamConnection) readLoop(conn streamConn) bool {
+	healthy := false
+
+	conn.SetReadDeadline(time.Now().Add(tradeStreamReadTimeout))
+	conn.SetPongHandler(func(appData string) error {
+		conn.SetReadDeadline(time.Now().Add(tradeStreamReadTimeout))
+		return nil
+	})
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(tradeStreamPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				deadline := time.Now().Add(tradeStreamWriteTimeout)
+				if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+					log.WithError(err).WithFields(log.Fields{
+						"connection": c.id,
+					}).Warnf("Failed to ping Binance trade stream")
+				}
+			}
+		}
+	}()
+
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			if !c.isClosed() {
+				log.WithError(err).WithFields(log.Fields{
+					"connection": c.id,
+				}).Errorf("Failed to read trade stream message")
+			}
+			return healthy
+		}
+		conn.SetReadDeadline(time.Now().Add(tradeStreamReadTimeout))
+
+		var message combinedStreamMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"connection": c.id,
+			}).Errorf("Failed to decode trade stream message")
+			continue
+		}
+
+		// Responses to subscribe and unsubscribe commands have no stream.
+		if message.Stream == "" {
+			continue
+		}
+
+		var trade binanceapi.StreamAggTrade
+		if err := json.Unmarshal(message.Data, &trade); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"stream": message.Stream,
+			}).Errorf("Failed to decode trade stream message")
+			continue
+		}
+		healthy = true
+
+		c.manager.dispatch(trade)
+	}
+}
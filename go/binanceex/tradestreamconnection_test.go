@@ -0,0 +1,153 @@
+package binanceex
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/util"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStreamConn is a websocket connection fed by the test. Reads fail once
+// messages is closed, as if the connection dropped.
+type fakeStreamConn struct {
+	messages chan []byte
+	commands chan streamCommand
+
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func newFakeStreamConn() *fakeStreamConn {
+	return &fakeStreamConn{
+		messages: make(chan []byte, 8),
+		commands: make(chan streamCommand, 8),
+		closed:   make(chan bool),
+	}
+}
+
+func (c *fakeStreamConn) ReadMessage() (int, []byte, error) {
+	select {
+	case message, ok := <-c.messages:
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		return websocket.TextMessage, message, nil
+	case <-c.closed:
+		return 0, nil, fmt.Errorf("use of closed connection")
+	}
+}
+
+func (c *fakeStreamConn) WriteMessage(messageType int, data []byte) error {
+	var command streamCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		return err
+	}
+	c.commands <- command
+	return nil
+}
+
+func (c *fakeStreamConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return nil
+}
+
+func (c *fakeStreamConn) SetReadDeadline(t time.Time) error           { return nil }
+func (c *fakeStreamConn) SetWriteDeadline(t time.Time) error          { return nil }
+func (c *fakeStreamConn) SetPongHandler(h func(appData string) error) {}
+
+func (c *fakeStreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *fakeStreamConn) receiveCommand(t *testing.T) streamCommand {
+	select {
+	case command := <-c.commands:
+		return command
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a command")
+	}
+	return streamCommand{}
+}
+
+func receiveTrade(t *testing.T, channel TradeStreamChannel) binanceapi.StreamAggTrade {
+	select {
+	case trade := <-channel:
+		return trade
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a trade")
+	}
+	return binanceapi.StreamAggTrade{}
+}
+
+func TestTradeStreamReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	manager := NewTradeStreamManager()
+	manager.getPriceTicker = func(symbol string) (*binanceapi.PriceTickerResponse, error) {
+		return &binanceapi.PriceTickerResponse{Symbol: symbol, Price: 0.02}, nil
+	}
+	channel := manager.Subscribe("test")
+
+	// The first attempt to connect fails.
+	conns := make(chan *fakeStreamConn, 2)
+	dials := 0
+	connection := newTradeStreamConnection(1, manager)
+	connection.backoff = util.NewBackoff(time.Millisecond, 10*time.Millisecond)
+	connection.dial = func() (streamConn, error) {
+		dials++
+		if dials == 1 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		conn := newFakeStreamConn()
+		conns <- conn
+		return conn, nil
+	}
+	connection.subscribe([]string{"ethbtc", "ltcbtc"})
+	go connection.run()
+	defer connection.close()
+
+	first := <-conns
+	command := first.receiveCommand(t)
+	assert.Equal("SUBSCRIBE", command.Method)
+	assert.ElementsMatch([]string{"ethbtc@aggTrade", "ltcbtc@aggTrade"}, command.Params)
+
+	first.messages <- []byte(`{"stream": "ethbtc@aggTrade", "data": {"e": "aggTrade", "s": "ETHBTC", "p": "0.01"}}`)
+	trade := receiveTrade(t, channel)
+	assert.Equal("ETHBTC", trade.Symbol)
+	assert.Equal(0.01, trade.Price)
+
+	// After the connection drops every symbol is subscribed to again, and
+	// their prices caught up on.
+	close(first.messages)
+	var second *fakeStreamConn
+	select {
+	case second = <-conns:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a reconnect")
+	}
+	command = second.receiveCommand(t)
+	assert.Equal("SUBSCRIBE", command.Method)
+	assert.ElementsMatch([]string{"ethbtc@aggTrade", "ltcbtc@aggTrade"}, command.Params)
+
+	resynced := []string{}
+	for i := 0; i < 2; i++ {
+		trade := receiveTrade(t, channel)
+		assert.Equal(0.02, trade.Price)
+		resynced = append(resynced, trade.Symbol)
+	}
+	assert.ElementsMatch([]string{"ETHBTC", "LTCBTC"}, resynced)
+
+	// Symbols added while connected are subscribed to on the connection.
+	connection.subscribe([]string{"bnbbtc"})
+	command = second.receiveCommand(t)
+	assert.Equal("SUBSCRIBE", command.Method)
+	assert.Equal([]string{"bnbbtc@aggTrade"}, command.Params)
+}
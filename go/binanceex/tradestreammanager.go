@@ -16,8 +16,6 @@
 package binanceex
 
 import (
-	"encoding/json"
-	"fmt"
 	"github.com/crankykernel/binanceapi-go"
 	"gitlab.com/crankykernel/maker/go/log"
 	"strings"
@@ -25,20 +23,41 @@ import (
 	"time"
 )
 
+// The maximum number of symbols to subscribe to over a single connection.
+// Binance allows more, but spreading symbols over a few connections limits
+// the damage when one connection drops.
+const maxSymbolsPerConnection = 50
+
 type TradeStreamChannel chan binanceapi.StreamAggTrade
 
 type TradeStreamManager struct {
+	// Serializes symbol changes. Held while subscribe commands are sent,
+	// outside the main lock, so they reach Binance in order.
+	symbolLock sync.Mutex
+
 	lock          sync.RWMutex
 	subscriptions map[TradeStreamChannel]string
-	streams       map[string]*binanceapi.Stream
+	filtered      map[*TradeStreamSubscription]bool
 	streamCount   map[string]int
+
+	// The connection each symbol is subscribed over.
+	connections      map[string]*tradeStreamConnection
+	connectionPool   []*tradeStreamConnection
+	nextConnectionId int
+
+	// Fetches the last price of a symbol to catch up after a reconnect.
+	getPriceTicker func(symbol string) (*binanceapi.PriceTickerResponse, error)
 }
 
 func NewTradeStreamManager() *TradeStreamManager {
 	return &TradeStreamManager{
 		subscriptions: make(map[TradeStreamChannel]string),
-		streams:       make(map[string]*binanceapi.Stream),
+		filtered:      make(map[*TradeStreamSubscription]bool),
 		streamCount:   make(map[string]int),
+		connections:   make(map[string]*tradeStreamConnection),
+		getPriceTicker: func(symbol string) (*binanceapi.PriceTickerResponse, error) {
+			return binanceapi.NewRestClient().GetPriceTicker(symbol)
+		},
 	}
 }
 
@@ -59,99 +78,166 @@ func (m *TradeStreamManager) Unsubscribe(channel TradeStreamChannel) {
 	delete(m.subscriptions, channel)
 }
 
-func (m *TradeStreamManager) AddSymbol(symbol string) {
+// SubscribeFiltered creates a subscription that only receives trades for the
+// symbols added to it, throttled to the latest trade per symbol every
+// interval.
+func (m *TradeStreamManager) SubscribeFiltered(name string, interval time.Duration) *TradeStreamSubscription {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	symbol = strings.ToLower(symbol)
-	_, exists := m.streamCount[symbol]
-	if exists {
-		m.streamCount[symbol] += 1
+	subscription := newTradeStreamSubscription(name, interval)
+	m.filtered[subscription] = true
+	go subscription.run()
+	return subscription
+}
+
+func (m *TradeStreamManager) UnsubscribeFiltered(subscription *TradeStreamSubscription) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, exists := m.filtered[subscription]; !exists {
+		log.Errorf("Attempt to unsubscribe non existing filtered subscription")
 		return
 	}
-	m.streamCount[symbol] = 1
-	go m.runStream(symbol)
+	delete(m.filtered, subscription)
+	close(subscription.done)
+}
+
+func (m *TradeStreamManager) AddSymbol(symbol string) {
+	m.AddSymbols(symbol)
+}
+
+// AddSymbols streams the trades of the symbols. The symbols new to each
+// connection are subscribed to with a single command, sent once the lock is
+// released so a slow connection doesn't hold up the dispatch of trades.
+func (m *TradeStreamManager) AddSymbols(symbols ...string) {
+	m.symbolLock.Lock()
+	defer m.symbolLock.Unlock()
+
+	subscribe := make(map[*tradeStreamConnection][]string)
+	m.lock.Lock()
+	for _, symbol := range symbols {
+		symbol = strings.ToLower(symbol)
+		if _, exists := m.streamCount[symbol]; exists {
+			m.streamCount[symbol] += 1
+			continue
+		}
+		m.streamCount[symbol] = 1
+		connection := m.getConnection()
+		m.connections[symbol] = connection
+		subscribe[connection] = append(subscribe[connection], symbol)
+	}
+	m.lock.Unlock()
+
+	for connection, symbols := range subscribe {
+		connection.subscribe(symbols)
+	}
 }
 
 func (m *TradeStreamManager) RemoveSymbol(symbol string) {
+	m.symbolLock.Lock()
+	defer m.symbolLock.Unlock()
+
 	m.lock.Lock()
-	defer m.lock.Unlock()
 	symbol = strings.ToLower(symbol)
 	count, exists := m.streamCount[symbol]
 	if !exists {
+		m.lock.Unlock()
 		return
 	}
 	if count > 1 {
 		m.streamCount[symbol] -= 1
+		m.lock.Unlock()
+		return
+	}
+	delete(m.streamCount, symbol)
+	connection := m.connections[symbol]
+	delete(m.connections, symbol)
+	empty := connection != nil && m.connectionSymbols()[connection] == 0
+	if empty {
+		m.removeConnection(connection)
+	}
+	m.lock.Unlock()
+
+	if connection == nil {
+		return
+	}
+	if empty {
+		connection.close()
 	} else {
-		delete(m.streamCount, symbol)
+		connection.unsubscribe(symbol)
 	}
 }
 
-func (m *TradeStreamManager) streamRefCount(name string) int {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	count, exists := m.streamCount[name]
-	if exists {
-		return count
+// connectionSymbols returns the number of symbols streamed over each
+// connection. Must be called with the lock held.
+func (m *TradeStreamManager) connectionSymbols() map[*tradeStreamConnection]int {
+	counts := make(map[*tradeStreamConnection]int)
+	for _, connection := range m.connections {
+		counts[connection]++
 	}
-	return 0
+	return counts
 }
 
-func (m *TradeStreamManager) runStream(name string) {
-Retry:
-	if m.streamRefCount(name) == 0 {
-		return
+// getConnection returns a connection with room for another symbol, opening a
+// new one if all connections are full. Must be called with the lock held.
+func (m *TradeStreamManager) getConnection() *tradeStreamConnection {
+	counts := m.connectionSymbols()
+	for _, connection := range m.connectionPool {
+		if counts[connection] < maxSymbolsPerConnection {
+			return connection
+		}
 	}
-	streamName := fmt.Sprintf("%s@aggTrade", strings.ToLower(name))
-	stream, err := binanceapi.OpenSingleStream(streamName)
-	if err != nil {
-		log.WithError(err).
-			WithField("stream", streamName).
-			Errorf("Failed to open trade stream")
-		time.Sleep(1 * time.Second)
-		goto Retry
-	}
-	log.WithFields(log.Fields{
-		"symbol": name,
-	}).Infof("Connected to trade Binance aggTrade stream")
-	for {
-		payload, err := stream.Next()
-		if err != nil {
-			log.WithError(err).
-				WithField("stream", streamName).
-				Errorf("Failed to read trade stream message")
-			stream.Close()
-			time.Sleep(1 * time.Second)
-			goto Retry
+	m.nextConnectionId++
+	connection := newTradeStreamConnection(m.nextConnectionId, m)
+	m.connectionPool = append(m.connectionPool, connection)
+	go connection.run()
+	return connection
+}
+
+// removeConnection takes the connection out of the pool, it is left to the
+// caller to close it. Must be called with the lock held.
+func (m *TradeStreamManager) removeConnection(connection *tradeStreamConnection) {
+	for i, c := range m.connectionPool {
+		if c == connection {
+			m.connectionPool = append(m.connectionPool[:i], m.connectionPool[i+1:]...)
+			break
 		}
+	}
+}
 
-		// Check if we still have subscribers.
-		count := m.streamRefCount(name)
-		if count == 0 {
-			log.WithFields(log.Fields{
-				"tickerStream": name,
-			}).Infof("Trade stream reference count is zero, disconnected stream")
-			stream.Close()
-			return
+func (m *TradeStreamManager) dispatch(trade binanceapi.StreamAggTrade) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for channel := range m.subscriptions {
+		select {
+		case channel <- trade:
+		default:
+			log.Warnf("Failed to send Binance trade to channel [%s], would block",
+				m.subscriptions[channel])
 		}
+	}
+	for subscription := range m.filtered {
+		subscription.offer(trade)
+	}
+}
 
-		var trade binanceapi.StreamAggTrade
-		if err := json.Unmarshal(payload, &trade); err != nil {
+// resyncPrices fetches the last price for each symbol from the REST API and
+// dispatches it as a trade so subscribers catch up on any price movement
+// missed while a connection was down.
+func (m *TradeStreamManager) resyncPrices(symbols []string) {
+	for _, symbol := range symbols {
+		symbol = strings.ToUpper(symbol)
+		ticker, err := m.getPriceTicker(symbol)
+		if err != nil {
 			log.WithError(err).WithFields(log.Fields{
-				"name": name,
-			}).Errorf("Failed to decode trade stream message")
+				"symbol": symbol,
+			}).Errorf("Failed to resync price after trade stream reconnect")
 			continue
 		}
-
-		m.lock.RLock()
-		for channel := range m.subscriptions {
-			select {
-			case channel <- trade:
-			default:
-				log.Warnf("Failed to send Binance trade to channel [%s], would block",
-					m.subscriptions[channel])
-			}
-		}
-		m.lock.RUnlock()
+		m.dispatch(binanceapi.StreamAggTrade{
+			EventType:       "aggTrade",
+			EventTimeMillis: time.Now().UnixNano() / int64(time.Millisecond),
+			Symbol:          symbol,
+			Price:           ticker.Price,
+		})
 	}
 }
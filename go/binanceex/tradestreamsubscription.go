@@ -0,0 +1,126 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binanceex
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscribing to this symbol subscribes to trades for all symbols.
+const TradeStreamAllSymbols = "*"
+
+// TradeStreamSubscription delivers trades for a set of symbols. Trades are
+// coalesced per symbol so at most the latest trade for each symbol is
+// delivered once per interval, regardless of how fast trades arrive. A slow
+// reader will see fewer updates rather than dropped symbols.
+type TradeStreamSubscription struct {
+	C        TradeStreamChannel
+	name     string
+	interval time.Duration
+	lock     sync.Mutex
+	symbols  map[string]bool
+	pending  map[string]binanceapi.StreamAggTrade
+	order    []string
+	done     chan bool
+}
+
+func newTradeStreamSubscription(name string, interval time.Duration) *TradeStreamSubscription {
+	return &TradeStreamSubscription{
+		C:        make(TradeStreamChannel, 64),
+		name:     name,
+		interval: interval,
+		symbols:  make(map[string]bool),
+		pending:  make(map[string]binanceapi.StreamAggTrade),
+		done:     make(chan bool),
+	}
+}
+
+func (s *TradeStreamSubscription) AddSymbols(symbols ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, symbol := range symbols {
+		s.symbols[strings.ToUpper(symbol)] = true
+	}
+}
+
+func (s *TradeStreamSubscription) RemoveSymbols(symbols ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, symbol := range symbols {
+		symbol = strings.ToUpper(symbol)
+		delete(s.symbols, symbol)
+		delete(s.pending, symbol)
+	}
+}
+
+func (s *TradeStreamSubscription) Symbols() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	symbols := []string{}
+	for symbol := range s.symbols {
+		symbols = append(symbols, symbol)
+	}
+	return symbols
+}
+
+func (s *TradeStreamSubscription) offer(trade binanceapi.StreamAggTrade) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.symbols[TradeStreamAllSymbols] && !s.symbols[trade.Symbol] {
+		return
+	}
+	if _, exists := s.pending[trade.Symbol]; !exists {
+		s.order = append(s.order, trade.Symbol)
+	}
+	s.pending[trade.Symbol] = trade
+}
+
+func (s *TradeStreamSubscription) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.order) > 0 {
+		symbol := s.order[0]
+		trade, exists := s.pending[symbol]
+		if exists {
+			select {
+			case s.C <- trade:
+			default:
+				// Reader is behind, try again on the next tick. The
+				// pending trade will be replaced by newer trades in the
+				// meantime.
+				return
+			}
+			delete(s.pending, symbol)
+		}
+		s.order = s.order[1:]
+	}
+}
+
+func (s *TradeStreamSubscription) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
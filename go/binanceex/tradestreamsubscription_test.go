@@ -0,0 +1,92 @@
+package binanceex
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTradeStreamSubscriptionFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	subscription := newTradeStreamSubscription("test", time.Second)
+	subscription.AddSymbols("ethbtc", "LTCBTC")
+	assert.ElementsMatch([]string{"ETHBTC", "LTCBTC"}, subscription.Symbols())
+
+	// Only the latest trade of each symbol is delivered, in the order the
+	// symbols first traded.
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: "LTCBTC", Price: 0.01})
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: "BNBBTC", Price: 0.001})
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: "ETHBTC", Price: 0.02})
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: "LTCBTC", Price: 0.011})
+	subscription.flush()
+	assert.Len(subscription.C, 2)
+	assert.Equal(binanceapi.StreamAggTrade{Symbol: "LTCBTC", Price: 0.011}, <-subscription.C)
+	assert.Equal(binanceapi.StreamAggTrade{Symbol: "ETHBTC", Price: 0.02}, <-subscription.C)
+
+	// Nothing new, nothing delivered.
+	subscription.flush()
+	assert.Len(subscription.C, 0)
+
+	// The pending trade of a removed symbol is dropped.
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: "ETHBTC", Price: 0.021})
+	subscription.RemoveSymbols("ethbtc")
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: "ETHBTC", Price: 0.022})
+	subscription.flush()
+	assert.Len(subscription.C, 0)
+	assert.Equal([]string{"LTCBTC"}, subscription.Symbols())
+
+	subscription.AddSymbols(TradeStreamAllSymbols)
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: "BNBBTC", Price: 0.002})
+	subscription.flush()
+	assert.Equal("BNBBTC", (<-subscription.C).Symbol)
+}
+
+func TestTradeStreamSubscriptionSlowReader(t *testing.T) {
+	assert := assert.New(t)
+
+	subscription := newTradeStreamSubscription("test", time.Second)
+	subscription.AddSymbols(TradeStreamAllSymbols)
+	symbols := cap(subscription.C) + 2
+	for i := 0; i < symbols; i++ {
+		subscription.offer(binanceapi.StreamAggTrade{Symbol: string(rune('A' + i))})
+	}
+
+	// What doesn't fit is kept for the next flush, updated by newer trades.
+	subscription.flush()
+	assert.Len(subscription.C, cap(subscription.C))
+	last := string(rune('A' + symbols - 1))
+	subscription.offer(binanceapi.StreamAggTrade{Symbol: last, Price: 1})
+	for len(subscription.C) > 0 {
+		<-subscription.C
+	}
+	subscription.flush()
+	assert.Len(subscription.C, 2)
+	assert.Equal(string(rune('A'+symbols-2)), (<-subscription.C).Symbol)
+	assert.Equal(binanceapi.StreamAggTrade{Symbol: last, Price: 1}, <-subscription.C)
+}
+
+func TestSubscribeFiltered(t *testing.T) {
+	assert := assert.New(t)
+
+	manager := NewTradeStreamManager()
+	subscription := manager.SubscribeFiltered("test", 10*time.Millisecond)
+	subscription.AddSymbols("ETHBTC")
+
+	// Trades arriving faster than the interval are coalesced.
+	for i := 1; i <= 10; i++ {
+		manager.dispatch(binanceapi.StreamAggTrade{Symbol: "ETHBTC", Price: float64(i)})
+	}
+	manager.dispatch(binanceapi.StreamAggTrade{Symbol: "LTCBTC", Price: 1})
+	trade := receiveTrade(t, subscription.C)
+	assert.Equal(binanceapi.StreamAggTrade{Symbol: "ETHBTC", Price: 10}, trade)
+
+	manager.UnsubscribeFiltered(subscription)
+	manager.dispatch(binanceapi.StreamAggTrade{Symbol: "ETHBTC", Price: 11})
+	select {
+	case trade := <-subscription.C:
+		t.Fatalf("received %v after unsubscribing", trade)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
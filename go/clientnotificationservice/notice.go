@@ -22,11 +22,16 @@ type Level string
 const LevelInfo = "info"
 const LevelWarning = "warning"
 const LevelError = "error"
+const LevelCritical = "critical"
 
 type Notice struct {
 	Level   Level                  `json:"level"`
 	Message string                 `json:"message"`
 	Data    map[string]interface{} `json:"data"`
+
+	// The client should alert the user and keep the notice until it is
+	// acknowledged.
+	Alert bool `json:"alert,omitempty"`
 }
 
 func NewNotice(level Level, msg string) *Notice {
@@ -41,6 +46,11 @@ func (n *Notice) WithData(data map[string]interface{}) *Notice {
 	return n
 }
 
+func (n *Notice) WithAlert() *Notice {
+	n.Alert = true
+	return n
+}
+
 type Service struct {
 	lock        sync.RWMutex
 	subscribers map[chan *Notice]bool
@@ -0,0 +1,224 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/idgenerator"
+	"gitlab.com/crankykernel/maker/go/tradeimport"
+	"gitlab.com/crankykernel/maker/go/types"
+)
+
+var importFlags struct {
+	symbols []string
+	from    string
+	to      string
+	dryRun  bool
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import trades made outside of Maker.",
+}
+
+var importBinanceHistoryCmd = &cobra.Command{
+	Use:   "binance-history",
+	Short: "Import closed trades from the Binance trade history.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(importFlags.symbols) == 0 {
+			fmt.Println("At least one --symbol is required.")
+			os.Exit(1)
+		}
+		from, err := parseImportDate(importFlags.from)
+		if err != nil {
+			fmt.Printf("Invalid --from date: %v\n", err)
+			os.Exit(1)
+		}
+		to, err := parseImportDate(importFlags.to)
+		if err != nil {
+			fmt.Printf("Invalid --to date: %v\n", err)
+			os.Exit(1)
+		}
+		if !to.IsZero() {
+			// Include the whole of the last day.
+			to = to.AddDate(0, 0, 1)
+		}
+		db.DbOpen(DefaultDataDirectory)
+		if err := importBinanceHistory(importFlags.symbols, from, to,
+			importFlags.dryRun); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	flags := importBinanceHistoryCmd.Flags()
+	flags.StringSliceVar(&importFlags.symbols, "symbol", nil,
+		"Symbols to import, may be repeated")
+	flags.StringVar(&importFlags.from, "from", "",
+		"Import fills from this date (YYYY-MM-DD, UTC)")
+	flags.StringVar(&importFlags.to, "to", "",
+		"Import fills up to and including this date (YYYY-MM-DD, UTC)")
+	flags.BoolVar(&importFlags.dryRun, "dry-run", false,
+		"Print what would be imported without saving")
+	importCmd.AddCommand(importBinanceHistoryCmd)
+	rootCmd.AddCommand(importCmd)
+}
+
+func parseImportDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.UTC)
+}
+
+// The orders of a symbol that already belong to trades in the database.
+type existingOrders struct {
+	// Orders of trades made by Maker. Their fills are left out of the
+	// import.
+	maker map[int64]bool
+
+	// Buy orders of trades already imported.
+	imported map[int64]bool
+}
+
+func loadExistingOrders() (map[string]*existingOrders, error) {
+	states, err := db.DbQueryTrades(db.TradeQueryOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trades: %v", err)
+	}
+	orders := map[string]*existingOrders{}
+	for _, state := range states {
+		symbolOrders := orders[state.Symbol]
+		if symbolOrders == nil {
+			symbolOrders = &existingOrders{
+				maker:    map[int64]bool{},
+				imported: map[int64]bool{},
+			}
+			orders[state.Symbol] = symbolOrders
+		}
+		if state.Imported {
+			symbolOrders.imported[state.BuyOrderId] = true
+			continue
+		}
+		symbolOrders.maker[state.BuyOrderId] = true
+		symbolOrders.maker[state.SellOrderId] = true
+		events, err := db.DbGetTradeEvents(state.TradeID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load events for trade %s: %v",
+				state.TradeID, err)
+		}
+		for _, event := range events {
+			if event.OrderUpdate != nil && event.OrderUpdate.OrderID != 0 {
+				symbolOrders.maker[event.OrderUpdate.OrderID] = true
+			}
+		}
+	}
+	return orders, nil
+}
+
+func importBinanceHistory(symbols []string, from time.Time, to time.Time,
+	dryRun bool) error {
+	exchangeInfo := binanceex.NewExchangeInfoService()
+	if err := exchangeInfo.Update(); err != nil {
+		return fmt.Errorf("failed to get exchange info: %v", err)
+	}
+
+	orders, err := loadExistingOrders()
+	if err != nil {
+		return err
+	}
+
+	client := binanceex.GetBinanceRestClient()
+	idGenerator := idgenerator.NewIdGenerator()
+
+	for _, symbol := range symbols {
+		symbol = strings.ToUpper(symbol)
+		symbolInfo, err := exchangeInfo.GetSymbol(symbol)
+		if err != nil {
+			return fmt.Errorf("%s: %v", symbol, err)
+		}
+
+		fills, err := tradeimport.FetchFills(client, symbol, from, to)
+		if err != nil {
+			return fmt.Errorf("%s: failed to get trade history: %v", symbol, err)
+		}
+
+		symbolOrders := orders[symbol]
+		if symbolOrders != nil {
+			external := fills[:0]
+			for _, fill := range fills {
+				if !symbolOrders.maker[fill.OrderID] {
+					external = append(external, fill)
+				}
+			}
+			fills = external
+		}
+
+		result := tradeimport.MatchFills(symbol, symbolInfo.BaseAsset,
+			symbolInfo.StepSize, fills)
+
+		imported := 0
+		skipped := 0
+		for _, trade := range result.Closed {
+			if symbolOrders != nil && symbolOrders.imported[trade.State.BuyOrderId] {
+				skipped++
+				continue
+			}
+			tradeId, err := idGenerator.GetID(&trade.State.OpenTime)
+			if err != nil {
+				return err
+			}
+			trade.State.TradeID = tradeId.String()
+			if dryRun {
+				printImportedTrade(trade)
+			} else {
+				if err := db.DbSaveTrade(trade); err != nil {
+					return fmt.Errorf("%s: failed to save trade: %v", symbol, err)
+				}
+				if err := db.DbArchiveTrade(trade); err != nil {
+					return fmt.Errorf("%s: failed to archive trade: %v", symbol, err)
+				}
+			}
+			imported++
+		}
+
+		fmt.Printf("%s: %d fills, %d trades imported, %d already imported, "+
+			"%d still open, %s sold without a matching buy.\n",
+			symbol, len(fills), imported, skipped, len(result.Open),
+			result.UnmatchedSellQuantity)
+	}
+
+	return nil
+}
+
+func printImportedTrade(trade *types.Trade) {
+	state := trade.State
+	fmt.Printf("  %s %s bought %s at %s, sold %s at %s on %s, profit %s (%.2f%%)\n",
+		state.OpenTime.UTC().Format("2006-01-02 15:04:05"), state.Symbol,
+		state.BuyFillQuantity, state.AverageBuyPrice,
+		state.SellFillQuantity, state.AverageSellPrice,
+		state.CloseTime.UTC().Format("2006-01-02 15:04:05"),
+		state.Profit, state.ProfitPercent)
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/types"
+)
+
+var tradeReplayShowEvents bool
+
+var tradeCmd = &cobra.Command{
+	Use:   "trade",
+	Short: "Trade maintenance commands.",
+}
+
+var tradeReplayCmd = &cobra.Command{
+	Use:   "replay <trade-id>",
+	Short: "Rebuild a trade from its event log and compare to the saved state.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		db.DbOpen(DefaultDataDirectory)
+		if !tradeReplay(args[0], tradeReplayShowEvents) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	tradeReplayCmd.Flags().BoolVar(&tradeReplayShowEvents, "events", false,
+		"Print each event as it is applied")
+	tradeCmd.AddCommand(tradeReplayCmd)
+	rootCmd.AddCommand(tradeCmd)
+}
+
+// Fields that are not derived from events: the history log, and the last
+// price and values computed from it as prices stream in.
+var tradeReplayIgnoredFields = map[string]bool{
+	"History":       true,
+	"LastPrice":     true,
+	"ProfitPercent": true,
+}
+
+// tradeReplay rebuilds the trade from its events, printing the differences to
+// the saved trade state. Returns false if the states differ or the trade
+// could not be replayed.
+func tradeReplay(tradeId string, showEvents bool) bool {
+	saved, err := db.DbGetTradeByID(tradeId)
+	if err != nil {
+		fmt.Printf("Failed to load trade %s: %v\n", tradeId, err)
+		return false
+	}
+
+	events, err := db.DbGetTradeEvents(tradeId)
+	if err != nil {
+		fmt.Printf("Failed to load events for trade %s: %v\n", tradeId, err)
+		return false
+	}
+
+	if showEvents {
+		for _, event := range events {
+			buf, _ := json.Marshal(event)
+			fmt.Printf("%d %s %s %s\n", event.Sequence,
+				event.Timestamp.Format("2006-01-02 15:04:05.000"),
+				event.Type, string(buf))
+		}
+	}
+
+	replayed, err := types.ReplayTradeEvents(events)
+	if err != nil {
+		fmt.Printf("Failed to replay trade %s: %v\n", tradeId, err)
+		return false
+	}
+
+	differences := diffTradeStates(*saved, replayed.State)
+	if len(differences) == 0 {
+		fmt.Printf("Trade %s: %d events replayed, state matches.\n",
+			tradeId, len(events))
+		return true
+	}
+
+	fmt.Printf("Trade %s: %d events replayed, %d fields differ:\n",
+		tradeId, len(events), len(differences))
+	for _, difference := range differences {
+		fmt.Println(difference)
+	}
+	return false
+}
+
+// Compare the JSON representation of two trade states, returning a line per
+// top level field that differs.
+func diffTradeStates(saved types.TradeState, replayed types.TradeState) []string {
+	savedFields, err := tradeStateFields(saved)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	replayedFields, err := tradeStateFields(replayed)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	names := []string{}
+	for name := range savedFields {
+		names = append(names, name)
+	}
+	for name := range replayedFields {
+		if _, ok := savedFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differences := []string{}
+	for _, name := range names {
+		if tradeReplayIgnoredFields[name] {
+			continue
+		}
+		if !reflect.DeepEqual(savedFields[name], replayedFields[name]) {
+			savedValue, _ := json.Marshal(savedFields[name])
+			replayedValue, _ := json.Marshal(replayedFields[name])
+			differences = append(differences, fmt.Sprintf(
+				"  %s:\n    saved:    %s\n    replayed: %s",
+				name, savedValue, replayedValue))
+		}
+	}
+	return differences
+}
+
+func tradeStateFields(state types.TradeState) (map[string]interface{}, error) {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -65,3 +65,15 @@ func Set(key string, val string) {
 func GetString(key string) string {
 	return viper.GetString(key)
 }
+
+func GetFloat64(key string) float64 {
+	return viper.GetFloat64(key)
+}
+
+func GetInt(key string) int {
+	return viper.GetInt(key)
+}
+
+func GetBool(key string) bool {
+	return viper.GetBool(key)
+}
@@ -42,7 +42,7 @@ func initDb(db *sql.DB) error {
 	row := tx.QueryRow("select max(version) from schema")
 	if err := row.Scan(&version); err != nil {
 		log.Printf("Initializing database.")
-		_, err := db.Exec("create table schema (version integer not null primary key, timestamp timestamp)")
+		_, err := tx.Exec("create table schema (version integer not null primary key, timestamp timestamp)")
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("failed to create schema table: %v", err)
@@ -122,6 +122,127 @@ func initDb(db *sql.DB) error {
 		}
 	}
 
+	if version < 4 {
+		_, err := tx.Exec(`create table trade_event (id integer primary key autoincrement, trade_id string, timestamp timestamp, type string, data json)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create trade_event table: %v", err)
+		}
+		_, err = tx.Exec(`create index trade_event_trade_id on trade_event (trade_id)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create trade_event index: %v", err)
+		}
+		if err := incrementVersion(tx, 4); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if version < 5 {
+		rows, err := tx.Query(`select id, data from binance_trade`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to load trades: %v", err)
+		}
+
+		tradeStates := []types.TradeState{}
+		for rows.Next() {
+			var localId string
+			var data string
+			if err := rows.Scan(&localId, &data); err != nil {
+				log.WithError(err).Error("Failed to scan row.")
+				continue
+			}
+
+			var tradeState types.TradeState
+			if err := json.Unmarshal([]byte(data), &tradeState); err != nil {
+				log.WithError(err).WithField("tradeId", localId).
+					Error("Failed to unmarshal v1 trade state.")
+				continue
+			}
+			tradeStates = append(tradeStates, tradeState)
+		}
+		rows.Close()
+
+		for _, tradeState := range tradeStates {
+			tradeState = types.TradeStateV1ToTradeStateV2(tradeState)
+			if err := TxDbUpdateTradeState(tx, &tradeState); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to migrate trade %s: %v",
+					tradeState.TradeID, err)
+			}
+		}
+		log.Printf("Migrated %d trades to decimal amounts.", len(tradeStates))
+		if err := incrementVersion(tx, 5); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if version < 6 {
+		_, err := tx.Exec(`create table guard_rule (id string primary key unique, data json)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create guard_rule table: %v", err)
+		}
+		if err := incrementVersion(tx, 6); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if version < 7 {
+		_, err := tx.Exec(`create table trade_template (name string primary key unique, data json)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create trade_template table: %v", err)
+		}
+		if err := incrementVersion(tx, 7); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if version < 8 {
+		_, err := tx.Exec(`create table trade_tag (trade_id string, tag string, primary key (trade_id, tag))`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create trade_tag table: %v", err)
+		}
+		_, err = tx.Exec(`create index trade_tag_tag on trade_tag (tag)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create trade_tag index: %v", err)
+		}
+		if err := incrementVersion(tx, 8); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if version < 9 {
+		_, err := tx.Exec(`create table signal (name string primary key unique, data json)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create signal table: %v", err)
+		}
+		_, err = tx.Exec(`create table signal_log (id integer primary key autoincrement, signal string, nonce string, timestamp timestamp, data json)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create signal_log table: %v", err)
+		}
+		_, err = tx.Exec(`create unique index signal_log_nonce on signal_log (signal, nonce)`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to create signal_log index: %v", err)
+		}
+		if err := incrementVersion(tx, 9); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	tx.Commit()
 	return nil
 }
@@ -134,6 +255,8 @@ func DbOpen(dataDirectory string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Trades are saved from many goroutines, SQLite only allows one writer.
+	db.SetMaxOpenConns(1)
 	if err := initDb(db); err != nil {
 		log.Fatal(err)
 	}
@@ -155,16 +278,19 @@ func DbSaveBinanceRawExecutionReport(timestamp time.Time, event []byte) error {
 }
 
 func DbSaveTrade(trade *types.Trade) error {
-	tx, err := db.Begin()
+	data, err := formatJson(trade.State)
 	if err != nil {
 		return err
 	}
-	data, err := formatJson(trade.State)
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
 	_, err = tx.Exec(`insert into binance_trade (id, data) values (?, ?)`,
 		trade.State.TradeID, data)
+	if err == nil {
+		err = txDbSetTradeTags(tx, &trade.State)
+	}
 	tx.Commit()
 	return err
 }
@@ -176,7 +302,26 @@ func TxDbUpdateTradeState(tx *sql.Tx, trade *types.TradeState) error {
 	}
 	_, err = tx.Exec(`update binance_trade set data = ? where id = ?`,
 		data, trade.TradeID)
-	return err
+	if err != nil {
+		return err
+	}
+	return txDbSetTradeTags(tx, trade)
+}
+
+// txDbSetTradeTags replaces the indexed tags of a trade with its current
+// tags.
+func txDbSetTradeTags(tx *sql.Tx, trade *types.TradeState) error {
+	if _, err := tx.Exec(`delete from trade_tag where trade_id = ?`, trade.TradeID); err != nil {
+		return err
+	}
+	for _, tag := range trade.Tags {
+		_, err := tx.Exec(`insert or ignore into trade_tag (trade_id, tag) values (?, ?)`,
+			trade.TradeID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func DbUpdateTrade(trade *types.Trade) error {
@@ -194,6 +339,257 @@ func DbUpdateTrade(trade *types.Trade) error {
 	return err
 }
 
+// DbSaveTradeEvent appends an event to the trade event log. The sequence
+// assigned by the database is set on the event.
+func DbSaveTradeEvent(event *types.TradeEvent) error {
+	data, err := formatJson(event)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec(`insert into trade_event (trade_id, timestamp, type, data) values (?, ?, ?, ?)`,
+		event.TradeID, formatTimestamp(event.Timestamp), event.Type, data)
+	if err != nil {
+		return err
+	}
+	sequence, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	event.Sequence = sequence
+	return nil
+}
+
+// DbGetTradeEvents returns the events of a trade in the order they were
+// recorded.
+func DbGetTradeEvents(tradeId string) ([]types.TradeEvent, error) {
+	rows, err := db.Query(`select id, data from trade_event where trade_id = ? order by id`,
+		tradeId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []types.TradeEvent{}
+	for rows.Next() {
+		var sequence int64
+		var data string
+		if err := rows.Scan(&sequence, &data); err != nil {
+			return nil, err
+		}
+		var event types.TradeEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, err
+		}
+		event.Sequence = sequence
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// DbSaveGuardRule inserts or replaces a guard rule.
+func DbSaveGuardRule(rule *types.GuardRule) error {
+	data, err := formatJson(rule)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`insert or replace into guard_rule (id, data) values (?, ?)`,
+		rule.ID, data)
+	return err
+}
+
+func DbDeleteGuardRule(id string) error {
+	_, err := db.Exec(`delete from guard_rule where id = ?`, id)
+	return err
+}
+
+func DbGetGuardRules() ([]types.GuardRule, error) {
+	rows, err := db.Query(`select data from guard_rule order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []types.GuardRule{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var rule types.GuardRule
+		if err := json.Unmarshal([]byte(data), &rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func DbSaveTradeTemplate(template *types.TradeTemplate) error {
+	data, err := formatJson(template)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`insert or replace into trade_template (name, data) values (?, ?)`,
+		template.Name, data)
+	return err
+}
+
+func DbDeleteTradeTemplate(name string) error {
+	_, err := db.Exec(`delete from trade_template where name = ?`, name)
+	return err
+}
+
+// DbGetTradeTemplate returns the template with the name, or nil if there is
+// no such template.
+func DbGetTradeTemplate(name string) (*types.TradeTemplate, error) {
+	row := db.QueryRow(`select data from trade_template where name = ?`, name)
+	var data string
+	if err := row.Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var template types.TradeTemplate
+	if err := json.Unmarshal([]byte(data), &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func DbGetTradeTemplates() ([]types.TradeTemplate, error) {
+	rows, err := db.Query(`select data from trade_template order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []types.TradeTemplate{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var template types.TradeTemplate
+		if err := json.Unmarshal([]byte(data), &template); err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+func DbSaveSignal(signal *types.Signal) error {
+	data, err := formatJson(signal)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`insert or replace into signal (name, data) values (?, ?)`,
+		signal.Name, data)
+	return err
+}
+
+func DbDeleteSignal(name string) error {
+	_, err := db.Exec(`delete from signal where name = ?`, name)
+	return err
+}
+
+// DbGetSignal returns the signal with the name, or nil if there is no such
+// signal.
+func DbGetSignal(name string) (*types.Signal, error) {
+	row := db.QueryRow(`select data from signal where name = ?`, name)
+	var data string
+	if err := row.Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var signal types.Signal
+	if err := json.Unmarshal([]byte(data), &signal); err != nil {
+		return nil, err
+	}
+	return &signal, nil
+}
+
+func DbGetSignals() ([]types.Signal, error) {
+	rows, err := db.Query(`select data from signal order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signals := []types.Signal{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var signal types.Signal
+		if err := json.Unmarshal([]byte(data), &signal); err != nil {
+			return nil, err
+		}
+		signals = append(signals, signal)
+	}
+	return signals, rows.Err()
+}
+
+// DbSaveSignalLogEntry appends an entry to the signal log. The nonce of an
+// entry can only be saved once per signal.
+func DbSaveSignalLogEntry(entry *types.SignalLogEntry) error {
+	data, err := formatJson(entry)
+	if err != nil {
+		return err
+	}
+	nonce := sql.NullString{String: entry.Nonce, Valid: entry.Nonce != ""}
+	result, err := db.Exec(`insert into signal_log (signal, nonce, timestamp, data) values (?, ?, ?, ?)`,
+		entry.Signal, nonce, formatTimestamp(entry.Time), data)
+	if err != nil {
+		return err
+	}
+	entry.ID, err = result.LastInsertId()
+	return err
+}
+
+// DbSignalNonceUsed returns true if the nonce was already saved for the
+// signal.
+func DbSignalNonceUsed(signal string, nonce string) (bool, error) {
+	row := db.QueryRow(`select count(*) from signal_log where signal = ? and nonce = ?`,
+		signal, nonce)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// DbGetSignalLog returns the most recent entries of the signal log, newest
+// first.
+func DbGetSignalLog(signal string, limit int) ([]types.SignalLogEntry, error) {
+	rows, err := db.Query(`select id, data from signal_log where signal = ? order by id desc limit ?`,
+		signal, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []types.SignalLogEntry{}
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var entry types.SignalLogEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, err
+		}
+		entry.ID = id
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
 func DbArchiveTrade(trade *types.Trade) error {
 	tx, err := db.Begin()
 	if err != nil {
@@ -214,6 +610,7 @@ func DbRestoreTradeState() ([]types.TradeState, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	tradeStates := []types.TradeState{}
 
@@ -264,25 +661,43 @@ func DbGetTradeByID(tradeId string) (*types.TradeState, error) {
 
 type TradeQueryOptions struct {
 	IsClosed bool
+
+	// Only trades with all of these tags.
+	Tags []string
+
+	// Only trades with notes containing this text, ignoring case.
+	Notes string
 }
 
 func DbQueryTrades(options TradeQueryOptions) ([]types.TradeState, error) {
 
 	where := []string{}
+	args := []interface{}{}
 
 	if options.IsClosed {
 		where = append(where, fmt.Sprintf("json_extract(binance_trade.data, '$.CloseTime') != ''"))
 	}
 
+	for _, tag := range options.Tags {
+		where = append(where, "binance_trade.id in (select trade_id from trade_tag where tag = ?)")
+		args = append(args, tag)
+	}
+
+	if options.Notes != "" {
+		where = append(where, "json_extract(binance_trade.data, '$.Notes') like ?")
+		args = append(args, "%"+options.Notes+"%")
+	}
+
 	sql := "select id, data from binance_trade"
 	if len(where) > 0 {
-		sql = fmt.Sprintf("%s WHERE %s", sql, strings.Join(where, "AND "))
+		sql = fmt.Sprintf("%s WHERE %s", sql, strings.Join(where, " AND "))
 	}
 
-	rows, err := db.Query(sql)
+	rows, err := db.Query(sql, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	tradeStates := []types.TradeState{}
 
@@ -0,0 +1,351 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package decimal provides a fixed point decimal type for prices,
+// quantities and fees. Values are held as an integer number of 1e-8 units,
+// the precision Binance uses for all amounts, so sums and step size
+// rounding are exact.
+package decimal
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Places is the number of decimal places a Decimal holds.
+const Places = 8
+
+const scale = 100000000
+
+var bigScale = big.NewInt(scale)
+
+var Zero = Decimal{}
+
+type Decimal struct {
+	value int64
+}
+
+// New returns value * 10^exp, rounded to Places.
+func New(value int64, exp int) Decimal {
+	r := new(big.Rat).SetInt64(value)
+	e := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10),
+		big.NewInt(int64(abs(exp))), nil))
+	if exp < 0 {
+		r.Quo(r, e)
+	} else {
+		r.Mul(r, e)
+	}
+	d, err := fromRat(r)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func NewFromInt(value int64) Decimal {
+	return New(value, 0)
+}
+
+// NewFromFloat converts a float to a decimal using the shortest string that
+// represents the float. Values received from the exchange as strings and
+// parsed to a float come back exactly. Panics if the float is NaN, infinite
+// or out of range.
+func NewFromFloat(value float64) Decimal {
+	d, err := NewFromFloatChecked(value)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// NewFromFloatChecked is like NewFromFloat but returns an error for a NaN,
+// infinite or out of range float. For values received from the exchange or
+// a client.
+func NewFromFloatChecked(value float64) (Decimal, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Zero, fmt.Errorf("invalid decimal: %v", value)
+	}
+	return NewFromString(strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// NewFromString parses a decimal number, with an optional exponent, rounding
+// it half away from zero to Places.
+func NewFromString(value string) (Decimal, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+	if !ok {
+		return Zero, fmt.Errorf("invalid decimal: %q", value)
+	}
+	return fromRat(r)
+}
+
+// RequireFromString is like NewFromString but panics on error. For
+// constants.
+func RequireFromString(value string) Decimal {
+	d, err := NewFromString(value)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func fromRat(r *big.Rat) (Decimal, error) {
+	num := new(big.Int).Mul(r.Num(), bigScale)
+	v := quoRound(num, r.Denom())
+	if !v.IsInt64() {
+		return Zero, fmt.Errorf("decimal out of range: %s", r.FloatString(Places))
+	}
+	return Decimal{v.Int64()}, nil
+}
+
+// quoRound returns x/y rounded half away from zero.
+func quoRound(x *big.Int, y *big.Int) *big.Int {
+	q, m := new(big.Int).QuoRem(x, y, new(big.Int))
+	if m.Sign() != 0 {
+		m.Abs(m).Lsh(m, 1)
+		if m.CmpAbs(y) >= 0 {
+			if x.Sign()*y.Sign() < 0 {
+				q.Sub(q, big.NewInt(1))
+			} else {
+				q.Add(q, big.NewInt(1))
+			}
+		}
+	}
+	return q
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (d Decimal) Add(d2 Decimal) Decimal {
+	return Decimal{d.value + d2.value}
+}
+
+func (d Decimal) Sub(d2 Decimal) Decimal {
+	return Decimal{d.value - d2.value}
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{-d.value}
+}
+
+func (d Decimal) Abs() Decimal {
+	if d.value < 0 {
+		return d.Neg()
+	}
+	return d
+}
+
+// Mul returns d * d2 rounded half away from zero to Places. Panics on
+// overflow.
+func (d Decimal) Mul(d2 Decimal) Decimal {
+	v, err := d.MulChecked(d2)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// MulChecked is like Mul but returns an error on overflow.
+func (d Decimal) MulChecked(d2 Decimal) (Decimal, error) {
+	x := new(big.Int).Mul(big.NewInt(d.value), big.NewInt(d2.value))
+	v := quoRound(x, bigScale)
+	if !v.IsInt64() {
+		return Zero, fmt.Errorf("decimal multiplication overflow: %s * %s", d, d2)
+	}
+	return Decimal{v.Int64()}, nil
+}
+
+// Div returns d / d2 rounded half away from zero to Places. Panics if d2 is
+// zero or on overflow.
+func (d Decimal) Div(d2 Decimal) Decimal {
+	v, err := d.DivChecked(d2)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// DivChecked is like Div but returns an error if d2 is zero or on overflow.
+func (d Decimal) DivChecked(d2 Decimal) (Decimal, error) {
+	if d2.value == 0 {
+		return Zero, fmt.Errorf("decimal division by zero: %s / 0", d)
+	}
+	x := new(big.Int).Mul(big.NewInt(d.value), bigScale)
+	v := quoRound(x, big.NewInt(d2.value))
+	if !v.IsInt64() {
+		return Zero, fmt.Errorf("decimal division overflow: %s / %s", d, d2)
+	}
+	return Decimal{v.Int64()}, nil
+}
+
+// RoundDown returns d rounded towards zero to a multiple of step. A zero
+// step returns d unchanged.
+func (d Decimal) RoundDown(step Decimal) Decimal {
+	if step.value == 0 {
+		return d
+	}
+	return Decimal{d.value / step.value * step.value}
+}
+
+// Round returns d rounded half away from zero to a multiple of step. A zero
+// step returns d unchanged.
+func (d Decimal) Round(step Decimal) Decimal {
+	if step.value == 0 {
+		return d
+	}
+	q := quoRound(big.NewInt(d.value), big.NewInt(step.value))
+	return Decimal{q.Int64() * step.value}
+}
+
+func (d Decimal) Cmp(d2 Decimal) int {
+	switch {
+	case d.value < d2.value:
+		return -1
+	case d.value > d2.value:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) Equal(d2 Decimal) bool {
+	return d.value == d2.value
+}
+
+func (d Decimal) LessThan(d2 Decimal) bool {
+	return d.value < d2.value
+}
+
+func (d Decimal) LessThanOrEqual(d2 Decimal) bool {
+	return d.value <= d2.value
+}
+
+func (d Decimal) GreaterThan(d2 Decimal) bool {
+	return d.value > d2.value
+}
+
+func (d Decimal) GreaterThanOrEqual(d2 Decimal) bool {
+	return d.value >= d2.value
+}
+
+func (d Decimal) Sign() int {
+	return d.Cmp(Zero)
+}
+
+func (d Decimal) IsZero() bool {
+	return d.value == 0
+}
+
+func (d Decimal) IsPositive() bool {
+	return d.value > 0
+}
+
+func (d Decimal) IsNegative() bool {
+	return d.value < 0
+}
+
+// DecimalPlaces returns the number of decimal places needed to print d
+// exactly. For a step or tick size this is the precision the exchange
+// accepts.
+func (d Decimal) DecimalPlaces() int {
+	places := Places
+	for v := d.value; places > 0 && v%10 == 0; v /= 10 {
+		places--
+	}
+	return places
+}
+
+// Float64 returns the nearest float to d. Only for display and percentage
+// calculations.
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// String formats d without trailing zeros.
+func (d Decimal) String() string {
+	return d.StringFixed(d.DecimalPlaces())
+}
+
+// StringFixed formats d with exactly the given number of decimal places,
+// rounding half away from zero if places is less than the precision of d.
+func (d Decimal) StringFixed(places int) string {
+	if places > Places {
+		places = Places
+	} else if places < 0 {
+		places = 0
+	}
+	v := d
+	if places < Places {
+		v = d.Round(New(1, -places))
+	}
+	sign := ""
+	u := v.value
+	if u < 0 {
+		sign = "-"
+		u = -u
+	}
+	s := fmt.Sprintf("%s%d", sign, u/scale)
+	if places > 0 {
+		frac := fmt.Sprintf("%08d", u%scale)
+		s += "." + frac[:places]
+	}
+	return s
+}
+
+// MarshalJSON encodes d as a JSON number with exact digits.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or string. Numbers written as floats
+// by earlier versions are rounded to Places.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*d = Zero
+		return nil
+	}
+	value, err := NewFromString(s)
+	if err != nil {
+		return err
+	}
+	*d = value
+	return nil
+}
+
+func Min(d Decimal, rest ...Decimal) Decimal {
+	for _, d2 := range rest {
+		if d2.LessThan(d) {
+			d = d2
+		}
+	}
+	return d
+}
+
+func Max(d Decimal, rest ...Decimal) Decimal {
+	for _, d2 := range rest {
+		if d2.GreaterThan(d) {
+			d = d2
+		}
+	}
+	return d
+}
@@ -0,0 +1,134 @@
+package decimal
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestNewFromString(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"0", "0"},
+		{"1", "1"},
+		{"0.00123400", "0.001234"},
+		{"-1.5", "-1.5"},
+		{"1e-07", "0.0000001"},
+		{"0.30000000000000004", "0.3"},
+		{"0.000000005", "0.00000001"},
+		{"-0.000000005", "-0.00000001"},
+		{"0.000000004", "0"},
+		{"12345.123456789", "12345.12345679"},
+	}
+	for _, test := range tests {
+		d, err := NewFromString(test.input)
+		assert.NoError(err, test.input)
+		assert.Equal(test.expected, d.String(), test.input)
+	}
+
+	_, err := NewFromString("abc")
+	assert.Error(err)
+}
+
+func TestArithmetic(t *testing.T) {
+	assert := assert.New(t)
+
+	// Summing floats gives 0.30000000000000004.
+	sum := RequireFromString("0.1").Add(RequireFromString("0.2"))
+	assert.Equal("0.3", sum.String())
+
+	assert.Equal("0.00012345",
+		RequireFromString("0.12345").Mul(RequireFromString("0.001")).String())
+	assert.Equal("0.33333333",
+		NewFromInt(1).Div(NewFromInt(3)).String())
+	assert.Equal("0.66666667",
+		NewFromInt(2).Div(NewFromInt(3)).String())
+	assert.Equal("-0.5", NewFromInt(-1).Div(NewFromInt(2)).String())
+}
+
+func TestArithmeticChecked(t *testing.T) {
+	assert := assert.New(t)
+
+	max := RequireFromString("92233720368.54775807")
+	d, err := max.MulChecked(NewFromInt(1))
+	assert.NoError(err)
+	assert.Equal(max, d)
+	_, err = max.MulChecked(NewFromInt(2))
+	assert.Error(err)
+	assert.Panics(func() { max.Mul(NewFromInt(2)) })
+
+	d, err = NewFromInt(1).DivChecked(NewFromInt(4))
+	assert.NoError(err)
+	assert.Equal("0.25", d.String())
+	_, err = NewFromInt(1).DivChecked(Zero)
+	assert.Error(err)
+	assert.Panics(func() { NewFromInt(1).Div(Zero) })
+	_, err = max.DivChecked(RequireFromString("0.5"))
+	assert.Error(err)
+	assert.Panics(func() { max.Div(RequireFromString("0.5")) })
+}
+
+func TestNewFromFloat(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := NewFromFloatChecked(0.1)
+	assert.NoError(err)
+	assert.Equal("0.1", d.String())
+	assert.Equal("0.00001", NewFromFloat(1e-05).String())
+
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e11, -1e11} {
+		_, err := NewFromFloatChecked(value)
+		assert.Error(err, "%v", value)
+		assert.Panics(func() { NewFromFloat(value) }, "%v", value)
+	}
+}
+
+func TestRoundToStep(t *testing.T) {
+	assert := assert.New(t)
+
+	step := RequireFromString("0.001")
+	assert.Equal("1.234", RequireFromString("1.2349").RoundDown(step).String())
+	assert.Equal("1.235", RequireFromString("1.2345").Round(step).String())
+	assert.Equal("1.234", RequireFromString("1.234").RoundDown(step).String())
+	assert.Equal("0.099", RequireFromString("0.0999").RoundDown(step).String())
+
+	// Float step size rounding gave 0.8 - 0.1 = 0.7000000000000001.
+	step = RequireFromString("0.1")
+	assert.Equal("0.7", RequireFromString("0.79").RoundDown(step).String())
+
+	assert.Equal(3, step.Mul(RequireFromString("0.01")).DecimalPlaces())
+	assert.Equal(0, NewFromInt(10).DecimalPlaces())
+}
+
+func TestStringFixed(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("1.23400000", RequireFromString("1.234").StringFixed(Places))
+	assert.Equal("1.23", RequireFromString("1.234").StringFixed(2))
+	assert.Equal("1", RequireFromString("1.234").StringFixed(0))
+	assert.Equal("-0.50", RequireFromString("-0.5").StringFixed(2))
+}
+
+func TestJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	var value struct {
+		Number Decimal
+		String Decimal
+		Float  Decimal
+	}
+	err := json.Unmarshal([]byte(`{"Number": 0.001, "String": "0.002", "Float": 1e-05}`), &value)
+	assert.NoError(err)
+	assert.Equal("0.001", value.Number.String())
+	assert.Equal("0.002", value.String.String())
+	assert.Equal("0.00001", value.Float.String())
+
+	bytes, err := json.Marshal(value)
+	assert.NoError(err)
+	assert.Equal(`{"Number":0.001,"String":0.002,"Float":0.00001}`, string(bytes))
+}
@@ -18,11 +18,13 @@ package idgenerator
 import (
 	"github.com/oklog/ulid"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 type IdGenerator struct {
 	entropy *rand.Rand
+	lock    sync.Mutex
 }
 
 func NewIdGenerator() *IdGenerator {
@@ -36,5 +38,7 @@ func (g *IdGenerator) GetID(timestamp *time.Time) (ulid.ULID, error) {
 		_timestamp := time.Now()
 		timestamp = &_timestamp
 	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	return ulid.New(ulid.Timestamp(*timestamp), g.entropy)
 }
@@ -0,0 +1,120 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"net/http"
+)
+
+// ApiError is an error that carries the status to report to the client,
+// whether that client is using the REST API or the websocket.
+type ApiError struct {
+	StatusCode int    `json:"code"`
+	Message    string `json:"message"`
+
+	// The raw error response from Binance, if the error came from Binance.
+	Binance json.RawMessage `json:"binance,omitempty"`
+
+	// A machine readable reason and its details, for errors the client may
+	// want to handle.
+	Reason string      `json:"reason,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+func NewApiError(statusCode int, format string, args ...interface{}) *ApiError {
+	return &ApiError{
+		StatusCode: statusCode,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+// NewBinanceApiError wraps an error response from the Binance REST API.
+func NewBinanceApiError(statusCode int, body []byte) *ApiError {
+	var binanceError struct {
+		Code int64  `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	message := string(body)
+	if err := json.Unmarshal(body, &binanceError); err == nil && binanceError.Msg != "" {
+		message = binanceError.Msg
+	}
+	return &ApiError{
+		StatusCode: statusCode,
+		Message:    message,
+		Binance:    body,
+	}
+}
+
+// NewRestrictionApiError rejects a buy that the trading restrictions don't
+// allow.
+func NewRestrictionApiError(err *tradeservice.RestrictionError) *ApiError {
+	return &ApiError{
+		StatusCode: http.StatusForbidden,
+		Message:    err.Message,
+		Reason:     string(err.Reason),
+		Data:       err,
+	}
+}
+
+// NewPriceDeviationApiError rejects a manual price that is too far from the
+// market and was not confirmed.
+func NewPriceDeviationApiError(deviation *tradeservice.PriceDeviation) *ApiError {
+	return &ApiError{
+		StatusCode: http.StatusBadRequest,
+		Message:    deviation.Message() + ", set confirmDeviation to place it anyway",
+		Reason:     "PRICE_DEVIATION",
+		Data:       deviation,
+	}
+}
+
+// ToApiError converts any error to an ApiError, treating errors that are not
+// already ApiErrors as internal server errors.
+func ToApiError(err error) *ApiError {
+	if apiError, ok := err.(*ApiError); ok {
+		return apiError
+	}
+	return NewApiError(http.StatusInternalServerError, "%v", err)
+}
+
+// WriteApiError writes an error to a REST client. Errors from Binance are
+// forwarded as is.
+func WriteApiError(w http.ResponseWriter, err error) {
+	apiError := ToApiError(err)
+	if apiError.Binance != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apiError.StatusCode)
+		w.Write(apiError.Binance)
+		return
+	}
+	if apiError.Reason != "" {
+		WriteJsonResponse(w, apiError.StatusCode, map[string]interface{}{
+			"error":      true,
+			"statusCode": apiError.StatusCode,
+			"message":    apiError.Message,
+			"reason":     apiError.Reason,
+			"data":       apiError.Data,
+		})
+		return
+	}
+	WriteJsonError(w, apiError.StatusCode, apiError.Message)
+}
@@ -104,6 +104,10 @@ func (m *Authenticator) requiresAuth(path string) bool {
 	if strings.HasPrefix(path, "/api/login") {
 		return false
 	}
+	// Signals authenticate each payload with the signal secret.
+	if strings.HasPrefix(path, "/api/signals/") {
+		return false
+	}
 	if strings.HasPrefix(path, "/api") {
 		return true
 	}
@@ -20,7 +20,10 @@ import (
 	"github.com/crankykernel/binanceapi-go"
 	"gitlab.com/crankykernel/maker/go/config"
 	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 func SavePreferencesHandler(w http.ResponseWriter, r *http.Request) {
@@ -43,6 +46,99 @@ func SavePreferencesHandler(w http.ResponseWriter, r *http.Request) {
 	config.WriteConfig(ServerFlags.ConfigFilename)
 }
 
+// SaveExitExecutionHandler sets the default exit execution for trades that
+// don't set their own. The request body is an ExitExecutionSettings.
+func SaveExitExecutionHandler(w http.ResponseWriter, r *http.Request) {
+	var request ExitExecutionSettings
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.WithFields(log.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+		}).WithError(err).Errorf("Failed to decode exit execution configuration.")
+		WriteJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := request.validate(); err != nil {
+		WriteApiError(w, err)
+		return
+	}
+
+	config.Set("exit.execution.mode", string(request.ExitMode))
+	config.Set("exit.execution.maxSlippagePercent",
+		strconv.FormatFloat(request.ExitMaxSlippagePercent, 'f', -1, 64))
+	config.Set("exit.execution.marketAfterAttempts",
+		strconv.Itoa(request.ExitMarketAfterAttempts))
+	config.Set("exit.execution.depthChunks",
+		strconv.FormatBool(request.ExitDepthChunks))
+	config.WriteConfig(ServerFlags.ConfigFilename)
+}
+
+// SaveTradingRestrictionsHandler sets the restrictions on new buys. The
+// request body is a TradingRestrictions.
+func SaveTradingRestrictionsHandler(w http.ResponseWriter, r *http.Request) {
+	var request tradeservice.TradingRestrictions
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.WithFields(log.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+		}).WithError(err).Errorf("Failed to decode trading restrictions.")
+		WriteJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.CooldownHours < 0 {
+		WriteJsonError(w, http.StatusBadRequest, "cooldownHours must not be negative")
+		return
+	}
+
+	joinList := func(list []string) string {
+		return strings.Join(tradeservice.ParseAssetList(strings.Join(list, ",")), ",")
+	}
+	config.Set(tradeservice.CooldownHoursConfigKey,
+		strconv.FormatFloat(request.CooldownHours, 'f', -1, 64))
+	config.Set(tradeservice.AllowSymbolsConfigKey, joinList(request.AllowSymbols))
+	config.Set(tradeservice.DenySymbolsConfigKey, joinList(request.DenySymbols))
+	config.Set(tradeservice.AllowQuoteAssetsConfigKey, joinList(request.AllowQuoteAssets))
+	config.Set(tradeservice.DenyQuoteAssetsConfigKey, joinList(request.DenyQuoteAssets))
+	config.WriteConfig(ServerFlags.ConfigFilename)
+	WriteJsonResponse(w, http.StatusOK, tradeservice.GetTradingRestrictions())
+}
+
+// SavePriceGuardHandler sets how far a manual buy or sell price may be from
+// the market before it has to be confirmed. A percent left out uses the
+// default, zero has every price worse than the market confirmed and a
+// negative percent turns the check off.
+func SavePriceGuardHandler(w http.ResponseWriter, r *http.Request) {
+	type priceGuardConfig struct {
+		BuyMaxDeviationPercent  *float64 `json:"buyMaxDeviationPercent"`
+		SellMaxDeviationPercent *float64 `json:"sellMaxDeviationPercent"`
+	}
+	formatPercent := func(percent *float64) string {
+		if percent == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*percent, 'f', -1, 64)
+	}
+
+	var request priceGuardConfig
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.WithFields(log.Fields{
+			"path":   r.URL.Path,
+			"method": r.Method,
+		}).WithError(err).Errorf("Failed to decode price guard configuration.")
+		WriteJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	config.Set(tradeservice.BuyMaxDeviationConfigKey,
+		formatPercent(request.BuyMaxDeviationPercent))
+	config.Set(tradeservice.SellMaxDeviationConfigKey,
+		formatPercent(request.SellMaxDeviationPercent))
+	config.WriteConfig(ServerFlags.ConfigFilename)
+}
+
 func SaveBinanceConfigHandler(w http.ResponseWriter, r *http.Request) {
 	type binanceApiConfiguration struct {
 		ApiKey    string `json:"key"`
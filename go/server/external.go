@@ -0,0 +1,269 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+// Listing and adoption of orders and balances that were not created by
+// Maker, for example buys made from the Binance mobile app.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+	"time"
+)
+
+type ExternalBalance struct {
+	Asset     string          `json:"asset"`
+	Free      decimal.Decimal `json:"free"`
+	Locked    decimal.Decimal `json:"locked"`
+	Managed   decimal.Decimal `json:"managed"`
+	Unmanaged decimal.Decimal `json:"unmanaged"`
+}
+
+type ExternalResponse struct {
+	OpenOrders []binanceapi.OrderResponse    `json:"openOrders"`
+	Reports    []tradeservice.ExternalReport `json:"reports"`
+	Balances   []ExternalBalance             `json:"balances"`
+}
+
+// AdoptRequest adopts either an open buy order, if OrderID is set, or a
+// quantity of the symbol's base asset already held. When adopting a balance
+// the quantity defaults to everything not held by a trade, and the price
+// defaults to the average price of the most recent buys of that quantity.
+type AdoptRequest struct {
+	Symbol   string          `json:"symbol"`
+	OrderID  int64           `json:"orderId"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Price    decimal.Decimal `json:"price"`
+	TradeSettings
+}
+
+func listExternal(tradeService *tradeservice.TradeService) (*ExternalResponse, error) {
+	restClient := binanceex.GetBinanceRestClient()
+
+	response := &ExternalResponse{
+		OpenOrders: []binanceapi.OrderResponse{},
+		Reports:    tradeService.ExternalReports(),
+		Balances:   []ExternalBalance{},
+	}
+
+	openOrders, err := restClient.GetOpenOrders("")
+	if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to get open orders: %v", err)
+	}
+	for _, order := range openOrders {
+		if !tradeService.IsManagedOrder(order.ClientOrderId) {
+			response.OpenOrders = append(response.OpenOrders, order)
+		}
+	}
+
+	balances, err := getExternalBalances(tradeService)
+	if err != nil {
+		return nil, err
+	}
+	for _, balance := range balances {
+		if balance.Unmanaged.IsPositive() {
+			response.Balances = append(response.Balances, balance)
+		}
+	}
+
+	return response, nil
+}
+
+func getExternalBalances(tradeService *tradeservice.TradeService) (map[string]ExternalBalance, error) {
+	account, err := binanceex.GetBinanceRestClient().GetAccount()
+	if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to get account: %v", err)
+	}
+	managed := tradeService.ManagedQuantities()
+	balances := make(map[string]ExternalBalance)
+	for _, accountBalance := range account.Balances {
+		balance := ExternalBalance{
+			Asset:   accountBalance.Asset,
+			Free:    decimal.NewFromFloat(accountBalance.Free),
+			Locked:  decimal.NewFromFloat(accountBalance.Locked),
+			Managed: managed[accountBalance.Asset],
+		}
+		balance.Unmanaged = balance.Free.Add(balance.Locked).Sub(balance.Managed)
+		balances[balance.Asset] = balance
+	}
+	return balances, nil
+}
+
+func adoptTrade(tradeService *tradeservice.TradeService,
+	request AdoptRequest) (*tradeCommandResult, error) {
+	if request.Symbol == "" {
+		return nil, NewApiError(http.StatusBadRequest, "symbol required")
+	}
+	if err := request.TradeSettings.validate(); err != nil {
+		return nil, err
+	}
+
+	symbolInfo, err := tradeService.ExchangeInfo().GetSymbol(request.Symbol)
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest,
+			"invalid symbol %s: %v", request.Symbol, err)
+	}
+
+	logFields := log.Fields{
+		"symbol":  request.Symbol,
+		"orderId": request.OrderID,
+	}
+
+	restClient := binanceex.GetBinanceRestClient()
+
+	trade := types.NewTrade()
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Now(),
+		Type:      types.HistoryTypeCreated,
+		Fields:    request,
+	})
+	trade.State.Symbol = request.Symbol
+
+	if request.OrderID != 0 {
+		order, err := restClient.GetOrderByOrderId(request.Symbol, request.OrderID)
+		if err != nil {
+			return nil, NewApiError(http.StatusBadRequest,
+				"failed to get order: %v", err)
+		}
+
+		fills := []types.OrderFill{}
+		if order.Status == binanceapi.OrderStatusPartiallyFilled {
+			trades, err := restClient.GetMytrades(request.Symbol, 0, -1)
+			if err != nil {
+				return nil, NewApiError(http.StatusInternalServerError,
+					"failed to get trades: %v", err)
+			}
+			for _, entry := range trades {
+				if entry.OrderID == order.OrderId {
+					fills = append(fills, types.OrderFill{
+						Price:            decimal.NewFromFloat(entry.Price),
+						Quantity:         decimal.NewFromFloat(entry.Quantity),
+						CommissionAsset:  entry.CommissionAsset,
+						CommissionAmount: decimal.NewFromFloat(entry.Commission),
+					})
+				}
+			}
+		}
+
+		request.TradeSettings.apply(trade, logFields)
+		if err := tradeService.AdoptOrder(trade, *order, fills); err != nil {
+			return nil, NewApiError(http.StatusBadRequest, "%v", err)
+		}
+		return &tradeCommandResult{TradeID: trade.State.TradeID}, nil
+	}
+
+	balances, err := getExternalBalances(tradeService)
+	if err != nil {
+		return nil, err
+	}
+	balance := balances[symbolInfo.BaseAsset]
+
+	quantity := request.Quantity
+	if quantity.IsZero() {
+		quantity = decimal.Min(balance.Unmanaged, balance.Free)
+	} else if quantity.GreaterThan(balance.Unmanaged) {
+		return nil, NewApiError(http.StatusBadRequest,
+			"quantity %s is more than the %s %s not held by trades",
+			quantity, balance.Unmanaged, symbolInfo.BaseAsset)
+	}
+	if !quantity.IsPositive() {
+		return nil, NewApiError(http.StatusBadRequest,
+			"no %s balance to adopt", symbolInfo.BaseAsset)
+	}
+
+	price := request.Price
+	if price.IsZero() {
+		trades, err := restClient.GetMytrades(request.Symbol, 0, -1)
+		if err != nil {
+			return nil, NewApiError(http.StatusInternalServerError,
+				"failed to get trades: %v", err)
+		}
+		price, err = computeEntryPrice(trades, quantity)
+		if err != nil {
+			return nil, NewApiError(http.StatusBadRequest,
+				"%v, the price must be provided", err)
+		}
+	}
+
+	logFields["quantity"] = quantity
+	logFields["price"] = price
+	request.TradeSettings.apply(trade, logFields)
+	if err := tradeService.AdoptBalance(trade, quantity, price); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, "%v", err)
+	}
+	return &tradeCommandResult{TradeID: trade.State.TradeID}, nil
+}
+
+// computeEntryPrice returns the average price paid for the quantity by
+// the most recent buys in the trade history, which is ordered oldest first.
+func computeEntryPrice(trades []binanceapi.MyTradesResponseEntry,
+	quantity decimal.Decimal) (decimal.Decimal, error) {
+	remaining := quantity
+	cost := decimal.Zero
+	for i := len(trades) - 1; i >= 0 && remaining.IsPositive(); i-- {
+		if !trades[i].IsBuyer {
+			continue
+		}
+		filled := decimal.Min(remaining, decimal.NewFromFloat(trades[i].Quantity))
+		cost = cost.Add(filled.Mul(decimal.NewFromFloat(trades[i].Price)))
+		remaining = remaining.Sub(filled)
+	}
+	if remaining.IsPositive() {
+		return decimal.Zero, fmt.Errorf(
+			"trade history does not cover a quantity of %s", quantity)
+	}
+	return cost.Div(quantity), nil
+}
+
+func externalHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := listExternal(tradeService)
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, response)
+	}
+}
+
+func adoptHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request AdoptRequest
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&request); err != nil {
+			log.Printf("error: failed to decode request body: %v", err)
+			WriteBadRequestError(w)
+			return
+		}
+
+		response, err := adoptTrade(tradeService, request)
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+
+		WriteJsonResponse(w, http.StatusOK, response)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+// Guard rules that act on many trades at once when a reference market drops,
+// and the panic kill switch. Either blocks new buys until re-armed.
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+	"strings"
+)
+
+// GuardRuleRequest creates a guard rule, or replaces the settings of the
+// rule if the ID is set.
+type GuardRuleRequest struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Enabled       bool              `json:"enabled"`
+	Symbol        string            `json:"symbol"`
+	DropPercent   float64           `json:"dropPercent"`
+	WindowMinutes float64           `json:"windowMinutes"`
+	Action        types.GuardAction `json:"action"`
+
+	// The stop loss percent to tighten to for TIGHTEN_STOPS.
+	StopLossPercent float64 `json:"stopLossPercent"`
+
+	// Only act on trades in this quote asset, all trades if not set.
+	QuoteAsset string `json:"quoteAsset"`
+}
+
+func (r GuardRuleRequest) validate(tradeService *tradeservice.TradeService) error {
+	if r.Symbol == "" {
+		return NewApiError(http.StatusBadRequest, "missing required parameter: symbol")
+	}
+	if _, err := tradeService.ExchangeInfo().GetSymbol(strings.ToUpper(r.Symbol)); err != nil {
+		return NewApiError(http.StatusBadRequest, "invalid symbol %s: %v", r.Symbol, err)
+	}
+	if r.DropPercent <= 0 {
+		return NewApiError(http.StatusBadRequest, "dropPercent must be positive")
+	}
+	if r.WindowMinutes <= 0 {
+		return NewApiError(http.StatusBadRequest, "windowMinutes must be positive")
+	}
+	switch r.Action {
+	case types.GuardActionTightenStops:
+		if r.StopLossPercent <= 0 {
+			return NewApiError(http.StatusBadRequest,
+				"stopLossPercent must be positive to tighten stops")
+		}
+	case types.GuardActionCancelBuys, types.GuardActionSellAll:
+	default:
+		return NewApiError(http.StatusBadRequest,
+			"invalid value for action: %v", r.Action)
+	}
+	return nil
+}
+
+func (r GuardRuleRequest) rule() types.GuardRule {
+	return types.GuardRule{
+		ID:              r.ID,
+		Name:            r.Name,
+		Enabled:         r.Enabled,
+		Symbol:          strings.ToUpper(r.Symbol),
+		DropPercent:     r.DropPercent,
+		WindowMinutes:   r.WindowMinutes,
+		Action:          r.Action,
+		StopLossPercent: r.StopLossPercent,
+		QuoteAsset:      strings.ToUpper(r.QuoteAsset),
+	}
+}
+
+type GuardResponse struct {
+	KillSwitch bool   `json:"killSwitch"`
+	Blocked    string `json:"blocked,omitempty"`
+
+	Rules []types.GuardRule `json:"rules"`
+}
+
+type PanicResponse struct {
+	Results []tradeservice.GuardResult `json:"results"`
+}
+
+func getGuard(tradeService *tradeservice.TradeService) *GuardResponse {
+	return &GuardResponse{
+		KillSwitch: config.GetBool(tradeservice.KillSwitchConfigKey),
+		Blocked:    tradeService.EntriesBlocked(),
+		Rules:      tradeService.GuardRules(),
+	}
+}
+
+func saveGuardRule(tradeService *tradeservice.TradeService,
+	request GuardRuleRequest) (*types.GuardRule, error) {
+	if err := request.validate(tradeService); err != nil {
+		return nil, err
+	}
+	rule, err := tradeService.SaveGuardRule(request.rule())
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest, "%v", err)
+	}
+	return &rule, nil
+}
+
+// rearmGuard re-arms a fired guard rule, or all rules and the kill switch if
+// no rule ID is given.
+func rearmGuard(tradeService *tradeservice.TradeService, ruleId string) error {
+	if err := tradeService.RearmGuard(ruleId); err != nil {
+		return NewApiError(http.StatusBadRequest, "%v", err)
+	}
+	if ruleId == "" && config.GetBool(tradeservice.KillSwitchConfigKey) {
+		log.Infof("Kill switch re-armed")
+		config.Set(tradeservice.KillSwitchConfigKey, "false")
+		config.WriteConfig(ServerFlags.ConfigFilename)
+	}
+	return nil
+}
+
+// panicSell turns on the kill switch, then cancels every pending buy and
+// market sells every open trade.
+func panicSell(tradeService *tradeservice.TradeService) *PanicResponse {
+	config.Set(tradeservice.KillSwitchConfigKey, "true")
+	config.WriteConfig(ServerFlags.ConfigFilename)
+	return &PanicResponse{
+		Results: tradeService.Panic(),
+	}
+}
+
+func getGuardHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJsonResponse(w, http.StatusOK, getGuard(tradeService))
+	}
+}
+
+func saveGuardRuleHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request GuardRuleRequest
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&request); err != nil {
+			log.Printf("error: failed to decode request body: %v", err)
+			WriteBadRequestError(w)
+			return
+		}
+
+		rule, err := saveGuardRule(tradeService, request)
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, rule)
+	}
+}
+
+func deleteGuardRuleHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := tradeService.DeleteGuardRule(mux.Vars(r)["ruleId"]); err != nil {
+			WriteApiError(w, NewApiError(http.StatusNotFound, "%v", err))
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, getGuard(tradeService))
+	}
+}
+
+// Re-arm the guard.
+//
+// Query string parameters:
+// - ruleId: the rule to re-arm, all rules and the kill switch if not set.
+func rearmGuardHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := rearmGuard(tradeService, r.FormValue("ruleId")); err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, getGuard(tradeService))
+	}
+}
+
+func panicHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJsonResponse(w, http.StatusOK, panicSell(tradeService))
+	}
+}
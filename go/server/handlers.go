@@ -18,12 +18,12 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/crankykernel/binanceapi-go"
 	"github.com/gobuffalo/packr/v2"
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
 	"gitlab.com/crankykernel/maker/go/binanceex"
 	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
 	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/tradeservice"
 	"gitlab.com/crankykernel/maker/go/types"
@@ -33,6 +33,7 @@ import (
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -125,6 +126,139 @@ func abandonTradeHandler(tradeService *tradeservice.TradeService) http.HandlerFu
 	}
 }
 
+// Update the time based exit policy of a trade. The request body is an
+// ExitPolicySettings, all zero to clear the policy.
+//
+// Router vars:
+// - tradeId: The trade ID to update.
+func updateExitPolicyHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trade, err := findTrade(tradeService, mux.Vars(r)["tradeId"])
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+
+		var settings ExitPolicySettings
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&settings); err != nil {
+			log.Printf("error: failed to decode request body: %v", err)
+			WriteBadRequestError(w)
+			return
+		}
+
+		if err := updateExitPolicy(tradeService, trade, settings); err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, tradeService.Snapshot(trade).ExitPolicy)
+	}
+}
+
+// Update how the exits of a trade are executed. The request body is an
+// ExitExecutionSettings, without an exitMode to use the configured default.
+//
+// Router vars:
+// - tradeId: The trade ID to update.
+func updateExitExecutionHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trade, err := findTrade(tradeService, mux.Vars(r)["tradeId"])
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+
+		var settings ExitExecutionSettings
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&settings); err != nil {
+			log.Printf("error: failed to decode request body: %v", err)
+			WriteBadRequestError(w)
+			return
+		}
+
+		if err := updateExitExecution(tradeService, trade, settings); err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, tradeService.Snapshot(trade).ExitExecution)
+	}
+}
+
+// Set the tags and notes of a trade. The request body is a MetadataUpdate,
+// fields not set are left as is.
+//
+// Router vars:
+// - tradeId: The trade ID, which may be closed.
+func updateMetadataHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var update tradeservice.MetadataUpdate
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&update); err != nil {
+			log.Printf("error: failed to decode request body: %v", err)
+			WriteBadRequestError(w)
+			return
+		}
+
+		state, err := updateMetadata(tradeService, mux.Vars(r)["tradeId"], update)
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, state)
+	}
+}
+
+// Sell what is left of a trade with an execution algo. The request body is
+// an AlgoSellRequest.
+//
+// Router vars:
+// - tradeId: The trade ID to sell.
+func algoSellHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trade, err := findTrade(tradeService, mux.Vars(r)["tradeId"])
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+
+		var request AlgoSellRequest
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&request); err != nil {
+			log.Printf("error: failed to decode request body: %v", err)
+			WriteBadRequestError(w)
+			return
+		}
+
+		if err := algoSell(tradeService, trade, request); err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, tradeService.Snapshot(trade).Algo)
+	}
+}
+
+// Pause, resume or cancel the execution algo of a trade.
+//
+// Router vars:
+// - tradeId: The trade ID to update.
+// - action: pause, resume or cancel.
+func updateAlgoHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		trade, err := findTrade(tradeService, vars["tradeId"])
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+
+		if err := updateAlgo(tradeService, trade, vars["action"]); err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, tradeService.Snapshot(trade).Algo)
+	}
+}
+
 // Update the stop loss settings for a trade.
 //
 // Router vars:
@@ -133,6 +267,11 @@ func abandonTradeHandler(tradeService *tradeservice.TradeService) http.HandlerFu
 // Query string parameters:
 // - enable: boolean
 // - percent: floating point number where 5.0 means 5.0 percent.
+// - mode: optional PERCENT, TRAILING or PRICE, replaces the adjustments too.
+// - price: the stop price for PRICE mode.
+// - breakEvenPercent: raise the stop to break even at this profit.
+// - stepPercent: raise the stop by stepRaisePercent for each step of profit.
+// - stepRaisePercent: floating point number where 1.0 means 1.0 percent.
 func updateTradeStopLossSettingsHandler(tradeService *tradeservice.TradeService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
@@ -162,12 +301,40 @@ func updateTradeStopLossSettingsHandler(tradeService *tradeservice.TradeService)
 			return
 		}
 
+		var settings *StopLossSettings
+		if mode := r.FormValue("mode"); mode != "" {
+			settings = &StopLossSettings{
+				StopLossMode: types.StopLossMode(mode),
+			}
+			floats := map[string]*float64{
+				"breakEvenPercent": &settings.StopLossBreakEvenPercent,
+				"stepPercent":      &settings.StopLossStepPercent,
+				"stepRaisePercent": &settings.StopLossStepRaisePercent,
+			}
+			for name, value := range floats {
+				if r.FormValue(name) == "" {
+					continue
+				}
+				if *value, err = strconv.ParseFloat(r.FormValue(name), 64); err != nil {
+					WriteBadRequestError(w)
+					return
+				}
+			}
+			if r.FormValue("price") != "" {
+				if settings.StopLossPrice, err = decimal.NewFromString(r.FormValue("price")); err != nil {
+					WriteBadRequestError(w)
+					return
+				}
+			}
+		}
+
 		trade := tradeService.FindTradeByLocalID(tradeId)
 		if trade == nil {
 			log.Printf("Failed to find trade with ID %s.", tradeId)
 			WriteJsonError(w, http.StatusNotFound, "")
+		} else if err := updateStopLoss(tradeService, trade, enable, percent, settings); err != nil {
+			WriteApiError(w, err)
 		} else {
-			tradeService.UpdateStopLoss(trade, enable, percent)
 			WriteJsonResponse(w, http.StatusOK, nil)
 		}
 	}
@@ -248,14 +415,8 @@ func deleteBuyHandler(tradeService *tradeservice.TradeService) http.HandlerFunc
 			return
 		}
 
-		log.WithFields(log.Fields{
-			"symbol":  trade.State.Symbol,
-			"tradeId": tradeId,
-		}).Infof("Cancelling buy order.")
-
-		if err := tradeService.CancelBuy(trade); err != nil {
-			WriteJsonError(w, http.StatusBadRequest,
-				fmt.Sprintf("Failed to cancel buy order: %v", err))
+		if err := cancelBuy(tradeService, trade); err != nil {
+			WriteApiError(w, err)
 		} else {
 			WriteJsonResponse(w, http.StatusOK, nil)
 		}
@@ -281,25 +442,8 @@ func DeleteSellHandler(tradeService *tradeservice.TradeService) http.HandlerFunc
 			return
 		}
 
-		log.WithFields(log.Fields{
-			"symbol":      trade.State.Symbol,
-			"tradeId":     trade.State.TradeID,
-			"sellOrderId": trade.State.SellOrderId,
-		}).Infof("Cancelling sell order.")
-
-		switch trade.State.Status {
-		case types.TradeStatusNew:
-			fallthrough
-		case types.TradeStatusPendingBuy:
-			trade.State.LimitSell.Enabled = false
-			db.DbUpdateTrade(trade)
-			tradeService.BroadcastTradeUpdate(trade)
-			return
-		}
-
-		if err := tradeService.CancelSell(trade); err != nil {
-			WriteJsonError(w, http.StatusBadRequest,
-				fmt.Sprintf("%s", string(err.Error())))
+		if err := cancelSell(tradeService, trade); err != nil {
+			WriteApiError(w, err)
 		} else {
 			WriteJsonResponse(w, http.StatusOK, nil)
 		}
@@ -332,39 +476,15 @@ func limitSellByPercentHandler(tradeService *tradeservice.TradeService) http.Han
 			return
 		}
 
-		switch trade.State.Status {
-		case types.TradeStatusNew:
-			fallthrough
-		case types.TradeStatusPendingBuy:
-			trade.SetLimitSellByPercent(percent)
-			db.DbUpdateTrade(trade)
-			tradeService.BroadcastTradeUpdate(trade)
-			log.WithFields(log.Fields{
-				"symbol":  trade.State.Symbol,
-				"tradeId": trade.State.TradeID,
-				"percent": percent,
-			}).Info("Updated limit sell on buy.")
+		if isDryRun(r) {
+			writeSellPreview(w, tradeService, trade, CommandLimitSellByPercent,
+				percent, decimal.Zero)
 			return
 		}
 
-		startTime := time.Now()
-
-		if trade.State.Status == types.TradeStatusPendingSell {
-			log.Printf("Cancelling existing sell order.")
-			tradeService.CancelSell(trade)
-		}
-
-		err = tradeService.LimitSellByPercent(trade, percent)
-		if err != nil {
-			log.WithError(err).Error("Limit sell order failed.")
-			WriteJsonResponse(w, http.StatusBadRequest, err.Error())
+		if err := limitSellByPercent(tradeService, trade, percent); err != nil {
+			WriteApiError(w, err)
 		}
-
-		duration := time.Since(startTime)
-		log.WithFields(log.Fields{
-			"duration": duration,
-			"symbol":   trade.State.Symbol,
-		}).Debug("Sell order posted.")
 	}
 }
 
@@ -386,7 +506,7 @@ func limitSellByPriceHandler(tradeService *tradeservice.TradeService) http.Handl
 			return
 		}
 
-		price, err := strconv.ParseFloat(r.FormValue("price"), 64)
+		price, err := decimal.NewFromString(r.FormValue("price"))
 		if err != nil {
 			WriteJsonError(w, http.StatusBadRequest,
 				fmt.Sprintf("failed to parse price: %s: %v",
@@ -400,39 +520,16 @@ func limitSellByPriceHandler(tradeService *tradeservice.TradeService) http.Handl
 			return
 		}
 
-		switch trade.State.Status {
-		case types.TradeStatusNew:
-			fallthrough
-		case types.TradeStatusPendingBuy:
-			trade.SetLimitSellByPrice(price)
-			db.DbUpdateTrade(trade)
-			tradeService.BroadcastTradeUpdate(trade)
-			log.WithFields(log.Fields{
-				"symbol":  trade.State.Symbol,
-				"tradeId": trade.State.TradeID,
-				"price":   price,
-			}).Info("Updated limit sell on buy.")
+		if isDryRun(r) {
+			writeSellPreview(w, tradeService, trade, CommandLimitSellByPrice,
+				0, price)
 			return
 		}
 
-		startTime := time.Now()
-
-		if trade.State.Status == types.TradeStatusPendingSell {
-			log.Printf("Cancelling existing sell order.")
-			tradeService.CancelSell(trade)
-		}
-
-		err = tradeService.LimitSellByPrice(trade, price)
-		if err != nil {
-			log.WithError(err).Error("Limit sell order failed.")
-			WriteJsonResponse(w, http.StatusBadRequest, err.Error())
+		confirmDeviation, _ := strconv.ParseBool(r.FormValue("confirmDeviation"))
+		if err := limitSellByPrice(tradeService, trade, price, confirmDeviation); err != nil {
+			WriteApiError(w, err)
 		}
-
-		duration := time.Since(startTime)
-		log.WithFields(log.Fields{
-			"duration": duration,
-			"symbol":   trade.State.Symbol,
-		}).Debug("Sell order posted.")
 	}
 }
 
@@ -452,18 +549,77 @@ func marketSellHandler(tradeService *tradeservice.TradeService) http.HandlerFunc
 			return
 		}
 
-		if trade.State.Status == types.TradeStatusPendingSell {
-			log.Printf("Cancelling existing sell order.")
-			tradeService.CancelSell(trade)
+		if isDryRun(r) {
+			writeSellPreview(w, tradeService, trade, CommandMarketSell,
+				0, decimal.Zero)
+			return
+		}
+
+		if err := marketSell(tradeService, trade); err != nil {
+			WriteApiError(w, err)
+		}
+	}
+}
+
+// isDryRun returns true if the dryRun form value is set, in which case
+// the order is previewed rather than posted.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+	return dryRun
+}
+
+// dryRunRoutes are the routes that handle the dryRun form value.
+var dryRunRoutes = map[string]bool{
+	"/api/binance/trade/{tradeId}/limitSellByPercent": true,
+	"/api/binance/trade/{tradeId}/limitSellByPrice":   true,
+	"/api/binance/trade/{tradeId}/marketSell":         true,
+}
+
+// dryRunMiddleware fails a request for a dry run of a route that can't
+// preview, instead of carrying it out for real.
+func dryRunMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && isDryRun(r) {
+			template := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+			}
+			if !dryRunRoutes[template] {
+				WriteJsonError(w, http.StatusBadRequest,
+					"dryRun not supported by this endpoint")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeSellPreview(w http.ResponseWriter, tradeService *tradeservice.TradeService,
+	trade *types.Trade, command string, percent float64, price decimal.Decimal) {
+	preview, err := previewSell(tradeService, trade, command, percent, price)
+	if err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, preview)
+}
+
+func previewBuyHandler(tradeService *tradeservice.TradeService,
+	binancePriceService *binanceex.BinancePriceService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestBody, err := readBuyOrderRequest(r)
+		if err != nil {
+			WriteApiError(w, err)
+			return
 		}
 
-		err := tradeService.MarketSell(trade, false)
+		preview, err := prepareBuyOrder(tradeService, binancePriceService, requestBody)
 		if err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"symbol": trade.State.Symbol,
-			}).Errorf("Market sell failed")
-			WriteJsonError(w, http.StatusInternalServerError, err.Error())
+			WriteApiError(w, err)
+			return
 		}
+
+		WriteJsonResponse(w, http.StatusOK, preview)
 	}
 }
 
@@ -530,10 +686,17 @@ func staticAssetHandler() http.HandlerFunc {
 	}
 }
 
+// Query closed trades. Trades must have every tag given.
+//
+// Query string parameters:
+// - tag: only trades with the tag, may be given more than once.
+// - notes: only trades with notes containing the text.
 func queryTradesHandler(w http.ResponseWriter, r *http.Request) {
 
 	queryOptions := db.TradeQueryOptions{}
 	queryOptions.IsClosed = true
+	queryOptions.Tags = types.NormalizeTags(r.URL.Query()["tag"])
+	queryOptions.Notes = strings.TrimSpace(r.URL.Query().Get("notes"))
 
 	trades, err := db.DbQueryTrades(queryOptions)
 	if err != nil {
@@ -560,193 +723,19 @@ func getTradeHandler(w http.ResponseWriter, r *http.Request) {
 
 func PostBuyHandler(tradeService *tradeservice.TradeService,
 	binancePriceService *binanceex.BinancePriceService) http.HandlerFunc {
-	type BuyOrderRequest struct {
-		Symbol                  string              `json:"symbol"`
-		Quantity                float64             `json:"quantity"`
-		PriceSource             types.PriceSource   `json:"priceSource"`
-		LimitSellEnabled        bool                `json:"limitSellEnabled"`
-		LimitSellType           types.LimitSellType `json:"limitSellType"`
-		LimitSellPercent        float64             `json:"limitSellPercent"`
-		LimitSellPrice          float64             `json:"limitSellPrice"`
-		StopLossEnabled         bool                `json:"stopLossEnabled"`
-		StopLossPercent         float64             `json:"stopLossPercent"`
-		TrailingProfitEnabled   bool                `json:"trailingProfitEnabled"`
-		TrailingProfitPercent   float64             `json:"trailingProfitPercent"`
-		TrailingProfitDeviation float64             `json:"trailingProfitDeviation"`
-		Price                   float64             `json:"price"`
-		OffsetTicks             int64               `json:"offsetTicks"`
-	}
-
-	type BuyOrderResponse struct {
-		TradeID string `json:"trade_id"`
-	}
-
 	return func(w http.ResponseWriter, r *http.Request) {
-		params := binanceapi.OrderParameters{
-			Side:        binanceapi.OrderSideBuy,
-			Type:        binanceapi.OrderTypeLimit,
-			TimeInForce: binanceapi.TimeInForceGTC,
-		}
-
-		var requestBody BuyOrderRequest
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&requestBody); err != nil {
-			log.Printf("error: failed to decode request body: %v", err)
-			WriteBadRequestError(w)
-			return
-		}
-
-		log.Debugf("Received buy order request: %v", log.ToJson(requestBody))
-
-		commonLogFields := log.Fields{
-			"symbol": requestBody.Symbol,
-		}
-
-		// Validate price source.
-		switch requestBody.PriceSource {
-		case types.PriceSourceLast:
-		case types.PriceSourceBestBid:
-		case types.PriceSourceBestAsk:
-		case types.PriceSourceManual:
-		case "":
-			WriteJsonError(w, http.StatusBadRequest, "missing required parameter: priceSource")
-			return
-		default:
-			WriteJsonError(w, http.StatusBadRequest,
-				fmt.Sprintf("invalid value for priceSource: %v", requestBody.PriceSource))
-			return
-		}
-
-		// Validate limit sell.
-		if requestBody.LimitSellEnabled {
-			switch requestBody.LimitSellType {
-			case types.LimitSellTypePercent:
-			case types.LimitSellTypePrice:
-			default:
-				WriteJsonError(w, http.StatusBadRequest,
-					fmt.Sprintf("limit sell type invalid or not set"))
-				return
-			}
-		}
-
-		params.Symbol = requestBody.Symbol
-		params.Quantity = requestBody.Quantity
-
-		orderId, err := tradeService.MakeOrderID()
+		requestBody, err := readBuyOrderRequest(r)
 		if err != nil {
-			log.WithFields(commonLogFields).WithError(err).Errorf("Failed to create order ID.")
-			WriteJsonError(w, http.StatusInternalServerError, err.Error())
+			WriteApiError(w, err)
 			return
 		}
-		params.NewClientOrderId = orderId
-
-		trade := types.NewTrade()
-		trade.AddHistory(types.HistoryEntry{
-			Timestamp: time.Now(),
-			Type:      types.HistoryTypeCreated,
-			Fields:    requestBody,
-		})
-		trade.State.Symbol = params.Symbol
-		trade.AddClientOrderID(params.NewClientOrderId)
-
-		switch requestBody.PriceSource {
-		case types.PriceSourceManual:
-			params.Price = requestBody.Price
-		default:
-			params.Price, err = binancePriceService.GetPrice(params.Symbol, requestBody.PriceSource)
-			if err != nil {
-				log.WithError(err).WithFields(commonLogFields).WithFields(log.Fields{
-					"priceSource": requestBody.PriceSource,
-				}).Error("Failed to get buy price.")
-				WriteJsonError(w, http.StatusInternalServerError,
-					fmt.Sprintf("Failed to get price: %v", err))
-				return
-			}
-			if requestBody.OffsetTicks != 0 {
-				newPrice := binancePriceService.AdjustPriceByTicks(requestBody.Symbol,
-					params.Price, requestBody.OffsetTicks)
-				log.WithFields(log.Fields{
-					"offsetTicks": requestBody.OffsetTicks,
-					"price":       fmt.Sprintf("%.8f", params.Price),
-					"newPrice":    fmt.Sprintf("%.8f", newPrice),
-				}).Infof("Price adjusted by ticks")
-				params.Price = newPrice
-			}
-		}
 
-		if requestBody.StopLossEnabled {
-			trade.SetStopLoss(requestBody.StopLossEnabled,
-				requestBody.StopLossPercent)
-		}
-
-		if requestBody.TrailingProfitEnabled {
-			trade.SetTrailingProfit(requestBody.TrailingProfitEnabled,
-				requestBody.TrailingProfitPercent,
-				requestBody.TrailingProfitDeviation)
-		}
-
-		tradeId := tradeService.AddNewTrade(trade)
-		commonLogFields["tradeId"] = tradeId
-		if requestBody.LimitSellEnabled {
-			if requestBody.LimitSellType == types.LimitSellTypePercent {
-				log.WithFields(commonLogFields).Infof("Setting limit sell at %f percent.",
-					requestBody.LimitSellPercent)
-				trade.SetLimitSellByPercent(requestBody.LimitSellPercent)
-			} else if requestBody.LimitSellType == types.LimitSellTypePrice {
-				log.WithFields(commonLogFields).Infof("Setting limit sell at price %f.",
-					requestBody.LimitSellPrice)
-				trade.SetLimitSellByPrice(requestBody.LimitSellPrice)
-			}
-		}
-
-		log.WithFields(commonLogFields).WithFields(log.Fields{
-			"type":                    params.Type,
-			"price":                   params.Price,
-			"quantity":                params.Quantity,
-			"clientOrderId":           params.NewClientOrderId,
-			"priceSource":             requestBody.PriceSource,
-			"limitSellEnabled":        requestBody.LimitSellEnabled,
-			"limitSellType":           requestBody.LimitSellType,
-			"limitSellPercent":        requestBody.LimitSellPercent,
-			"limitSellPrice":          requestBody.LimitSellPrice,
-			"stopLossEnabled":         requestBody.StopLossEnabled,
-			"stopLossPercent":         requestBody.StopLossPercent,
-			"trailingProfitEnabled":   requestBody.TrailingProfitEnabled,
-			"trailingProfitPercent":   requestBody.TrailingProfitPercent,
-			"trailingProfitDeviation": requestBody.TrailingProfitDeviation,
-			"offsetTicks":             requestBody.OffsetTicks,
-		}).Infof("Posting BUY order for %s", params.Symbol)
-
-		response, err := binanceex.GetBinanceRestClient().PostOrder(params)
+		response, err := placeBuyOrder(tradeService, binancePriceService, requestBody)
 		if err != nil {
-			log.WithError(err).
-				Errorf("Failed to post buy order.")
-			switch err := err.(type) {
-			case *binanceapi.RestApiError:
-				log.Debugf("Forwarding Binance error repsonse.")
-				w.WriteHeader(response.StatusCode)
-				w.Write(err.Body)
-			default:
-				WriteJsonResponse(w, http.StatusInternalServerError,
-					err.Error())
-			}
-			if trade != nil {
-				tradeService.FailTrade(trade)
-			}
+			WriteApiError(w, err)
 			return
 		}
 
-		data, err := ioutil.ReadAll(response.Body)
-		var buyResponse binanceapi.PostOrderResponse
-		if err := json.Unmarshal(data, &buyResponse); err != nil {
-			log.Printf("error: failed to decode buy order response: %v", err)
-		}
-		log.WithFields(log.Fields{
-			"tradeId": tradeId,
-		}).Debugf("Decoded BUY response: %s", log.ToJson(buyResponse))
-
-		WriteJsonResponse(w, http.StatusOK, BuyOrderResponse{
-			TradeID: tradeId,
-		})
+		WriteJsonResponse(w, http.StatusOK, response)
 	}
 }
@@ -0,0 +1,138 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"sync"
+	"time"
+)
+
+// The number of trade messages kept for websocket clients to resume from.
+const messageJournalSize = 1000
+
+// MessageJournal assigns sequence numbers to trade messages and keeps the
+// most recent ones so a reconnecting websocket client can receive the
+// messages it missed instead of a dump of every trade.
+type MessageJournal struct {
+	// Identifies this journal so clients can detect a server restart, after
+	// which sequence numbers start over.
+	ID string
+
+	lock        sync.RWMutex
+	sequence    uint64
+	messages    []*MakerMessage
+	subscribers map[chan *MakerMessage]bool
+}
+
+func NewMessageJournal() *MessageJournal {
+	return &MessageJournal{
+		ID:          fmt.Sprintf("%d", time.Now().UnixNano()),
+		subscribers: make(map[chan *MakerMessage]bool),
+	}
+}
+
+func (j *MessageJournal) Run(tradeService *tradeservice.TradeService) {
+	// Every trade update must be journaled for clients to resume from, so
+	// the subscription can't drop events.
+	channel := tradeService.SubscribeBlocking("message-journal")
+	for {
+		event := <-channel
+		switch event.EventType {
+		case tradeservice.TradeEventTypeUpdate:
+			tradeState := event.TradeState
+			j.append(&MakerMessage{
+				Type:  MakerMessageTypeTrade,
+				Trade: &tradeState,
+			})
+		case tradeservice.TradeEventTypeArchive:
+			j.append(&MakerMessage{
+				Type:    MakerMessageTypeTradeArchived,
+				TradeID: event.TradeID,
+			})
+		default:
+			log.Printf("ERROR: Unknown trade server event type: %s",
+				event.EventType)
+		}
+	}
+}
+
+func (j *MessageJournal) append(message *MakerMessage) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.sequence++
+	message.Sequence = j.sequence
+	j.messages = append(j.messages, message)
+	if len(j.messages) > messageJournalSize {
+		j.messages = j.messages[len(j.messages)-messageJournalSize:]
+	}
+	for channel := range j.subscribers {
+		select {
+		case channel <- message:
+		default:
+			// The subscriber has fallen behind. Closing the channel
+			// tells it to disconnect its client, which can then resume
+			// from the last message it received.
+			log.Warnf("Message journal subscriber too slow, closing")
+			close(channel)
+			delete(j.subscribers, channel)
+		}
+	}
+}
+
+// Subscribe returns a channel that receives all messages after the returned
+// sequence number.
+func (j *MessageJournal) Subscribe() (chan *MakerMessage, uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	channel := make(chan *MakerMessage, 128)
+	j.subscribers[channel] = true
+	return channel, j.sequence
+}
+
+// SubscribeFrom subscribes to new messages and returns the journaled
+// messages after the given sequence number. If messages after the sequence
+// number are no longer available, false is returned and no subscription is
+// made.
+func (j *MessageJournal) SubscribeFrom(sequence uint64) (chan *MakerMessage, []*MakerMessage, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if sequence > j.sequence {
+		return nil, nil, false
+	}
+	missed := []*MakerMessage{}
+	if sequence < j.sequence {
+		if len(j.messages) == 0 || j.messages[0].Sequence > sequence+1 {
+			return nil, nil, false
+		}
+		for _, message := range j.messages {
+			if message.Sequence > sequence {
+				missed = append(missed, message)
+			}
+		}
+	}
+	channel := make(chan *MakerMessage, 128)
+	j.subscribers[channel] = true
+	return channel, missed, true
+}
+
+func (j *MessageJournal) Unsubscribe(channel chan *MakerMessage) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.subscribers, channel)
+}
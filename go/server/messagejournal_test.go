@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func appendTradeArchived(journal *MessageJournal, tradeId string) {
+	journal.append(&MakerMessage{
+		Type:    MakerMessageTypeTradeArchived,
+		TradeID: tradeId,
+	})
+}
+
+func TestMessageJournalResume(t *testing.T) {
+	assert := assert.New(t)
+
+	journal := NewMessageJournal()
+	channel, sequence := journal.Subscribe()
+	assert.Equal(uint64(0), sequence)
+
+	appendTradeArchived(journal, "1")
+	appendTradeArchived(journal, "2")
+	appendTradeArchived(journal, "3")
+	assert.Equal(uint64(1), (<-channel).Sequence)
+	journal.Unsubscribe(channel)
+
+	// The client disconnected after the first message.
+	channel, missed, resumed := journal.SubscribeFrom(1)
+	assert.True(resumed)
+	assert.Len(missed, 2)
+	assert.Equal("2", missed[0].TradeID)
+	assert.Equal(uint64(3), missed[1].Sequence)
+
+	// New messages follow on from the missed ones.
+	appendTradeArchived(journal, "4")
+	message := <-channel
+	assert.Equal("4", message.TradeID)
+	assert.Equal(uint64(4), message.Sequence)
+	journal.Unsubscribe(channel)
+
+	// Nothing was missed.
+	channel, missed, resumed = journal.SubscribeFrom(4)
+	assert.True(resumed)
+	assert.Empty(missed)
+	journal.Unsubscribe(channel)
+
+	// A sequence number the journal hasn't reached, as after a restart.
+	_, _, resumed = journal.SubscribeFrom(5)
+	assert.False(resumed)
+}
+
+func TestMessageJournalResumeTooOld(t *testing.T) {
+	assert := assert.New(t)
+
+	journal := NewMessageJournal()
+	for i := 0; i < messageJournalSize+1; i++ {
+		appendTradeArchived(journal, "trade")
+	}
+
+	// The message after sequence 0 is no longer journaled, the client
+	// needs a full dump.
+	_, _, resumed := journal.SubscribeFrom(0)
+	assert.False(resumed)
+
+	channel, missed, resumed := journal.SubscribeFrom(1)
+	assert.True(resumed)
+	assert.Len(missed, messageJournalSize)
+	journal.Unsubscribe(channel)
+}
+
+func TestMessageJournalSlowSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	journal := NewMessageJournal()
+	channel, _ := journal.Subscribe()
+
+	// A subscriber that stops reading has its channel closed so its
+	// client reconnects, and resumes.
+	received := 0
+	for i := 0; i < cap(channel)+1; i++ {
+		appendTradeArchived(journal, "trade")
+	}
+	for range channel {
+		received++
+	}
+	assert.Equal(cap(channel), received)
+
+	_, missed, resumed := journal.SubscribeFrom(uint64(received))
+	assert.True(resumed)
+	assert.Len(missed, 1)
+}
@@ -0,0 +1,232 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+)
+
+var oneHundred = decimal.NewFromInt(100)
+
+// PositionSizeRequest is the amount to buy. Only one of the fields may be
+// set.
+type PositionSizeRequest struct {
+	// The quantity of the base asset.
+	Quantity decimal.Decimal `json:"quantity"`
+
+	// The amount of the quote asset to spend.
+	QuoteAmount decimal.Decimal `json:"quoteAmount"`
+
+	// The percent (0-100) of the free quote asset balance to spend.
+	BalancePercent float64 `json:"balancePercent"`
+
+	// The amount of the quote asset to lose if the stop loss is hit,
+	// requires the stop loss to be enabled.
+	RiskAmount decimal.Decimal `json:"riskAmount"`
+}
+
+// PositionSize is the computed size of a buy and its projected outcome.
+type PositionSize struct {
+	Quantity decimal.Decimal `json:"quantity"`
+	Price    decimal.Decimal `json:"price"`
+	Notional decimal.Decimal `json:"notional"`
+
+	// The commission projected for the buy and the sell, in the quote
+	// asset.
+	ProjectedFees decimal.Decimal `json:"projectedFees"`
+
+	// The loss if the stop loss is hit, and the profit if the limit sell
+	// fills, after fees. Zero when not enabled.
+	Risk   decimal.Decimal `json:"risk"`
+	Reward decimal.Decimal `json:"reward"`
+
+	// Reward divided by risk, if both are known.
+	RiskReward float64 `json:"riskReward,omitempty"`
+}
+
+// positionSizer is the part of the trade service used to size a position.
+type positionSizer interface {
+	ExchangeInfo() *binanceex.ExchangeInfoService
+	CommissionRate(maker bool) decimal.Decimal
+}
+
+// sizePosition computes the quantity to buy at the price, rounded down to
+// the step size and checked against the minimum notional.
+func sizePosition(tradeService positionSizer, symbol string,
+	price decimal.Decimal, request PositionSizeRequest,
+	settings TradeSettings) (*PositionSize, error) {
+	symbolInfo, err := tradeService.ExchangeInfo().GetSymbol(symbol)
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest,
+			"invalid symbol %s: %v", symbol, err)
+	}
+	if !price.IsPositive() {
+		return nil, NewApiError(http.StatusBadRequest,
+			"price must be greater than 0")
+	}
+
+	count := 0
+	for _, set := range []bool{
+		!request.Quantity.IsZero(),
+		!request.QuoteAmount.IsZero(),
+		request.BalancePercent != 0,
+		!request.RiskAmount.IsZero(),
+	} {
+		if set {
+			count++
+		}
+	}
+	if count != 1 {
+		return nil, NewApiError(http.StatusBadRequest,
+			"exactly one of quantity, quoteAmount, balancePercent or riskAmount is required")
+	}
+
+	var quantity decimal.Decimal
+	switch {
+	case !request.Quantity.IsZero():
+		quantity = request.Quantity
+	case !request.QuoteAmount.IsZero():
+		quantity, err = request.QuoteAmount.DivChecked(price)
+	case request.BalancePercent != 0:
+		if request.BalancePercent < 0 || request.BalancePercent > 100 {
+			return nil, NewApiError(http.StatusBadRequest,
+				"balancePercent must be between 0 and 100")
+		}
+		var balance, amount decimal.Decimal
+		balance, err = getFreeBalance(symbolInfo.QuoteAsset)
+		if err != nil {
+			return nil, err
+		}
+		amount, err = percentOf(balance, request.BalancePercent)
+		if err == nil {
+			quantity, err = amount.DivChecked(price)
+		}
+	case !request.RiskAmount.IsZero():
+		if !settings.StopLossEnabled || settings.stopLossPercent(price) <= 0 {
+			return nil, NewApiError(http.StatusBadRequest,
+				"riskAmount requires a stop loss")
+		}
+		var distance decimal.Decimal
+		distance, err = percentOf(price, settings.stopLossPercent(price))
+		if err != nil {
+			break
+		}
+		if !distance.IsPositive() {
+			return nil, NewApiError(http.StatusBadRequest,
+				"the stop loss is too close to the price of %s to size by risk", price)
+		}
+		quantity, err = request.RiskAmount.DivChecked(distance)
+	}
+	if err != nil {
+		return nil, outOfRange(err)
+	}
+
+	if !quantity.IsPositive() {
+		return nil, NewApiError(http.StatusBadRequest,
+			"quantity must be greater than 0")
+	}
+	quantity = quantity.RoundDown(symbolInfo.StepSize)
+	if !quantity.IsPositive() {
+		return nil, NewApiError(http.StatusBadRequest,
+			"quantity is less than the step size %s", symbolInfo.StepSize)
+	}
+
+	notional, err := quantity.MulChecked(price)
+	if err != nil {
+		return nil, outOfRange(err)
+	}
+	if notional.LessThan(symbolInfo.MinNotional) {
+		return nil, NewApiError(http.StatusBadRequest,
+			"notional %s is less than the minimum of %s",
+			notional, symbolInfo.MinNotional)
+	}
+
+	size := &PositionSize{
+		Quantity: quantity,
+		Price:    price,
+		Notional: notional,
+	}
+
+	// Limit buys are projected at the taker rate as they are usually
+	// placed at or near the best ask. The sell is a maker order only if
+	// it's a limit sell.
+	buyFee := notional.Mul(tradeService.CommissionRate(false))
+	sellFee := notional.Mul(tradeService.CommissionRate(settings.LimitSellEnabled))
+	size.ProjectedFees = buyFee.Add(sellFee)
+
+	if settings.StopLossEnabled {
+		size.Risk, err = percentOf(notional, settings.stopLossPercent(price))
+		if err != nil {
+			return nil, outOfRange(err)
+		}
+		size.Risk = size.Risk.Add(size.ProjectedFees)
+	}
+
+	if settings.LimitSellEnabled {
+		switch settings.LimitSellType {
+		case types.LimitSellTypePercent:
+			size.Reward, err = percentOf(notional, settings.LimitSellPercent)
+		default:
+			size.Reward, err = settings.LimitSellPrice.Sub(price).MulChecked(quantity)
+		}
+		if err != nil {
+			return nil, outOfRange(err)
+		}
+		size.Reward = size.Reward.Sub(size.ProjectedFees)
+	}
+
+	if size.Risk.IsPositive() && settings.LimitSellEnabled {
+		if riskReward, err := size.Reward.DivChecked(size.Risk); err == nil {
+			size.RiskReward = riskReward.Float64()
+		}
+	}
+
+	return size, nil
+}
+
+// percentOf returns percent (0-100) of the amount.
+func percentOf(amount decimal.Decimal, percent float64) (decimal.Decimal, error) {
+	d, err := decimal.NewFromFloatChecked(percent)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	d, err = amount.MulChecked(d)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return d.Div(oneHundred), nil
+}
+
+func outOfRange(err error) error {
+	return NewApiError(http.StatusBadRequest, "position size out of range: %v", err)
+}
+
+func getFreeBalance(asset string) (decimal.Decimal, error) {
+	account, err := binanceex.GetBinanceRestClient().GetAccount()
+	if err != nil {
+		return decimal.Zero, NewApiError(http.StatusInternalServerError,
+			"failed to get account: %v", err)
+	}
+	for _, balance := range account.Balances {
+		if balance.Asset == asset {
+			return decimal.NewFromFloat(balance.Free), nil
+		}
+	}
+	return decimal.Zero, nil
+}
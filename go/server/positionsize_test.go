@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+	"testing"
+)
+
+type fakeSizer struct {
+	exchangeInfo *binanceex.ExchangeInfoService
+}
+
+func newFakeSizer() fakeSizer {
+	exchangeInfo := binanceex.NewExchangeInfoService()
+	exchangeInfo.Symbols["ETHBTC"] = binanceex.SymbolInfo{
+		BaseAsset:   "ETH",
+		QuoteAsset:  "BTC",
+		TickSize:    decimal.RequireFromString("0.00000001"),
+		StepSize:    decimal.RequireFromString("0.001"),
+		MinNotional: decimal.RequireFromString("0.001"),
+	}
+	return fakeSizer{exchangeInfo: exchangeInfo}
+}
+
+func (s fakeSizer) ExchangeInfo() *binanceex.ExchangeInfoService {
+	return s.exchangeInfo
+}
+
+func (s fakeSizer) CommissionRate(maker bool) decimal.Decimal {
+	return types.DEFAULT_FEE
+}
+
+func TestSizePositionByRisk(t *testing.T) {
+	assert := assert.New(t)
+
+	sizer := newFakeSizer()
+	settings := TradeSettings{
+		StopLossEnabled: true,
+		StopLossPercent: 5,
+	}
+	request := PositionSizeRequest{
+		RiskAmount: decimal.RequireFromString("0.01"),
+	}
+
+	size, err := sizePosition(sizer, "ETHBTC", decimal.RequireFromString("0.02"),
+		request, settings)
+	assert.Nil(err)
+	assert.Equal("10", size.Quantity.String())
+	assert.Equal("0.2", size.Notional.String())
+
+	// The stop loss rounds to no distance at all from a tiny price.
+	size, err = sizePosition(sizer, "ETHBTC", decimal.RequireFromString("0.00000001"),
+		request, settings)
+	assert.Nil(size)
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+
+	// A stop loss at the price.
+	settings.StopLossMode = types.StopLossModePrice
+	settings.StopLossPrice = decimal.RequireFromString("0.02")
+	_, err = sizePosition(sizer, "ETHBTC", decimal.RequireFromString("0.02"),
+		request, settings)
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+
+	settings.StopLossMode = ""
+	settings.StopLossPercent = 0
+	_, err = sizePosition(sizer, "ETHBTC", decimal.RequireFromString("0.02"),
+		request, settings)
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+}
+
+func TestSizePositionOutOfRange(t *testing.T) {
+	assert := assert.New(t)
+
+	sizer := newFakeSizer()
+
+	// The quantity is more than a decimal holds.
+	_, err := sizePosition(sizer, "ETHBTC", decimal.RequireFromString("0.00000001"),
+		PositionSizeRequest{QuoteAmount: decimal.NewFromInt(1000)}, TradeSettings{})
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+
+	_, err = sizePosition(sizer, "ETHBTC", decimal.NewFromInt(1000000),
+		PositionSizeRequest{Quantity: decimal.NewFromInt(1000000)}, TradeSettings{})
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+
+	size, err := sizePosition(sizer, "ETHBTC", decimal.RequireFromString("0.02"),
+		PositionSizeRequest{QuoteAmount: decimal.RequireFromString("0.2")}, TradeSettings{})
+	assert.Nil(err)
+	assert.Equal("10", size.Quantity.String())
+}
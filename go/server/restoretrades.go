@@ -19,6 +19,7 @@ import (
 	"github.com/crankykernel/binanceapi-go"
 	"gitlab.com/crankykernel/maker/go/binanceex"
 	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
 	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/tradeservice"
 	"gitlab.com/crankykernel/maker/go/types"
@@ -38,22 +39,40 @@ func restoreTrades(tradeService *tradeservice.TradeService) {
 		position := types.NewTradeWithState(state)
 		tradeService.RestoreTrade(position)
 
-		if position.State.Status == types.TradeStatusNew {
-			var clientOrderId string = ""
-			for clientOrderId = range position.State.ClientOrderIDs {
-				break
+		if state.Algo.Active() {
+			// The algo looks up its own child orders.
+			tradeService.UpdateSellableQuantity(position)
+			continue
+		}
+
+		if state.Status == types.TradeStatusNew || state.Status == types.TradeStatusPendingBuy {
+			var order *binanceapi.OrderResponse
+			if state.Status == types.TradeStatusNew {
+				var clientOrderId string = ""
+				for clientOrderId = range state.ClientOrderIDs {
+					break
+				}
+				order, err = binanceRestClient.GetOrderByClientId(state.Symbol, clientOrderId)
+			} else if state.BuyOrderId <= state.Entry.ReplacedOrderID {
+				// A chasing buy was replaced but the new order was not
+				// acknowledged.
+				order, err = binanceRestClient.GetOrderByClientId(
+					state.Symbol, state.Entry.ClientOrderID)
+			} else {
+				order, err = binanceRestClient.GetOrderByOrderId(
+					state.Symbol, state.BuyOrderId)
 			}
-			order, err := binanceRestClient.GetOrderByClientId(position.State.Symbol, clientOrderId)
 			if err != nil {
-				log.WithError(err).Error("Failed to get trade by client order ID.")
+				log.WithError(err).WithFields(log.Fields{
+					"tradeId": state.TradeID,
+					"symbol":  state.Symbol,
+				}).Error("Failed to get buy order.")
 				continue
 			}
 
-			switch order.Status {
-			case binanceapi.OrderStatusNew:
-				position.State.Status = types.TradeStatusPendingBuy
-			case binanceapi.OrderStatusPartiallyFilled:
-				position.State.Status = types.TradeStatusPendingBuy
+			// Fills already recorded are skipped, they are recorded in the
+			// order they are made.
+			addBuyFills := func() {
 				trades := tradeHistoryCache[state.Symbol]
 				if trades == nil {
 					trades, err = binanceRestClient.GetMytrades(state.Symbol, 0, -1)
@@ -62,80 +81,99 @@ func restoreTrades(tradeService *tradeservice.TradeService) {
 					}
 					tradeHistoryCache[state.Symbol] = trades
 				}
+				skip := len(state.BuySideFills)
+				if state.Entry.ReplacedOrderID != 0 {
+					// Fills of the earlier orders of a chasing buy.
+					skip -= state.Entry.BuyFills
+				}
 				for _, trade := range trades {
-					if trade.OrderID == order.OrderId {
-						log.Println(log.ToJson(trade))
-						fill := types.OrderFill{
-							Price:            trade.Price,
-							Quantity:         trade.Quantity,
-							CommissionAsset:  trade.CommissionAsset,
-							CommissionAmount: trade.Commission,
-						}
-						position.DoAddBuyFill(fill)
+					if trade.OrderID != order.OrderId {
+						continue
 					}
-				}
-			case binanceapi.OrderStatusFilled:
-				position.State.Status = types.TradeStatusWatching
-				trades := tradeHistoryCache[state.Symbol]
-				if trades == nil {
-					trades, err = binanceRestClient.GetMytrades(state.Symbol, 0, -1)
-					if err != nil {
-						log.Errorf("Failed to get trades: %v", err)
+					if skip > 0 {
+						skip--
+						continue
 					}
-					tradeHistoryCache[state.Symbol] = trades
-				}
-				for _, trade := range trades {
-					if trade.OrderID == order.OrderId {
-						log.Println(log.ToJson(trade))
-						fill := types.OrderFill{
-							Price:            trade.Price,
-							Quantity:         trade.Quantity,
-							CommissionAsset:  trade.CommissionAsset,
-							CommissionAmount: trade.Commission,
-						}
-						position.DoAddBuyFill(fill)
+					log.Println(log.ToJson(trade))
+					fill := types.OrderFill{
+						Price:            decimal.NewFromFloat(trade.Price),
+						Quantity:         decimal.NewFromFloat(trade.Quantity),
+						CommissionAsset:  trade.CommissionAsset,
+						CommissionAmount: decimal.NewFromFloat(trade.Commission),
 					}
+					tradeService.AddFill(position, binanceapi.OrderSideBuy, fill)
 				}
-			default:
-				log.Errorf("Don't know how to restore new trade now with status %s.",
-					order.Status)
-				log.Println(log.ToJson(order))
-			}
-		} else if position.State.Status == types.TradeStatusPendingBuy {
-			order, err := binanceRestClient.GetOrderByOrderId(
-				position.State.Symbol, position.State.BuyOrderId)
-			if err != nil {
-				log.WithError(err).Error("Failed to get order by ID.")
 			}
+
 			switch order.Status {
 			case binanceapi.OrderStatusNew:
-				// No change.
+				// Stop limit and take profit limit entries stay NEW until
+				// triggered.
+				if state.Status == types.TradeStatusNew {
+					tradeService.ChangeStatus(position, types.TradeStatusPendingBuy)
+				}
+			case binanceapi.OrderStatusPartiallyFilled:
+				if state.Status == types.TradeStatusNew {
+					tradeService.ChangeStatus(position, types.TradeStatusPendingBuy)
+				}
+				addBuyFills()
+			case binanceapi.OrderStatusFilled:
+				addBuyFills()
+				tradeService.ChangeStatus(position, types.TradeStatusWatching)
+			case binanceapi.OrderStatusCanceled, binanceapi.OrderStatusExpired,
+				binanceapi.OrderStatusRejected:
+				addBuyFills()
+				closeTime := time.Unix(0, order.TimeMillis*int64(time.Millisecond))
+				if tradeService.Snapshot(position).BuyFillQuantity.IsPositive() {
+					tradeService.ChangeStatus(position, types.TradeStatusWatching)
+				} else if order.Status == binanceapi.OrderStatusRejected {
+					tradeService.CloseTrade(position, types.TradeStatusFailed, closeTime)
+				} else {
+					tradeService.CloseTrade(position, types.TradeStatusCanceled, closeTime)
+				}
+				log.WithFields(log.Fields{
+					"tradeId":     state.TradeID,
+					"symbol":      state.Symbol,
+					"orderStatus": order.Status,
+				}).Infof("Buy order closed while offline.")
 			default:
 				log.WithFields(log.Fields{
-					"tradeId":     position.State.TradeID,
+					"tradeId":     state.TradeID,
 					"orderStatus": order.Status,
-					"symbol":      position.State.Symbol,
-					"tradeStatus": position.State.Status,
+					"symbol":      state.Symbol,
+					"tradeStatus": state.Status,
 				}).Warnf("Don't know how to restore pending buy trade.")
+				log.Println(log.ToJson(order))
 			}
 		}
 
-		if position.State.Status == types.TradeStatusPendingSell {
-			order, err := binanceRestClient.GetOrderByOrderId(
-				position.State.Symbol, position.State.SellOrderId)
+		if state.Status == types.TradeStatusPendingSell {
+			var order *binanceapi.OrderResponse
+			if state.SellOrderId <= state.ExitPolicy.ReplacedOrderID {
+				// The limit sell was replaced but the new order was not
+				// acknowledged.
+				order, err = binanceRestClient.GetOrderByClientId(
+					state.Symbol, state.ExitPolicy.ClientOrderID)
+			} else {
+				order, err = binanceRestClient.GetOrderByOrderId(
+					state.Symbol, state.SellOrderId)
+			}
 			if err != nil {
 				log.WithError(err).Errorf(
 					"Failed to find existing order %d for %s.",
-					position.State.SellOrderId, position.State.Symbol)
+					state.SellOrderId, state.Symbol)
 			} else {
 				if order.Status == binanceapi.OrderStatusNew {
 					// Unchanged.
-				} else if order.Status == binanceapi.OrderStatusCanceled {
+				} else if order.Status == binanceapi.OrderStatusCanceled ||
+					order.Status == binanceapi.OrderStatusExpired ||
+					order.Status == binanceapi.OrderStatusRejected {
 					log.WithFields(log.Fields{
-						"symbol":  state.Symbol,
-						"tradeId": state.TradeID,
+						"symbol":      state.Symbol,
+						"tradeId":     state.TradeID,
+						"orderStatus": order.Status,
 					}).Infof("Outstanding sell order has been canceled.")
-					position.State.Status = types.TradeStatusWatching
+					tradeService.ChangeStatus(position, types.TradeStatusWatching)
 				} else if order.Status == binanceapi.OrderStatusFilled {
 					trades := tradeHistoryCache[state.Symbol]
 					if trades == nil {
@@ -146,27 +184,28 @@ func restoreTrades(tradeService *tradeservice.TradeService) {
 						tradeHistoryCache[state.Symbol] = trades
 					}
 					for _, trade := range trades {
-						if trade.OrderID == state.SellOrderId {
+						if trade.OrderID == order.OrderId {
 							fill := types.OrderFill{
-								Price:            trade.Price,
-								Quantity:         trade.Quantity,
-								CommissionAmount: trade.Commission,
+								Price:            decimal.NewFromFloat(trade.Price),
+								Quantity:         decimal.NewFromFloat(trade.Quantity),
+								CommissionAmount: decimal.NewFromFloat(trade.Commission),
 								CommissionAsset:  trade.CommissionAsset,
 							}
-							position.DoAddSellFill(fill)
+							tradeService.AddFill(position, binanceapi.OrderSideSell, fill)
 						}
 					}
-					if position.State.SellFillQuantity != position.State.BuyFillQuantity {
+					current := tradeService.Snapshot(position)
+					if current.SellFillQuantity != current.BuyFillQuantity {
 						log.WithFields(log.Fields{
-							"buyQuantity":  position.State.BuyFillQuantity,
-							"sellQuantity": position.State.SellFillQuantity,
+							"buyQuantity":  current.BuyFillQuantity,
+							"sellQuantity": current.SellFillQuantity,
 						}).Warnf("Order is filled but sell quantity != buy quantity.")
 					} else {
 						closeTime := time.Unix(0, order.TimeMillis*int64(time.Millisecond))
 						log.WithFields(log.Fields{
-							"symbol":    position.State.Symbol,
+							"symbol":    state.Symbol,
 							"closeTime": closeTime,
-							"tradeId":   position.State.TradeID,
+							"tradeId":   state.TradeID,
 						}).Infof("Closing trade.")
 						tradeService.CloseTrade(position, types.TradeStatusDone, closeTime)
 					}
@@ -181,7 +220,6 @@ func restoreTrades(tradeService *tradeservice.TradeService) {
 			}
 		}
 		tradeService.UpdateSellableQuantity(position)
-		db.DbUpdateTrade(position)
 	}
 	log.Printf("Restored %d trade states.", len(tradeService.TradesByClientID))
 }
@@ -143,15 +143,26 @@ func ServerMain() {
 
 	db.DbOpen(ServerFlags.DataDirectory)
 
-	tradeService := tradeservice.NewTradeService(applicationContext.BinanceTradeStreamManager)
+	clientNotificationService := clientnotificationservice.New()
+
+	tradeService := tradeservice.NewTradeService(applicationContext.BinanceTradeStreamManager,
+		clientNotificationService)
 	applicationContext.TradeService = tradeService
 
 	restoreTrades(tradeService)
+	if err := tradeService.LoadGuardRules(); err != nil {
+		log.WithError(err).Errorf("Failed to load guard rules")
+	}
+	if err := tradeService.LoadCooldowns(); err != nil {
+		log.WithError(err).Errorf("Failed to load stop loss cooldowns")
+	}
+
+	messageJournal := NewMessageJournal()
+	go messageJournal.Run(tradeService)
 
 	binanceExchangeInfoService := initBinanceExchangeInfoService()
 	binancePriceService := binanceex.NewBinancePriceService(binanceExchangeInfoService)
 
-	clientNotificationService := clientnotificationservice.New()
 	healthService := healthservice.New()
 
 	applicationContext.BinanceUserDataStream = binanceex.NewBinanceUserDataStream(
@@ -210,6 +221,7 @@ func ServerMain() {
 		authenticator = NewAuthenticator(ServerFlags.ConfigFilename)
 		router.Use(authenticator.Middleware)
 	}
+	router.Use(dryRunMiddleware)
 
 	router.HandleFunc("/api/config", configHandler).Methods("GET")
 	router.HandleFunc("/api/version", VersionHandler).Methods("GET")
@@ -243,6 +255,7 @@ func ServerMain() {
 	})
 
 	router.HandleFunc("/api/binance/buy", PostBuyHandler(tradeService, binancePriceService)).Methods("POST")
+	router.HandleFunc("/api/binance/buy/preview", previewBuyHandler(tradeService, binancePriceService)).Methods("POST")
 	router.HandleFunc("/api/binance/buy", deleteBuyHandler(tradeService)).Methods("DELETE")
 	router.HandleFunc("/api/binance/sell", DeleteSellHandler(tradeService)).Methods("DELETE")
 
@@ -267,6 +280,50 @@ func ServerMain() {
 		archiveTradeHandler(tradeService)).Methods("POST")
 	router.HandleFunc("/api/binance/trade/{tradeId}/abandon",
 		abandonTradeHandler(tradeService)).Methods("POST")
+	router.HandleFunc("/api/binance/trade/{tradeId}/exitPolicy",
+		updateExitPolicyHandler(tradeService)).Methods("POST")
+	router.HandleFunc("/api/binance/trade/{tradeId}/exitExecution",
+		updateExitExecutionHandler(tradeService)).Methods("POST")
+	router.HandleFunc("/api/binance/trade/{tradeId}/metadata",
+		updateMetadataHandler(tradeService)).Methods("POST")
+	router.HandleFunc("/api/binance/trade/{tradeId}/algoSell",
+		algoSellHandler(tradeService)).Methods("POST")
+	router.HandleFunc("/api/binance/trade/{tradeId}/algo/{action}",
+		updateAlgoHandler(tradeService)).Methods("POST")
+
+	// Orders and balances not managed by Maker.
+	router.HandleFunc("/api/binance/external",
+		externalHandler(tradeService)).Methods("GET")
+	router.HandleFunc("/api/binance/external/adopt",
+		adoptHandler(tradeService)).Methods("POST")
+
+	// Guard rules and the kill switch.
+	router.HandleFunc("/api/guard",
+		getGuardHandler(tradeService)).Methods("GET")
+	router.HandleFunc("/api/guard/rule",
+		saveGuardRuleHandler(tradeService)).Methods("POST")
+	router.HandleFunc("/api/guard/rule/{ruleId}",
+		deleteGuardRuleHandler(tradeService)).Methods("DELETE")
+	router.HandleFunc("/api/guard/rearm",
+		rearmGuardHandler(tradeService)).Methods("POST")
+	router.HandleFunc("/api/guard/panic",
+		panicHandler(tradeService)).Methods("POST")
+
+	// Signal webhooks and their configuration.
+	signalService := NewSignalService(tradeService, binancePriceService,
+		clientNotificationService)
+	router.HandleFunc("/api/signals/{name}",
+		receiveSignalHandler(signalService)).Methods("POST")
+	router.HandleFunc("/api/signal", getSignalsHandler).Methods("GET")
+	router.HandleFunc("/api/signal", saveSignalHandler).Methods("POST")
+	router.HandleFunc("/api/signal/{name}", deleteSignalHandler).Methods("DELETE")
+	router.HandleFunc("/api/signal/{name}/log", getSignalLogHandler).Methods("GET")
+
+	// Trade templates.
+	router.HandleFunc("/api/template", getTemplatesHandler).Methods("GET")
+	router.HandleFunc("/api/template", saveTemplateHandler).Methods("POST")
+	router.HandleFunc("/api/template/{name}", getTemplateHandler).Methods("GET")
+	router.HandleFunc("/api/template/{name}", deleteTemplateHandler).Methods("DELETE")
 
 	// Handlers that proxy requests to Binance.
 	binanceProxyHandlers := NewBinanceProxyHandlers()
@@ -283,13 +340,19 @@ func ServerMain() {
 		SaveBinanceConfigHandler).Methods("POST")
 	router.HandleFunc("/api/config/preferences",
 		SavePreferencesHandler).Methods("POST")
+	router.HandleFunc("/api/config/exitExecution",
+		SaveExitExecutionHandler).Methods("POST")
+	router.HandleFunc("/api/config/tradingRestrictions",
+		SaveTradingRestrictionsHandler).Methods("POST")
+	router.HandleFunc("/api/config/priceGuard",
+		SavePriceGuardHandler).Methods("POST")
 
 	binanceApiProxyHandler := http.StripPrefix("/proxy/binance",
 		binanceapi.NewBinanceApiProxyHandler())
 	router.PathPrefix("/proxy/binance").Handler(binanceApiProxyHandler)
 
 	router.PathPrefix("/ws").Handler(NewUserWebSocketHandler(applicationContext,
-		clientNotificationService, healthService))
+		clientNotificationService, healthService, binancePriceService, messageJournal))
 
 	router.PathPrefix("/").HandlerFunc(staticAssetHandler())
 
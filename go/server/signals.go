@@ -0,0 +1,703 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+// Signals: webhooks that alerts from charting tools post to, to open and
+// close trades. A payload is authenticated with an HMAC-SHA256 signature of
+// the body in the X-Signature header, or for tools that can't sign, with
+// the signal secret in the payload. Example payload:
+//
+//   {"action": "BUY", "symbol": "ETHBTC", "nonce": "8c1f...",
+//    "timestamp": "2019-08-27T09:56:00Z", "secret": "..."}
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How far the timestamp of a payload may be from now.
+	signalMaxAge = 5 * time.Minute
+
+	// The rate limit of signals that don't set one.
+	DefaultSignalRateLimit = 10
+
+	signalMaxPayloadSize = 64 * 1024
+
+	signalSignatureHeader = "X-Signature"
+
+	signalDefaultLogLimit = 100
+)
+
+var signalNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// signalTime is a payload timestamp, either in unix seconds or
+// milliseconds, or as an RFC 3339 string.
+type signalTime struct {
+	time.Time
+}
+
+func (t *signalTime) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		if value > 1e12 {
+			t.Time = time.Unix(0, int64(value)*int64(time.Millisecond))
+		} else {
+			t.Time = time.Unix(int64(value), 0)
+		}
+	case string:
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+		t.Time = parsed
+	default:
+		return fmt.Errorf("invalid timestamp: %s", string(data))
+	}
+	return nil
+}
+
+// SignalPayload is what an alert posts to a signal.
+type SignalPayload struct {
+	Action types.SignalAction `json:"action"`
+	Symbol string             `json:"symbol"`
+
+	// BUY: the template to buy with instead of the signal's, and notes to
+	// record on the trade.
+	Template string `json:"template"`
+	Notes    string `json:"notes"`
+
+	// STOP_LOSS: the stop loss percent to set.
+	StopLossPercent float64 `json:"stopLossPercent"`
+
+	// Replay protection, a nonce can only be used once.
+	Nonce     string     `json:"nonce"`
+	Timestamp signalTime `json:"timestamp"`
+
+	// The signal secret, if the payload is not signed.
+	Secret string `json:"secret"`
+
+	DryRun bool `json:"dryRun"`
+}
+
+// SignalTradeResult is what a SELL or STOP_LOSS signal did to a trade.
+type SignalTradeResult struct {
+	TradeID string `json:"tradeId"`
+	Action  string `json:"action"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	SignalResultCancelBuy      = "CANCEL_BUY"
+	SignalResultMarketSell     = "MARKET_SELL"
+	SignalResultUpdateStopLoss = "UPDATE_STOP_LOSS"
+)
+
+type SignalResult struct {
+	Signal string             `json:"signal"`
+	Action types.SignalAction `json:"action"`
+	Symbol string             `json:"symbol"`
+	DryRun bool               `json:"dryRun"`
+
+	// The buy made, or previewed, by a BUY signal.
+	Buy *BuyOrderResponse `json:"buy,omitempty"`
+
+	Trades []SignalTradeResult `json:"trades,omitempty"`
+}
+
+type SignalService struct {
+	tradeService        *tradeservice.TradeService
+	binancePriceService *binanceex.BinancePriceService
+	notificationService *clientnotificationservice.Service
+
+	lock sync.Mutex
+
+	// The times payloads were accepted by each signal, for rate limits.
+	accepted map[string][]time.Time
+
+	// Nonces seen by each signal within the max age.
+	nonces map[string]map[string]time.Time
+
+	// Looks up a nonce in the signal log, for nonces seen before a
+	// restart.
+	nonceUsed func(signal string, nonce string) (bool, error)
+}
+
+func NewSignalService(tradeService *tradeservice.TradeService,
+	binancePriceService *binanceex.BinancePriceService,
+	notificationService *clientnotificationservice.Service) *SignalService {
+	return &SignalService{
+		tradeService:        tradeService,
+		binancePriceService: binancePriceService,
+		notificationService: notificationService,
+		accepted:            make(map[string][]time.Time),
+		nonces:              make(map[string]map[string]time.Time),
+		nonceUsed:           db.DbSignalNonceUsed,
+	}
+}
+
+// verifySignature checks the hex encoded HMAC-SHA256 signature of the body,
+// which may be prefixed with "sha256=".
+func verifySignature(secret string, body []byte, signature string) bool {
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// authenticate checks the payload was sent by someone holding the secret.
+func (s *SignalService) authenticate(signal *types.Signal, body []byte,
+	signature string, payload *SignalPayload) error {
+	if signature != "" {
+		if verifySignature(signal.Secret, body, signature) {
+			return nil
+		}
+		return NewApiError(http.StatusUnauthorized, "invalid signature")
+	}
+	if signal.RequireSignature {
+		return NewApiError(http.StatusUnauthorized, "signature required")
+	}
+	if payload.Secret == "" ||
+		subtle.ConstantTimeCompare([]byte(payload.Secret), []byte(signal.Secret)) != 1 {
+		return NewApiError(http.StatusUnauthorized, "invalid secret")
+	}
+	return nil
+}
+
+// rateLimit records a payload accepted by the signal, failing if the signal
+// has already accepted its limit in the last minute.
+func (s *SignalService) rateLimit(signal *types.Signal, now time.Time) error {
+	limit := signal.RateLimitPerMinute
+	if limit <= 0 {
+		limit = DefaultSignalRateLimit
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	accepted := s.accepted[signal.Name]
+	for len(accepted) > 0 && now.Sub(accepted[0]) >= time.Minute {
+		accepted = accepted[1:]
+	}
+	if len(accepted) >= limit {
+		s.accepted[signal.Name] = accepted
+		return NewApiError(http.StatusTooManyRequests,
+			"rate limit of %d signals a minute reached", limit)
+	}
+	s.accepted[signal.Name] = append(accepted, now)
+	return nil
+}
+
+// checkReplay rejects payloads that are too old, or whose nonce has been
+// seen before. The nonce is marked as used.
+func (s *SignalService) checkReplay(signal *types.Signal, payload *SignalPayload,
+	now time.Time) error {
+	if payload.Nonce == "" {
+		return NewApiError(http.StatusBadRequest, "missing required parameter: nonce")
+	}
+	if payload.Timestamp.IsZero() {
+		return NewApiError(http.StatusBadRequest, "missing required parameter: timestamp")
+	}
+	age := now.Sub(payload.Timestamp.Time)
+	if age > signalMaxAge || age < -signalMaxAge {
+		return NewApiError(http.StatusBadRequest,
+			"timestamp %s is more than %v from the server time",
+			payload.Timestamp.Format(time.RFC3339), signalMaxAge)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	nonces := s.nonces[signal.Name]
+	if nonces == nil {
+		nonces = make(map[string]time.Time)
+		s.nonces[signal.Name] = nonces
+	}
+	for nonce, seen := range nonces {
+		if now.Sub(seen) > 2*signalMaxAge {
+			delete(nonces, nonce)
+		}
+	}
+	if _, ok := nonces[payload.Nonce]; ok {
+		return NewApiError(http.StatusConflict, "nonce already used")
+	}
+	// Nonces from before a restart.
+	used, err := s.nonceUsed(signal.Name, payload.Nonce)
+	if err != nil {
+		return NewApiError(http.StatusInternalServerError, "%v", err)
+	}
+	if used {
+		return NewApiError(http.StatusConflict, "nonce already used")
+	}
+	nonces[payload.Nonce] = now
+	return nil
+}
+
+// Receive handles a payload posted to a signal. Every payload is recorded
+// in the signal log with what was done.
+func (s *SignalService) Receive(name string, body []byte, signature string,
+	remoteAddr string) (*SignalResult, error) {
+	now := time.Now()
+	entry := &types.SignalLogEntry{
+		Signal:     name,
+		Time:       now,
+		RemoteAddr: remoteAddr,
+		Status:     types.SignalStatusRejected,
+	}
+	// The secret is not kept in the log.
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err == nil {
+		if _, ok := fields["secret"]; ok {
+			fields["secret"] = "********"
+		}
+		entry.Payload, _ = json.Marshal(fields)
+	} else {
+		entry.Payload, _ = json.Marshal(string(body))
+	}
+
+	signal, err := db.DbGetSignal(name)
+	if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError, "%v", err)
+	}
+	if signal == nil || !signal.Enabled {
+		// Not logged to the database, anyone can post to any name.
+		log.WithFields(log.Fields{
+			"signal":     name,
+			"remoteAddr": remoteAddr,
+		}).Warnf("Payload received for unknown or disabled signal")
+		return nil, NewApiError(http.StatusNotFound, "signal %s not found", name)
+	}
+
+	result, err := s.receive(signal, body, signature, entry, now)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Status = types.SignalStatusAccepted
+		entry.Result = result
+	}
+	if err := db.DbSaveSignalLogEntry(entry); err != nil {
+		log.WithError(err).WithField("signal", name).
+			Errorf("Failed to save signal log entry")
+	}
+
+	logFields := log.Fields{
+		"signal":     name,
+		"remoteAddr": remoteAddr,
+		"action":     entry.Action,
+		"symbol":     entry.Symbol,
+		"dryRun":     entry.DryRun,
+		"status":     entry.Status,
+	}
+	if err != nil {
+		log.WithFields(logFields).WithError(err).Warnf("Signal rejected")
+		return nil, err
+	}
+	log.WithFields(logFields).Infof("Signal accepted")
+	s.notify(entry)
+	return result, nil
+}
+
+func (s *SignalService) receive(signal *types.Signal, body []byte, signature string,
+	entry *types.SignalLogEntry, now time.Time) (*SignalResult, error) {
+	var payload SignalPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, "invalid payload: %v", err)
+	}
+	if err := s.authenticate(signal, body, signature, &payload); err != nil {
+		return nil, err
+	}
+	// Replays don't count towards the rate limit, so they can't be used
+	// to lock out the real alerts.
+	if err := s.checkReplay(signal, &payload, now); err != nil {
+		return nil, err
+	}
+	if err := s.rateLimit(signal, now); err != nil {
+		return nil, err
+	}
+	entry.Nonce = payload.Nonce
+
+	payload.Action = types.SignalAction(strings.ToUpper(string(payload.Action)))
+	payload.Symbol = strings.ToUpper(strings.TrimSpace(payload.Symbol))
+	entry.Action = payload.Action
+	entry.Symbol = payload.Symbol
+	entry.DryRun = signal.DryRun || payload.DryRun
+
+	switch payload.Action {
+	case types.SignalActionBuy, types.SignalActionSell, types.SignalActionStopLoss:
+	case "":
+		return nil, NewApiError(http.StatusBadRequest, "missing required parameter: action")
+	default:
+		return nil, NewApiError(http.StatusBadRequest, "invalid action: %s", payload.Action)
+	}
+	if !signal.AllowsAction(payload.Action) {
+		return nil, NewApiError(http.StatusForbidden,
+			"action %s is not allowed for signal %s", payload.Action, signal.Name)
+	}
+	if payload.Symbol == "" {
+		return nil, NewApiError(http.StatusBadRequest, "missing required parameter: symbol")
+	}
+	if _, err := s.tradeService.ExchangeInfo().GetSymbol(payload.Symbol); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, "invalid symbol %s: %v",
+			payload.Symbol, err)
+	}
+
+	result := &SignalResult{
+		Signal: signal.Name,
+		Action: payload.Action,
+		Symbol: payload.Symbol,
+		DryRun: entry.DryRun,
+	}
+	var err error
+	switch payload.Action {
+	case types.SignalActionBuy:
+		result.Buy, err = s.buy(signal, &payload, result.DryRun)
+	case types.SignalActionSell:
+		result.Trades = s.actOnTrades(payload.Symbol, result.DryRun, s.sellTrade)
+	case types.SignalActionStopLoss:
+		if payload.StopLossPercent <= 0 {
+			return nil, NewApiError(http.StatusBadRequest,
+				"stopLossPercent must be positive")
+		}
+		result.Trades = s.actOnTrades(payload.Symbol, result.DryRun,
+			func(trade *types.Trade, state types.TradeState, dryRun bool) *SignalTradeResult {
+				return s.updateStopLoss(trade, state, payload.StopLossPercent, dryRun)
+			})
+	}
+	if err != nil {
+		entry.Status = types.SignalStatusFailed
+		return nil, err
+	}
+	return result, nil
+}
+
+// buy opens a trade with the template, tagged with the signal name.
+func (s *SignalService) buy(signal *types.Signal, payload *SignalPayload,
+	dryRun bool) (*BuyOrderResponse, error) {
+	template := payload.Template
+	if template == "" {
+		template = signal.Template
+	}
+	body, err := json.Marshal(map[string]string{"template": template})
+	if err != nil {
+		return nil, err
+	}
+	request, err := decodeBuyOrderRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	request.Symbol = payload.Symbol
+	request.DryRun = dryRun
+	request.Tags = append(request.Tags, "signal:"+signal.Name)
+	if payload.Notes != "" {
+		request.Notes = payload.Notes
+	}
+	if request.PriceSource == "" {
+		request.PriceSource = types.PriceSourceBestAsk
+	}
+	return placeBuyOrder(s.tradeService, s.binancePriceService, request)
+}
+
+// actOnTrades calls the action on every trade on the symbol, returning what
+// was done to the trades it applied to.
+func (s *SignalService) actOnTrades(symbol string, dryRun bool,
+	action func(trade *types.Trade, state types.TradeState, dryRun bool) *SignalTradeResult) []SignalTradeResult {
+	results := []SignalTradeResult{}
+	for _, snapshot := range s.tradeService.GetAllTrades() {
+		if snapshot.State.Symbol != symbol || snapshot.IsDone() {
+			continue
+		}
+		trade := s.tradeService.FindTradeByLocalID(snapshot.State.TradeID)
+		if trade == nil {
+			continue
+		}
+		if result := action(trade, snapshot.State, dryRun); result != nil {
+			results = append(results, *result)
+		}
+	}
+	return results
+}
+
+func (s *SignalService) sellTrade(trade *types.Trade, state types.TradeState,
+	dryRun bool) *SignalTradeResult {
+	result := &SignalTradeResult{
+		TradeID: state.TradeID,
+	}
+	var err error
+	switch state.Status {
+	case types.TradeStatusNew, types.TradeStatusPendingBuy:
+		result.Action = SignalResultCancelBuy
+		if !dryRun {
+			err = cancelBuy(s.tradeService, trade)
+		}
+	case types.TradeStatusWatching, types.TradeStatusPendingSell,
+		types.TradeStatusExitFailed:
+		result.Action = SignalResultMarketSell
+		if !dryRun {
+			err = marketSell(s.tradeService, trade)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (s *SignalService) updateStopLoss(trade *types.Trade, state types.TradeState,
+	percent float64, dryRun bool) *SignalTradeResult {
+	switch state.Status {
+	case types.TradeStatusNew, types.TradeStatusPendingBuy,
+		types.TradeStatusWatching, types.TradeStatusPendingSell:
+	default:
+		return nil
+	}
+	result := &SignalTradeResult{
+		TradeID: state.TradeID,
+		Action:  SignalResultUpdateStopLoss,
+	}
+	if !dryRun {
+		if err := updateStopLoss(s.tradeService, trade, true, percent, nil); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+func (s *SignalService) notify(entry *types.SignalLogEntry) {
+	if s.notificationService == nil {
+		return
+	}
+	message := fmt.Sprintf("Signal %s: %s %s", entry.Signal, entry.Action, entry.Symbol)
+	if entry.DryRun {
+		message += " (dry run)"
+	}
+	notice := clientnotificationservice.NewNotice(clientnotificationservice.LevelInfo,
+		message).WithData(map[string]interface{}{
+		"signal": entry.Signal,
+		"action": entry.Action,
+		"symbol": entry.Symbol,
+		"dryRun": entry.DryRun,
+		"result": entry.Result,
+	})
+	go s.notificationService.Broadcast(notice)
+}
+
+// SignalRequest creates a signal, or replaces the signal with the same name.
+type SignalRequest struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+
+	// Generated for a new signal if not set, kept for an existing signal.
+	Secret string `json:"secret"`
+
+	RequireSignature   bool                 `json:"requireSignature"`
+	Actions            []types.SignalAction `json:"actions"`
+	Template           string               `json:"template"`
+	RateLimitPerMinute int                  `json:"rateLimitPerMinute"`
+	DryRun             bool                 `json:"dryRun"`
+}
+
+func (r *SignalRequest) validate() error {
+	if !signalNamePattern.MatchString(r.Name) {
+		return NewApiError(http.StatusBadRequest,
+			"name must only contain letters, numbers, - and _")
+	}
+	for i, action := range r.Actions {
+		action = types.SignalAction(strings.ToUpper(string(action)))
+		switch action {
+		case types.SignalActionBuy, types.SignalActionSell, types.SignalActionStopLoss:
+		default:
+			return NewApiError(http.StatusBadRequest, "invalid action: %s", action)
+		}
+		r.Actions[i] = action
+	}
+	if r.RateLimitPerMinute < 0 {
+		return NewApiError(http.StatusBadRequest, "rateLimitPerMinute must not be negative")
+	}
+	allowsBuy := (&types.Signal{Actions: r.Actions}).AllowsAction(types.SignalActionBuy)
+	if allowsBuy && r.Template == "" {
+		return NewApiError(http.StatusBadRequest,
+			"template required for a signal allowed to BUY")
+	}
+	if r.Template != "" {
+		if _, err := getTemplate(r.Template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateSignalSecret() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func saveSignal(request SignalRequest) (*types.Signal, error) {
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+	existing, err := db.DbGetSignal(request.Name)
+	if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError, "%v", err)
+	}
+	now := time.Now()
+	signal := &types.Signal{
+		Name:               request.Name,
+		Enabled:            request.Enabled,
+		Secret:             request.Secret,
+		RequireSignature:   request.RequireSignature,
+		Actions:            request.Actions,
+		Template:           request.Template,
+		RateLimitPerMinute: request.RateLimitPerMinute,
+		DryRun:             request.DryRun,
+		CreateTime:         now,
+		UpdateTime:         now,
+	}
+	if existing != nil {
+		signal.CreateTime = existing.CreateTime
+		if signal.Secret == "" {
+			signal.Secret = existing.Secret
+		}
+	}
+	if signal.Secret == "" {
+		signal.Secret, err = generateSignalSecret()
+		if err != nil {
+			return nil, NewApiError(http.StatusInternalServerError, "%v", err)
+		}
+	}
+	if err := db.DbSaveSignal(signal); err != nil {
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to save signal %s: %v", signal.Name, err)
+	}
+	log.WithFields(log.Fields{
+		"signal":   signal.Name,
+		"enabled":  signal.Enabled,
+		"actions":  signal.Actions,
+		"template": signal.Template,
+		"dryRun":   signal.DryRun,
+	}).Infof("Signal saved")
+	return signal, nil
+}
+
+// Receive a payload from an alert. Authenticated by the signal secret
+// rather than a session.
+//
+// Router vars:
+// - name: The signal name.
+func receiveSignalHandler(signalService *SignalService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, signalMaxPayloadSize))
+		if err != nil {
+			WriteJsonError(w, http.StatusBadRequest, "failed to read payload")
+			return
+		}
+		result, err := signalService.Receive(mux.Vars(r)["name"], body,
+			r.Header.Get(signalSignatureHeader), r.RemoteAddr)
+		if err != nil {
+			WriteApiError(w, err)
+			return
+		}
+		WriteJsonResponse(w, http.StatusOK, result)
+	}
+}
+
+func getSignalsHandler(w http.ResponseWriter, r *http.Request) {
+	signals, err := db.DbGetSignals()
+	if err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, signals)
+}
+
+func saveSignalHandler(w http.ResponseWriter, r *http.Request) {
+	var request SignalRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.Printf("error: failed to decode request body: %v", err)
+		WriteBadRequestError(w)
+		return
+	}
+
+	signal, err := saveSignal(request)
+	if err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, signal)
+}
+
+func deleteSignalHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := db.DbDeleteSignal(name); err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"signal": name,
+	}).Infof("Signal deleted")
+	getSignalsHandler(w, r)
+}
+
+// Get the most recent payloads received by a signal, newest first.
+//
+// Query string parameters:
+// - limit: the number of entries, 100 if not set.
+func getSignalLogHandler(w http.ResponseWriter, r *http.Request) {
+	limit := signalDefaultLogLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			WriteJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	entries, err := db.DbGetSignalLog(mux.Vars(r)["name"], limit)
+	if err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, entries)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func statusCode(err error) int {
+	if apiError, ok := err.(*ApiError); ok {
+		return apiError.StatusCode
+	}
+	return 0
+}
+
+// newTestSignalService returns a signal service whose signal log holds the
+// given nonces of the signal "test".
+func newTestSignalService(logged ...string) *SignalService {
+	service := NewSignalService(nil, nil, nil)
+	service.nonceUsed = func(signal string, nonce string) (bool, error) {
+		if signal != "test" {
+			return false, nil
+		}
+		for _, used := range logged {
+			if nonce == used {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return service
+}
+
+func TestVerifySignature(t *testing.T) {
+	assert := assert.New(t)
+
+	body := []byte(`{"action": "BUY", "symbol": "ETHBTC"}`)
+	signature := sign("secret", body)
+
+	assert.True(verifySignature("secret", body, signature))
+	assert.True(verifySignature("secret", body, "sha256="+signature))
+	assert.True(verifySignature("secret", body, " "+signature+"\n"))
+	assert.False(verifySignature("other", body, signature))
+	assert.False(verifySignature("secret", []byte(`{"action": "SELL"}`), signature))
+	assert.False(verifySignature("secret", body, "not hex"))
+	assert.False(verifySignature("secret", body, ""))
+}
+
+func TestSignalAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestSignalService()
+	signal := &types.Signal{Name: "test", Secret: "secret"}
+	body := []byte(`{"action": "BUY"}`)
+
+	// Signed.
+	assert.Nil(service.authenticate(signal, body, sign("secret", body), &SignalPayload{}))
+	err := service.authenticate(signal, body, sign("other", body), &SignalPayload{})
+	assert.Equal(http.StatusUnauthorized, statusCode(err))
+
+	// A bad signature isn't made good by the secret in the payload.
+	err = service.authenticate(signal, body, sign("other", body),
+		&SignalPayload{Secret: "secret"})
+	assert.Equal(http.StatusUnauthorized, statusCode(err))
+
+	// The secret in the payload.
+	assert.Nil(service.authenticate(signal, body, "", &SignalPayload{Secret: "secret"}))
+	err = service.authenticate(signal, body, "", &SignalPayload{Secret: "other"})
+	assert.Equal(http.StatusUnauthorized, statusCode(err))
+	err = service.authenticate(signal, body, "", &SignalPayload{})
+	assert.Equal(http.StatusUnauthorized, statusCode(err))
+
+	// Only a signature will do.
+	signal.RequireSignature = true
+	err = service.authenticate(signal, body, "", &SignalPayload{Secret: "secret"})
+	assert.Equal(http.StatusUnauthorized, statusCode(err))
+	assert.Nil(service.authenticate(signal, body, sign("secret", body), &SignalPayload{}))
+}
+
+func TestSignalCheckReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestSignalService("logged")
+	signal := &types.Signal{Name: "test"}
+	now := time.Now()
+	payload := func(nonce string, timestamp time.Time) *SignalPayload {
+		return &SignalPayload{
+			Nonce:     nonce,
+			Timestamp: signalTime{timestamp},
+		}
+	}
+
+	err := service.checkReplay(signal, payload("", now), now)
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+	err = service.checkReplay(signal, payload("a", time.Time{}), now)
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+
+	// A nonce can only be used once.
+	assert.Nil(service.checkReplay(signal, payload("a", now), now))
+	err = service.checkReplay(signal, payload("a", now), now.Add(time.Second))
+	assert.Equal(http.StatusConflict, statusCode(err))
+
+	// But by each signal.
+	assert.Nil(service.checkReplay(&types.Signal{Name: "other"}, payload("a", now), now))
+
+	// The timestamp may be up to the max age either side of now.
+	assert.Nil(service.checkReplay(signal, payload("b", now.Add(-signalMaxAge)), now))
+	assert.Nil(service.checkReplay(signal, payload("c", now.Add(signalMaxAge)), now))
+	err = service.checkReplay(signal,
+		payload("d", now.Add(-signalMaxAge-time.Second)), now)
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+	err = service.checkReplay(signal,
+		payload("e", now.Add(signalMaxAge+time.Second)), now)
+	assert.Equal(http.StatusBadRequest, statusCode(err))
+
+	// A rejected payload doesn't use up its nonce.
+	assert.Nil(service.checkReplay(signal, payload("d", now), now))
+
+	// Nonces from before a restart are found in the signal log.
+	err = service.checkReplay(signal, payload("logged", now), now)
+	assert.Equal(http.StatusConflict, statusCode(err))
+	service = newTestSignalService("logged")
+	err = service.checkReplay(signal, payload("logged", now), now)
+	assert.Equal(http.StatusConflict, statusCode(err))
+
+	service.nonceUsed = func(signal string, nonce string) (bool, error) {
+		return false, fmt.Errorf("database locked")
+	}
+	err = service.checkReplay(signal, payload("f", now), now)
+	assert.Equal(http.StatusInternalServerError, statusCode(err))
+}
+
+func TestSignalRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestSignalService()
+	signal := &types.Signal{Name: "test", RateLimitPerMinute: 2}
+	now := time.Now()
+
+	assert.Nil(service.rateLimit(signal, now))
+	assert.Nil(service.rateLimit(signal, now.Add(time.Second)))
+	err := service.rateLimit(signal, now.Add(2*time.Second))
+	assert.Equal(http.StatusTooManyRequests, statusCode(err))
+
+	// Each signal has its own limit.
+	assert.Nil(service.rateLimit(&types.Signal{Name: "other", RateLimitPerMinute: 2}, now))
+
+	// Room is made as accepted payloads get older than a minute.
+	assert.Nil(service.rateLimit(signal, now.Add(time.Minute)))
+	err = service.rateLimit(signal, now.Add(time.Minute))
+	assert.Equal(http.StatusTooManyRequests, statusCode(err))
+
+	// The default limit.
+	signal = &types.Signal{Name: "default"}
+	for i := 0; i < DefaultSignalRateLimit; i++ {
+		assert.Nil(service.rateLimit(signal, now))
+	}
+	err = service.rateLimit(signal, now)
+	assert.Equal(http.StatusTooManyRequests, statusCode(err))
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+// Trade templates: named buy settings shared by every client, that a buy
+// request can name and override fields of.
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Buy request fields that are particular to a single buy and can't be set
+// by a template.
+var templateExcludedFields = []string{
+	"symbol", "price", "stopPrice", "template", "dryRun", "confirmDeviation",
+}
+
+// TemplateRequest creates a template, or replaces the template with the same
+// name.
+type TemplateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// The buy request fields to set, such as priceSource, offsetTicks,
+	// quoteAmount, limitSellEnabled or entryChase.
+	Settings json.RawMessage `json:"settings"`
+}
+
+func (r *TemplateRequest) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return NewApiError(http.StatusBadRequest, "missing required parameter: name")
+	}
+	if len(r.Settings) == 0 {
+		return NewApiError(http.StatusBadRequest, "missing required parameter: settings")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(r.Settings, &fields); err != nil {
+		return NewApiError(http.StatusBadRequest, "settings must be an object: %v", err)
+	}
+	for _, field := range templateExcludedFields {
+		if _, ok := fields[field]; ok {
+			return NewApiError(http.StatusBadRequest,
+				"%s can't be set by a template", field)
+		}
+	}
+	var buyRequest BuyOrderRequest
+	decoder := json.NewDecoder(bytes.NewReader(r.Settings))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&buyRequest); err != nil {
+		return NewApiError(http.StatusBadRequest, "invalid settings: %v", err)
+	}
+	return buyRequest.TradeSettings.validate()
+}
+
+func getTemplates() ([]types.TradeTemplate, error) {
+	templates, err := db.DbGetTradeTemplates()
+	if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to load templates: %v", err)
+	}
+	return templates, nil
+}
+
+func getTemplate(name string) (*types.TradeTemplate, error) {
+	template, err := db.DbGetTradeTemplate(name)
+	if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to load template %s: %v", name, err)
+	}
+	if template == nil {
+		return nil, NewApiError(http.StatusNotFound, "template %s not found", name)
+	}
+	return template, nil
+}
+
+func saveTemplate(request TemplateRequest) (*types.TradeTemplate, error) {
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+	existing, err := db.DbGetTradeTemplate(request.Name)
+	if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to load template %s: %v", request.Name, err)
+	}
+	now := time.Now()
+	template := &types.TradeTemplate{
+		Name:        request.Name,
+		Description: request.Description,
+		Settings:    request.Settings,
+		CreateTime:  now,
+		UpdateTime:  now,
+	}
+	if existing != nil {
+		template.CreateTime = existing.CreateTime
+	}
+	if err := db.DbSaveTradeTemplate(template); err != nil {
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to save template %s: %v", request.Name, err)
+	}
+	log.WithFields(log.Fields{
+		"template": template.Name,
+		"settings": string(template.Settings),
+	}).Infof("Trade template saved")
+	return template, nil
+}
+
+func deleteTemplate(name string) error {
+	if _, err := getTemplate(name); err != nil {
+		return err
+	}
+	signals, err := db.DbGetSignals()
+	if err != nil {
+		return NewApiError(http.StatusInternalServerError, "%v", err)
+	}
+	for _, signal := range signals {
+		if signal.Template == name {
+			return NewApiError(http.StatusConflict,
+				"template %s is used by signal %s", name, signal.Name)
+		}
+	}
+	if err := db.DbDeleteTradeTemplate(name); err != nil {
+		return NewApiError(http.StatusInternalServerError,
+			"failed to delete template %s: %v", name, err)
+	}
+	log.WithFields(log.Fields{
+		"template": name,
+	}).Infof("Trade template deleted")
+	return nil
+}
+
+// decodeBuyOrderRequest decodes a buy request. If the request names a
+// template the template settings are decoded first, so any field set in the
+// request overrides the template.
+func decodeBuyOrderRequest(body []byte) (BuyOrderRequest, error) {
+	var request BuyOrderRequest
+	var named struct {
+		Template string `json:"template"`
+	}
+	if err := json.Unmarshal(body, &named); err != nil {
+		return request, NewApiError(http.StatusBadRequest, "invalid buy request: %v", err)
+	}
+	if named.Template != "" {
+		template, err := getTemplate(named.Template)
+		if err != nil {
+			return request, err
+		}
+		if err := json.Unmarshal(template.Settings, &request); err != nil {
+			return request, NewApiError(http.StatusInternalServerError,
+				"invalid template %s: %v", template.Name, err)
+		}
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return request, NewApiError(http.StatusBadRequest, "invalid buy request: %v", err)
+	}
+	return request, nil
+}
+
+// readBuyOrderRequest reads and decodes the buy request in a REST request
+// body.
+func readBuyOrderRequest(r *http.Request) (BuyOrderRequest, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return BuyOrderRequest{}, NewApiError(http.StatusBadRequest,
+			"failed to read request body: %v", err)
+	}
+	return decodeBuyOrderRequest(body)
+}
+
+func getTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := getTemplates()
+	if err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, templates)
+}
+
+func getTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	template, err := getTemplate(mux.Vars(r)["name"])
+	if err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, template)
+}
+
+func saveTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var request TemplateRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		log.Printf("error: failed to decode request body: %v", err)
+		WriteBadRequestError(w)
+		return
+	}
+
+	template, err := saveTemplate(request)
+	if err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	WriteJsonResponse(w, http.StatusOK, template)
+}
+
+func deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if err := deleteTemplate(mux.Vars(r)["name"]); err != nil {
+		WriteApiError(w, err)
+		return
+	}
+	getTemplatesHandler(w, r)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func openTestDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DbOpen(dir)
+}
+
+func TestTemplateRequestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	request := TemplateRequest{
+		Name:     " scalp ",
+		Settings: json.RawMessage(`{"priceSource": "BEST_BID", "quoteAmount": "0.01"}`),
+	}
+	assert.Nil(request.validate())
+	assert.Equal("scalp", request.Name)
+
+	for _, invalid := range []TemplateRequest{
+		{Name: " ", Settings: json.RawMessage(`{}`)},
+		{Name: "scalp"},
+		{Name: "scalp", Settings: json.RawMessage(`[]`)},
+		// Set for each buy, not by a template.
+		{Name: "scalp", Settings: json.RawMessage(`{"symbol": "ETHBTC"}`)},
+		{Name: "scalp", Settings: json.RawMessage(`{"price": "0.01"}`)},
+		{Name: "scalp", Settings: json.RawMessage(`{"unknown": 1}`)},
+		{Name: "scalp", Settings: json.RawMessage(`{"limitSellEnabled": true}`)},
+	} {
+		err := invalid.validate()
+		assert.Equal(http.StatusBadRequest, statusCode(err), string(invalid.Settings))
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	openTestDb(t)
+
+	saved, err := saveTemplate(TemplateRequest{
+		Name:        "templates-test",
+		Description: "Take 2%",
+		Settings: json.RawMessage(
+			`{"priceSource": "BEST_BID", "limitSellEnabled": true, "limitSellType": "PERCENT", "limitSellPercent": 2}`),
+	})
+	assert.Nil(err)
+	assert.Equal(saved.CreateTime, saved.UpdateTime)
+
+	template, err := getTemplate("templates-test")
+	assert.Nil(err)
+	assert.Equal("Take 2%", template.Description)
+
+	// Replacing the template keeps when it was created.
+	replaced, err := saveTemplate(TemplateRequest{
+		Name: "templates-test",
+		Settings: json.RawMessage(
+			`{"priceSource": "BEST_BID", "limitSellEnabled": true, "limitSellType": "PERCENT", "limitSellPercent": 3}`),
+	})
+	assert.Nil(err)
+	assert.True(replaced.CreateTime.Equal(saved.CreateTime))
+	templates, err := getTemplates()
+	assert.Nil(err)
+	count := 0
+	for _, template := range templates {
+		if template.Name == "templates-test" {
+			count++
+		}
+	}
+	assert.Equal(1, count)
+
+	// The fields of the buy request override the template.
+	request, err := decodeBuyOrderRequest([]byte(
+		`{"symbol": "ETHBTC", "template": "templates-test", "priceSource": "BEST_ASK"}`))
+	assert.Nil(err)
+	assert.Equal("ETHBTC", request.Symbol)
+	assert.Equal(types.PriceSourceBestAsk, request.PriceSource)
+	assert.True(request.LimitSellEnabled)
+	assert.Equal(3.0, request.LimitSellPercent)
+
+	_, err = decodeBuyOrderRequest([]byte(`{"symbol": "ETHBTC", "template": "unknown"}`))
+	assert.Equal(http.StatusNotFound, statusCode(err))
+
+	// A template a signal buys with can't be deleted.
+	signal := &types.Signal{Name: "templates-test", Template: "templates-test"}
+	assert.Nil(db.DbSaveSignal(signal))
+	assert.Equal(http.StatusConflict, statusCode(deleteTemplate("templates-test")))
+	signal.Template = ""
+	assert.Nil(db.DbSaveSignal(signal))
+
+	assert.Nil(deleteTemplate("templates-test"))
+	_, err = getTemplate("templates-test")
+	assert.Equal(http.StatusNotFound, statusCode(err))
+	assert.Equal(http.StatusNotFound, statusCode(deleteTemplate("templates-test")))
+}
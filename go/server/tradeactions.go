@@ -0,0 +1,1270 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+// Trade actions shared by the REST handlers and the websocket command
+// protocol. Errors returned are ApiErrors where the status to report to the
+// client is known.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TradeSettings are the exit settings given when a trade is created.
+type TradeSettings struct {
+	LimitSellEnabled        bool                `json:"limitSellEnabled"`
+	LimitSellType           types.LimitSellType `json:"limitSellType"`
+	LimitSellPercent        float64             `json:"limitSellPercent"`
+	LimitSellPrice          decimal.Decimal     `json:"limitSellPrice"`
+	StopLossEnabled         bool                `json:"stopLossEnabled"`
+	StopLossPercent         float64             `json:"stopLossPercent"`
+	TrailingProfitEnabled   bool                `json:"trailingProfitEnabled"`
+	TrailingProfitPercent   float64             `json:"trailingProfitPercent"`
+	TrailingProfitDeviation float64             `json:"trailingProfitDeviation"`
+	StopLossSettings
+	ExitPolicySettings
+	ExitExecutionSettings
+}
+
+func (s TradeSettings) validate() error {
+	if s.LimitSellEnabled {
+		switch s.LimitSellType {
+		case types.LimitSellTypePercent:
+		case types.LimitSellTypePrice:
+		default:
+			return NewApiError(http.StatusBadRequest,
+				"limit sell type invalid or not set")
+		}
+	}
+	if s.StopLossEnabled {
+		if err := s.StopLossSettings.validate(s.StopLossPercent); err != nil {
+			return err
+		}
+	}
+	if err := s.ExitExecutionSettings.validate(); err != nil {
+		return err
+	}
+	return s.ExitPolicySettings.validate(types.LimitSellState{
+		Enabled: s.LimitSellEnabled,
+		Type:    s.LimitSellType,
+	})
+}
+
+// stopLossPercent returns how far below the price the stop loss is, in
+// percent.
+func (s TradeSettings) stopLossPercent(price decimal.Decimal) float64 {
+	if s.StopLossMode == types.StopLossModePrice && price.IsPositive() {
+		distance, err := price.Sub(s.StopLossPrice).MulChecked(decimal.NewFromInt(100))
+		if err == nil {
+			distance, err = distance.DivChecked(price)
+		}
+		if err != nil {
+			// Too far from the price for a decimal.
+			return (price.Float64() - s.StopLossPrice.Float64()) * 100 / price.Float64()
+		}
+		return distance.Float64()
+	}
+	return s.StopLossPercent
+}
+
+// StopLossSettings are the stop loss mode and the adjustments that raise the
+// stop as the price rises.
+type StopLossSettings struct {
+	// PERCENT, TRAILING or PRICE. The stop price is for PRICE mode.
+	StopLossMode  types.StopLossMode `json:"stopLossMode"`
+	StopLossPrice decimal.Decimal    `json:"stopLossPrice"`
+
+	// Raise the stop to break even once the profit reaches this percent.
+	StopLossBreakEvenPercent float64 `json:"stopLossBreakEvenPercent"`
+
+	// Raise the stop by stopLossStepRaisePercent for every
+	// stopLossStepPercent of profit.
+	StopLossStepPercent      float64 `json:"stopLossStepPercent"`
+	StopLossStepRaisePercent float64 `json:"stopLossStepRaisePercent"`
+}
+
+func (s StopLossSettings) validate(percent float64) error {
+	switch s.StopLossMode {
+	case "", types.StopLossModePercent, types.StopLossModeTrailing:
+		if s.StopLossMode == types.StopLossModeTrailing && percent <= 0 {
+			return NewApiError(http.StatusBadRequest,
+				"a trailing stop loss requires a percent")
+		}
+	case types.StopLossModePrice:
+		if !s.StopLossPrice.IsPositive() {
+			return NewApiError(http.StatusBadRequest,
+				"stopLossPrice is required for a PRICE stop loss")
+		}
+	default:
+		return NewApiError(http.StatusBadRequest,
+			"invalid value for stopLossMode: %v", s.StopLossMode)
+	}
+	if s.StopLossBreakEvenPercent < 0 || s.StopLossStepPercent < 0 ||
+		s.StopLossStepRaisePercent < 0 {
+		return NewApiError(http.StatusBadRequest,
+			"stop loss adjustments must not be negative")
+	}
+	if s.StopLossStepPercent > 0 || s.StopLossStepRaisePercent > 0 {
+		if s.StopLossStepPercent == 0 || s.StopLossStepRaisePercent == 0 {
+			return NewApiError(http.StatusBadRequest,
+				"stopLossStepPercent and stopLossStepRaisePercent must both be set")
+		}
+		switch s.StopLossMode {
+		case "", types.StopLossModePercent:
+		default:
+			return NewApiError(http.StatusBadRequest,
+				"stepped stops are only valid for a PERCENT stop loss")
+		}
+	}
+	return nil
+}
+
+func (s StopLossSettings) state(enabled bool, percent float64) types.StopLossState {
+	mode := s.StopLossMode
+	if mode == "" {
+		mode = types.StopLossModePercent
+	}
+	return types.StopLossState{
+		Enabled:          enabled,
+		Percent:          percent,
+		Mode:             mode,
+		Price:            s.StopLossPrice,
+		BreakEvenPercent: s.StopLossBreakEvenPercent,
+		StepPercent:      s.StopLossStepPercent,
+		StepRaisePercent: s.StopLossStepRaisePercent,
+	}
+}
+
+// ExitPolicySettings are the time based exits of a trade. Times are from
+// when the trade was opened.
+type ExitPolicySettings struct {
+	// Market sell after holding the trade this many hours.
+	MaxHoldHours float64 `json:"maxHoldHours"`
+
+	// Market sell at the first of these times reached.
+	SellAt []time.Time `json:"sellAt"`
+
+	// Lower the limit sell percent by decayPercent every decayHours,
+	// starting decayAfterHours after the trade opened, down to break
+	// even.
+	DecayPercent    float64 `json:"decayPercent"`
+	DecayHours      float64 `json:"decayHours"`
+	DecayAfterHours float64 `json:"decayAfterHours"`
+}
+
+func (s ExitPolicySettings) validate(limitSell types.LimitSellState) error {
+	if s.MaxHoldHours < 0 || s.DecayPercent < 0 || s.DecayHours < 0 ||
+		s.DecayAfterHours < 0 {
+		return NewApiError(http.StatusBadRequest,
+			"exit policy hours and percent must not be negative")
+	}
+	if s.DecayPercent > 0 || s.DecayHours > 0 {
+		if s.DecayPercent == 0 || s.DecayHours == 0 {
+			return NewApiError(http.StatusBadRequest,
+				"decayPercent and decayHours must both be set")
+		}
+		if !limitSell.Enabled || limitSell.Type != types.LimitSellTypePercent {
+			return NewApiError(http.StatusBadRequest,
+				"decay requires a limit sell by percent")
+		}
+	}
+	return nil
+}
+
+func (s ExitPolicySettings) state() types.ExitPolicyState {
+	return types.ExitPolicyState{
+		MaxHoldHours:    s.MaxHoldHours,
+		SellAt:          s.SellAt,
+		DecayPercent:    s.DecayPercent,
+		DecayHours:      s.DecayHours,
+		DecayAfterHours: s.DecayAfterHours,
+	}
+}
+
+// apply sets the settings on a trade that has not been added to the trade
+// service yet, so they are part of its initial state.
+func (s TradeSettings) apply(trade *types.Trade, logFields log.Fields) {
+	if s.StopLossEnabled {
+		trade.State.StopLoss = s.StopLossSettings.state(s.StopLossEnabled,
+			s.StopLossPercent)
+	}
+
+	if s.TrailingProfitEnabled {
+		trade.SetTrailingProfit(s.TrailingProfitEnabled,
+			s.TrailingProfitPercent, s.TrailingProfitDeviation)
+	}
+
+	if s.LimitSellEnabled {
+		if s.LimitSellType == types.LimitSellTypePercent {
+			log.WithFields(logFields).Infof("Setting limit sell at %f percent.",
+				s.LimitSellPercent)
+			trade.SetLimitSellByPercent(s.LimitSellPercent)
+		} else if s.LimitSellType == types.LimitSellTypePrice {
+			log.WithFields(logFields).Infof("Setting limit sell at price %s.",
+				s.LimitSellPrice)
+			trade.SetLimitSellByPrice(s.LimitSellPrice)
+		}
+	}
+
+	trade.State.ExitPolicy = s.ExitPolicySettings.state()
+	trade.State.ExitPolicy.DecayFromPercent = s.LimitSellPercent
+	trade.State.ExitExecution = s.ExitExecutionSettings.state()
+}
+
+// ExitExecutionSettings are how the stop loss, trailing profit and market
+// sell exits of a trade are executed. Without an exitMode the configured
+// default is used.
+type ExitExecutionSettings struct {
+	// MARKET or LIMIT_IOC.
+	ExitMode types.ExitExecutionMode `json:"exitMode"`
+
+	// How far below the best bid a limit IOC sell may fill, in percent.
+	ExitMaxSlippagePercent float64 `json:"exitMaxSlippagePercent"`
+
+	// Market sell what is left after this many limit IOC sells.
+	ExitMarketAfterAttempts int `json:"exitMarketAfterAttempts"`
+
+	// Size each sell to the bids visible within the slippage.
+	ExitDepthChunks bool `json:"exitDepthChunks"`
+}
+
+func (s ExitExecutionSettings) validate() error {
+	switch s.ExitMode {
+	case "", types.ExitExecutionMarket, types.ExitExecutionLimitIOC:
+	default:
+		return NewApiError(http.StatusBadRequest,
+			"invalid value for exitMode: %v", s.ExitMode)
+	}
+	if s.ExitMaxSlippagePercent < 0 || s.ExitMaxSlippagePercent >= 100 {
+		return NewApiError(http.StatusBadRequest,
+			"exitMaxSlippagePercent must be between 0 and 100")
+	}
+	if s.ExitMarketAfterAttempts < 0 {
+		return NewApiError(http.StatusBadRequest,
+			"exitMarketAfterAttempts must not be negative")
+	}
+	if s.ExitMode == "" && (s.ExitMaxSlippagePercent > 0 ||
+		s.ExitMarketAfterAttempts > 0 || s.ExitDepthChunks) {
+		return NewApiError(http.StatusBadRequest,
+			"exitMode is required with the other exit settings")
+	}
+	return nil
+}
+
+func (s ExitExecutionSettings) state() types.ExitExecutionState {
+	return types.ExitExecutionState{
+		Mode:                s.ExitMode,
+		MaxSlippagePercent:  s.ExitMaxSlippagePercent,
+		MarketAfterAttempts: s.ExitMarketAfterAttempts,
+		DepthChunks:         s.ExitDepthChunks,
+	}
+}
+
+// EntrySettings are the policies for a buy order that doesn't fill straight
+// away.
+type EntrySettings struct {
+	// Cancel the buy if not filled after this many minutes.
+	EntryExpireMinutes float64 `json:"entryExpireMinutes"`
+
+	// Cancel the buy if the price rises this percent above the order
+	// price.
+	EntryRunawayPercent float64 `json:"entryRunawayPercent"`
+
+	// Replace the buy at the best bid every entryChaseSeconds, up to
+	// entryMaxPrice.
+	EntryChase        bool            `json:"entryChase"`
+	EntryChaseSeconds int64           `json:"entryChaseSeconds"`
+	EntryMaxPrice     decimal.Decimal `json:"entryMaxPrice"`
+}
+
+func (s EntrySettings) validate(order binanceapi.OrderParameters) error {
+	if s.EntryExpireMinutes < 0 {
+		return NewApiError(http.StatusBadRequest,
+			"entryExpireMinutes must not be negative")
+	}
+	if s.EntryRunawayPercent < 0 {
+		return NewApiError(http.StatusBadRequest,
+			"entryRunawayPercent must not be negative")
+	}
+	if s.state().Enabled() {
+		if order.Type == binanceapi.OrderTypeMarket ||
+			order.TimeInForce == binanceapi.TimeInForceIOC ||
+			order.TimeInForce == binanceapi.TimeInForceFOK {
+			return NewApiError(http.StatusBadRequest,
+				"entry policies are only valid for orders that rest on the book")
+		}
+	}
+	if s.EntryChase {
+		switch order.Type {
+		case binanceapi.OrderTypeLimit, binanceapi.OrderTypeLimitMaker:
+		default:
+			return NewApiError(http.StatusBadRequest,
+				"entryChase is not valid for %s orders", order.Type)
+		}
+		if s.EntryChaseSeconds != 0 && s.EntryChaseSeconds < tradeservice.MinChaseSeconds {
+			return NewApiError(http.StatusBadRequest,
+				"entryChaseSeconds must be at least %d", tradeservice.MinChaseSeconds)
+		}
+		if !s.EntryMaxPrice.IsPositive() {
+			return NewApiError(http.StatusBadRequest,
+				"entryMaxPrice is required to chase the best bid")
+		}
+		if s.EntryMaxPrice.LessThan(decimal.NewFromFloat(order.Price)) {
+			return NewApiError(http.StatusBadRequest,
+				"entryMaxPrice %s is below the buy price %v",
+				s.EntryMaxPrice, order.Price)
+		}
+	}
+	return nil
+}
+
+func (s EntrySettings) state() types.EntryState {
+	return types.EntryState{
+		ExpireMinutes:  s.EntryExpireMinutes,
+		RunawayPercent: s.EntryRunawayPercent,
+		Chase:          s.EntryChase,
+		ChaseSeconds:   s.EntryChaseSeconds,
+		MaxPrice:       s.EntryMaxPrice,
+	}
+}
+
+// AlgoSettings work an order as a series of smaller child orders with an
+// execution algorithm.
+type AlgoSettings struct {
+	Algo types.AlgoType `json:"algo"`
+
+	// TWAP: the number of equal slices spread over the duration.
+	AlgoDurationMinutes float64 `json:"algoDurationMinutes"`
+	AlgoSlices          int     `json:"algoSlices"`
+
+	// ICEBERG: the quantity shown on the book at a time.
+	AlgoVisibleQuantity decimal.Decimal `json:"algoVisibleQuantity"`
+
+	// PARTICIPATION: the percent of the volume traded on the symbol to
+	// take.
+	AlgoParticipationPercent float64 `json:"algoParticipationPercent"`
+}
+
+// validate checks the settings for a parent order of the type. Children of
+// a LIMIT parent don't trade past its price.
+func (s AlgoSettings) validate(orderType binanceapi.OrderType, price decimal.Decimal) error {
+	switch s.Algo {
+	case "":
+		return nil
+	case types.AlgoTypeTWAP:
+		if s.AlgoDurationMinutes <= 0 {
+			return NewApiError(http.StatusBadRequest,
+				"algoDurationMinutes must be positive for a TWAP")
+		}
+		if s.AlgoSlices < 1 {
+			return NewApiError(http.StatusBadRequest,
+				"algoSlices must be at least 1 for a TWAP")
+		}
+	case types.AlgoTypeIceberg:
+		if !s.AlgoVisibleQuantity.IsPositive() {
+			return NewApiError(http.StatusBadRequest,
+				"algoVisibleQuantity is required for an iceberg")
+		}
+		if orderType != binanceapi.OrderTypeLimit || !price.IsPositive() {
+			return NewApiError(http.StatusBadRequest,
+				"an iceberg requires a limit price")
+		}
+	case types.AlgoTypeParticipation:
+		if s.AlgoParticipationPercent <= 0 || s.AlgoParticipationPercent > 100 {
+			return NewApiError(http.StatusBadRequest,
+				"algoParticipationPercent must be above 0 and at most 100")
+		}
+	default:
+		return NewApiError(http.StatusBadRequest,
+			"invalid value for algo: %v", s.Algo)
+	}
+	switch orderType {
+	case binanceapi.OrderTypeMarket, binanceapi.OrderTypeLimit:
+	default:
+		return NewApiError(http.StatusBadRequest,
+			"algo is not valid for %s orders", orderType)
+	}
+	return nil
+}
+
+func (s AlgoSettings) state(side binanceapi.OrderSide, quantity decimal.Decimal,
+	price decimal.Decimal) *types.AlgoState {
+	return &types.AlgoState{
+		Type:                 s.Algo,
+		Side:                 side,
+		Quantity:             quantity,
+		Price:                price,
+		DurationMinutes:      s.AlgoDurationMinutes,
+		Slices:               s.AlgoSlices,
+		VisibleQuantity:      s.AlgoVisibleQuantity,
+		ParticipationPercent: s.AlgoParticipationPercent,
+	}
+}
+
+type BuyOrderRequest struct {
+	Symbol      string            `json:"symbol"`
+	PriceSource types.PriceSource `json:"priceSource"`
+	Price       decimal.Decimal   `json:"price"`
+	OffsetTicks int64             `json:"offsetTicks"`
+
+	// The entry order type, LIMIT if not set. The time in force defaults
+	// to GTC for order types that take one. The stop price is required
+	// for STOP_LOSS_LIMIT (breakout) and TAKE_PROFIT_LIMIT (dip) buys.
+	OrderType   binanceapi.OrderType   `json:"orderType"`
+	TimeInForce binanceapi.TimeInForce `json:"timeInForce"`
+	StopPrice   decimal.Decimal        `json:"stopPrice"`
+
+	PositionSizeRequest
+	TradeSettings
+	EntrySettings
+
+	// Buy with child orders instead of posting the order, for a MARKET or
+	// LIMIT order type.
+	AlgoSettings
+
+	// Place a buy with a manual price that is too far above the market.
+	ConfirmDeviation bool `json:"confirmDeviation"`
+
+	// The name of the template the other fields default to.
+	Template string `json:"template"`
+
+	// Labels, such as the strategy or signal source, and notes to record
+	// on the trade.
+	Tags  []string `json:"tags"`
+	Notes string   `json:"notes"`
+
+	// Return the order that would be posted without posting it.
+	DryRun bool `json:"dryRun"`
+}
+
+// BuyOrderPreview is the buy order that would be posted for a request and
+// its projected outcome.
+type BuyOrderPreview struct {
+	Order binanceapi.OrderParameters `json:"order"`
+	PositionSize
+
+	BreakEvenPrice decimal.Decimal `json:"breakEvenPrice"`
+	LimitSellPrice decimal.Decimal `json:"limitSellPrice"`
+	StopLossPrice  decimal.Decimal `json:"stopLossPrice"`
+
+	// How far a manual price is from the market.
+	PriceDeviation *tradeservice.PriceDeviation `json:"priceDeviation,omitempty"`
+
+	Warnings []string `json:"warnings"`
+}
+
+type BuyOrderResponse struct {
+	TradeID string `json:"trade_id,omitempty"`
+	DryRun  bool   `json:"dryRun,omitempty"`
+	BuyOrderPreview
+}
+
+// prepareBuyOrder validates a buy request and builds the order to post,
+// without a client order ID.
+func prepareBuyOrder(tradeService *tradeservice.TradeService,
+	binancePriceService *binanceex.BinancePriceService,
+	requestBody BuyOrderRequest) (*BuyOrderPreview, error) {
+	params := binanceapi.OrderParameters{
+		Side:        binanceapi.OrderSideBuy,
+		Type:        requestBody.OrderType,
+		TimeInForce: requestBody.TimeInForce,
+	}
+
+	commonLogFields := log.Fields{
+		"symbol": requestBody.Symbol,
+	}
+
+	if err := validateBuyOrderType(&params, requestBody.StopPrice); err != nil {
+		return nil, err
+	}
+
+	// A market buy needs a price only to size the order.
+	if params.Type == binanceapi.OrderTypeMarket && requestBody.PriceSource == "" {
+		requestBody.PriceSource = types.PriceSourceBestAsk
+	}
+
+	// Validate price source.
+	switch requestBody.PriceSource {
+	case types.PriceSourceLast:
+	case types.PriceSourceBestBid:
+	case types.PriceSourceBestAsk:
+	case types.PriceSourceManual:
+	case "":
+		return nil, NewApiError(http.StatusBadRequest, "missing required parameter: priceSource")
+	default:
+		return nil, NewApiError(http.StatusBadRequest,
+			"invalid value for priceSource: %v", requestBody.PriceSource)
+	}
+
+	if err := requestBody.TradeSettings.validate(); err != nil {
+		return nil, err
+	}
+
+	params.Symbol = requestBody.Symbol
+
+	var price decimal.Decimal
+	var err error
+	switch requestBody.PriceSource {
+	case types.PriceSourceManual:
+		price = requestBody.Price
+	default:
+		price, err = binancePriceService.GetPrice(params.Symbol, requestBody.PriceSource)
+		if err != nil {
+			log.WithError(err).WithFields(commonLogFields).WithFields(log.Fields{
+				"priceSource": requestBody.PriceSource,
+			}).Error("Failed to get buy price.")
+			return nil, NewApiError(http.StatusInternalServerError,
+				"Failed to get price: %v", err)
+		}
+		if requestBody.OffsetTicks != 0 {
+			newPrice := binancePriceService.AdjustPriceByTicks(requestBody.Symbol,
+				price, requestBody.OffsetTicks)
+			log.WithFields(log.Fields{
+				"offsetTicks": requestBody.OffsetTicks,
+				"price":       price,
+				"newPrice":    newPrice,
+			}).Infof("Price adjusted by ticks")
+			price = newPrice
+		}
+	}
+
+	exchangeInfo := tradeService.ExchangeInfo()
+	params.Price, err = exchangeInfo.PriceParameter(params.Symbol, price)
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest,
+			"invalid symbol %s: %v", params.Symbol, err)
+	}
+
+	size, err := sizePosition(tradeService, params.Symbol,
+		decimal.NewFromFloat(params.Price), requestBody.PositionSizeRequest,
+		requestBody.TradeSettings)
+	if err != nil {
+		return nil, err
+	}
+	params.Quantity, err = exchangeInfo.QuantityParameter(params.Symbol, size.Quantity)
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest,
+			"invalid symbol %s: %v", params.Symbol, err)
+	}
+
+	preview := &BuyOrderPreview{
+		Order:        params,
+		PositionSize: *size,
+		Warnings:     []string{},
+	}
+
+	switch params.Type {
+	case binanceapi.OrderTypeMarket:
+		preview.Order.Price = 0
+		preview.addWarning("market buy sized at a %s price of %s, the fill price may differ",
+			requestBody.PriceSource, size.Price)
+	case binanceapi.OrderTypeStopLossLimit, binanceapi.OrderTypeTakeProfitLimit:
+		preview.Order.StopPrice, err = exchangeInfo.PriceParameter(params.Symbol,
+			requestBody.StopPrice)
+		if err != nil {
+			return nil, NewApiError(http.StatusBadRequest,
+				"invalid symbol %s: %v", params.Symbol, err)
+		}
+		stopPrice := decimal.NewFromFloat(preview.Order.StopPrice)
+		if err := checkStopPrice(binancePriceService, params.Symbol, params.Type,
+			stopPrice); err != nil {
+			return nil, err
+		}
+		if params.Type == binanceapi.OrderTypeStopLossLimit && size.Price.LessThan(stopPrice) {
+			preview.addWarning("limit price %s is below the stop price %s and may not fill",
+				size.Price, stopPrice)
+		}
+	}
+
+	if err := requestBody.EntrySettings.validate(preview.Order); err != nil {
+		return nil, err
+	}
+	if err := requestBody.AlgoSettings.validate(params.Type,
+		decimal.NewFromFloat(preview.Order.Price)); err != nil {
+		return nil, err
+	}
+	if requestBody.Algo != "" && requestBody.EntrySettings.state().Enabled() {
+		return nil, NewApiError(http.StatusBadRequest,
+			"entry policies are not valid with an algo")
+	}
+	if restriction := tradeService.BuyRestriction(params.Symbol); restriction != nil {
+		preview.addWarning("%s", restriction.Message)
+	}
+	if requestBody.PriceSource == types.PriceSourceManual {
+		preview.PriceDeviation, err = checkManualPrice(tradeService, params.Symbol,
+			binanceapi.OrderSideBuy, decimal.NewFromFloat(params.Price))
+		if err != nil {
+			return nil, err
+		}
+		if preview.PriceDeviation.Exceeded {
+			preview.addWarning("%s", preview.PriceDeviation.Message())
+		}
+	}
+
+	targets, err := tradeService.PreviewBuyTargets(params.Symbol, size.Price,
+		size.Quantity, requestBody.limitSellState(), requestBody.stopLossState())
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest, "%v", err)
+	}
+	preview.BreakEvenPrice = targets.BreakEvenPrice
+	preview.LimitSellPrice = targets.LimitSellPrice
+	preview.StopLossPrice = targets.StopLossPrice
+
+	if !price.Equal(size.Price) {
+		preview.addWarning("price %s rounded to the tick size as %s",
+			price, size.Price)
+	}
+	if !requestBody.Quantity.IsZero() && !requestBody.Quantity.Equal(size.Quantity) {
+		preview.addWarning("quantity %s rounded down to the step size as %s",
+			requestBody.Quantity, size.Quantity)
+	}
+	if !requestBody.StopLossEnabled {
+		preview.addWarning("no stop loss is set")
+	}
+	if requestBody.LimitSellEnabled &&
+		targets.LimitSellPrice.LessThanOrEqual(targets.BreakEvenPrice) {
+		preview.addWarning("limit sell price %s is not above the break even price %s",
+			targets.LimitSellPrice, targets.BreakEvenPrice)
+	}
+	if size.Risk.IsPositive() && requestBody.LimitSellEnabled && size.RiskReward < 1 {
+		preview.addWarning("reward is less than the risk")
+	}
+
+	return preview, nil
+}
+
+// validateBuyOrderType checks the order type and time in force of a buy,
+// filling in the defaults.
+func validateBuyOrderType(params *binanceapi.OrderParameters, stopPrice decimal.Decimal) error {
+	if params.Type == "" {
+		params.Type = binanceapi.OrderTypeLimit
+	}
+
+	switch params.Type {
+	case binanceapi.OrderTypeLimit, binanceapi.OrderTypeStopLossLimit,
+		binanceapi.OrderTypeTakeProfitLimit:
+		switch params.TimeInForce {
+		case "":
+			params.TimeInForce = binanceapi.TimeInForceGTC
+		case binanceapi.TimeInForceGTC, binanceapi.TimeInForceIOC,
+			binanceapi.TimeInForceFOK:
+		default:
+			return NewApiError(http.StatusBadRequest,
+				"invalid value for timeInForce: %v", params.TimeInForce)
+		}
+	case binanceapi.OrderTypeMarket, binanceapi.OrderTypeLimitMaker:
+		if params.TimeInForce != "" {
+			return NewApiError(http.StatusBadRequest,
+				"timeInForce is not valid for %s orders", params.Type)
+		}
+	default:
+		return NewApiError(http.StatusBadRequest,
+			"invalid value for orderType: %v", params.Type)
+	}
+
+	switch params.Type {
+	case binanceapi.OrderTypeStopLossLimit, binanceapi.OrderTypeTakeProfitLimit:
+		if !stopPrice.IsPositive() {
+			return NewApiError(http.StatusBadRequest,
+				"stopPrice is required for %s orders", params.Type)
+		}
+	default:
+		if !stopPrice.IsZero() {
+			return NewApiError(http.StatusBadRequest,
+				"stopPrice is not valid for %s orders", params.Type)
+		}
+	}
+
+	return nil
+}
+
+// checkStopPrice checks that a stop buy won't trigger as soon as it is
+// placed, which Binance rejects. A STOP_LOSS_LIMIT buy triggers when the
+// price rises to the stop price, and a TAKE_PROFIT_LIMIT buy when it falls
+// to it.
+func checkStopPrice(binancePriceService *binanceex.BinancePriceService, symbol string,
+	orderType binanceapi.OrderType, stopPrice decimal.Decimal) error {
+	lastPrice, err := binancePriceService.GetPrice(symbol, types.PriceSourceLast)
+	if err != nil {
+		log.WithError(err).WithField("symbol", symbol).
+			Warnf("Failed to get last price to check stop price")
+		return nil
+	}
+	if orderType == binanceapi.OrderTypeStopLossLimit && stopPrice.LessThanOrEqual(lastPrice) {
+		return NewApiError(http.StatusBadRequest,
+			"stop price %s must be above the last price %s for a breakout buy",
+			stopPrice, lastPrice)
+	}
+	if orderType == binanceapi.OrderTypeTakeProfitLimit && stopPrice.GreaterThanOrEqual(lastPrice) {
+		return NewApiError(http.StatusBadRequest,
+			"stop price %s must be below the last price %s for a dip buy",
+			stopPrice, lastPrice)
+	}
+	return nil
+}
+
+func (p *BuyOrderPreview) addWarning(format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (r BuyOrderRequest) limitSellState() types.LimitSellState {
+	return types.LimitSellState{
+		Enabled: r.LimitSellEnabled,
+		Type:    r.LimitSellType,
+		Percent: r.LimitSellPercent,
+		Price:   r.LimitSellPrice,
+	}
+}
+
+func (r BuyOrderRequest) stopLossState() types.StopLossState {
+	return r.StopLossSettings.state(r.StopLossEnabled, r.StopLossPercent)
+}
+
+func placeBuyOrder(tradeService *tradeservice.TradeService,
+	binancePriceService *binanceex.BinancePriceService,
+	requestBody BuyOrderRequest) (*BuyOrderResponse, error) {
+	log.Debugf("Received buy order request: %v", log.ToJson(requestBody))
+
+	preview, err := prepareBuyOrder(tradeService, binancePriceService, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	if requestBody.DryRun {
+		return &BuyOrderResponse{
+			DryRun:          true,
+			BuyOrderPreview: *preview,
+		}, nil
+	}
+
+	// Checked after the preview so a blocked buy can still be previewed.
+	if restriction := tradeService.BuyRestriction(requestBody.Symbol); restriction != nil {
+		tradeService.NotifyRestriction(restriction)
+		return nil, NewRestrictionApiError(restriction)
+	}
+	if deviation := preview.PriceDeviation; deviation != nil && deviation.Exceeded {
+		if !requestBody.ConfirmDeviation {
+			return nil, NewPriceDeviationApiError(deviation)
+		}
+		log.WithFields(log.Fields{
+			"symbol":           requestBody.Symbol,
+			"price":            deviation.Price,
+			"deviationPercent": deviation.DeviationPercent,
+		}).Warnf("Buy price deviation confirmed.")
+	}
+
+	params := preview.Order
+	commonLogFields := log.Fields{
+		"symbol": requestBody.Symbol,
+	}
+
+	// The children of an algo get their own client order IDs.
+	if requestBody.Algo == "" {
+		orderId, err := tradeService.MakeOrderID()
+		if err != nil {
+			log.WithFields(commonLogFields).WithError(err).Errorf("Failed to create order ID.")
+			return nil, NewApiError(http.StatusInternalServerError, "%v", err)
+		}
+		params.NewClientOrderId = orderId
+		preview.Order.NewClientOrderId = orderId
+	}
+
+	trade := types.NewTrade()
+	trade.AddHistory(types.HistoryEntry{
+		Timestamp: time.Now(),
+		Type:      types.HistoryTypeCreated,
+		Fields:    requestBody,
+	})
+	trade.State.Symbol = params.Symbol
+	trade.State.BuyOrder.Type = params.Type
+	trade.State.BuyOrder.TimeInForce = params.TimeInForce
+	trade.State.BuyOrder.StopPrice = decimal.NewFromFloat(params.StopPrice)
+	trade.State.Entry = requestBody.EntrySettings.state()
+	trade.State.Template = requestBody.Template
+	trade.State.Tags = types.NormalizeTags(requestBody.Tags)
+	trade.State.Notes = strings.TrimSpace(requestBody.Notes)
+	if requestBody.Algo != "" {
+		trade.State.Algo = requestBody.AlgoSettings.state(binanceapi.OrderSideBuy,
+			preview.Quantity, decimal.NewFromFloat(params.Price))
+		trade.State.BuyOrder.Quantity = preview.Quantity
+		trade.State.BuyOrder.Price = decimal.NewFromFloat(params.Price)
+	} else {
+		trade.AddClientOrderID(params.NewClientOrderId)
+	}
+
+	// Set before the trade is added so the settings are part of the
+	// initial state recorded in the trade event log.
+	requestBody.TradeSettings.apply(trade, commonLogFields)
+
+	tradeId := tradeService.AddNewTrade(trade)
+	commonLogFields["tradeId"] = tradeId
+
+	log.WithFields(commonLogFields).WithFields(log.Fields{
+		"type":                    params.Type,
+		"timeInForce":             params.TimeInForce,
+		"price":                   params.Price,
+		"stopPrice":               params.StopPrice,
+		"quantity":                params.Quantity,
+		"notional":                preview.Notional,
+		"clientOrderId":           params.NewClientOrderId,
+		"priceSource":             requestBody.PriceSource,
+		"limitSellEnabled":        requestBody.LimitSellEnabled,
+		"limitSellType":           requestBody.LimitSellType,
+		"limitSellPercent":        requestBody.LimitSellPercent,
+		"limitSellPrice":          requestBody.LimitSellPrice,
+		"stopLossEnabled":         requestBody.StopLossEnabled,
+		"stopLossPercent":         requestBody.StopLossPercent,
+		"trailingProfitEnabled":   requestBody.TrailingProfitEnabled,
+		"trailingProfitPercent":   requestBody.TrailingProfitPercent,
+		"trailingProfitDeviation": requestBody.TrailingProfitDeviation,
+		"offsetTicks":             requestBody.OffsetTicks,
+		"entryExpireMinutes":      requestBody.EntryExpireMinutes,
+		"entryRunawayPercent":     requestBody.EntryRunawayPercent,
+		"entryChase":              requestBody.EntryChase,
+		"entryMaxPrice":           requestBody.EntryMaxPrice,
+		"algo":                    requestBody.Algo,
+		"template":                requestBody.Template,
+		"tags":                    trade.State.Tags,
+	}).Infof("Posting BUY order for %s", params.Symbol)
+
+	if requestBody.Algo != "" {
+		tradeService.StartAlgo(trade)
+		return &BuyOrderResponse{
+			TradeID:         tradeId,
+			BuyOrderPreview: *preview,
+		}, nil
+	}
+
+	response, err := tradeService.PostOrder(trade, params)
+	if err != nil {
+		log.WithError(err).
+			Errorf("Failed to post buy order.")
+		tradeService.FailTrade(trade)
+		switch err := err.(type) {
+		case *binanceapi.RestApiError:
+			log.Debugf("Forwarding Binance error repsonse.")
+			return nil, NewBinanceApiError(response.StatusCode, err.Body)
+		default:
+			return nil, NewApiError(http.StatusInternalServerError, "%v", err)
+		}
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	var buyResponse binanceapi.PostOrderResponse
+	if err := json.Unmarshal(data, &buyResponse); err != nil {
+		log.Printf("error: failed to decode buy order response: %v", err)
+	}
+	log.WithFields(log.Fields{
+		"tradeId": tradeId,
+	}).Debugf("Decoded BUY response: %s", log.ToJson(buyResponse))
+
+	return &BuyOrderResponse{
+		TradeID:         tradeId,
+		BuyOrderPreview: *preview,
+	}, nil
+}
+
+func findTrade(tradeService *tradeservice.TradeService, tradeId string) (*types.Trade, error) {
+	if tradeId == "" {
+		return nil, NewApiError(http.StatusBadRequest, "tradeId required")
+	}
+	trade := tradeService.FindTradeByLocalID(tradeId)
+	if trade == nil {
+		return nil, NewApiError(http.StatusNotFound, "trade not found")
+	}
+	return trade, nil
+}
+
+// updateMetadata changes the tags and notes of an open or closed trade.
+func updateMetadata(tradeService *tradeservice.TradeService, tradeId string,
+	update tradeservice.MetadataUpdate) (*types.TradeState, error) {
+	if tradeId == "" {
+		return nil, NewApiError(http.StatusBadRequest, "tradeId required")
+	}
+	state, err := tradeService.UpdateMetadata(tradeId, update)
+	if err == sql.ErrNoRows {
+		return nil, NewApiError(http.StatusNotFound, "trade not found")
+	} else if err != nil {
+		return nil, NewApiError(http.StatusInternalServerError, "%v", err)
+	}
+	return state, nil
+}
+
+func cancelBuy(tradeService *tradeservice.TradeService, trade *types.Trade) error {
+	state := tradeService.Snapshot(trade)
+	log.WithFields(log.Fields{
+		"symbol":  state.Symbol,
+		"tradeId": state.TradeID,
+	}).Infof("Cancelling buy order.")
+
+	if state.Algo.Active() && state.Algo.Side == binanceapi.OrderSideBuy {
+		if err := tradeService.CancelAlgo(trade); err != nil {
+			return NewApiError(http.StatusBadRequest,
+				"Failed to cancel buy algo: %v", err)
+		}
+		return nil
+	}
+
+	if err := tradeService.CancelBuy(trade); err != nil {
+		return NewApiError(http.StatusBadRequest,
+			"Failed to cancel buy order: %v", err)
+	}
+	return nil
+}
+
+// updateStopLoss updates the stop loss of a trade. Without settings only
+// enable and percent are changed, keeping the mode and adjustments.
+func updateStopLoss(tradeService *tradeservice.TradeService, trade *types.Trade,
+	enable bool, percent float64, settings *StopLossSettings) error {
+	if settings == nil {
+		tradeService.UpdateStopLoss(trade, enable, percent)
+		return nil
+	}
+	if err := settings.validate(percent); err != nil {
+		return err
+	}
+	tradeService.UpdateStopLossSettings(trade, settings.state(enable, percent))
+	return nil
+}
+
+// updateExitPolicy replaces the exit policy of a trade. Decay restarts from
+// the current limit sell percent.
+func updateExitPolicy(tradeService *tradeservice.TradeService, trade *types.Trade,
+	settings ExitPolicySettings) error {
+	state := tradeService.Snapshot(trade)
+	switch state.Status {
+	case types.TradeStatusDone, types.TradeStatusCanceled,
+		types.TradeStatusFailed, types.TradeStatusAbandoned:
+		return NewApiError(http.StatusBadRequest, "trade is closed")
+	}
+	if err := settings.validate(state.LimitSell); err != nil {
+		return err
+	}
+	tradeService.UpdateExitPolicy(trade, settings.state())
+	return nil
+}
+
+// updateExitExecution sets how the exits of a trade are executed, an empty
+// exitMode to use the configured default.
+func updateExitExecution(tradeService *tradeservice.TradeService, trade *types.Trade,
+	settings ExitExecutionSettings) error {
+	state := tradeService.Snapshot(trade)
+	switch state.Status {
+	case types.TradeStatusDone, types.TradeStatusCanceled,
+		types.TradeStatusFailed, types.TradeStatusAbandoned:
+		return NewApiError(http.StatusBadRequest, "trade is closed")
+	}
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	tradeService.UpdateExitExecution(trade, settings.state())
+	return nil
+}
+
+// AlgoSellRequest sells what is left of a trade with an execution algo. The
+// children are limit orders at the price if set, otherwise market orders.
+type AlgoSellRequest struct {
+	Price decimal.Decimal `json:"price"`
+	AlgoSettings
+}
+
+func algoSell(tradeService *tradeservice.TradeService, trade *types.Trade,
+	request AlgoSellRequest) error {
+	if request.Algo == "" {
+		return NewApiError(http.StatusBadRequest, "missing required parameter: algo")
+	}
+	orderType := binanceapi.OrderTypeMarket
+	if request.Price.IsPositive() {
+		orderType = binanceapi.OrderTypeLimit
+	}
+	if err := request.AlgoSettings.validate(orderType, request.Price); err != nil {
+		return err
+	}
+	algo := request.AlgoSettings.state(binanceapi.OrderSideSell, decimal.Zero,
+		request.Price)
+	if err := tradeService.AlgoSell(trade, *algo); err != nil {
+		return NewApiError(http.StatusBadRequest, "%s", err.Error())
+	}
+	return nil
+}
+
+const (
+	AlgoActionPause  = "pause"
+	AlgoActionResume = "resume"
+	AlgoActionCancel = "cancel"
+)
+
+// updateAlgo pauses, resumes or cancels the algo working an order of the
+// trade.
+func updateAlgo(tradeService *tradeservice.TradeService, trade *types.Trade,
+	action string) error {
+	var err error
+	switch action {
+	case AlgoActionPause:
+		err = tradeService.PauseAlgo(trade)
+	case AlgoActionResume:
+		err = tradeService.ResumeAlgo(trade)
+	case AlgoActionCancel:
+		err = tradeService.CancelAlgo(trade)
+	default:
+		return NewApiError(http.StatusBadRequest, "invalid algo action: %s", action)
+	}
+	if err != nil {
+		return NewApiError(http.StatusBadRequest, "%s", err.Error())
+	}
+	return nil
+}
+
+func cancelSell(tradeService *tradeservice.TradeService, trade *types.Trade) error {
+	state := tradeService.Snapshot(trade)
+	log.WithFields(log.Fields{
+		"symbol":      state.Symbol,
+		"tradeId":     state.TradeID,
+		"sellOrderId": state.SellOrderId,
+	}).Infof("Cancelling sell order.")
+
+	if state.Algo.Active() && state.Algo.Side == binanceapi.OrderSideSell {
+		if err := tradeService.CancelAlgo(trade); err != nil {
+			return NewApiError(http.StatusBadRequest, "%s", err.Error())
+		}
+		return nil
+	}
+
+	switch state.Status {
+	case types.TradeStatusNew:
+		fallthrough
+	case types.TradeStatusPendingBuy:
+		limitSell := state.LimitSell
+		limitSell.Enabled = false
+		tradeService.UpdateLimitSell(trade, limitSell)
+		return nil
+	}
+
+	if err := tradeService.CancelSell(trade); err != nil {
+		return NewApiError(http.StatusBadRequest, "%s", err.Error())
+	}
+	return nil
+}
+
+func limitSellByPercent(tradeService *tradeservice.TradeService, trade *types.Trade,
+	percent float64) error {
+	state := tradeService.Snapshot(trade)
+	switch state.Status {
+	case types.TradeStatusNew:
+		fallthrough
+	case types.TradeStatusPendingBuy:
+		limitSell := state.LimitSell
+		limitSell.Enabled = true
+		limitSell.Type = types.LimitSellTypePercent
+		limitSell.Percent = percent
+		tradeService.UpdateLimitSell(trade, limitSell)
+		log.WithFields(log.Fields{
+			"symbol":  state.Symbol,
+			"tradeId": state.TradeID,
+			"percent": percent,
+		}).Info("Updated limit sell on buy.")
+		return nil
+	}
+
+	startTime := time.Now()
+
+	if state.Status == types.TradeStatusPendingSell {
+		log.Printf("Cancelling existing sell order.")
+		tradeService.CancelSell(trade)
+	}
+
+	if err := tradeService.LimitSellByPercent(trade, percent); err != nil {
+		log.WithError(err).Error("Limit sell order failed.")
+		return NewApiError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	duration := time.Since(startTime)
+	log.WithFields(log.Fields{
+		"duration": duration,
+		"symbol":   state.Symbol,
+	}).Debug("Sell order posted.")
+	return nil
+}
+
+// checkManualPrice checks how far a manual price is from the market. A
+// price the exchange would reject is an error.
+func checkManualPrice(tradeService *tradeservice.TradeService, symbol string,
+	side binanceapi.OrderSide, price decimal.Decimal) (*tradeservice.PriceDeviation, error) {
+	deviation, err := tradeService.CheckPriceDeviation(symbol, side, price)
+	if err != nil {
+		if percentPriceError, ok := err.(*tradeservice.PercentPriceError); ok {
+			return nil, &ApiError{
+				StatusCode: http.StatusBadRequest,
+				Message:    percentPriceError.Error(),
+				Reason:     "PERCENT_PRICE",
+				Data:       percentPriceError,
+			}
+		}
+		return nil, NewApiError(http.StatusInternalServerError,
+			"failed to check price against the market: %v", err)
+	}
+	return deviation, nil
+}
+
+// limitSellByPrice sells at the price, which is rejected if too far below
+// the market unless confirmDeviation is set.
+func limitSellByPrice(tradeService *tradeservice.TradeService, trade *types.Trade,
+	price decimal.Decimal, confirmDeviation bool) error {
+	state := tradeService.Snapshot(trade)
+	deviation, err := checkManualPrice(tradeService, state.Symbol,
+		binanceapi.OrderSideSell, price)
+	if err != nil {
+		return err
+	}
+	if deviation.Exceeded {
+		if !confirmDeviation {
+			return NewPriceDeviationApiError(deviation)
+		}
+		log.WithFields(log.Fields{
+			"symbol":           state.Symbol,
+			"tradeId":          state.TradeID,
+			"price":            price,
+			"deviationPercent": deviation.DeviationPercent,
+		}).Warnf("Limit sell price deviation confirmed.")
+	}
+
+	switch state.Status {
+	case types.TradeStatusNew:
+		fallthrough
+	case types.TradeStatusPendingBuy:
+		limitSell := state.LimitSell
+		limitSell.Enabled = true
+		limitSell.Type = types.LimitSellTypePrice
+		limitSell.Price = price
+		tradeService.UpdateLimitSell(trade, limitSell)
+		log.WithFields(log.Fields{
+			"symbol":  state.Symbol,
+			"tradeId": state.TradeID,
+			"price":   price,
+		}).Info("Updated limit sell on buy.")
+		return nil
+	}
+
+	startTime := time.Now()
+
+	if state.Status == types.TradeStatusPendingSell {
+		log.Printf("Cancelling existing sell order.")
+		tradeService.CancelSell(trade)
+	}
+
+	if err := tradeService.LimitSellByPrice(trade, price); err != nil {
+		log.WithError(err).Error("Limit sell order failed.")
+		return NewApiError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	duration := time.Since(startTime)
+	log.WithFields(log.Fields{
+		"duration": duration,
+		"symbol":   state.Symbol,
+	}).Debug("Sell order posted.")
+	return nil
+}
+
+// SellOrderPreview is the sell order that would be posted for a trade and
+// its projected outcome.
+type SellOrderPreview struct {
+	DryRun          bool                       `json:"dryRun"`
+	Order           binanceapi.OrderParameters `json:"order"`
+	Price           decimal.Decimal            `json:"price"`
+	ProjectedFee    decimal.Decimal            `json:"projectedFee"`
+	ProjectedProfit decimal.Decimal            `json:"projectedProfit"`
+	BreakEvenPrice  decimal.Decimal            `json:"breakEvenPrice"`
+	Warnings        []string                   `json:"warnings"`
+}
+
+// previewSell returns the order that the marketSell, limitSellByPercent or
+// limitSellByPrice command would post.
+func previewSell(tradeService *tradeservice.TradeService, trade *types.Trade,
+	command string, percent float64, price decimal.Decimal) (*SellOrderPreview, error) {
+	var preview *tradeservice.SellPreview
+	var err error
+	switch command {
+	case CommandMarketSell:
+		preview, err = tradeService.PreviewMarketSell(trade)
+	case CommandLimitSellByPercent:
+		preview, err = tradeService.PreviewLimitSellByPercent(trade, percent)
+	case CommandLimitSellByPrice:
+		preview, err = tradeService.PreviewLimitSellByPrice(trade, price)
+	default:
+		return nil, NewApiError(http.StatusBadRequest,
+			"cannot preview %s", command)
+	}
+	if err != nil {
+		return nil, NewApiError(http.StatusBadRequest, "%v", err)
+	}
+
+	response := &SellOrderPreview{
+		DryRun:          true,
+		Order:           preview.Order,
+		Price:           preview.Price,
+		ProjectedFee:    preview.ProjectedFee,
+		ProjectedProfit: preview.ProjectedProfit,
+		BreakEvenPrice:  preview.BreakEvenPrice,
+		Warnings:        []string{},
+	}
+	if preview.Price.LessThan(preview.BreakEvenPrice) {
+		response.Warnings = append(response.Warnings, fmt.Sprintf(
+			"price %s is below the break even price %s",
+			preview.Price, preview.BreakEvenPrice))
+	}
+	if command == CommandLimitSellByPrice {
+		deviation, err := checkManualPrice(tradeService, tradeService.Snapshot(trade).Symbol,
+			binanceapi.OrderSideSell, price)
+		if err != nil {
+			return nil, err
+		}
+		if deviation.Exceeded {
+			response.Warnings = append(response.Warnings, deviation.Message())
+		}
+	}
+	if tradeService.Snapshot(trade).Status == types.TradeStatusPendingSell {
+		response.Warnings = append(response.Warnings,
+			"the open sell order will be cancelled")
+	}
+	return response, nil
+}
+
+func marketSell(tradeService *tradeservice.TradeService, trade *types.Trade) error {
+	state := tradeService.Snapshot(trade)
+	if state.Status == types.TradeStatusPendingSell {
+		log.Printf("Cancelling existing sell order.")
+		tradeService.CancelSell(trade)
+	}
+
+	if err := tradeService.MarketSell(trade); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": state.Symbol,
+		}).Errorf("Market sell failed")
+		return NewApiError(http.StatusInternalServerError, "%s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+// The websocket command protocol. Clients send requests of the form:
+//
+//   {"protocolVersion": 1, "id": "1", "method": "marketSell",
+//    "params": {"tradeId": "..."}}
+//
+// and receive a response message with the same ID carrying either a result
+// or an error:
+//
+//   {"messageType": "response", "protocolVersion": 1, "id": "1",
+//    "result": {...}}
+//   {"messageType": "response", "protocolVersion": 1, "id": "1",
+//    "error": {"code": 404, "message": "trade not found"}}
+
+import (
+	"encoding/json"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/tradeservice"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+)
+
+const WebSocketProtocolVersion = 1
+
+const (
+	CommandBuy                  = "buy"
+	CommandCancelBuy            = "cancelBuy"
+	CommandCancelSell           = "cancelSell"
+	CommandLimitSellByPercent   = "limitSellByPercent"
+	CommandLimitSellByPrice     = "limitSellByPrice"
+	CommandMarketSell           = "marketSell"
+	CommandUpdateStopLoss       = "updateStopLoss"
+	CommandUpdateTrailingProfit = "updateTrailingProfit"
+	CommandSubscribe            = "subscribe"
+	CommandUnsubscribe          = "unsubscribe"
+	CommandListExternal         = "listExternal"
+	CommandAdopt                = "adopt"
+	CommandUpdateExitPolicy     = "updateExitPolicy"
+	CommandUpdateExitExecution  = "updateExitExecution"
+	CommandAlgoSell             = "algoSell"
+	CommandPauseAlgo            = "pauseAlgo"
+	CommandResumeAlgo           = "resumeAlgo"
+	CommandCancelAlgo           = "cancelAlgo"
+	CommandUpdateMetadata       = "updateMetadata"
+)
+
+// dryRunCommands are the commands that can preview their order with dryRun
+// instead of posting it.
+var dryRunCommands = map[string]bool{
+	CommandBuy:                true,
+	CommandLimitSellByPercent: true,
+	CommandLimitSellByPrice:   true,
+	CommandMarketSell:         true,
+}
+
+// ClientMessage is a command request sent from a websocket client.
+type ClientMessage struct {
+	ProtocolVersion int             `json:"protocolVersion"`
+	ID              string          `json:"id"`
+	Method          string          `json:"method"`
+	Params          json.RawMessage `json:"params"`
+}
+
+type tradeCommandParams struct {
+	TradeID   string          `json:"tradeId"`
+	Enable    bool            `json:"enable"`
+	Percent   float64         `json:"percent"`
+	Price     decimal.Decimal `json:"price"`
+	Deviation float64         `json:"deviation"`
+
+	// Stop loss mode and adjustments for updateStopLoss, the stop price of
+	// a PRICE stop loss is given as price. Without a mode only enable and
+	// percent are changed.
+	Mode             types.StopLossMode `json:"mode"`
+	BreakEvenPercent float64            `json:"breakEvenPercent"`
+	StepPercent      float64            `json:"stepPercent"`
+	StepRaisePercent float64            `json:"stepRaisePercent"`
+
+	// Preview the sell order instead of posting it.
+	DryRun bool `json:"dryRun"`
+
+	// Place a limitSellByPrice that is too far below the market.
+	ConfirmDeviation bool `json:"confirmDeviation"`
+}
+
+type exitPolicyCommandParams struct {
+	TradeID string `json:"tradeId"`
+	ExitPolicySettings
+}
+
+type exitExecutionCommandParams struct {
+	TradeID string `json:"tradeId"`
+	ExitExecutionSettings
+}
+
+type metadataCommandParams struct {
+	TradeID string `json:"tradeId"`
+	tradeservice.MetadataUpdate
+}
+
+type algoSellCommandParams struct {
+	TradeID string `json:"tradeId"`
+	AlgoSellRequest
+}
+
+type subscribeCommandParams struct {
+	Symbols []string `json:"symbols"`
+}
+
+type tradeCommandResult struct {
+	TradeID string `json:"tradeId"`
+}
+
+// commandSession holds the state of the command protocol for a single
+// websocket connection.
+type commandSession struct {
+	handler           *UserWebSocketHandler
+	tradeSubscription *binanceex.TradeStreamSubscription
+
+	// Clients receive trades for all symbols until they subscribe to
+	// specific symbols.
+	explicitSubscription bool
+}
+
+func (s *commandSession) execute(request ClientMessage) *MakerMessage {
+	response := &MakerMessage{
+		Type:            MakerMessageTypeResponse,
+		ProtocolVersion: WebSocketProtocolVersion,
+		RequestID:       request.ID,
+	}
+	result, err := s.dispatch(request)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"method": request.Method,
+			"id":     request.ID,
+		}).Warnf("Websocket command failed")
+		response.Error = ToApiError(err)
+	} else {
+		response.Result = result
+	}
+	return response
+}
+
+func (s *commandSession) dispatch(request ClientMessage) (interface{}, error) {
+	if request.ProtocolVersion != WebSocketProtocolVersion {
+		return nil, NewApiError(http.StatusBadRequest,
+			"unsupported protocol version: %d", request.ProtocolVersion)
+	}
+
+	if !dryRunCommands[request.Method] && len(request.Params) > 0 {
+		// Fail rather than carry out a command the client meant to
+		// preview.
+		var params struct {
+			DryRun bool `json:"dryRun"`
+		}
+		if json.Unmarshal(request.Params, &params) == nil && params.DryRun {
+			return nil, NewApiError(http.StatusBadRequest,
+				"dryRun not supported by method: %s", request.Method)
+		}
+	}
+
+	tradeService := s.handler.appContext.TradeService
+
+	switch request.Method {
+	case CommandBuy:
+		if len(request.Params) == 0 {
+			return nil, NewApiError(http.StatusBadRequest, "missing params")
+		}
+		params, err := decodeBuyOrderRequest(request.Params)
+		if err != nil {
+			return nil, err
+		}
+		return placeBuyOrder(tradeService, s.handler.binancePriceService, params)
+	case CommandListExternal:
+		return listExternal(tradeService)
+	case CommandAdopt:
+		var params AdoptRequest
+		if err := decodeCommandParams(request, &params); err != nil {
+			return nil, err
+		}
+		return adoptTrade(tradeService, params)
+	case CommandUpdateExitPolicy:
+		var params exitPolicyCommandParams
+		if err := decodeCommandParams(request, &params); err != nil {
+			return nil, err
+		}
+		trade, err := findTrade(tradeService, params.TradeID)
+		if err != nil {
+			return nil, err
+		}
+		if err := updateExitPolicy(tradeService, trade, params.ExitPolicySettings); err != nil {
+			return nil, err
+		}
+		return tradeCommandResult{
+			TradeID: params.TradeID,
+		}, nil
+	case CommandUpdateExitExecution:
+		var params exitExecutionCommandParams
+		if err := decodeCommandParams(request, &params); err != nil {
+			return nil, err
+		}
+		trade, err := findTrade(tradeService, params.TradeID)
+		if err != nil {
+			return nil, err
+		}
+		if err := updateExitExecution(tradeService, trade, params.ExitExecutionSettings); err != nil {
+			return nil, err
+		}
+		return tradeCommandResult{
+			TradeID: params.TradeID,
+		}, nil
+	case CommandUpdateMetadata:
+		var params metadataCommandParams
+		if err := decodeCommandParams(request, &params); err != nil {
+			return nil, err
+		}
+		if _, err := updateMetadata(tradeService, params.TradeID, params.MetadataUpdate); err != nil {
+			return nil, err
+		}
+		return tradeCommandResult{
+			TradeID: params.TradeID,
+		}, nil
+	case CommandAlgoSell:
+		var params algoSellCommandParams
+		if err := decodeCommandParams(request, &params); err != nil {
+			return nil, err
+		}
+		trade, err := findTrade(tradeService, params.TradeID)
+		if err != nil {
+			return nil, err
+		}
+		if err := algoSell(tradeService, trade, params.AlgoSellRequest); err != nil {
+			return nil, err
+		}
+		return tradeCommandResult{
+			TradeID: params.TradeID,
+		}, nil
+	case CommandSubscribe, CommandUnsubscribe:
+		var params subscribeCommandParams
+		if err := decodeCommandParams(request, &params); err != nil {
+			return nil, err
+		}
+		if request.Method == CommandSubscribe {
+			if !s.explicitSubscription {
+				s.tradeSubscription.RemoveSymbols(binanceex.TradeStreamAllSymbols)
+				s.explicitSubscription = true
+			}
+			s.tradeSubscription.AddSymbols(params.Symbols...)
+		} else {
+			s.tradeSubscription.RemoveSymbols(params.Symbols...)
+		}
+		return subscribeCommandParams{
+			Symbols: s.tradeSubscription.Symbols(),
+		}, nil
+	}
+
+	var params tradeCommandParams
+	if err := decodeCommandParams(request, &params); err != nil {
+		return nil, err
+	}
+
+	switch request.Method {
+	case CommandCancelBuy, CommandCancelSell, CommandLimitSellByPercent,
+		CommandLimitSellByPrice, CommandMarketSell, CommandUpdateStopLoss,
+		CommandUpdateTrailingProfit, CommandPauseAlgo, CommandResumeAlgo,
+		CommandCancelAlgo:
+	default:
+		return nil, NewApiError(http.StatusBadRequest,
+			"unknown method: %s", request.Method)
+	}
+
+	trade, err := findTrade(tradeService, params.TradeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.DryRun {
+		return previewSell(tradeService, trade, request.Method,
+			params.Percent, params.Price)
+	}
+
+	switch request.Method {
+	case CommandCancelBuy:
+		err = cancelBuy(tradeService, trade)
+	case CommandCancelSell:
+		err = cancelSell(tradeService, trade)
+	case CommandLimitSellByPercent:
+		err = limitSellByPercent(tradeService, trade, params.Percent)
+	case CommandLimitSellByPrice:
+		err = limitSellByPrice(tradeService, trade, params.Price,
+			params.ConfirmDeviation)
+	case CommandMarketSell:
+		err = marketSell(tradeService, trade)
+	case CommandUpdateStopLoss:
+		var settings *StopLossSettings
+		if params.Mode != "" {
+			settings = &StopLossSettings{
+				StopLossMode:             params.Mode,
+				StopLossPrice:            params.Price,
+				StopLossBreakEvenPercent: params.BreakEvenPercent,
+				StopLossStepPercent:      params.StepPercent,
+				StopLossStepRaisePercent: params.StepRaisePercent,
+			}
+		}
+		err = updateStopLoss(tradeService, trade, params.Enable, params.Percent,
+			settings)
+	case CommandUpdateTrailingProfit:
+		tradeService.UpdateTrailingProfit(trade, params.Enable, params.Percent,
+			params.Deviation)
+	case CommandPauseAlgo:
+		err = updateAlgo(tradeService, trade, AlgoActionPause)
+	case CommandResumeAlgo:
+		err = updateAlgo(tradeService, trade, AlgoActionResume)
+	case CommandCancelAlgo:
+		err = updateAlgo(tradeService, trade, AlgoActionCancel)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return tradeCommandResult{
+		TradeID: params.TradeID,
+	}, nil
+}
+
+func decodeCommandParams(request ClientMessage, params interface{}) error {
+	if len(request.Params) == 0 {
+		return NewApiError(http.StatusBadRequest, "missing params")
+	}
+	if err := json.Unmarshal(request.Params, params); err != nil {
+		return NewApiError(http.StatusBadRequest, "invalid params: %v", err)
+	}
+	return nil
+}
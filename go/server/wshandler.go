@@ -24,35 +24,52 @@ import (
 	"gitlab.com/crankykernel/maker/go/context"
 	"gitlab.com/crankykernel/maker/go/healthservice"
 	"gitlab.com/crankykernel/maker/go/log"
-	"gitlab.com/crankykernel/maker/go/tradeservice"
 	"gitlab.com/crankykernel/maker/go/types"
 	"gitlab.com/crankykernel/maker/go/version"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// This handler implements the read-only websocket that all clients connect
+// How often price updates are sent to websocket clients. Only the latest trade
+// for each symbol is sent per interval.
+const tradeStreamThrottleInterval = 250 * time.Millisecond
+
+// This handler implements the websocket that all clients connect
 // to for state updates.
+//
+// Clients may also send commands over the websocket, see wscommands.go. A
+// client reconnecting can pass the journal ID and last sequence number it
+// received as the "journal" and "sequence" query parameters to receive the
+// trade messages it missed instead of every trade.
 type UserWebSocketHandler struct {
 	appContext          *context.ApplicationContext
 	clientNoticeService *clientnotificationservice.Service
 	healthService       *healthservice.Service
+	binancePriceService *binanceex.BinancePriceService
+	messageJournal      *MessageJournal
 }
 
 func NewUserWebSocketHandler(
 	appContext *context.ApplicationContext,
 	clientNoticeService *clientnotificationservice.Service,
-	healthService *healthservice.Service) *UserWebSocketHandler {
+	healthService *healthservice.Service,
+	binancePriceService *binanceex.BinancePriceService,
+	messageJournal *MessageJournal) *UserWebSocketHandler {
 	return &UserWebSocketHandler{
 		appContext:          appContext,
 		clientNoticeService: clientNoticeService,
 		healthService:       healthService,
+		binancePriceService: binancePriceService,
+		messageJournal:      messageJournal,
 	}
 }
 
-func (h *UserWebSocketHandler) readLoop(ws *websocket.Conn, doneChannel chan bool) {
+func (h *UserWebSocketHandler) readLoop(ws *websocket.Conn, doneChannel chan bool,
+	writeChannel chan *MakerMessage, session *commandSession) {
 	for {
-		_, _, err := ws.ReadMessage()
+		_, payload, err := ws.ReadMessage()
 		if err != nil {
 			if strings.Index(err.Error(), "going away") > -1 {
 				log.WithError(err).WithFields(log.Fields{
@@ -69,6 +86,31 @@ func (h *UserWebSocketHandler) readLoop(ws *websocket.Conn, doneChannel chan boo
 			}
 			break
 		}
+
+		var request ClientMessage
+		var response *MakerMessage
+		if err := json.Unmarshal(payload, &request); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"remoteAddr": ws.RemoteAddr(),
+			}).Warnf("Failed to decode client websocket message")
+			response = &MakerMessage{
+				Type:            MakerMessageTypeResponse,
+				ProtocolVersion: WebSocketProtocolVersion,
+				Error: NewApiError(http.StatusBadRequest,
+					"failed to decode message: %v", err),
+			}
+		} else {
+			response = session.execute(request)
+		}
+
+		select {
+		case writeChannel <- response:
+		default:
+			log.WithFields(log.Fields{
+				"remoteAddr": ws.RemoteAddr(),
+				"id":         request.ID,
+			}).Errorf("Failed to queue command response for websocket client")
+		}
 	}
 	log.WithField("remoteAddr", ws.RemoteAddr()).Debug("Client websocket read-loop done")
 }
@@ -111,10 +153,31 @@ func (h *UserWebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		ws.Close()
 	}()
 
+	// Subscribe to the journal before sending any trade state so no update
+	// is missed between the two.
+	var journalChannel chan *MakerMessage
+	var missedMessages []*MakerMessage
+	resumed := false
+	sequence := uint64(0)
+	if r.FormValue("journal") == h.messageJournal.ID {
+		sequence, err = strconv.ParseUint(r.FormValue("sequence"), 10, 64)
+		if err == nil {
+			journalChannel, missedMessages, resumed = h.messageJournal.SubscribeFrom(sequence)
+		}
+	}
+	if !resumed {
+		journalChannel, sequence = h.messageJournal.Subscribe()
+	}
+	defer h.messageJournal.Unsubscribe(journalChannel)
+
 	if err := ws.WriteJSON(map[string]interface{}{
-		"messageType":  MakerMessageTypeVersion,
-		"version":      version.Version,
-		"git_revision": version.GitRevision,
+		"messageType":     MakerMessageTypeVersion,
+		"version":         version.Version,
+		"git_revision":    version.GitRevision,
+		"protocolVersion": WebSocketProtocolVersion,
+		"journal":         h.messageJournal.ID,
+		"sequence":        sequence,
+		"resumed":         resumed,
 	}); err != nil {
 		log.WithError(err).Errorf("Failed to send version message to client websocket")
 		return
@@ -122,37 +185,55 @@ func (h *UserWebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	log.WithFields(log.Fields{
 		"remoteAddr": r.RemoteAddr,
+		"resumed":    resumed,
 	}).Info("Client websocket connected")
 
 	doneChannel := make(chan bool)
-	tradeChannel := h.appContext.TradeService.Subscribe("wshandler")
-	defer h.appContext.TradeService.Unsubscribe(tradeChannel)
 
-	binanceTradeStreamChannel := h.appContext.BinanceTradeStreamManager.Subscribe("wshandler")
-	defer h.appContext.BinanceTradeStreamManager.Unsubscribe(binanceTradeStreamChannel)
+	tradeSubscription := h.appContext.BinanceTradeStreamManager.SubscribeFiltered(
+		"wshandler", tradeStreamThrottleInterval)
+	tradeSubscription.AddSymbols(binanceex.TradeStreamAllSymbols)
+	defer h.appContext.BinanceTradeStreamManager.UnsubscribeFiltered(tradeSubscription)
 
 	binanceUserStreamChannel := h.appContext.BinanceUserDataStream.Subscribe("wshandler")
 	defer h.appContext.BinanceUserDataStream.Unsubscribe(binanceUserStreamChannel)
 
 	writeChannel := make(chan *MakerMessage, 128)
 
-	go h.readLoop(ws, doneChannel)
-	go h.writeLoop(ws, writeChannel)
+	session := &commandSession{
+		handler:           h,
+		tradeSubscription: tradeSubscription,
+	}
 
-	trades := h.appContext.TradeService.GetAllTrades()
-	for _, trade := range trades {
-		message := map[string]interface{}{
-			"messageType": MakerMessageTypeTrade,
-			"trade":       trade.State,
+	// Catch the client up before starting the write loop, which would
+	// otherwise write to the websocket at the same time.
+	if resumed {
+		for _, message := range missedMessages {
+			if err := h.WriteMessage(ws, message); err != nil {
+				log.WithError(err).Errorf("Failed to send missed message to client websocket")
+				return
+			}
 		}
-		bytes, err := json.Marshal(message)
-		if err != nil {
-			log.Printf("error: failed to convert message to json: %v", err)
-		} else {
-			ws.WriteMessage(websocket.TextMessage, bytes)
+	} else {
+		trades := h.appContext.TradeService.GetAllTrades()
+		for _, trade := range trades {
+			message := map[string]interface{}{
+				"messageType": MakerMessageTypeTrade,
+				"trade":       trade.State,
+			}
+			bytes, err := json.Marshal(message)
+			if err != nil {
+				log.Printf("error: failed to convert message to json: %v", err)
+			} else if err := ws.WriteMessage(websocket.TextMessage, bytes); err != nil {
+				log.WithError(err).Errorf("Failed to send trade to client websocket")
+				return
+			}
 		}
 	}
 
+	go h.readLoop(ws, doneChannel, writeChannel, session)
+	go h.writeLoop(ws, writeChannel)
+
 	clientNoticeChannel := h.clientNoticeService.Subscribe()
 	defer h.clientNoticeService.Unsubscribe(clientNoticeChannel)
 
@@ -186,27 +267,20 @@ Loop:
 					"eventType": binanceUserEvent.EventType,
 				}).Info("Ignoring binance user stream event.")
 			}
-		case trade := <-binanceTradeStreamChannel:
+		case trade := <-tradeSubscription.C:
 			outboundMessage = &MakerMessage{
 				Type:            MakerMessageTypeBinanceAggTrade,
 				BinanceAggTrade: &trade,
 			}
-		case trade := <-tradeChannel:
-			switch trade.EventType {
-			case tradeservice.TradeEventTypeUpdate:
-				outboundMessage = &MakerMessage{
-					Type:  MakerMessageTypeTrade,
-					Trade: &trade.TradeState,
-				}
-			case tradeservice.TradeEventTypeArchive:
-				outboundMessage = &MakerMessage{
-					Type:    MakerMessageTypeTradeArchived,
-					TradeID: trade.TradeID,
-				}
-			default:
-				log.Printf("ERROR: Unknown trade server event type: %s",
-					trade.EventType)
+		case message, ok := <-journalChannel:
+			if !ok {
+				log.WithFields(log.Fields{
+					"remoteAddr": ws.RemoteAddr(),
+				}).Errorf("Websocket client fell behind trade updates, closing")
+				ws.Close()
+				break Loop
 			}
+			outboundMessage = message
 		case notice := <-clientNoticeChannel:
 			outboundMessage = &MakerMessage{
 				Type:   MakerMessageTypeNotice,
@@ -223,6 +297,14 @@ Loop:
 			select {
 			case writeChannel <- outboundMessage:
 			default:
+				if outboundMessage.Type == MakerMessageTypeBinanceAggTrade {
+					// Price updates are superseded by the next one, so
+					// drop it rather than disconnecting a slow client.
+					log.WithFields(log.Fields{
+						"remoteAddr": ws.RemoteAddr(),
+					}).Debugf("Websocket client queue full, dropping price update")
+					continue
+				}
 				log.WithFields(log.Fields{
 					"remoteAddr": ws.RemoteAddr(),
 				}).Errorf("Too many messages queued for websocket client, dropping")
@@ -239,13 +321,23 @@ Loop:
 }
 
 type MakerMessage struct {
-	Type                       MakerMessageType                     `json:"messageType"`
+	Type MakerMessageType `json:"messageType"`
+
+	// Sequence number of journaled messages, used to resume a connection.
+	Sequence uint64 `json:"sequence,omitempty"`
+
+	// Command response fields.
+	ProtocolVersion int         `json:"protocolVersion,omitempty"`
+	RequestID       string      `json:"id,omitempty"`
+	Result          interface{} `json:"result,omitempty"`
+	Error           *ApiError   `json:"error,omitempty"`
+
 	Trade                      *types.TradeState                     `json:"trade,omitempty"`
-	TradeID                    string                               `json:"tradeId,omitempty"`
+	TradeID                    string                                `json:"tradeId,omitempty"`
 	BinanceAggTrade            *binanceapi.StreamAggTrade            `json:"binanceAggTrade,omitempty"`
 	BinanceOutboundAccountInfo *binanceapi.StreamOutboundAccountInfo `json:"binanceOutboundAccountInfo,omitempty"`
-	Notice                     *clientnotificationservice.Notice    `json:"notice,omitempty"`
-	Health                     *healthservice.State                 `json:"health,omitempty"`
+	Notice                     *clientnotificationservice.Notice     `json:"notice,omitempty"`
+	Health                     *healthservice.State                  `json:"health,omitempty"`
 }
 
 type MakerMessageType string
@@ -257,3 +349,4 @@ const MakerMessageTypeBinanceAggTrade MakerMessageType = "binanceAggTrade"
 const MakerMessageTypeBinanceAccountInfo MakerMessageType = "binanceOutboundAccountInfo"
 const MakerMessageTypeNotice MakerMessageType = "notice"
 const MakerMessageTypeHealth MakerMessageType = "health"
+const MakerMessageTypeResponse MakerMessageType = "response"
@@ -0,0 +1,199 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package tradeimport builds closed trades from the exchange trade history,
+// for trades that were not made with Maker.
+package tradeimport
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"sort"
+	"time"
+)
+
+// MatchResult is the result of matching the fills of a symbol.
+type MatchResult struct {
+	// Trades that have been sold, with the status DONE.
+	Closed []*types.Trade
+
+	// Trades with a quantity still held at the end of the history.
+	Open []*types.Trade
+
+	// The quantity sold that could not be matched to a buy, for example
+	// when the buy was before the history that was fetched.
+	UnmatchedSellQuantity decimal.Decimal
+}
+
+// The maximum number of fills Binance returns per request.
+const fetchLimit = 1000
+
+// FetchFills pages through the account's fills for a symbol, returning
+// those between from and to. A zero time leaves the range open at that end.
+func FetchFills(client *binanceapi.RestClient, symbol string,
+	from time.Time, to time.Time) ([]binanceapi.MyTradesResponseEntry, error) {
+	fills := []binanceapi.MyTradesResponseEntry{}
+	fromId := int64(0)
+	for {
+		page, err := client.GetMytrades(symbol, fetchLimit, fromId)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range page {
+			if entry.ID >= fromId {
+				fromId = entry.ID + 1
+			}
+			timestamp := time.Unix(0, entry.TimeMillis*int64(time.Millisecond))
+			if !from.IsZero() && timestamp.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !timestamp.Before(to) {
+				continue
+			}
+			fills = append(fills, entry)
+		}
+		if len(page) < fetchLimit {
+			break
+		}
+	}
+	return fills, nil
+}
+
+type lot struct {
+	trade        *types.Trade
+	remaining    decimal.Decimal
+	sellOrderIds []int64
+}
+
+// MatchFills groups the fills of a symbol into trades. Each buy order opens
+// a trade, and sells are matched to the open trades first in, first out,
+// splitting sell fills across trades where needed. A trade is closed once
+// less than the step size of it remains unsold.
+//
+// The trades returned do not have a trade ID.
+func MatchFills(symbol string, baseAsset string, stepSize decimal.Decimal,
+	fills []binanceapi.MyTradesResponseEntry) MatchResult {
+	fills = append([]binanceapi.MyTradesResponseEntry{}, fills...)
+	sort.SliceStable(fills, func(i, j int) bool {
+		if fills[i].TimeMillis != fills[j].TimeMillis {
+			return fills[i].TimeMillis < fills[j].TimeMillis
+		}
+		return fills[i].ID < fills[j].ID
+	})
+
+	result := MatchResult{}
+	queue := []*lot{}
+	lotsByOrderId := map[int64]*lot{}
+
+	for _, entry := range fills {
+		timestamp := time.Unix(0, entry.TimeMillis*int64(time.Millisecond))
+		fill := newOrderFill(entry)
+
+		if entry.IsBuyer {
+			buy := lotsByOrderId[entry.OrderID]
+			if buy == nil {
+				trade := types.NewTrade()
+				trade.State.Symbol = symbol
+				trade.State.OpenTime = timestamp
+				trade.State.BuyOrderId = entry.OrderID
+				trade.State.Imported = true
+				buy = &lot{
+					trade: trade,
+				}
+				lotsByOrderId[entry.OrderID] = buy
+				queue = append(queue, buy)
+			}
+			buy.trade.DoAddBuyFill(fill)
+			buy.remaining = buy.remaining.Add(fill.Quantity)
+			if fill.CommissionAsset == baseAsset {
+				buy.remaining = buy.remaining.Sub(fill.CommissionAmount)
+			}
+			continue
+		}
+
+		unsold := fill.Quantity
+		for unsold.IsPositive() && len(queue) > 0 {
+			buy := queue[0]
+			quantity := decimal.Min(unsold, buy.remaining)
+			part := fill
+			if !quantity.Equal(fill.Quantity) {
+				part.Quantity = quantity
+				part.CommissionAmount = fill.CommissionAmount.Mul(quantity).
+					Div(fill.Quantity)
+				part.CommissionBNB = fill.CommissionBNB.Mul(quantity).
+					Div(fill.Quantity)
+			}
+			buy.trade.DoAddSellFill(part)
+			buy.trade.State.SellOrderId = entry.OrderID
+			if len(buy.sellOrderIds) == 0 ||
+				buy.sellOrderIds[len(buy.sellOrderIds)-1] != entry.OrderID {
+				buy.sellOrderIds = append(buy.sellOrderIds, entry.OrderID)
+			}
+			buy.remaining = buy.remaining.Sub(quantity)
+			unsold = unsold.Sub(quantity)
+
+			if buy.remaining.RoundDown(stepSize).IsZero() {
+				closeTrade(buy, stepSize, timestamp)
+				result.Closed = append(result.Closed, buy.trade)
+				delete(lotsByOrderId, buy.trade.State.BuyOrderId)
+				queue = queue[1:]
+			}
+		}
+		result.UnmatchedSellQuantity = result.UnmatchedSellQuantity.Add(unsold)
+	}
+
+	for _, buy := range queue {
+		buy.trade.UpdateSellableQuantity(stepSize)
+		result.Open = append(result.Open, buy.trade)
+	}
+
+	return result
+}
+
+func newOrderFill(entry binanceapi.MyTradesResponseEntry) types.OrderFill {
+	fill := types.OrderFill{
+		Price:            decimal.NewFromFloat(entry.Price),
+		Quantity:         decimal.NewFromFloat(entry.Quantity),
+		CommissionAsset:  entry.CommissionAsset,
+		CommissionAmount: decimal.NewFromFloat(entry.Commission),
+	}
+	// The price of BNB at the time of the fill isn't known, so the quote
+	// commission of BNB fills is left to be estimated.
+	if fill.CommissionAsset == "BNB" {
+		fill.CommissionBNB = fill.CommissionAmount
+	}
+	return fill
+}
+
+func closeTrade(buy *lot, stepSize decimal.Decimal, closeTime time.Time) {
+	trade := buy.trade
+	trade.UpdateSellableQuantity(stepSize)
+	for _, fill := range trade.State.BuySideFills {
+		trade.State.BuyOrder.Quantity = trade.State.BuyOrder.Quantity.Add(fill.Quantity)
+	}
+	trade.State.BuyOrder.Price = trade.State.AverageBuyPrice
+	trade.State.LastBuyStatus = binanceapi.OrderStatusFilled
+	trade.State.SellOrder.Status = binanceapi.OrderStatusFilled
+	trade.State.SellOrder.Quantity = trade.State.SellFillQuantity
+	trade.State.SellOrder.Price = trade.State.AverageSellPrice
+	trade.State.LastPrice = trade.State.AverageSellPrice
+	trade.State.Status = types.TradeStatusDone
+	trade.State.CloseTime = &closeTime
+	trade.AddHistoryEntry(types.HistoryTypeImported, map[string]interface{}{
+		"buyOrderId":   trade.State.BuyOrderId,
+		"sellOrderIds": buy.sellOrderIds,
+	})
+}
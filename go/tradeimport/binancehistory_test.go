@@ -0,0 +1,62 @@
+package tradeimport
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+)
+
+func TestMatchFills(t *testing.T) {
+	assert := assert.New(t)
+
+	fills := []binanceapi.MyTradesResponseEntry{
+		// Sold before the history starts.
+		{ID: 1, OrderID: 10, Price: 0.02, Quantity: 0.5, TimeMillis: 1000},
+		// Two fills of the first buy, the second fill out of order.
+		{ID: 3, OrderID: 11, Price: 0.01, Quantity: 1, TimeMillis: 3000,
+			IsBuyer: true, Commission: 0.001, CommissionAsset: "ETH"},
+		{ID: 2, OrderID: 11, Price: 0.01, Quantity: 1, TimeMillis: 2000,
+			IsBuyer: true, Commission: 0.001, CommissionAsset: "ETH"},
+		{ID: 4, OrderID: 12, Price: 0.012, Quantity: 2, TimeMillis: 4000,
+			IsBuyer: true, Commission: 0.0001, CommissionAsset: "BNB"},
+		// Sells all of the first buy and half of the second.
+		{ID: 5, OrderID: 13, Price: 0.015, Quantity: 2.998, TimeMillis: 5000,
+			Commission: 0.00004497, CommissionAsset: "BTC"},
+		{ID: 6, OrderID: 14, Price: 0.016, Quantity: 1, TimeMillis: 6000,
+			Commission: 0.000016, CommissionAsset: "BTC"},
+		{ID: 7, OrderID: 15, Price: 0.011, Quantity: 1, TimeMillis: 7000,
+			IsBuyer: true, CommissionAsset: "BNB"},
+	}
+
+	result := MatchFills("ETHBTC", "ETH", decimal.RequireFromString("0.001"), fills)
+
+	assert.Equal("0.5", result.UnmatchedSellQuantity.String())
+	assert.Len(result.Closed, 2)
+	assert.Len(result.Open, 1)
+
+	first := result.Closed[0].State
+	assert.Equal(types.TradeStatusDone, first.Status)
+	assert.True(first.Imported)
+	assert.Equal(int64(11), first.BuyOrderId)
+	assert.Equal(int64(2000), first.OpenTime.UnixNano()/1e6)
+	assert.Equal(int64(5000), first.CloseTime.UnixNano()/1e6)
+	assert.Equal("1.998", first.BuyFillQuantity.String())
+	assert.Equal("2", first.BuyOrder.Quantity.String())
+	assert.Equal("1.998", first.SellFillQuantity.String())
+	assert.Equal(int64(13), first.SellOrderId)
+
+	second := result.Closed[1].State
+	assert.Equal(int64(12), second.BuyOrderId)
+	assert.Equal("2", second.SellFillQuantity.String())
+	assert.Len(second.SellSideFills, 2)
+	assert.Equal("0.000015", second.SellSideFills[0].CommissionAmount.String())
+	assert.Equal(int64(14), second.SellOrderId)
+	assert.Equal("0.0001", second.FeeBNB.String())
+
+	open := result.Open[0].State
+	assert.Equal(types.TradeStatusNew, open.Status)
+	assert.Equal(int64(15), open.BuyOrderId)
+	assert.Nil(open.CloseTime)
+}
@@ -0,0 +1,679 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"time"
+)
+
+const (
+	// How often a running algo is checked for its next child order.
+	algoCheckInterval = 1 * time.Second
+
+	// How long a child order can go unreported before it is looked up on
+	// the exchange.
+	algoChildCheckInterval = 30 * time.Second
+
+	// The number of child orders in a row that can fail before the algo is
+	// canceled.
+	algoMaxFailures = 5
+)
+
+const (
+	AlgoReasonCanceled = "CANCELED"
+	AlgoReasonFailed   = "FAILED"
+	AlgoReasonExit     = "EXIT"
+)
+
+// algoRunner is what a running algo keeps outside of the trade state.
+type algoRunner struct {
+	// The volume traded on the symbol when the last participation child
+	// was sized.
+	volumeMark decimal.Decimal
+	marked     bool
+}
+
+func (s *TradeService) StartAlgo(trade *types.Trade) {
+	s.call(trade, func() error {
+		s.startAlgo(trade)
+		return nil
+	})
+}
+
+// startAlgo starts working the parent order of the algo set on the trade.
+func (s *TradeService) startAlgo(trade *types.Trade) {
+	algo := *trade.State.Algo
+	now := time.Now()
+	algo.Status = types.AlgoStatusRunning
+	algo.StartTime = now
+	algo.NextChildTime = now
+	s.updateAlgo(trade, algo)
+
+	log.WithFields(log.Fields{
+		"tradeId":  trade.State.TradeID,
+		"symbol":   trade.State.Symbol,
+		"type":     algo.Type,
+		"side":     algo.Side,
+		"quantity": algo.Quantity,
+		"price":    algo.Price,
+	}).Infof("Starting execution algo")
+	trade.AddHistoryEntry(types.HistoryTypeAlgoStarted, algo)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+	go s.runAlgo(trade)
+}
+
+func (s *TradeService) AlgoSell(trade *types.Trade, algo types.AlgoState) error {
+	return s.call(trade, func() error {
+		return s.algoSell(trade, algo)
+	})
+}
+
+// algoSell sells what is left of the position with an algo, replacing a
+// pending limit sell.
+func (s *TradeService) algoSell(trade *types.Trade, algo types.AlgoState) error {
+	switch trade.State.Status {
+	case types.TradeStatusWatching, types.TradeStatusPendingSell:
+	default:
+		return fmt.Errorf("can't sell trade in status %s", trade.State.Status)
+	}
+	if trade.State.Algo.Active() {
+		return fmt.Errorf("algo already running")
+	}
+	if trade.State.Exit != nil && !trade.State.Exit.Complete {
+		return fmt.Errorf("exit already in progress")
+	}
+
+	stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+	if err != nil {
+		return err
+	}
+	quantity := trade.State.SellableQuantity.Sub(trade.State.SellFillQuantity).
+		RoundDown(stepSize)
+	if quantity.LessThan(stepSize) {
+		return fmt.Errorf("nothing left to sell")
+	}
+
+	if trade.State.Status == types.TradeStatusPendingSell {
+		if err := s.cancelSell(trade); err != nil {
+			return err
+		}
+	}
+
+	algo.Side = binanceapi.OrderSideSell
+	algo.Quantity = quantity
+	s.updateAlgo(trade, algo)
+	s.startAlgo(trade)
+	return nil
+}
+
+func (s *TradeService) runAlgo(trade *types.Trade) {
+	runner := &algoRunner{}
+	for {
+		time.Sleep(algoCheckInterval)
+		done := false
+		err := s.call(trade, func() error {
+			done = s.checkAlgo(trade, time.Now(), runner)
+			return nil
+		})
+		if done || err != nil {
+			// Finished, or the trade has been removed.
+			return
+		}
+	}
+}
+
+// checkAlgo moves the algo forward, returning true once it is finished.
+// Only one child order is worked at a time.
+func (s *TradeService) checkAlgo(trade *types.Trade, now time.Time, runner *algoRunner) bool {
+	if !trade.State.Algo.Active() {
+		return true
+	}
+	algo := trade.State.Algo
+	switch {
+	case algo.ChildClientOrderID != "":
+		s.checkAlgoChild(trade, now)
+	case trade.IsDone():
+		s.finishAlgo(trade)
+	case algo.Status == types.AlgoStatusPaused:
+	case algo.Status != types.AlgoStatusRunning:
+		// Stopped, and the last child is finished.
+		s.finishAlgo(trade)
+	case !now.Before(algo.NextChildTime):
+		s.nextAlgoChild(trade, now, runner)
+	}
+	return !trade.State.Algo.Active()
+}
+
+// algoRemaining returns the quantity of the parent order not yet filled.
+func algoRemaining(algo *types.AlgoState) decimal.Decimal {
+	return algo.Quantity.Sub(algo.Filled).Sub(algo.ChildFilled)
+}
+
+// algoPrice returns the price used to size child orders: the algo's limit
+// price, or the last price for market children.
+func (s *TradeService) algoPrice(trade *types.Trade) (decimal.Decimal, error) {
+	if trade.State.Algo.Price.IsPositive() {
+		return trade.State.Algo.Price, nil
+	}
+	if trade.State.LastPrice.IsPositive() {
+		return trade.State.LastPrice, nil
+	}
+	ticker, err := s.exchange.GetPriceTicker(trade.State.Symbol)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return decimal.NewFromFloatChecked(ticker.Price)
+}
+
+// nextAlgoChild posts the next child order of a running algo, or finishes
+// the algo if what is left is too small to trade. Children are market
+// orders, or limit IOC orders at the algo's price, except for an iceberg
+// which rests its visible quantity on the book.
+func (s *TradeService) nextAlgoChild(trade *types.Trade, now time.Time, runner *algoRunner) {
+	algo := *trade.State.Algo
+	symbol := trade.State.Symbol
+
+	stepSize, err := s.binanceExchangeInfo.GetStepSize(symbol)
+	if err != nil {
+		s.algoChildFailed(trade, algo, err)
+		return
+	}
+	minNotional, err := s.binanceExchangeInfo.GetMinNotional(symbol)
+	if err != nil {
+		s.algoChildFailed(trade, algo, err)
+		return
+	}
+	price, err := s.algoPrice(trade)
+	if err != nil {
+		s.algoChildFailed(trade, algo, err)
+		return
+	}
+
+	remaining := algoRemaining(&algo).RoundDown(stepSize)
+	if remaining.LessThan(stepSize) || remaining.Mul(price).LessThan(minNotional) {
+		s.finishAlgo(trade)
+		return
+	}
+	least := minNotional.Div(price).RoundDown(stepSize).Add(stepSize)
+
+	order := binanceapi.OrderParameters{
+		Symbol: symbol,
+		Side:   algo.Side,
+		Type:   binanceapi.OrderTypeMarket,
+	}
+	if algo.Price.IsPositive() {
+		order.Type = binanceapi.OrderTypeLimit
+		order.TimeInForce = binanceapi.TimeInForceIOC
+		order.Price, err = s.binanceExchangeInfo.PriceParameter(symbol, algo.Price)
+		if err != nil {
+			s.algoChildFailed(trade, algo, err)
+			return
+		}
+	}
+
+	var quantity decimal.Decimal
+	switch algo.Type {
+	case types.AlgoTypeTWAP:
+		slices := algo.Slices - algo.Children
+		if slices < 1 {
+			slices = 1
+		}
+		quantity = remaining.Div(decimal.NewFromInt(int64(slices))).RoundDown(stepSize)
+		interval := time.Duration(algo.DurationMinutes * float64(time.Minute) /
+			float64(algo.Slices))
+		algo.NextChildTime = now.Add(interval)
+	case types.AlgoTypeIceberg:
+		quantity = algo.VisibleQuantity
+		order.TimeInForce = binanceapi.TimeInForceGTC
+	case types.AlgoTypeParticipation:
+		volume := s.symbolVolume(symbol)
+		if !runner.marked {
+			runner.volumeMark = volume
+			runner.marked = true
+			return
+		}
+		quantity = volume.Sub(runner.volumeMark).
+			Mul(decimal.NewFromFloat(algo.ParticipationPercent / 100)).
+			RoundDown(stepSize)
+		if quantity.LessThan(least) {
+			// Wait for more volume.
+			return
+		}
+		runner.volumeMark = volume
+	default:
+		s.algoChildFailed(trade, algo, fmt.Errorf("unknown algo type %s", algo.Type))
+		return
+	}
+	if quantity.LessThan(least) {
+		quantity = least
+	}
+	// Don't leave a remainder too small to trade.
+	if remaining.Sub(quantity).LessThan(least) {
+		quantity = remaining
+	}
+
+	quantityParameter, err := s.binanceExchangeInfo.QuantityParameter(symbol, quantity)
+	if err != nil {
+		s.algoChildFailed(trade, algo, err)
+		return
+	}
+	order.Quantity = quantityParameter
+	clientOrderId, err := s.MakeOrderID()
+	if err != nil {
+		s.algoChildFailed(trade, algo, err)
+		return
+	}
+
+	// Save the child before posting so it can be found if the response is
+	// lost.
+	algo.ChildClientOrderID = clientOrderId
+	algo.ChildOrderID = 0
+	algo.ChildFilled = decimal.Zero
+	algo.ChildTime = now
+	s.updateAlgo(trade, algo)
+	db.DbUpdateTrade(trade)
+
+	logFields := log.Fields{
+		"tradeId":       trade.State.TradeID,
+		"symbol":        symbol,
+		"algo":          algo.Type,
+		"side":          algo.Side,
+		"child":         algo.Children + 1,
+		"type":          order.Type,
+		"quantity":      quantity,
+		"price":         order.Price,
+		"clientOrderId": clientOrderId,
+	}
+	log.WithFields(logFields).Infof("Posting algo child order")
+
+	order.NewClientOrderId = clientOrderId
+	_, err = s.postOrder(trade, order)
+
+	history := map[string]interface{}{
+		"algo":          algo.Type,
+		"child":         algo.Children + 1,
+		"type":          order.Type,
+		"quantity":      quantity,
+		"clientOrderId": clientOrderId,
+		"success":       err == nil,
+	}
+	if order.Price > 0 {
+		history["price"] = order.Price
+	}
+	if err != nil {
+		history["error"] = err.Error()
+		trade.AddHistoryEntry(types.HistoryTypeAlgoChild, history)
+		if binanceex.ParseBinanceError(err) != nil {
+			// Rejected by the exchange, there is no child order. Otherwise
+			// it is looked up later.
+			algo.ChildClientOrderID = ""
+		}
+		algo.NextChildTime = now
+		s.algoChildFailed(trade, algo, err)
+		return
+	}
+
+	algo.Children++
+	algo.Failures = 0
+	algo.LastError = ""
+	s.updateAlgo(trade, algo)
+	trade.AddHistoryEntry(types.HistoryTypeAlgoChild, history)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+// algoChildFailed records a failed child order, canceling the algo once too
+// many have failed in a row.
+func (s *TradeService) algoChildFailed(trade *types.Trade, algo types.AlgoState, err error) {
+	algo.Failures++
+	algo.LastError = err.Error()
+	log.WithError(err).WithFields(log.Fields{
+		"tradeId":  trade.State.TradeID,
+		"symbol":   trade.State.Symbol,
+		"algo":     algo.Type,
+		"failures": algo.Failures,
+	}).Errorf("Algo child order failed")
+	if algo.Failures >= algoMaxFailures {
+		algo.Status = types.AlgoStatusCanceled
+		algo.Reason = AlgoReasonFailed
+	}
+	s.updateAlgo(trade, algo)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+// onAlgoReport follows the child order of an algo from its execution
+// reports. The fills are recorded on the trade by the state machine, the
+// algo only counts how much of the parent order is done.
+func (s *TradeService) onAlgoReport(trade *types.Trade, report binanceapi.StreamExecutionReport) {
+	if !trade.State.Algo.Active() {
+		return
+	}
+	algo := *trade.State.Algo
+	if algo.ChildClientOrderID == "" ||
+		(report.ClientOrderID != algo.ChildClientOrderID &&
+			report.OriginalClientOrderID != algo.ChildClientOrderID) {
+		return
+	}
+	algo.ChildOrderID = report.OrderID
+	algo.ChildTime = time.Now()
+	filled := decimal.NewFromFloat(report.CumulativeFilledQuantity)
+	if filled.GreaterThan(algo.ChildFilled) {
+		algo.ChildFilled = filled
+	}
+	switch report.CurrentOrderStatus {
+	case binanceapi.OrderStatusNew, binanceapi.OrderStatusPartiallyFilled:
+		s.updateAlgo(trade, algo)
+		if algo.Status != types.AlgoStatusRunning {
+			// Paused or canceled before the child was acknowledged.
+			s.cancelAlgoChild(trade)
+		}
+	default:
+		s.endAlgoChild(trade, algo)
+	}
+}
+
+// checkAlgoChild looks up a child order that hasn't been reported on for a
+// while, in case its reports were missed or its post was lost.
+func (s *TradeService) checkAlgoChild(trade *types.Trade, now time.Time) {
+	algo := *trade.State.Algo
+	if now.Sub(algo.ChildTime) < algoChildCheckInterval {
+		return
+	}
+	logFields := log.Fields{
+		"tradeId":       trade.State.TradeID,
+		"symbol":        trade.State.Symbol,
+		"clientOrderId": algo.ChildClientOrderID,
+	}
+
+	order, err := s.exchange.GetOrderByClientId(trade.State.Symbol, algo.ChildClientOrderID)
+	if err != nil {
+		binanceError := binanceex.ParseBinanceError(err)
+		if binanceError != nil && binanceError.IsNoSuchOrder() {
+			// The post never made it to the exchange.
+			algo.ChildClientOrderID = ""
+			s.algoChildFailed(trade, algo, err)
+			return
+		}
+		log.WithError(err).WithFields(logFields).Warnf("Failed to query algo child order")
+		algo.ChildTime = now
+		s.updateAlgo(trade, algo)
+		return
+	}
+
+	algo.ChildOrderID = order.OrderId
+	algo.ChildTime = now
+	switch order.Status {
+	case binanceapi.OrderStatusNew, binanceapi.OrderStatusPartiallyFilled:
+		s.updateAlgo(trade, algo)
+		if algo.Status != types.AlgoStatusRunning {
+			s.cancelAlgoChild(trade)
+		}
+		return
+	}
+
+	executed := decimal.NewFromFloat(order.ExecutedQty)
+	if executed.GreaterThan(algo.ChildFilled) {
+		recorded, err := s.addMissedFills(trade, algo.Side, order.OrderId)
+		if err != nil {
+			log.WithError(err).WithFields(logFields).Warnf("Failed to get algo child fills")
+			s.updateAlgo(trade, algo)
+			return
+		}
+		if recorded.LessThan(executed) {
+			// Look again once the trade history has caught up.
+			log.WithFields(logFields).WithFields(log.Fields{
+				"executed": executed,
+				"recorded": recorded,
+			}).Warnf("Algo child fills missing from trade history")
+			s.updateAlgo(trade, algo)
+			return
+		}
+		algo.ChildFilled = executed
+	}
+	s.endAlgoChild(trade, algo)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+// addMissedFills records the fills of the order from the trade history that
+// were not reported, with their commission, returning the quantity now
+// recorded for the order. Fills already recorded from a report are skipped,
+// and a report arriving later skips the fills recorded here.
+func (s *TradeService) addMissedFills(trade *types.Trade, side binanceapi.OrderSide,
+	orderId int64) (decimal.Decimal, error) {
+	trades, err := s.exchange.GetMytrades(trade.State.Symbol, 0, -1)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	recorded := decimal.Zero
+	for _, entry := range trades {
+		if entry.OrderID != orderId {
+			continue
+		}
+		recorded = recorded.Add(decimal.NewFromFloat(entry.Quantity))
+		if trade.HasFill(side, orderId, entry.ID) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"tradeId":  trade.State.TradeID,
+			"symbol":   trade.State.Symbol,
+			"orderId":  orderId,
+			"quantity": entry.Quantity,
+			"price":    entry.Price,
+		}).Warnf("Adding unreported fill")
+		s.addFill(trade, side, types.OrderFill{
+			Price:            decimal.NewFromFloat(entry.Price),
+			Quantity:         decimal.NewFromFloat(entry.Quantity),
+			CommissionAsset:  entry.CommissionAsset,
+			CommissionAmount: decimal.NewFromFloat(entry.Commission),
+			OrderID:          orderId,
+			TradeID:          entry.ID,
+		})
+	}
+	return recorded, nil
+}
+
+// endAlgoChild counts what the finished child order filled towards the
+// parent.
+func (s *TradeService) endAlgoChild(trade *types.Trade, algo types.AlgoState) {
+	algo.Filled = algo.Filled.Add(algo.ChildFilled)
+	algo.ChildClientOrderID = ""
+	algo.ChildOrderID = 0
+	algo.ChildFilled = decimal.Zero
+	s.updateAlgo(trade, algo)
+}
+
+// cancelAlgoChild cancels the working child order of the algo. A child not
+// yet acknowledged is canceled when its first report arrives.
+func (s *TradeService) cancelAlgoChild(trade *types.Trade) {
+	algo := trade.State.Algo
+	if algo.ChildOrderID == 0 {
+		return
+	}
+	if _, err := s.exchange.CancelOrderById(trade.State.Symbol, algo.ChildOrderID); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"symbol":  trade.State.Symbol,
+			"orderId": algo.ChildOrderID,
+		}).Warnf("Failed to cancel algo child order")
+	}
+}
+
+// finishAlgo marks the algo finished and moves the trade on. A buy that
+// filled anything is watched as if its order had filled, otherwise it is
+// closed. A sell is left to the state machine, unless only dust is left.
+func (s *TradeService) finishAlgo(trade *types.Trade) {
+	algo := *trade.State.Algo
+	if algo.Status != types.AlgoStatusCanceled {
+		algo.Status = types.AlgoStatusDone
+	}
+	algo.Finished = true
+	s.updateAlgo(trade, algo)
+
+	log.WithFields(log.Fields{
+		"tradeId":  trade.State.TradeID,
+		"symbol":   trade.State.Symbol,
+		"algo":     algo.Type,
+		"side":     algo.Side,
+		"status":   algo.Status,
+		"reason":   algo.Reason,
+		"filled":   algo.Filled,
+		"children": algo.Children,
+	}).Infof("Execution algo finished")
+	trade.AddHistoryEntry(types.HistoryTypeAlgoFinished, map[string]interface{}{
+		"algo":     algo.Type,
+		"status":   algo.Status,
+		"reason":   algo.Reason,
+		"quantity": algo.Quantity,
+		"filled":   algo.Filled,
+		"children": algo.Children,
+	})
+
+	now := time.Now()
+	if algo.Side == binanceapi.OrderSideBuy {
+		switch trade.State.Status {
+		case types.TradeStatusNew, types.TradeStatusPendingBuy:
+			if trade.State.BuyFillQuantity.IsPositive() {
+				s.changeStatus(trade, types.TradeStatusWatching, now)
+				s.triggerLimitSell(trade)
+			} else if algo.Reason == AlgoReasonFailed {
+				s.closeTrade(trade, types.TradeStatusFailed, now)
+			} else {
+				s.closeTrade(trade, types.TradeStatusCanceled, now)
+			}
+		}
+	} else if !trade.IsDone() && (trade.State.Exit == nil || trade.State.Exit.Complete) {
+		stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+		if err == nil && trade.State.SellFillQuantity.IsPositive() &&
+			trade.State.SellableQuantity.Sub(trade.State.SellFillQuantity).LessThan(stepSize) {
+			s.closeTrade(trade, types.TradeStatusDone, now)
+		}
+	}
+
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+func (s *TradeService) PauseAlgo(trade *types.Trade) error {
+	return s.call(trade, func() error {
+		return s.pauseAlgo(trade)
+	})
+}
+
+// pauseAlgo stops the algo posting child orders, canceling the working
+// child.
+func (s *TradeService) pauseAlgo(trade *types.Trade) error {
+	if !trade.State.Algo.Active() || trade.State.Algo.Status != types.AlgoStatusRunning {
+		return fmt.Errorf("no running algo")
+	}
+	algo := *trade.State.Algo
+	algo.Status = types.AlgoStatusPaused
+	s.updateAlgo(trade, algo)
+	s.cancelAlgoChild(trade)
+	s.algoUpdated(trade, "pause")
+	return nil
+}
+
+func (s *TradeService) ResumeAlgo(trade *types.Trade) error {
+	return s.call(trade, func() error {
+		return s.resumeAlgo(trade)
+	})
+}
+
+func (s *TradeService) resumeAlgo(trade *types.Trade) error {
+	if !trade.State.Algo.Active() || trade.State.Algo.Status != types.AlgoStatusPaused {
+		return fmt.Errorf("no paused algo")
+	}
+	algo := *trade.State.Algo
+	algo.Status = types.AlgoStatusRunning
+	algo.NextChildTime = time.Now()
+	algo.Failures = 0
+	s.updateAlgo(trade, algo)
+	s.algoUpdated(trade, "resume")
+	return nil
+}
+
+func (s *TradeService) CancelAlgo(trade *types.Trade) error {
+	return s.call(trade, func() error {
+		if !trade.State.Algo.Active() || trade.State.Algo.Status == types.AlgoStatusCanceled {
+			return fmt.Errorf("no algo to cancel")
+		}
+		s.cancelAlgo(trade, AlgoReasonCanceled)
+		return nil
+	})
+}
+
+// cancelAlgo stops the algo for good. It finishes once the working child is
+// canceled, leaving the trade with what was filled.
+func (s *TradeService) cancelAlgo(trade *types.Trade, reason string) {
+	algo := *trade.State.Algo
+	algo.Status = types.AlgoStatusCanceled
+	algo.Reason = reason
+	s.updateAlgo(trade, algo)
+	s.cancelAlgoChild(trade)
+	s.algoUpdated(trade, "cancel")
+}
+
+func (s *TradeService) algoUpdated(trade *types.Trade, action string) {
+	algo := trade.State.Algo
+	log.WithFields(log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+		"algo":    algo.Type,
+		"action":  action,
+		"reason":  algo.Reason,
+	}).Infof("Execution algo updated")
+	trade.AddHistoryEntry(types.HistoryTypeAlgoUpdate, map[string]interface{}{
+		"algo":   algo.Type,
+		"action": action,
+		"status": algo.Status,
+		"reason": algo.Reason,
+		"filled": algo.Filled.Add(algo.ChildFilled),
+	})
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+func (s *TradeService) updateAlgo(trade *types.Trade, algo types.AlgoState) {
+	s.applyEvent(trade, types.TradeEvent{
+		Type:        types.TradeEventAlgoUpdated,
+		AlgoUpdated: &algo,
+	})
+}
+
+// addVolume adds to the volume traded on the symbol.
+func (s *TradeService) addVolume(symbol string, quantity decimal.Decimal) {
+	s.volumeLock.Lock()
+	s.volumes[symbol] = s.volumes[symbol].Add(quantity)
+	s.volumeLock.Unlock()
+}
+
+// symbolVolume returns the volume traded on the symbol since it was first
+// streamed for an open trade.
+func (s *TradeService) symbolVolume(symbol string) decimal.Decimal {
+	s.volumeLock.Lock()
+	defer s.volumeLock.Unlock()
+	return s.volumes[symbol]
+}
@@ -0,0 +1,373 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"encoding/json"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// How often the entry policy of a pending buy is checked.
+	entryCheckInterval = 1 * time.Second
+
+	// The time between reprices of a chasing buy if not set, and the
+	// least allowed so a chase can't run into the API rate limits.
+	DefaultChaseSeconds = 30
+	MinChaseSeconds     = 5
+
+	// How long after a failed cancel the runaway policy tries again.
+	entryCancelRetryInterval = 10 * time.Second
+)
+
+const (
+	EntryCancelExpired = "EXPIRED"
+	EntryCancelRunaway = "RUNAWAY"
+)
+
+// startEntry watches a pending buy with an entry policy until it is no
+// longer pending.
+func (s *TradeService) startEntry(trade *types.Trade) {
+	if !trade.State.Entry.Enabled() {
+		return
+	}
+	go s.runEntry(trade)
+}
+
+func (s *TradeService) runEntry(trade *types.Trade) {
+	lastChase := time.Now()
+	for {
+		time.Sleep(entryCheckInterval)
+		done := false
+		err := s.call(trade, func() error {
+			done = s.checkEntry(trade, time.Now(), &lastChase)
+			return nil
+		})
+		if done || err != nil {
+			// No longer pending, or the trade has been removed.
+			return
+		}
+	}
+}
+
+// checkEntry applies the expiry and chase policies to a pending buy,
+// returning true once there is nothing more to do. The runaway policy is
+// checked on each price update instead.
+func (s *TradeService) checkEntry(trade *types.Trade, now time.Time, lastChase *time.Time) bool {
+	switch trade.State.Status {
+	case types.TradeStatusNew:
+		// Wait for the exchange to acknowledge the buy.
+		return false
+	case types.TradeStatusPendingBuy:
+	default:
+		return true
+	}
+	entry := trade.State.Entry
+	if entry.CancelReason != "" {
+		return true
+	}
+	if !entryOrderAcknowledged(trade) {
+		return false
+	}
+
+	if entry.ExpireMinutes > 0 {
+		expireAfter := time.Duration(entry.ExpireMinutes * float64(time.Minute))
+		if now.Sub(trade.State.OpenTime) >= expireAfter {
+			return s.cancelEntry(trade, EntryCancelExpired) == nil
+		}
+	}
+
+	if entry.Chase {
+		interval := time.Duration(entry.ChaseSeconds) * time.Second
+		if interval <= 0 {
+			interval = DefaultChaseSeconds * time.Second
+		}
+		if now.Sub(*lastChase) >= interval {
+			*lastChase = now
+			if err := s.chaseEntry(trade); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"tradeId": trade.State.TradeID,
+					"symbol":  trade.State.Symbol,
+				}).Errorf("Failed to chase buy order")
+			}
+		}
+	}
+
+	return false
+}
+
+// checkRunaway cancels a pending buy if the price has risen too far above
+// the buy order price for it to be likely to fill.
+func (s *TradeService) checkRunaway(trade *types.Trade, price decimal.Decimal) {
+	entry := trade.State.Entry
+	if entry.RunawayPercent <= 0 || entry.CancelReason != "" ||
+		!entryOrderAcknowledged(trade) {
+		return
+	}
+	if entry.CancelFailed != nil && time.Since(*entry.CancelFailed) < entryCancelRetryInterval {
+		return
+	}
+	orderPrice := trade.State.BuyOrder.Price
+	if !orderPrice.IsPositive() {
+		return
+	}
+	percent := price.Sub(orderPrice).Mul(decimal.NewFromInt(100)).
+		Div(orderPrice).Float64()
+	if percent > entry.RunawayPercent {
+		log.WithFields(log.Fields{
+			"tradeId":    trade.State.TradeID,
+			"symbol":     trade.State.Symbol,
+			"price":      price,
+			"orderPrice": orderPrice,
+			"percent":    percent,
+		}).Infof("Price ran away from buy order, cancelling.")
+		s.cancelEntry(trade, EntryCancelRunaway)
+	}
+}
+
+// entryOrderAcknowledged returns false while the order replacing a chased buy
+// has not been acknowledged, as the buy order ID is still that of the
+// canceled order.
+func entryOrderAcknowledged(trade *types.Trade) bool {
+	return trade.State.BuyOrderId > trade.State.Entry.ReplacedOrderID
+}
+
+// cancelEntry cancels the buy for the entry policy. The execution report for
+// the cancel moves the trade to WATCHING if anything was bought, otherwise
+// it is closed as CANCELED.
+func (s *TradeService) cancelEntry(trade *types.Trade, reason string) error {
+	_, err := s.exchange.CancelOrderById(trade.State.Symbol, trade.State.BuyOrderId)
+	history := map[string]interface{}{
+		"buyOrderId": trade.State.BuyOrderId,
+		"reason":     reason,
+		"success":    err == nil,
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"symbol":  trade.State.Symbol,
+			"reason":  reason,
+		}).Errorf("Failed to cancel buy order")
+		history["error"] = err.Error()
+		entry := trade.State.Entry
+		now := time.Now()
+		entry.CancelFailed = &now
+		s.updateEntry(trade, entry)
+	} else {
+		entry := trade.State.Entry
+		entry.CancelReason = reason
+		entry.CancelFailed = nil
+		s.updateEntry(trade, entry)
+	}
+	trade.AddHistoryEntry(types.HistoryTypeBuyCanceled, history)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+	return err
+}
+
+// chaseEntry replaces the buy at the best bid if the bid has moved above the
+// order price, up to the maximum price.
+func (s *TradeService) chaseEntry(trade *types.Trade) error {
+	ticker, err := s.exchange.GetBookTicker(trade.State.Symbol)
+	if err != nil {
+		return err
+	}
+	price, err := decimal.NewFromFloatChecked(ticker.BidPrice)
+	if err != nil {
+		return err
+	}
+	maxPrice := trade.State.Entry.MaxPrice
+	if maxPrice.IsPositive() && price.GreaterThan(maxPrice) {
+		price = maxPrice
+	}
+	if !price.GreaterThan(trade.State.BuyOrder.Price) {
+		return nil
+	}
+	return s.replaceBuy(trade, price)
+}
+
+// replaceBuy cancels the buy order and places a new one at the price for
+// the quantity not yet bought. The cancel goes first so the trade can never
+// buy more than asked for.
+func (s *TradeService) replaceBuy(trade *types.Trade, price decimal.Decimal) error {
+	logFields := log.Fields{
+		"tradeId":    trade.State.TradeID,
+		"symbol":     trade.State.Symbol,
+		"buyOrderId": trade.State.BuyOrderId,
+		"fromPrice":  trade.State.BuyOrder.Price,
+		"toPrice":    price,
+	}
+	history := map[string]interface{}{
+		"buyOrderId": trade.State.BuyOrderId,
+		"fromPrice":  trade.State.BuyOrder.Price,
+		"toPrice":    price,
+	}
+	failed := func(err error) error {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to reprice buy order")
+		history["success"] = false
+		history["error"] = err.Error()
+		trade.AddHistoryEntry(types.HistoryTypeBuyRepriced, history)
+		db.DbUpdateTrade(trade)
+		s.broadcastTradeUpdate(trade)
+		return err
+	}
+
+	// Work out the order before the cancel so nothing is left waiting on
+	// a bad symbol.
+	stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+	if err != nil {
+		return failed(err)
+	}
+	minNotional, err := s.binanceExchangeInfo.GetMinNotional(trade.State.Symbol)
+	if err != nil {
+		return failed(err)
+	}
+	priceParameter, err := s.binanceExchangeInfo.PriceParameter(trade.State.Symbol, price)
+	if err != nil {
+		return failed(err)
+	}
+
+	response, err := s.exchange.CancelOrderById(trade.State.Symbol, trade.State.BuyOrderId)
+	if err != nil {
+		// Most likely filled in the meantime.
+		return failed(err)
+	}
+
+	quantity := s.unfilledBuyQuantity(trade, response).RoundDown(stepSize)
+	if quantity.LessThan(stepSize) || quantity.Mul(price).LessThan(minNotional) {
+		// Nothing worth buying is left, the cancel report will move the
+		// trade on with what has been bought.
+		log.WithFields(logFields).WithField("quantity", quantity).
+			Infof("Remaining buy quantity too small to replace")
+		history["quantity"] = quantity
+		history["success"] = true
+		history["replaced"] = false
+		trade.AddHistoryEntry(types.HistoryTypeBuyRepriced, history)
+		db.DbUpdateTrade(trade)
+		s.broadcastTradeUpdate(trade)
+		return nil
+	}
+	quantityParameter, err := s.binanceExchangeInfo.QuantityParameter(
+		trade.State.Symbol, quantity)
+	if err != nil {
+		return failed(err)
+	}
+
+	clientOrderId, err := s.MakeOrderID()
+	if err != nil {
+		return failed(err)
+	}
+
+	// Recorded before posting so the cancel report for the old order,
+	// still to be processed, doesn't close the buy.
+	previous := trade.State.Entry
+	entry := previous
+	entry.ReplacedOrderID = trade.State.BuyOrderId
+	entry.ClientOrderID = clientOrderId
+	entry.BuyFills = len(trade.State.BuySideFills)
+	s.updateEntry(trade, entry)
+
+	order := binanceapi.OrderParameters{
+		Symbol:           trade.State.Symbol,
+		Side:             binanceapi.OrderSideBuy,
+		Type:             trade.State.BuyOrder.Type,
+		TimeInForce:      trade.State.BuyOrder.TimeInForce,
+		Quantity:         quantityParameter,
+		Price:            priceParameter,
+		NewClientOrderId: clientOrderId,
+	}
+	if order.Type == "" {
+		order.Type = binanceapi.OrderTypeLimit
+	}
+	if order.Type == binanceapi.OrderTypeLimit && order.TimeInForce == "" {
+		order.TimeInForce = binanceapi.TimeInForceGTC
+	}
+
+	history["quantity"] = quantity
+	history["clientOrderId"] = clientOrderId
+	if _, err := s.postOrder(trade, order); err != nil {
+		// Let the cancel report close out the buy.
+		s.updateEntry(trade, previous)
+		return failed(err)
+	}
+
+	now := time.Now()
+	entry.Reprices++
+	entry.LastReprice = &now
+	s.updateEntry(trade, entry)
+
+	log.WithFields(logFields).WithFields(log.Fields{
+		"quantity":      quantity,
+		"clientOrderId": clientOrderId,
+	}).Infof("Repriced buy order")
+	history["success"] = true
+	trade.AddHistoryEntry(types.HistoryTypeBuyRepriced, history)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+	return nil
+}
+
+// cancelOrderResponse is the part of the Binance cancel order response used
+// to size a replacement order.
+type cancelOrderResponse struct {
+	OrigQty     string `json:"origQty"`
+	ExecutedQty string `json:"executedQty"`
+}
+
+// unfilledBuyQuantity returns what is left to buy after the buy order has
+// been canceled. The cancel response is used if possible as fills may have
+// been made that have not been reported yet.
+func (s *TradeService) unfilledBuyQuantity(trade *types.Trade, response *http.Response) decimal.Decimal {
+	if response != nil && response.Body != nil {
+		data, err := ioutil.ReadAll(response.Body)
+		if err == nil {
+			var cancel cancelOrderResponse
+			if err := json.Unmarshal(data, &cancel); err == nil {
+				origQty, err0 := decimal.NewFromString(cancel.OrigQty)
+				executedQty, err1 := decimal.NewFromString(cancel.ExecutedQty)
+				if err0 == nil && err1 == nil {
+					return origQty.Sub(executedQty)
+				}
+			}
+		}
+	}
+
+	// The quantity filled before commission, by the current order only
+	// if the buy has been replaced before.
+	fills := trade.State.BuySideFills
+	if start := trade.State.Entry.BuyFills; start <= len(fills) {
+		fills = fills[start:]
+	}
+	filled := decimal.Zero
+	for _, fill := range fills {
+		filled = filled.Add(fill.Quantity)
+	}
+	return trade.State.BuyOrder.Quantity.Sub(filled)
+}
+
+func (s *TradeService) updateEntry(trade *types.Trade, entry types.EntryState) {
+	s.applyEvent(trade, types.TradeEvent{
+		Type:         types.TradeEventEntryUpdated,
+		EntryUpdated: &entry,
+	})
+}
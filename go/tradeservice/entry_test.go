@@ -0,0 +1,74 @@
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+	"time"
+)
+
+func newPendingBuyTrade(id string, symbol string) *types.Trade {
+	trade := types.NewTradeWithState(types.TradeState{
+		TradeID:    id,
+		Symbol:     symbol,
+		Status:     types.TradeStatusPendingBuy,
+		OpenTime:   time.Now(),
+		BuyOrderId: 1,
+	})
+	trade.State.BuyOrder.Quantity = decimal.NewFromInt(2)
+	trade.State.BuyOrder.Price = decimal.RequireFromString("0.01")
+	return trade
+}
+
+func TestUnfilledBuyQuantity(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTradeService(fakeSymbolStream{}, newFakeExchange(0), nil, nil)
+	trade := newPendingBuyTrade("entry", "ETHBTC")
+	trade.State.BuySideFills = []types.OrderFill{
+		{Quantity: decimal.RequireFromString("0.5")},
+	}
+	assert.Equal("1.5", service.unfilledBuyQuantity(trade, nil).String())
+
+	// After a reprice only the fills of the replacement order count
+	// against its quantity.
+	trade.State.Entry.BuyFills = 1
+	trade.State.BuySideFills = append(trade.State.BuySideFills,
+		types.OrderFill{Quantity: decimal.RequireFromString("0.25")})
+	assert.Equal("1.75", service.unfilledBuyQuantity(trade, nil).String())
+}
+
+func TestRunawayCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	service := newTestTradeService(t, exchange)
+	trade := newPendingBuyTrade("runaway", "ETHBTC")
+	trade.State.Entry.RunawayPercent = 5
+	price := decimal.RequireFromString("0.011")
+
+	// The replacement of a chased buy is not acknowledged yet.
+	trade.State.Entry.ReplacedOrderID = 1
+	service.checkRunaway(trade, price)
+	assert.Empty(exchange.canceledOrders())
+
+	// A failed cancel is not retried on the next price update.
+	trade.State.BuyOrderId = 2
+	exchange.cancelErr = fmt.Errorf("unavailable")
+	service.checkRunaway(trade, price)
+	service.checkRunaway(trade, price)
+	assert.Equal([]int64{2}, exchange.canceledOrders())
+	assert.NotNil(trade.State.Entry.CancelFailed)
+	assert.Equal("", trade.State.Entry.CancelReason)
+
+	// But is once the retry interval has passed.
+	failed := time.Now().Add(-entryCancelRetryInterval)
+	trade.State.Entry.CancelFailed = &failed
+	exchange.cancelErr = nil
+	service.checkRunaway(trade, price)
+	assert.Equal([]int64{2, 2}, exchange.canceledOrders())
+	assert.Equal(EntryCancelRunaway, trade.State.Entry.CancelReason)
+	assert.Nil(trade.State.Entry.CancelFailed)
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"net/http"
+)
+
+// Exchange is the subset of the exchange REST API used by the trade
+// service.
+type Exchange interface {
+	PostOrder(order binanceapi.OrderParameters) (*http.Response, error)
+	CancelOrderById(symbol string, orderId int64) (*http.Response, error)
+	GetOrderByClientId(symbol string, clientOrderId string) (*binanceapi.OrderResponse, error)
+	GetAccount() (*binanceapi.AccountInfoResponse, error)
+	GetPriceTicker(symbol string) (*binanceapi.PriceTickerResponse, error)
+	GetBookTicker(symbol string) (*binanceapi.BookTickerResponse, error)
+	GetDepth(symbol string, limit int64) (*binanceapi.DepthResponse, error)
+	GetMytrades(symbol string, limit int64, fromId int64) ([]binanceapi.MyTradesResponseEntry, error)
+}
+
+// binanceExchange is the Exchange backed by the Binance REST API. A new
+// client is created for each request so configuration changes to the API
+// key are picked up.
+type binanceExchange struct{}
+
+func (binanceExchange) PostOrder(order binanceapi.OrderParameters) (*http.Response, error) {
+	return binanceex.GetBinanceRestClient().PostOrder(order)
+}
+
+func (binanceExchange) CancelOrderById(symbol string, orderId int64) (*http.Response, error) {
+	return binanceex.GetBinanceRestClient().CancelOrderById(symbol, orderId)
+}
+
+func (binanceExchange) GetOrderByClientId(symbol string, clientOrderId string) (*binanceapi.OrderResponse, error) {
+	return binanceex.GetBinanceRestClient().GetOrderByClientId(symbol, clientOrderId)
+}
+
+func (binanceExchange) GetAccount() (*binanceapi.AccountInfoResponse, error) {
+	return binanceex.GetBinanceRestClient().GetAccount()
+}
+
+func (binanceExchange) GetPriceTicker(symbol string) (*binanceapi.PriceTickerResponse, error) {
+	return binanceapi.NewRestClient().GetPriceTicker(symbol)
+}
+
+func (binanceExchange) GetBookTicker(symbol string) (*binanceapi.BookTickerResponse, error) {
+	return binanceapi.NewRestClient().GetBookTicker(symbol)
+}
+
+func (binanceExchange) GetDepth(symbol string, limit int64) (*binanceapi.DepthResponse, error) {
+	return binanceapi.NewRestClient().GetDepth(symbol, limit)
+}
+
+func (binanceExchange) GetMytrades(symbol string, limit int64, fromId int64) ([]binanceapi.MyTradesResponseEntry, error) {
+	return binanceex.GetBinanceRestClient().GetMytrades(symbol, limit, fromId)
+}
+
+// symbolStream is the part of the trade stream manager used by the trade
+// service to follow prices for open trades.
+type symbolStream interface {
+	AddSymbol(symbol string)
+	RemoveSymbol(symbol string)
+}
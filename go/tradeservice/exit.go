@@ -0,0 +1,388 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"gitlab.com/crankykernel/maker/go/util"
+	"time"
+)
+
+const (
+	// The number of consecutive failures before giving up.
+	exitMaxAttempts = 8
+
+	exitRetryMin = 1 * time.Second
+	exitRetryMax = 30 * time.Second
+)
+
+// startExit starts an exit for a fired stop loss or trailing profit, or a
+// market sell, at the trigger price. The exit runs in the background,
+// canceling a pending limit sell then posting sells as set by the trade's
+// exit execution until the position is sold or the attempts are used up.
+func (s *TradeService) startExit(trade *types.Trade, trigger types.TriggerType,
+	price decimal.Decimal) {
+	if trade.State.Exit != nil && !trade.State.Exit.Complete &&
+		trade.State.Status != types.TradeStatusExitFailed {
+		log.WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"symbol":  trade.State.Symbol,
+			"trigger": trigger,
+		}).Warnf("Exit already in progress")
+		return
+	}
+	if trade.State.Algo.Active() && trade.State.Algo.Status != types.AlgoStatusCanceled {
+		// The exit takes over from an algo sell.
+		s.cancelAlgo(trade, AlgoReasonExit)
+	}
+	s.updateExit(trade, types.ExitState{
+		Trigger:           trigger,
+		StartTime:         time.Now(),
+		TriggerPrice:      price,
+		Execution:         s.exitExecution(trade),
+		StartSellQuantity: trade.State.SellFillQuantity,
+	})
+	db.DbUpdateTrade(trade)
+	go s.runExit(trade)
+}
+
+func (s *TradeService) updateExit(trade *types.Trade, exit types.ExitState) {
+	s.applyEvent(trade, types.TradeEvent{
+		Type:        types.TradeEventExitUpdated,
+		ExitUpdated: &exit,
+	})
+}
+
+func (s *TradeService) runExit(trade *types.Trade) {
+	backoff := util.NewBackoff(exitRetryMin, exitRetryMax)
+	sellAvailable := false
+	failures := 0
+	for {
+		done := false
+		err := s.call(trade, func() error {
+			attempts := 0
+			if trade.State.Exit != nil {
+				attempts = trade.State.Exit.Attempts
+			}
+			var err error
+			done, err = s.exitAttempt(trade, &sellAvailable)
+			if trade.State.Exit != nil && trade.State.Exit.Attempts > attempts {
+				// Check on the new order soon, an IOC sell is over
+				// at once.
+				backoff.Reset()
+			}
+			if err != nil {
+				failures++
+				if failures >= exitMaxAttempts {
+					s.exitFailed(trade, err)
+					done = true
+				}
+			} else {
+				failures = 0
+			}
+			return nil
+		})
+		if done || err != nil {
+			// Finished, or the trade has been removed.
+			return
+		}
+		time.Sleep(backoff.Next())
+	}
+}
+
+// exitAttempt moves the exit one step forward, returning true once there is
+// nothing more to do. An existing exit order is looked up by its client order
+// ID before a new one is posted so a lost response can't lead to a double
+// sell, and what it sold is counted once it is finished.
+func (s *TradeService) exitAttempt(trade *types.Trade, sellAvailable *bool) (bool, error) {
+	if trade.State.Exit == nil {
+		return true, nil
+	}
+	exit := *trade.State.Exit
+
+	logFields := log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+		"trigger": exit.Trigger,
+		"attempt": exit.Attempts,
+	}
+
+	restClient := s.exchange
+
+	if exit.ClientOrderID != "" {
+		order, err := restClient.GetOrderByClientId(trade.State.Symbol, exit.ClientOrderID)
+		if err != nil {
+			binanceError := binanceex.ParseBinanceError(err)
+			if trade.IsDone() {
+				// Sold, though what the last order sold is unknown.
+				s.completeExit(trade)
+				return true, nil
+			}
+			if binanceError == nil || !binanceError.IsNoSuchOrder() {
+				// Can't tell if the order exists, don't post another.
+				log.WithError(err).WithFields(logFields).
+					Warnf("Failed to query exit order")
+				trade.AddHistoryEntry(types.HistoryTypeExitAttempt, map[string]interface{}{
+					"trigger":       exit.Trigger,
+					"attempt":       exit.Attempts,
+					"clientOrderId": exit.ClientOrderID,
+					"success":       false,
+					"error":         fmt.Sprintf("failed to query exit order: %v", err),
+				})
+				db.DbUpdateTrade(trade)
+				return false, err
+			}
+		} else {
+			switch order.Status {
+			case binanceapi.OrderStatusNew, binanceapi.OrderStatusPartiallyFilled:
+				// Still working, check again later.
+				return false, nil
+			}
+			exit.SoldQuantity = exit.SoldQuantity.Add(
+				decimal.NewFromFloat(order.ExecutedQty))
+			exit.SoldCost = exit.SoldCost.Add(
+				decimal.NewFromFloat(order.CummulativeQuoteQty))
+			exit.ClientOrderID = ""
+			s.updateExit(trade, exit)
+			db.DbUpdateTrade(trade)
+			if order.Status == binanceapi.OrderStatusFilled {
+				log.WithFields(logFields).Infof("Exit order filled")
+				if *sellAvailable {
+					// Sold all there was.
+					s.completeExit(trade)
+					return true, nil
+				}
+			} else {
+				log.WithFields(logFields).WithFields(log.Fields{
+					"orderStatus": order.Status,
+					"executedQty": order.ExecutedQty,
+				}).Infof("Exit order did not fill completely")
+			}
+		}
+	}
+
+	if trade.IsDone() {
+		s.completeExit(trade)
+		return true, nil
+	}
+
+	if trade.State.Algo.Active() {
+		// Wait for the child order of the canceled algo to finish so what
+		// it sells is counted.
+		return false, nil
+	}
+
+	// Only the order the exit replaces is canceled, later pending sells are
+	// the exit's own orders not reported as finished yet.
+	if trade.State.Status == types.TradeStatusPendingSell && exit.Attempts == 0 {
+		switch trade.State.SellOrder.Status {
+		case binanceapi.OrderStatusNew, binanceapi.OrderStatusPartiallyFilled:
+			// Selling while the order is open would sell more than
+			// there is, the cancel is retried as a failed attempt.
+			if err := s.cancelSell(trade); err != nil {
+				exit.LastError = err.Error()
+				s.updateExit(trade, exit)
+				db.DbUpdateTrade(trade)
+				s.broadcastTradeUpdate(trade)
+				return false, err
+			}
+		}
+	}
+
+	stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to get step size")
+	}
+
+	sold := decimal.Max(trade.State.SellFillQuantity,
+		exit.StartSellQuantity.Add(exit.SoldQuantity))
+	quantity := trade.State.SellableQuantity.Sub(sold)
+	if *sellAvailable {
+		available, err := s.availableBalance(trade)
+		if err != nil {
+			log.WithError(err).WithFields(logFields).
+				Errorf("Failed to get available balance")
+		} else if available.LessThan(quantity) {
+			log.WithFields(logFields).WithFields(log.Fields{
+				"quantity":  quantity,
+				"available": available,
+			}).Warnf("Selling available balance")
+			quantity = available
+		}
+	}
+	if stepSize.IsPositive() {
+		quantity = quantity.RoundDown(stepSize)
+		if quantity.LessThan(stepSize) {
+			unreported := trade.State.SellableQuantity.Sub(trade.State.SellFillQuantity)
+			if !unreported.LessThan(stepSize) {
+				// Wait for the fills of the last orders to be reported.
+				return false, nil
+			}
+			log.WithFields(logFields).Infof("Nothing left to sell for exit")
+			if trade.State.SellFillQuantity.IsPositive() {
+				// Only dust is left.
+				s.closeTrade(trade, types.TradeStatusDone, time.Now())
+			}
+			s.completeExit(trade)
+			return true, nil
+		}
+	}
+
+	order, quantity, err := s.exitOrder(trade, exit, quantity)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to build exit order")
+		return false, err
+	}
+	quantityParameter, err := s.binanceExchangeInfo.QuantityParameter(
+		trade.State.Symbol, quantity)
+	if err != nil {
+		return false, err
+	}
+	order.Quantity = quantityParameter
+
+	clientOrderId, err := s.MakeOrderID()
+	if err != nil {
+		return false, err
+	}
+
+	// Save the client order ID before posting so the order can be found if
+	// the response is lost.
+	exit.Attempts++
+	if order.Type == binanceapi.OrderTypeLimit {
+		exit.LimitAttempts++
+	}
+	exit.ClientOrderID = clientOrderId
+	exit.LastError = ""
+	s.updateExit(trade, exit)
+	db.DbUpdateTrade(trade)
+
+	log.WithFields(logFields).WithFields(log.Fields{
+		"attempt":  exit.Attempts,
+		"quantity": quantity,
+		"type":     order.Type,
+		"price":    order.Price,
+	}).Infof("Posting exit sell")
+
+	order.NewClientOrderId = clientOrderId
+	_, err = s.postOrder(trade, order)
+
+	history := map[string]interface{}{
+		"trigger":       exit.Trigger,
+		"attempt":       exit.Attempts,
+		"type":          order.Type,
+		"quantity":      quantity,
+		"clientOrderId": clientOrderId,
+		"success":       err == nil,
+	}
+	if order.Price > 0 {
+		history["price"] = order.Price
+	}
+
+	if err == nil {
+		trade.AddHistoryEntry(types.HistoryTypeExitAttempt, history)
+		db.DbUpdateTrade(trade)
+		s.broadcastTradeUpdate(trade)
+		return false, nil
+	}
+
+	log.WithError(err).WithFields(logFields).Errorf("Exit sell failed")
+	history["error"] = err.Error()
+	trade.AddHistoryEntry(types.HistoryTypeExitAttempt, history)
+	exit.LastError = err.Error()
+	s.updateExit(trade, exit)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+
+	if binanceError := binanceex.ParseBinanceError(err); binanceError != nil {
+		if binanceError.IsInsufficientBalance() {
+			*sellAvailable = true
+		} else if binanceError.IsMinNotional() {
+			if trade.State.SellFillQuantity.IsPositive() {
+				// What is left over can't be sold.
+				log.WithFields(logFields).Warnf(
+					"Remaining quantity below minimum notional, closing trade")
+				s.closeTrade(trade, types.TradeStatusDone, time.Now())
+				s.completeExit(trade)
+				return true, nil
+			}
+			s.exitFailed(trade, err)
+			return true, nil
+		}
+	}
+
+	return false, err
+}
+
+// availableBalance returns the free balance of the base asset of the trade's
+// symbol.
+func (s *TradeService) availableBalance(trade *types.Trade) (decimal.Decimal, error) {
+	symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	account, err := s.exchange.GetAccount()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	for _, balance := range account.Balances {
+		if balance.Asset == symbolInfo.BaseAsset {
+			return decimal.NewFromFloat(balance.Free), nil
+		}
+	}
+	return decimal.Zero, fmt.Errorf("no balance for asset %s", symbolInfo.BaseAsset)
+}
+
+// exitFailed marks the trade as EXIT_FAILED, leaving an open position that
+// needs to be dealt with by hand.
+func (s *TradeService) exitFailed(trade *types.Trade, err error) {
+	log.WithError(err).WithFields(log.Fields{
+		"tradeId":  trade.State.TradeID,
+		"symbol":   trade.State.Symbol,
+		"trigger":  trade.State.Exit.Trigger,
+		"attempts": trade.State.Exit.Attempts,
+	}).Errorf("Exit failed, position is still open")
+
+	trade.AddHistoryEntry(types.HistoryTypeExitFailed, map[string]interface{}{
+		"trigger":  trade.State.Exit.Trigger,
+		"attempts": trade.State.Exit.Attempts,
+		"error":    fmt.Sprintf("%v", err),
+	})
+	s.changeStatus(trade, types.TradeStatusExitFailed, time.Now())
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+
+	if s.notificationService != nil {
+		notice := clientnotificationservice.NewNotice(
+			clientnotificationservice.LevelCritical,
+			fmt.Sprintf("%s exit for %s failed after %d attempts, the position is still open: %v",
+				trade.State.Exit.Trigger, trade.State.Symbol,
+				trade.State.Exit.Attempts, err)).
+			WithData(map[string]interface{}{
+				"tradeId": trade.State.TradeID,
+				"symbol":  trade.State.Symbol,
+			}).
+			WithAlert()
+		// Broadcast blocks on slow clients, don't hold the trade lock.
+		go s.notificationService.Broadcast(notice)
+	}
+}
@@ -0,0 +1,243 @@
+package tradeservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newBinanceError(code int, message string) error {
+	body, _ := json.Marshal(binanceex.BinanceError{Code: code, Message: message})
+	return &binanceapi.RestApiError{StatusCode: http.StatusBadRequest, Body: body}
+}
+
+// newExitingTrade returns a trade of 1 ETH with a stop loss exit started at
+// 0.01 but not running, so the test can step through the exit attempts.
+func newExitingTrade(service *TradeService, id string,
+	execution types.ExitExecutionState) *types.Trade {
+	trade := newWatchingTrade(id, "ETHBTC", 0)
+	service.updateExit(trade, types.ExitState{
+		Trigger:      types.TriggerStopLoss,
+		StartTime:    time.Now(),
+		TriggerPrice: decimal.RequireFromString("0.01"),
+		Execution:    execution,
+	})
+	return trade
+}
+
+func TestExitEscalatesToMarket(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	exchange.bidPrice = 0.01
+	service := newTestTradeService(t, exchange)
+	trade := newExitingTrade(service, "escalate", types.ExitExecutionState{
+		Mode:                types.ExitExecutionLimitIOC,
+		MaxSlippagePercent:  1,
+		MarketAfterAttempts: 2,
+	})
+	sellAvailable := false
+
+	done, err := service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	orders := exchange.postedOrders()
+	assert.Len(orders, 1)
+	assert.Equal(binanceapi.OrderTypeLimit, orders[0].Type)
+	assert.Equal(binanceapi.TimeInForceIOC, orders[0].TimeInForce)
+	assert.Equal(0.0099, orders[0].Price)
+	assert.Equal(1.0, orders[0].Quantity)
+	assert.Equal(orders[0].NewClientOrderId, trade.State.Exit.ClientOrderID)
+
+	// Only what the first sell didn't fill is sold by the next.
+	exchange.finishOrder(binanceapi.OrderStatusExpired, 0.4, 0.00396)
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	orders = exchange.postedOrders()
+	assert.Len(orders, 2)
+	assert.Equal(binanceapi.OrderTypeLimit, orders[1].Type)
+	assert.Equal(0.6, orders[1].Quantity)
+	assert.Equal("0.4", trade.State.Exit.SoldQuantity.String())
+
+	// The limit attempts are used up, what is left is market sold.
+	exchange.finishOrder(binanceapi.OrderStatusExpired, 0, 0)
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	orders = exchange.postedOrders()
+	assert.Len(orders, 3)
+	assert.Equal(binanceapi.OrderTypeMarket, orders[2].Type)
+	assert.Equal(0.6, orders[2].Quantity)
+	assert.Equal(3, trade.State.Exit.Attempts)
+	assert.Equal(2, trade.State.Exit.LimitAttempts)
+
+	// Everything is sold but the fills are not reported yet.
+	exchange.finishOrder(binanceapi.OrderStatusFilled, 0.6, 0.0057)
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	assert.Len(exchange.postedOrders(), 3)
+	assert.False(trade.State.Exit.Complete)
+
+	trade.State.SellFillQuantity = decimal.NewFromInt(1)
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.True(done)
+	assert.Len(exchange.postedOrders(), 3)
+	assert.Equal(types.TradeStatusDone, trade.State.Status)
+	assert.True(trade.State.Exit.Complete)
+	assert.Equal("0.00966", trade.State.Exit.AveragePrice.String())
+	assert.InDelta(3.4, trade.State.Exit.SlippagePercent, 0.0001)
+}
+
+func TestExitRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	service := newTestTradeService(t, exchange)
+	trade := newExitingTrade(service, "retry", types.ExitExecutionState{})
+	sellAvailable := false
+
+	// The response to the post is lost.
+	exchange.postErr = fmt.Errorf("timeout")
+	done, err := service.exitAttempt(trade, &sellAvailable)
+	assert.NotNil(err)
+	assert.False(done)
+	assert.Len(exchange.postedOrders(), 1)
+	assert.Equal("timeout", trade.State.Exit.LastError)
+	clientOrderId := trade.State.Exit.ClientOrderID
+	assert.NotEmpty(clientOrderId)
+	exchange.postErr = nil
+
+	// Nothing is posted while the order can't be looked up, or while it is
+	// still open.
+	exchange.orderErr = fmt.Errorf("timeout")
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.NotNil(err)
+	assert.False(done)
+	exchange.orderErr = nil
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	assert.Len(exchange.postedOrders(), 1)
+	assert.Equal(clientOrderId, trade.State.Exit.ClientOrderID)
+
+	// The order never made it to the exchange, post another.
+	exchange.orderErr = newBinanceError(binanceex.BinanceErrorCodeNoSuchOrder,
+		"Order does not exist.")
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	orders := exchange.postedOrders()
+	assert.Len(orders, 2)
+	assert.Equal(binanceapi.OrderTypeMarket, orders[1].Type)
+	assert.Equal(1.0, orders[1].Quantity)
+	assert.NotEqual(clientOrderId, orders[1].NewClientOrderId)
+	assert.Equal(2, trade.State.Exit.Attempts)
+	assert.Empty(trade.State.Exit.LastError)
+}
+
+func TestExitCancelFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	service := newTestTradeService(t, exchange)
+	trade := newExitingTrade(service, "cancel", types.ExitExecutionState{})
+	trade.State.Status = types.TradeStatusPendingSell
+	trade.State.SellOrderId = 5
+	trade.State.SellOrder.Status = binanceapi.OrderStatusNew
+	sellAvailable := false
+
+	// Nothing is sold while the limit sell is still open.
+	exchange.cancelErr = fmt.Errorf("unavailable")
+	done, err := service.exitAttempt(trade, &sellAvailable)
+	assert.NotNil(err)
+	assert.False(done)
+	assert.Equal([]int64{5}, exchange.canceledOrders())
+	assert.Empty(exchange.postedOrders())
+	assert.Equal("unavailable", trade.State.Exit.LastError)
+	assert.Equal(0, trade.State.Exit.Attempts)
+
+	// The cancel is tried again by the next attempt.
+	exchange.cancelErr = nil
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	assert.Equal([]int64{5, 5}, exchange.canceledOrders())
+	orders := exchange.postedOrders()
+	assert.Len(orders, 1)
+	assert.Equal(binanceapi.OrderTypeMarket, orders[0].Type)
+	assert.Equal(1, trade.State.Exit.Attempts)
+	assert.Empty(trade.State.Exit.LastError)
+}
+
+func TestExitSellsAvailableBalance(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	exchange.balances = []binanceapi.AccountBalance{
+		{Asset: "ETH", Free: 0.5},
+	}
+	service := newTestTradeService(t, exchange)
+	trade := newExitingTrade(service, "balance", types.ExitExecutionState{})
+	sellAvailable := false
+
+	exchange.postErr = newBinanceError(binanceex.BinanceErrorCodeNewOrderRejected,
+		"Account has insufficient balance for requested action.")
+	done, err := service.exitAttempt(trade, &sellAvailable)
+	assert.NotNil(err)
+	assert.False(done)
+	assert.True(sellAvailable)
+
+	exchange.postErr = nil
+	exchange.orderErr = newBinanceError(binanceex.BinanceErrorCodeNoSuchOrder,
+		"Order does not exist.")
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.False(done)
+	orders := exchange.postedOrders()
+	assert.Len(orders, 2)
+	assert.Equal(0.5, orders[1].Quantity)
+
+	// Selling all there was completes the exit.
+	exchange.orderErr = nil
+	exchange.finishOrder(binanceapi.OrderStatusFilled, 0.5, 0.005)
+	done, err = service.exitAttempt(trade, &sellAvailable)
+	assert.Nil(err)
+	assert.True(done)
+	assert.Len(exchange.postedOrders(), 2)
+	assert.True(trade.State.Exit.Complete)
+	assert.Equal("0.5", trade.State.Exit.SoldQuantity.String())
+}
+
+func TestExitBelowMinNotional(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	exchange.postErr = newBinanceError(binanceex.BinanceErrorCodeFilterFailure,
+		"Filter failure: MIN_NOTIONAL")
+	service := newTestTradeService(t, exchange)
+
+	// Nothing has been sold, the position is left open.
+	trade := newExitingTrade(service, "unsold", types.ExitExecutionState{})
+	sellAvailable := false
+	done, _ := service.exitAttempt(trade, &sellAvailable)
+	assert.True(done)
+	assert.Equal(types.TradeStatusExitFailed, trade.State.Status)
+
+	// What is left after a partial sell is dust.
+	trade = newExitingTrade(service, "dust", types.ExitExecutionState{})
+	trade.State.SellFillQuantity = decimal.RequireFromString("0.9")
+	done, _ = service.exitAttempt(trade, &sellAvailable)
+	assert.True(done)
+	assert.Equal(types.TradeStatusDone, trade.State.Status)
+	assert.True(trade.State.Exit.Complete)
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+)
+
+const (
+	// The slippage allowed below the best bid if not configured.
+	DefaultExitMaxSlippagePercent = 1.0
+
+	// The number of bids looked at to size an exit order to the book.
+	exitDepthLimit = 100
+)
+
+// DefaultExitExecution returns the configured exit execution, used by trades
+// that don't set their own.
+func DefaultExitExecution() types.ExitExecutionState {
+	return types.ExitExecutionState{
+		Mode:                types.ExitExecutionMode(config.GetString("exit.execution.mode")),
+		MaxSlippagePercent:  config.GetFloat64("exit.execution.maxSlippagePercent"),
+		MarketAfterAttempts: config.GetInt("exit.execution.marketAfterAttempts"),
+		DepthChunks:         config.GetBool("exit.execution.depthChunks"),
+	}
+}
+
+// exitExecution returns how an exit of the trade is to be executed.
+func (s *TradeService) exitExecution(trade *types.Trade) types.ExitExecutionState {
+	execution := trade.State.ExitExecution
+	if execution.Mode == "" {
+		execution = DefaultExitExecution()
+	}
+	if execution.Mode == "" {
+		execution.Mode = types.ExitExecutionMarket
+	}
+	if execution.MaxSlippagePercent <= 0 {
+		execution.MaxSlippagePercent = DefaultExitMaxSlippagePercent
+	}
+	return execution
+}
+
+func (s *TradeService) UpdateExitExecution(trade *types.Trade, execution types.ExitExecutionState) {
+	s.call(trade, func() error {
+		s.updateExitExecution(trade, execution)
+		return nil
+	})
+}
+
+// updateExitExecution sets how the exits of a trade are executed. An exit
+// already running carries on as it started.
+func (s *TradeService) updateExitExecution(trade *types.Trade, execution types.ExitExecutionState) {
+	s.recordSettings(trade, types.SettingsChangedEvent{
+		ExitExecution: &execution,
+	})
+	log.WithFields(log.Fields{
+		"symbol":              trade.State.Symbol,
+		"tradeId":             trade.State.TradeID,
+		"mode":                execution.Mode,
+		"maxSlippagePercent":  execution.MaxSlippagePercent,
+		"marketAfterAttempts": execution.MarketAfterAttempts,
+		"depthChunks":         execution.DepthChunks,
+	}).Infof("Exit execution updated")
+	trade.AddHistoryEntry(types.HistoryTypeExitExecutionUpdate, execution)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+// exitOrder builds the next order of an exit, selling no more than the
+// quantity. A limit IOC exit sells at the best bid less the maximum
+// slippage until it has used up its attempts, then falls back to market
+// sells. With depth chunks the quantity is cut down to what the bids within
+// the slippage can take.
+func (s *TradeService) exitOrder(trade *types.Trade, exit types.ExitState,
+	quantity decimal.Decimal) (binanceapi.OrderParameters, decimal.Decimal, error) {
+	symbol := trade.State.Symbol
+	execution := exit.Execution
+	order := binanceapi.OrderParameters{
+		Symbol: symbol,
+		Side:   binanceapi.OrderSideSell,
+		Type:   binanceapi.OrderTypeMarket,
+	}
+
+	limit := execution.Mode == types.ExitExecutionLimitIOC
+	if limit && execution.MarketAfterAttempts > 0 &&
+		exit.LimitAttempts >= execution.MarketAfterAttempts {
+		limit = false
+	}
+	if !limit && !execution.DepthChunks {
+		return order, quantity, nil
+	}
+
+	ticker, err := s.exchange.GetBookTicker(symbol)
+	if err != nil {
+		return order, quantity, err
+	}
+	bid, err := decimal.NewFromFloatChecked(ticker.BidPrice)
+	if err != nil {
+		return order, quantity, err
+	}
+	if !bid.IsPositive() {
+		return order, quantity, fmt.Errorf("no bid for %s", symbol)
+	}
+	price := bid.Mul(decimal.NewFromFloat(1 - execution.MaxSlippagePercent/100))
+
+	if execution.DepthChunks {
+		quantity, err = s.exitChunk(symbol, price, quantity)
+		if err != nil {
+			return order, quantity, err
+		}
+	}
+
+	if limit {
+		priceParameter, err := s.binanceExchangeInfo.PriceParameter(symbol, price)
+		if err != nil {
+			return order, quantity, err
+		}
+		order.Type = binanceapi.OrderTypeLimit
+		order.TimeInForce = binanceapi.TimeInForceIOC
+		order.Price = priceParameter
+	}
+
+	return order, quantity, nil
+}
+
+// exitChunk returns the part of the quantity the visible bids down to the
+// price can take, but no less than the minimum notional.
+func (s *TradeService) exitChunk(symbol string, price decimal.Decimal,
+	quantity decimal.Decimal) (decimal.Decimal, error) {
+	depth, err := s.exchange.GetDepth(symbol, exitDepthLimit)
+	if err != nil {
+		return quantity, err
+	}
+	visible := decimal.Zero
+	for _, bid := range depth.Bids {
+		if decimal.NewFromFloat(bid.Price).LessThan(price) {
+			break
+		}
+		visible = visible.Add(decimal.NewFromFloat(bid.Quantity))
+	}
+	if !visible.LessThan(quantity) {
+		return quantity, nil
+	}
+
+	stepSize, err := s.binanceExchangeInfo.GetStepSize(symbol)
+	if err != nil {
+		return quantity, err
+	}
+	minNotional, err := s.binanceExchangeInfo.GetMinNotional(symbol)
+	if err != nil {
+		return quantity, err
+	}
+	least := minNotional.Div(price).RoundDown(stepSize).Add(stepSize)
+	if visible.LessThan(least) {
+		visible = least
+	}
+	return decimal.Min(visible, quantity), nil
+}
+
+// completeExit records the average price of the exit and its slippage below
+// the trigger price.
+func (s *TradeService) completeExit(trade *types.Trade) {
+	exit := *trade.State.Exit
+	if exit.Complete {
+		return
+	}
+	exit.Complete = true
+	if exit.SoldQuantity.IsPositive() {
+		exit.AveragePrice = exit.SoldCost.Div(exit.SoldQuantity)
+		if exit.TriggerPrice.IsPositive() {
+			exit.SlippagePercent = exit.TriggerPrice.Sub(exit.AveragePrice).
+				Mul(decimal.NewFromInt(100)).Div(exit.TriggerPrice).Float64()
+		}
+	}
+	s.updateExit(trade, exit)
+
+	log.WithFields(log.Fields{
+		"tradeId":         trade.State.TradeID,
+		"symbol":          trade.State.Symbol,
+		"trigger":         exit.Trigger,
+		"triggerPrice":    exit.TriggerPrice,
+		"averagePrice":    exit.AveragePrice,
+		"slippagePercent": exit.SlippagePercent,
+		"attempts":        exit.Attempts,
+	}).Infof("Exit complete")
+	trade.AddHistoryEntry(types.HistoryTypeExitComplete, map[string]interface{}{
+		"trigger":         exit.Trigger,
+		"mode":            exit.Execution.Mode,
+		"triggerPrice":    exit.TriggerPrice,
+		"averagePrice":    exit.AveragePrice,
+		"quantity":        exit.SoldQuantity,
+		"slippagePercent": exit.SlippagePercent,
+		"attempts":        exit.Attempts,
+	})
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"math"
+	"time"
+)
+
+// How often the exit policies of open trades are checked.
+const exitPolicyCheckInterval = 10 * time.Second
+
+func (s *TradeService) UpdateExitPolicy(trade *types.Trade, policy types.ExitPolicyState) {
+	s.call(trade, func() error {
+		s.updateExitPolicy(trade, policy)
+		return nil
+	})
+}
+
+// updateExitPolicy replaces the exit policy settings of a trade. Decay
+// starts over from the current limit sell percent if not given.
+func (s *TradeService) updateExitPolicy(trade *types.Trade, policy types.ExitPolicyState) {
+	current := trade.State.ExitPolicy
+	policy.Decays = 0
+	policy.ReplacedOrderID = current.ReplacedOrderID
+	policy.ClientOrderID = current.ClientOrderID
+	if policy.DecayFromPercent == 0 {
+		policy.DecayFromPercent = trade.State.LimitSell.Percent
+	}
+	s.recordExitPolicy(trade, policy)
+	log.WithFields(log.Fields{
+		"symbol":          trade.State.Symbol,
+		"tradeId":         trade.State.TradeID,
+		"maxHoldHours":    policy.MaxHoldHours,
+		"sellAt":          policy.SellAt,
+		"decayPercent":    policy.DecayPercent,
+		"decayHours":      policy.DecayHours,
+		"decayAfterHours": policy.DecayAfterHours,
+	}).Infof("Exit policy updated")
+	trade.AddHistoryEntry(types.HistoryTypeExitPolicyUpdate, policy)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+func (s *TradeService) recordExitPolicy(trade *types.Trade, policy types.ExitPolicyState) {
+	s.applyEvent(trade, types.TradeEvent{
+		Type:              types.TradeEventExitPolicyUpdated,
+		ExitPolicyUpdated: &policy,
+	})
+}
+
+// exitPolicyUpdater periodically applies the exit policies of all open
+// trades.
+func (s *TradeService) exitPolicyUpdater() {
+	for {
+		time.Sleep(exitPolicyCheckInterval)
+		s.checkExitPolicies(time.Now())
+	}
+}
+
+func (s *TradeService) checkExitPolicies(now time.Time) {
+	s.lock.Lock()
+	workers := []*tradeWorker{}
+	for _, worker := range s.workers {
+		workers = append(workers, worker)
+	}
+	s.lock.Unlock()
+
+	for _, worker := range workers {
+		trade := worker.trade
+		worker.post(func() {
+			s.checkExitPolicy(trade, now)
+		})
+	}
+}
+
+func (s *TradeService) checkExitPolicy(trade *types.Trade, now time.Time) {
+	policy := trade.State.ExitPolicy
+	if !policy.Enabled() || trade.IsDone() || trade.State.Exit != nil {
+		return
+	}
+	switch trade.State.Status {
+	case types.TradeStatusWatching:
+	case types.TradeStatusPendingSell:
+	default:
+		return
+	}
+
+	held := now.Sub(trade.State.OpenTime)
+	if policy.MaxHoldHours > 0 && held >= hours(policy.MaxHoldHours) {
+		s.policyExit(trade, types.TriggerMaxHold)
+		return
+	}
+	for _, sellAt := range policy.SellAt {
+		if !now.Before(sellAt) {
+			s.policyExit(trade, types.TriggerSellAt)
+			return
+		}
+	}
+
+	if policy.DecayPercent > 0 && policy.DecayHours > 0 {
+		s.checkDecay(trade, held)
+	}
+}
+
+// policyExit market sells the trade for a time based exit.
+func (s *TradeService) policyExit(trade *types.Trade, trigger types.TriggerType) {
+	log.WithFields(log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+		"trigger": trigger,
+	}).Infof("Exit policy: Triggering market sell.")
+	s.recordTrigger(trade, trigger, trade.State.LastPrice)
+	s.startExit(trade, trigger, trade.State.LastPrice)
+}
+
+// checkDecay lowers the limit sell to the percent the decay has reached.
+func (s *TradeService) checkDecay(trade *types.Trade, held time.Duration) {
+	policy := trade.State.ExitPolicy
+	limitSell := trade.State.LimitSell
+	if !limitSell.Enabled || limitSell.Type != types.LimitSellTypePercent {
+		return
+	}
+	elapsed := held - hours(policy.DecayAfterHours)
+	if elapsed < hours(policy.DecayHours) {
+		return
+	}
+	steps := int(elapsed / hours(policy.DecayHours))
+	percent := math.Max(policy.DecayFromPercent-float64(steps)*policy.DecayPercent, 0)
+	if percent >= limitSell.Percent {
+		return
+	}
+	if err := s.repriceLimitSell(trade, percent); err != nil {
+		return
+	}
+	policy = trade.State.ExitPolicy
+	policy.Decays = steps
+	s.recordExitPolicy(trade, policy)
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+}
+
+// repriceLimitSell replaces the limit sell with one at the percent. An
+// outstanding sell is canceled first and recorded as replaced so its cancel
+// report doesn't return the trade to watching. If the new sell can't be
+// posted the cancel report will, and the next check tries again.
+func (s *TradeService) repriceLimitSell(trade *types.Trade, percent float64) error {
+	logFields := log.Fields{
+		"tradeId":     trade.State.TradeID,
+		"symbol":      trade.State.Symbol,
+		"sellOrderId": trade.State.SellOrderId,
+		"fromPercent": trade.State.LimitSell.Percent,
+		"toPercent":   percent,
+	}
+	history := map[string]interface{}{
+		"sellOrderId": trade.State.SellOrderId,
+		"fromPercent": trade.State.LimitSell.Percent,
+		"fromPrice":   trade.State.LimitSell.Price,
+		"toPercent":   percent,
+	}
+	failed := func(err error) error {
+		log.WithError(err).WithFields(logFields).Errorf("Failed to reprice limit sell")
+		history["success"] = false
+		history["error"] = err.Error()
+		trade.AddHistoryEntry(types.HistoryTypeSellRepriced, history)
+		db.DbUpdateTrade(trade)
+		s.broadcastTradeUpdate(trade)
+		return err
+	}
+
+	clientOrderId, err := s.MakeOrderID()
+	if err != nil {
+		return failed(err)
+	}
+
+	previous := trade.State.ExitPolicy
+	if trade.State.Status == types.TradeStatusPendingSell {
+		if trade.State.SellOrder.Type != string(binanceapi.OrderTypeLimit) {
+			// Not ours to reprice.
+			return nil
+		}
+		_, err := s.exchange.CancelOrderById(trade.State.Symbol, trade.State.SellOrderId)
+		if err != nil {
+			// Most likely filled in the meantime.
+			return failed(err)
+		}
+		policy := previous
+		policy.ReplacedOrderID = trade.State.SellOrderId
+		policy.ClientOrderID = clientOrderId
+		s.recordExitPolicy(trade, policy)
+	}
+
+	if err := s.limitSellByPercentWithID(trade, percent, clientOrderId); err != nil {
+		s.recordExitPolicy(trade, previous)
+		return failed(err)
+	}
+
+	log.WithFields(logFields).Infof("Repriced limit sell")
+	history["success"] = true
+	history["toPrice"] = trade.State.LimitSell.Price
+	history["clientOrderId"] = clientOrderId
+	trade.AddHistoryEntry(types.HistoryTypeSellRepriced, history)
+	return nil
+}
+
+func hours(n float64) time.Duration {
+	return time.Duration(n * float64(time.Hour))
+}
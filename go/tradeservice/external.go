@@ -0,0 +1,217 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"time"
+)
+
+// The number of execution reports for orders not placed by Maker to keep.
+const externalReportsMax = 100
+
+// ExternalReport is an execution report received for an order that does
+// not belong to any trade, such as one placed from the Binance app.
+type ExternalReport struct {
+	Timestamp        time.Time
+	Symbol           string
+	Side             binanceapi.OrderSide
+	OrderID          int64
+	ClientOrderID    string
+	OrderType        string
+	OrderStatus      binanceapi.OrderStatus
+	Price            decimal.Decimal
+	Quantity         decimal.Decimal
+	LastPrice        decimal.Decimal
+	LastQuantity     decimal.Decimal
+	CommissionAsset  string
+	CommissionAmount decimal.Decimal
+}
+
+func (s *TradeService) recordExternalReport(timestamp time.Time,
+	report binanceapi.StreamExecutionReport) {
+	s.externalLock.Lock()
+	defer s.externalLock.Unlock()
+	s.externalReports = append(s.externalReports, ExternalReport{
+		Timestamp:        timestamp,
+		Symbol:           report.Symbol,
+		Side:             report.Side,
+		OrderID:          report.OrderID,
+		ClientOrderID:    report.ClientOrderID,
+		OrderType:        report.OrderType,
+		OrderStatus:      report.CurrentOrderStatus,
+		Price:            decimal.NewFromFloat(report.Price),
+		Quantity:         decimal.NewFromFloat(report.Quantity),
+		LastPrice:        decimal.NewFromFloat(report.LastExecutedPrice),
+		LastQuantity:     decimal.NewFromFloat(report.LastExecutedQuantity),
+		CommissionAsset:  report.CommissionAsset,
+		CommissionAmount: decimal.NewFromFloat(report.CommissionAmount),
+	})
+	if len(s.externalReports) > externalReportsMax {
+		s.externalReports = s.externalReports[len(s.externalReports)-externalReportsMax:]
+	}
+}
+
+// ExternalReports returns the recent execution reports for orders that no
+// trade owns, oldest first.
+func (s *TradeService) ExternalReports() []ExternalReport {
+	s.externalLock.Lock()
+	defer s.externalLock.Unlock()
+	reports := make([]ExternalReport, len(s.externalReports))
+	copy(reports, s.externalReports)
+	return reports
+}
+
+func (s *TradeService) forgetExternalOrder(orderId int64) {
+	s.externalLock.Lock()
+	defer s.externalLock.Unlock()
+	reports := s.externalReports[:0]
+	for _, report := range s.externalReports {
+		if report.OrderID != orderId {
+			reports = append(reports, report)
+		}
+	}
+	s.externalReports = reports
+}
+
+// IsManagedOrder returns true if the client order ID belongs to a trade.
+func (s *TradeService) IsManagedOrder(clientOrderId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.TradesByClientID[clientOrderId]
+	return ok
+}
+
+// ManagedQuantities returns the quantity of each asset held by open trades.
+func (s *TradeService) ManagedQuantities() map[string]decimal.Decimal {
+	quantities := make(map[string]decimal.Decimal)
+	for _, trade := range s.GetAllTrades() {
+		if trade.IsDone() {
+			continue
+		}
+		symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+		if err != nil {
+			continue
+		}
+		held := trade.State.BuyFillQuantity.Sub(trade.State.SellFillQuantity)
+		if held.IsPositive() {
+			quantities[symbolInfo.BaseAsset] =
+				quantities[symbolInfo.BaseAsset].Add(held)
+		}
+	}
+	return quantities
+}
+
+// AdoptOrder creates a PENDING_BUY trade for an open buy order that was not
+// placed by Maker. Fills already made on the order are added to the trade.
+// The trade must have its stop loss, trailing profit and limit sell
+// settings applied, and must not be modified after being adopted.
+func (s *TradeService) AdoptOrder(trade *types.Trade, order binanceapi.OrderResponse,
+	fills []types.OrderFill) error {
+	if binanceapi.OrderSide(order.Side) != binanceapi.OrderSideBuy {
+		return fmt.Errorf("only buy orders can be adopted")
+	}
+	switch order.Status {
+	case binanceapi.OrderStatusNew, binanceapi.OrderStatusPartiallyFilled:
+	default:
+		return fmt.Errorf("order is not open: %s", order.Status)
+	}
+	if s.IsManagedOrder(order.ClientOrderId) {
+		return fmt.Errorf("order already belongs to a trade")
+	}
+
+	trade.State.Symbol = order.Symbol
+	trade.AddClientOrderID(order.ClientOrderId)
+	s.AddNewTrade(trade)
+	s.forgetExternalOrder(order.OrderId)
+
+	return s.call(trade, func() error {
+		s.applyEvent(trade, types.TradeEvent{
+			Timestamp: time.Unix(0, order.TimeMillis*int64(time.Millisecond)),
+			Type:      types.TradeEventOrderUpdate,
+			OrderUpdate: &types.OrderUpdateEvent{
+				Side:     binanceapi.OrderSideBuy,
+				OrderID:  order.OrderId,
+				Type:     order.Type,
+				Price:    decimal.NewFromFloat(order.Price),
+				Quantity: decimal.NewFromFloat(order.OrigQty),
+				Status:   order.Status,
+			},
+		})
+		s.changeStatus(trade, types.TradeStatusPendingBuy, time.Now())
+		for _, fill := range fills {
+			s.addFill(trade, binanceapi.OrderSideBuy, fill)
+		}
+		trade.AddHistoryEntry(types.HistoryTypeAdopted, map[string]interface{}{
+			"orderId":       order.OrderId,
+			"clientOrderId": order.ClientOrderId,
+		})
+		log.WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"symbol":  trade.State.Symbol,
+			"orderId": order.OrderId,
+		}).Infof("Adopted open buy order")
+		db.DbUpdateTrade(trade)
+		s.broadcastTradeUpdate(trade)
+		return nil
+	})
+}
+
+// AdoptBalance creates a WATCHING trade for a quantity of the symbol's base
+// asset already held, bought at the given price. The trade must have its
+// symbol and settings applied, and must not be modified after being adopted.
+func (s *TradeService) AdoptBalance(trade *types.Trade, quantity decimal.Decimal,
+	price decimal.Decimal) error {
+	symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+	if err != nil {
+		return err
+	}
+	if !quantity.IsPositive() || !price.IsPositive() {
+		return fmt.Errorf("quantity and price must be greater than 0")
+	}
+
+	s.AddNewTrade(trade)
+
+	return s.call(trade, func() error {
+		// No commission is known for the buy, recording it against the
+		// base asset rounds the sellable quantity to the step size.
+		s.addFill(trade, binanceapi.OrderSideBuy, types.OrderFill{
+			Price:           price,
+			Quantity:        quantity,
+			CommissionAsset: symbolInfo.BaseAsset,
+		})
+		s.changeStatus(trade, types.TradeStatusWatching, time.Now())
+		trade.AddHistoryEntry(types.HistoryTypeAdopted, map[string]interface{}{
+			"quantity": quantity,
+			"price":    price,
+		})
+		log.WithFields(log.Fields{
+			"tradeId":  trade.State.TradeID,
+			"symbol":   trade.State.Symbol,
+			"quantity": quantity,
+			"price":    price,
+		}).Infof("Adopted balance")
+		s.triggerLimitSell(trade)
+		db.DbUpdateTrade(trade)
+		s.broadcastTradeUpdate(trade)
+		return nil
+	})
+}
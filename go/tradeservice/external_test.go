@@ -0,0 +1,115 @@
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+	"time"
+)
+
+func TestExternalReports(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestTradeService(t, newFakeExchange(0))
+	for i := 0; i < externalReportsMax+10; i++ {
+		service.recordExternalReport(time.Now(), binanceapi.StreamExecutionReport{
+			Symbol:             "ETHBTC",
+			Side:               binanceapi.OrderSideBuy,
+			OrderID:            int64(i),
+			CurrentOrderStatus: binanceapi.OrderStatusNew,
+			Price:              0.01,
+			Quantity:           1,
+		})
+	}
+
+	// Only the most recent are kept.
+	reports := service.ExternalReports()
+	assert.Len(reports, externalReportsMax)
+	assert.Equal(int64(10), reports[0].OrderID)
+	assert.Equal(int64(externalReportsMax+9), reports[len(reports)-1].OrderID)
+	assert.Equal("0.01", reports[0].Price.String())
+
+	// A copy is returned.
+	reports[0].OrderID = -1
+	assert.Equal(int64(10), service.ExternalReports()[0].OrderID)
+
+	service.forgetExternalOrder(10)
+	reports = service.ExternalReports()
+	assert.Len(reports, externalReportsMax-1)
+	assert.Equal(int64(11), reports[0].OrderID)
+}
+
+func TestAdoptOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestTradeService(t, newFakeExchange(0))
+	order := binanceapi.OrderResponse{
+		Symbol:        "ETHBTC",
+		OrderId:       7,
+		ClientOrderId: "app",
+		Price:         0.01,
+		OrigQty:       2,
+		ExecutedQty:   1,
+		Status:        binanceapi.OrderStatusPartiallyFilled,
+		Type:          "LIMIT",
+		Side:          string(binanceapi.OrderSideBuy),
+		TimeMillis:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	service.recordExternalReport(time.Now(), binanceapi.StreamExecutionReport{
+		Symbol:  "ETHBTC",
+		OrderID: 7,
+	})
+
+	sell := order
+	sell.Side = string(binanceapi.OrderSideSell)
+	assert.NotNil(service.AdoptOrder(types.NewTrade(), sell, nil))
+	filled := order
+	filled.Status = binanceapi.OrderStatusFilled
+	assert.NotNil(service.AdoptOrder(types.NewTrade(), filled, nil))
+
+	trade := types.NewTrade()
+	assert.Nil(service.AdoptOrder(trade, order, []types.OrderFill{{
+		Price:           decimal.RequireFromString("0.01"),
+		Quantity:        decimal.NewFromInt(1),
+		CommissionAsset: "BTC",
+		OrderID:         7,
+		TradeID:         1,
+	}}))
+	state := service.Snapshot(trade)
+	assert.Equal(types.TradeStatusPendingBuy, state.Status)
+	assert.Equal("ETHBTC", state.Symbol)
+	assert.Equal(int64(7), state.BuyOrderId)
+	assert.Equal("2", state.BuyOrder.Quantity.String())
+	assert.Equal("1", state.BuyFillQuantity.String())
+	assert.True(service.IsManagedOrder("app"))
+	assert.Empty(service.ExternalReports())
+
+	// The order can only be adopted once.
+	assert.NotNil(service.AdoptOrder(types.NewTrade(), order, nil))
+}
+
+func TestAdoptBalance(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestTradeService(t, newFakeExchange(0))
+	price := decimal.RequireFromString("0.01")
+
+	trade := types.NewTrade()
+	trade.State.Symbol = "ETHBTC"
+	assert.NotNil(service.AdoptBalance(trade, decimal.Zero, price))
+	unknown := types.NewTrade()
+	unknown.State.Symbol = "XYZBTC"
+	assert.NotNil(service.AdoptBalance(unknown, decimal.NewFromInt(1), price))
+
+	assert.Nil(service.AdoptBalance(trade, decimal.RequireFromString("1.5"), price))
+	state := service.Snapshot(trade)
+	assert.Equal(types.TradeStatusWatching, state.Status)
+	assert.Equal("1.5", state.BuyFillQuantity.String())
+	assert.Equal("0.015", state.BuyCost.String())
+
+	quantities := service.ManagedQuantities()
+	assert.Len(quantities, 1)
+	assert.Equal("1.5", quantities["ETH"].String())
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"time"
+)
+
+const (
+	commissionRatesRefreshInterval = 1 * time.Hour
+	commissionRatesRetryInterval   = 1 * time.Minute
+
+	// How long a streamed price can be used for converting commissions
+	// before it is looked up again.
+	priceCacheMaxAge = 1 * time.Minute
+)
+
+// Binance discounts commissions paid in BNB by 25%.
+var bnbFeeDiscount = decimal.RequireFromString("0.75")
+
+// Account commission rates are given in units of 0.01%.
+var commissionRateUnit = decimal.RequireFromString("0.0001")
+
+type commissionRates struct {
+	maker decimal.Decimal
+	taker decimal.Decimal
+}
+
+type cachedPrice struct {
+	price     decimal.Decimal
+	timestamp time.Time
+}
+
+// commissionRatesUpdater keeps the account's maker and taker commission
+// rates up to date.
+func (s *TradeService) commissionRatesUpdater() {
+	for {
+		interval := commissionRatesRefreshInterval
+		if err := s.updateCommissionRates(); err != nil {
+			log.WithError(err).Warnf("Failed to get account commission rates")
+			interval = commissionRatesRetryInterval
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *TradeService) updateCommissionRates() error {
+	account, err := s.exchange.GetAccount()
+	if err != nil {
+		return err
+	}
+	rates := &commissionRates{
+		maker: decimal.NewFromInt(account.MakerCommission).Mul(commissionRateUnit),
+		taker: decimal.NewFromInt(account.TakerCommission).Mul(commissionRateUnit),
+	}
+	s.feeLock.Lock()
+	s.commissionRates = rates
+	s.feeLock.Unlock()
+	log.WithFields(log.Fields{
+		"maker": rates.maker,
+		"taker": rates.taker,
+	}).Infof("Updated account commission rates")
+	return nil
+}
+
+// projectedFee returns the commission rate expected for selling the trade,
+// using the account's maker rate for limit orders and taker rate for market
+// orders. Falls back to the rate paid on the buy if the account rates are
+// not known.
+func (s *TradeService) projectedFee(trade *types.Trade, maker bool) decimal.Decimal {
+	s.feeLock.Lock()
+	rates := s.commissionRates
+	s.feeLock.Unlock()
+
+	if rates == nil {
+		if trade.State.Fee.IsPositive() {
+			return trade.State.Fee
+		}
+		return types.DEFAULT_FEE
+	}
+
+	fee := rates.taker
+	if maker {
+		fee = rates.maker
+	}
+	if trade.FeeAsset() == "BNB" {
+		fee = fee.Mul(bnbFeeDiscount)
+	}
+	return fee
+}
+
+// CommissionRate returns the account's maker or taker commission rate, or
+// the default fee if the account rates are not known yet.
+func (s *TradeService) CommissionRate(maker bool) decimal.Decimal {
+	s.feeLock.Lock()
+	rates := s.commissionRates
+	s.feeLock.Unlock()
+
+	if rates == nil {
+		return types.DEFAULT_FEE
+	}
+	if maker {
+		return rates.maker
+	}
+	return rates.taker
+}
+
+func (s *TradeService) cachePrice(symbol string, price decimal.Decimal) {
+	s.feeLock.Lock()
+	s.prices[symbol] = cachedPrice{
+		price:     price,
+		timestamp: time.Now(),
+	}
+	s.feeLock.Unlock()
+}
+
+// bnbPrice returns the price of BNB in the quote asset, from the streamed
+// prices if recent enough, otherwise from the exchange.
+func (s *TradeService) bnbPrice(quoteAsset string) (decimal.Decimal, error) {
+	if quoteAsset == "BNB" {
+		return decimal.NewFromInt(1), nil
+	}
+	symbol := "BNB" + quoteAsset
+
+	s.feeLock.Lock()
+	cached, ok := s.prices[symbol]
+	s.feeLock.Unlock()
+	if ok && time.Since(cached.timestamp) < priceCacheMaxAge {
+		return cached.price, nil
+	}
+
+	ticker, err := s.exchange.GetPriceTicker(symbol)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	price, err := decimal.NewFromFloatChecked(ticker.Price)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	s.cachePrice(symbol, price)
+	return price, nil
+}
+
+// convertCommission sets the quote asset and BNB value of the commission
+// paid on a fill of the trade.
+func (s *TradeService) convertCommission(trade *types.Trade, fill *types.OrderFill) {
+	if fill.CommissionAmount.IsZero() {
+		return
+	}
+
+	logFields := log.Fields{
+		"tradeId":         trade.State.TradeID,
+		"symbol":          trade.State.Symbol,
+		"commissionAsset": fill.CommissionAsset,
+	}
+
+	symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).
+			Errorf("Failed to get symbol info to convert commission")
+		return
+	}
+
+	bnbPrice, err := s.bnbPrice(symbolInfo.QuoteAsset)
+	if err != nil {
+		log.WithError(err).WithFields(logFields).
+			Warnf("Failed to get BNB price to convert commission")
+	}
+
+	switch fill.CommissionAsset {
+	case symbolInfo.QuoteAsset:
+		fill.CommissionQuote = fill.CommissionAmount
+	case symbolInfo.BaseAsset:
+		fill.CommissionQuote = fill.CommissionAmount.Mul(fill.Price)
+	case "BNB":
+		if bnbPrice.IsPositive() {
+			fill.CommissionQuote = fill.CommissionAmount.Mul(bnbPrice)
+		}
+	default:
+		log.WithFields(logFields).Warnf("Don't know how to convert commission")
+	}
+
+	if fill.CommissionAsset == "BNB" {
+		fill.CommissionBNB = fill.CommissionAmount
+	} else if bnbPrice.IsPositive() {
+		fill.CommissionBNB = fill.CommissionQuote.Div(bnbPrice)
+	}
+}
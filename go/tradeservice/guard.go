@@ -0,0 +1,452 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The prices of guard rule symbols are kept as the high of each interval.
+const guardPriceInterval = 1 * time.Second
+
+// The config key of the kill switch, set by a panic to block new buys until
+// re-armed.
+const KillSwitchConfigKey = "guard.killSwitch"
+
+type guardPrice struct {
+	time  time.Time
+	price decimal.Decimal
+}
+
+// GuardResult is what a guard action did to a trade.
+type GuardResult struct {
+	TradeID string `json:"tradeId"`
+	Symbol  string `json:"symbol"`
+	Action  string `json:"action"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	GuardResultCancelBuy   = "CANCEL_BUY"
+	GuardResultMarketSell  = "MARKET_SELL"
+	GuardResultTightenStop = "TIGHTEN_STOP"
+
+	// The buy was canceled and what it filled is market sold.
+	GuardResultCancelBuyAndSell = "CANCEL_BUY_AND_SELL"
+)
+
+// LoadGuardRules loads the guard rules from the database and starts
+// following the prices of their symbols.
+func (s *TradeService) LoadGuardRules() error {
+	rules, err := db.DbGetGuardRules()
+	if err != nil {
+		return err
+	}
+	s.guardLock.Lock()
+	defer s.guardLock.Unlock()
+	for i := range rules {
+		rule := rules[i]
+		s.guardRules[rule.ID] = &rule
+		if rule.Enabled {
+			s.tradeStreamManager.AddSymbol(rule.Symbol)
+		}
+	}
+	log.Infof("Loaded %d guard rules.", len(rules))
+	return nil
+}
+
+// GuardRules returns a copy of the guard rules.
+func (s *TradeService) GuardRules() []types.GuardRule {
+	s.guardLock.Lock()
+	defer s.guardLock.Unlock()
+	rules := []types.GuardRule{}
+	for _, rule := range s.guardRules {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+	return rules
+}
+
+// SaveGuardRule adds a rule, or replaces the settings of the rule with the
+// same ID. Whether an existing rule has fired is kept.
+func (s *TradeService) SaveGuardRule(rule types.GuardRule) (types.GuardRule, error) {
+	s.guardLock.Lock()
+	defer s.guardLock.Unlock()
+
+	if rule.ID == "" {
+		id, err := s.idGenerator.GetID(nil)
+		if err != nil {
+			return rule, err
+		}
+		rule.ID = id.String()
+		rule.Fired = false
+		rule.FiredTime = nil
+		rule.FiredPrice = decimal.Zero
+	} else {
+		existing, ok := s.guardRules[rule.ID]
+		if !ok {
+			return rule, fmt.Errorf("guard rule %s not found", rule.ID)
+		}
+		rule.Fired = existing.Fired
+		rule.FiredTime = existing.FiredTime
+		rule.FiredPrice = existing.FiredPrice
+	}
+
+	if err := db.DbSaveGuardRule(&rule); err != nil {
+		return rule, err
+	}
+	if existing, ok := s.guardRules[rule.ID]; ok && existing.Enabled {
+		s.tradeStreamManager.RemoveSymbol(existing.Symbol)
+	}
+	if rule.Enabled {
+		s.tradeStreamManager.AddSymbol(rule.Symbol)
+	}
+	s.guardRules[rule.ID] = &rule
+
+	log.WithFields(log.Fields{
+		"ruleId":        rule.ID,
+		"symbol":        rule.Symbol,
+		"enabled":       rule.Enabled,
+		"dropPercent":   rule.DropPercent,
+		"windowMinutes": rule.WindowMinutes,
+		"action":        rule.Action,
+	}).Infof("Guard rule saved")
+	return rule, nil
+}
+
+func (s *TradeService) DeleteGuardRule(id string) error {
+	s.guardLock.Lock()
+	defer s.guardLock.Unlock()
+	rule, ok := s.guardRules[id]
+	if !ok {
+		return fmt.Errorf("guard rule %s not found", id)
+	}
+	if err := db.DbDeleteGuardRule(id); err != nil {
+		return err
+	}
+	if rule.Enabled {
+		s.tradeStreamManager.RemoveSymbol(rule.Symbol)
+	}
+	delete(s.guardRules, id)
+	return nil
+}
+
+// RearmGuard re-arms a fired rule, or every rule if the ID is empty. The
+// price history of the rule's symbol is dropped so a drop that already fired
+// the rule doesn't fire it again.
+func (s *TradeService) RearmGuard(id string) error {
+	s.guardLock.Lock()
+	defer s.guardLock.Unlock()
+	if id != "" {
+		if _, ok := s.guardRules[id]; !ok {
+			return fmt.Errorf("guard rule %s not found", id)
+		}
+	}
+	for _, rule := range s.guardRules {
+		if (id != "" && rule.ID != id) || !rule.Fired {
+			continue
+		}
+		rearmed := *rule
+		rearmed.Fired = false
+		rearmed.FiredTime = nil
+		rearmed.FiredPrice = decimal.Zero
+		if err := db.DbSaveGuardRule(&rearmed); err != nil {
+			return err
+		}
+		*rule = rearmed
+		delete(s.guardPrices, rule.Symbol)
+		log.WithFields(log.Fields{
+			"ruleId": rule.ID,
+			"symbol": rule.Symbol,
+		}).Infof("Guard rule re-armed")
+	}
+	return nil
+}
+
+// EntriesBlocked returns why new buys are blocked, or an empty string if
+// they are allowed.
+func (s *TradeService) EntriesBlocked() string {
+	if config.GetBool(KillSwitchConfigKey) {
+		return "the kill switch is on"
+	}
+	s.guardLock.Lock()
+	defer s.guardLock.Unlock()
+	for _, rule := range s.guardRules {
+		if rule.Fired {
+			name := rule.Name
+			if name == "" {
+				name = rule.ID
+			}
+			return fmt.Sprintf("guard rule %s fired", name)
+		}
+	}
+	return ""
+}
+
+// checkGuards records the price of a symbol and fires the rules that watch
+// it if it has dropped too far within their window.
+func (s *TradeService) checkGuards(symbol string, price decimal.Decimal, now time.Time) {
+	s.guardLock.Lock()
+	rules := []*types.GuardRule{}
+	window := time.Duration(0)
+	for _, rule := range s.guardRules {
+		if rule.Enabled && rule.Symbol == symbol {
+			rules = append(rules, rule)
+			ruleWindow := time.Duration(rule.WindowMinutes * float64(time.Minute))
+			if ruleWindow > window {
+				window = ruleWindow
+			}
+		}
+	}
+	if len(rules) == 0 {
+		s.guardLock.Unlock()
+		return
+	}
+
+	prices := s.guardPrices[symbol]
+	if last := len(prices) - 1; last >= 0 && now.Sub(prices[last].time) < guardPriceInterval {
+		prices[last].price = decimal.Max(prices[last].price, price)
+	} else {
+		prices = append(prices, guardPrice{time: now, price: price})
+	}
+	for len(prices) > 0 && now.Sub(prices[0].time) > window {
+		prices = prices[1:]
+	}
+	s.guardPrices[symbol] = prices
+
+	fired := []types.GuardRule{}
+	for _, rule := range rules {
+		if rule.Fired {
+			continue
+		}
+		since := now.Add(-time.Duration(rule.WindowMinutes * float64(time.Minute)))
+		high := decimal.Zero
+		for i := len(prices) - 1; i >= 0 && !prices[i].time.Before(since); i-- {
+			high = decimal.Max(high, prices[i].price)
+		}
+		if !high.IsPositive() {
+			continue
+		}
+		drop := high.Sub(price).Mul(decimal.NewFromInt(100)).Div(high).Float64()
+		if drop >= rule.DropPercent {
+			rule.Fired = true
+			rule.FiredTime = &now
+			rule.FiredPrice = price
+			fired = append(fired, *rule)
+			log.WithFields(log.Fields{
+				"ruleId":      rule.ID,
+				"symbol":      symbol,
+				"high":        high,
+				"price":       price,
+				"dropPercent": drop,
+				"action":      rule.Action,
+			}).Warnf("Guard rule fired")
+		}
+	}
+	s.guardLock.Unlock()
+
+	for _, rule := range fired {
+		// Acting on the trades talks to the exchange, don't hold up the
+		// price stream.
+		go s.fireGuardRule(rule)
+	}
+}
+
+// fireGuardRule records that the rule fired and carries out its action.
+func (s *TradeService) fireGuardRule(rule types.GuardRule) {
+	if err := db.DbSaveGuardRule(&rule); err != nil {
+		log.WithError(err).WithField("ruleId", rule.ID).
+			Errorf("Failed to save fired guard rule")
+	}
+
+	results := s.guardAction(rule.Action, rule.QuoteAsset, rule.StopLossPercent)
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+
+	name := rule.Name
+	if name == "" {
+		name = rule.ID
+	}
+	s.notifyGuard(fmt.Sprintf(
+		"Guard rule %s fired: %s dropped %.2f%% within %v minutes, %s on %d trades (%d failed). New buys are blocked until re-armed.",
+		name, rule.Symbol, rule.DropPercent, rule.WindowMinutes, rule.Action,
+		len(results), failed), map[string]interface{}{
+		"ruleId":  rule.ID,
+		"symbol":  rule.Symbol,
+		"price":   rule.FiredPrice,
+		"results": results,
+	})
+}
+
+// Panic cancels every pending buy and market sells every open trade.
+func (s *TradeService) Panic() []GuardResult {
+	log.Warnf("Panic, cancelling all buys and selling all trades")
+	results := s.guardAction(types.GuardActionSellAll, "", 0)
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	s.notifyGuard(fmt.Sprintf(
+		"Panic: acted on %d trades (%d failed). New buys are blocked until re-armed.",
+		len(results), failed), map[string]interface{}{
+		"results": results,
+	})
+	return results
+}
+
+func (s *TradeService) notifyGuard(message string, data map[string]interface{}) {
+	if s.notificationService == nil {
+		return
+	}
+	notice := clientnotificationservice.NewNotice(clientnotificationservice.LevelCritical,
+		message).WithData(data).WithAlert()
+	go s.notificationService.Broadcast(notice)
+}
+
+// guardAction carries out the action on every open trade, or the trades in
+// the quote asset if set. The trades are acted on at the same time.
+func (s *TradeService) guardAction(action types.GuardAction, quoteAsset string,
+	stopLossPercent float64) []GuardResult {
+	s.lock.Lock()
+	trades := []*types.Trade{}
+	for _, trade := range s.TradesByLocalID {
+		trades = append(trades, trade)
+	}
+	s.lock.Unlock()
+
+	results := []GuardResult{}
+	resultsLock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, trade := range trades {
+		if quoteAsset != "" {
+			symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+			if err != nil || symbolInfo.QuoteAsset != quoteAsset {
+				continue
+			}
+		}
+		wg.Add(1)
+		go func(trade *types.Trade) {
+			defer wg.Done()
+			var result *GuardResult
+			s.call(trade, func() error {
+				result = s.guardTrade(trade, action, stopLossPercent)
+				return nil
+			})
+			if result != nil {
+				resultsLock.Lock()
+				results = append(results, *result)
+				resultsLock.Unlock()
+			}
+		}(trade)
+	}
+	wg.Wait()
+	return results
+}
+
+// guardTrade carries out a guard action on a trade, returning nil if it
+// doesn't apply to the trade.
+func (s *TradeService) guardTrade(trade *types.Trade, action types.GuardAction,
+	stopLossPercent float64) *GuardResult {
+	if trade.IsDone() {
+		return nil
+	}
+	result := &GuardResult{
+		TradeID: trade.State.TradeID,
+		Symbol:  trade.State.Symbol,
+	}
+	var err error
+
+	switch trade.State.Status {
+	case types.TradeStatusNew, types.TradeStatusPendingBuy:
+		if action != types.GuardActionCancelBuys && action != types.GuardActionSellAll {
+			return nil
+		}
+		result.Action = GuardResultCancelBuy
+		if trade.State.Algo.Active() && trade.State.Algo.Side == binanceapi.OrderSideBuy {
+			s.cancelAlgo(trade, AlgoReasonCanceled)
+		} else {
+			err = s.cancelBuy(trade)
+		}
+		if err == nil && action == types.GuardActionSellAll &&
+			trade.State.BuyFillQuantity.IsPositive() {
+			// The exit sells what was bought, and what is reported
+			// filled before the cancel is.
+			result.Action = GuardResultCancelBuyAndSell
+			err = s.marketSellExit(trade)
+		}
+	case types.TradeStatusWatching, types.TradeStatusPendingSell, types.TradeStatusExitFailed:
+		switch action {
+		case types.GuardActionSellAll:
+			if trade.State.Exit != nil && !trade.State.Exit.Complete &&
+				trade.State.Status != types.TradeStatusExitFailed {
+				// Already being sold.
+				return nil
+			}
+			result.Action = GuardResultMarketSell
+			if trade.State.Algo.Active() {
+				// The exit takes over from the algo, selling once its
+				// last child order is finished.
+				err = s.marketSellExit(trade)
+			} else {
+				err = s.marketSell(trade)
+			}
+		case types.GuardActionTightenStops:
+			stopLoss := trade.State.StopLoss
+			if stopLoss.Mode == types.StopLossModePrice ||
+				(stopLoss.Enabled && stopLoss.Percent <= stopLossPercent) {
+				// A stop price set by hand, or already as tight.
+				return nil
+			}
+			result.Action = GuardResultTightenStop
+			stopLoss.Enabled = true
+			stopLoss.Percent = stopLossPercent
+			s.updateStopLossSettings(trade, stopLoss)
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+	log.WithFields(log.Fields{
+		"tradeId": result.TradeID,
+		"symbol":  result.Symbol,
+		"action":  result.Action,
+		"error":   result.Error,
+	}).Infof("Guard action")
+	return result
+}
@@ -0,0 +1,142 @@
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+	"time"
+)
+
+func TestKillSwitch(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestTradeService(t, newFakeExchange(0))
+	assert.Empty(service.EntriesBlocked())
+
+	config.Set(KillSwitchConfigKey, "true")
+	defer config.Set(KillSwitchConfigKey, "false")
+	assert.Equal("the kill switch is on", service.EntriesBlocked())
+
+	// Re-arming the rules leaves the kill switch alone.
+	assert.Nil(service.RearmGuard(""))
+	assert.Equal("the kill switch is on", service.EntriesBlocked())
+
+	config.Set(KillSwitchConfigKey, "false")
+	assert.Empty(service.EntriesBlocked())
+}
+
+func TestGuardRearm(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestTradeService(t, newFakeExchange(0))
+	rule, err := service.SaveGuardRule(types.GuardRule{
+		Name:          "eth",
+		Enabled:       true,
+		Symbol:        "ETHBTC",
+		DropPercent:   5,
+		WindowMinutes: 10,
+		Action:        types.GuardActionCancelBuys,
+	})
+	assert.Nil(err)
+	assert.NotEmpty(rule.ID)
+
+	now := time.Now()
+	service.checkGuards("ETHBTC", decimal.RequireFromString("0.01"), now)
+	service.checkGuards("ETHBTC", decimal.RequireFromString("0.0096"), now.Add(2*time.Second))
+	assert.Empty(service.EntriesBlocked())
+
+	service.checkGuards("ETHBTC", decimal.RequireFromString("0.0095"), now.Add(3*time.Second))
+	assert.Equal("guard rule eth fired", service.EntriesBlocked())
+	assert.True(service.GuardRules()[0].Fired)
+	assert.Equal("0.0095", service.GuardRules()[0].FiredPrice.String())
+
+	assert.NotNil(service.RearmGuard("unknown"))
+	assert.True(service.GuardRules()[0].Fired)
+
+	assert.Nil(service.RearmGuard(rule.ID))
+	assert.Empty(service.EntriesBlocked())
+	assert.False(service.GuardRules()[0].Fired)
+
+	// The drop that fired the rule is forgotten, only a new one fires it.
+	service.checkGuards("ETHBTC", decimal.RequireFromString("0.0094"), now.Add(4*time.Second))
+	assert.Empty(service.EntriesBlocked())
+	service.checkGuards("ETHBTC", decimal.RequireFromString("0.0089"), now.Add(5*time.Second))
+	assert.NotEmpty(service.EntriesBlocked())
+
+	assert.Nil(service.RearmGuard(""))
+	assert.Empty(service.EntriesBlocked())
+}
+
+func TestPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	service := newTestTradeService(t, exchange)
+
+	service.RestoreTrade(newPendingBuyTrade("buy", "ETHBTC"))
+	service.RestoreTrade(newWatchingTrade("watch", "LTCBTC", 0))
+
+	// Trades already being sold, or closed, are left alone.
+	exiting := newWatchingTrade("exiting", "ETHBTC", 0)
+	exiting.State.Exit = &types.ExitState{
+		Trigger:       types.TriggerStopLoss,
+		ClientOrderID: "open",
+	}
+	service.RestoreTrade(exiting)
+	done := newWatchingTrade("done", "ETHBTC", 0)
+	done.State.Status = types.TradeStatusDone
+	service.RestoreTrade(done)
+
+	results := service.Panic()
+	actions := map[string]string{}
+	for _, result := range results {
+		assert.Empty(result.Error)
+		actions[result.TradeID] = result.Action
+	}
+	assert.Equal(map[string]string{
+		"buy":   GuardResultCancelBuy,
+		"watch": GuardResultMarketSell,
+	}, actions)
+
+	assert.Equal([]int64{1}, exchange.canceledOrders())
+	orders := exchange.postedOrders()
+	assert.Len(orders, 1)
+	assert.Equal("LTCBTC", orders[0].Symbol)
+	assert.Equal(binanceapi.OrderSideSell, orders[0].Side)
+	assert.Equal(binanceapi.OrderTypeMarket, orders[0].Type)
+	assert.Equal(1.0, orders[0].Quantity)
+}
+
+func TestPanicPartiallyFilledBuy(t *testing.T) {
+	assert := assert.New(t)
+
+	exchange := newFakeExchange(0)
+	service := newTestTradeService(t, exchange)
+
+	trade := newPendingBuyTrade("partial", "ETHBTC")
+	trade.State.BuyFillQuantity = decimal.RequireFromString("0.5")
+	trade.State.SellableQuantity = decimal.RequireFromString("0.5")
+	service.RestoreTrade(trade)
+
+	posted := exchange.waitForOrder("ETHBTC")
+	results := service.Panic()
+	assert.Len(results, 1)
+	assert.Empty(results[0].Error)
+	assert.Equal(GuardResultCancelBuyAndSell, results[0].Action)
+	assert.Equal([]int64{1}, exchange.canceledOrders())
+
+	// What the buy filled is sold.
+	select {
+	case order := <-posted:
+		assert.Equal(binanceapi.OrderSideSell, order.Side)
+		assert.Equal(binanceapi.OrderTypeMarket, order.Type)
+		assert.Equal(0.5, order.Quantity)
+	case <-time.After(time.Second):
+		t.Fatal("no sell posted")
+	}
+	state := service.Snapshot(trade)
+	assert.Equal(types.TriggerMarketSell, state.Exit.Trigger)
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"strings"
+)
+
+// MetadataUpdate changes the tags, the notes or both of a trade. A field
+// that is not set is left as is.
+type MetadataUpdate struct {
+	Tags  *[]string `json:"tags"`
+	Notes *string   `json:"notes"`
+}
+
+// UpdateMetadata changes the tags and notes of a trade. Trades no longer
+// held by the service, such as closed trades, are updated in the database.
+func (s *TradeService) UpdateMetadata(tradeId string, update MetadataUpdate) (*types.TradeState, error) {
+	if trade := s.FindTradeByLocalID(tradeId); trade != nil {
+		var state types.TradeState
+		err := s.call(trade, func() error {
+			err := s.updateMetadata(trade, update)
+			s.broadcastTradeUpdate(trade)
+			state = trade.State.Copy()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &state, nil
+	}
+
+	state, err := db.DbGetTradeByID(tradeId)
+	if err != nil {
+		return nil, err
+	}
+	trade := types.NewTradeWithState(*state)
+	if err := s.updateMetadata(trade, update); err != nil {
+		return nil, err
+	}
+	return &trade.State, nil
+}
+
+// updateMetadata applies the update to the trade and saves it, returning
+// an error if it could not be saved.
+func (s *TradeService) updateMetadata(trade *types.Trade, update MetadataUpdate) error {
+	metadata := types.MetadataChangedEvent{
+		Tags:  trade.State.Tags,
+		Notes: trade.State.Notes,
+	}
+	if update.Tags != nil {
+		metadata.Tags = types.NormalizeTags(*update.Tags)
+	}
+	if update.Notes != nil {
+		metadata.Notes = strings.TrimSpace(*update.Notes)
+	}
+	s.applyEvent(trade, types.TradeEvent{
+		Type:            types.TradeEventMetadataChanged,
+		MetadataChanged: &metadata,
+	})
+	log.WithFields(log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+		"tags":    metadata.Tags,
+	}).Infof("Trade metadata updated")
+	trade.AddHistoryEntry(types.HistoryTypeMetadataUpdate, metadata)
+	return db.DbUpdateTrade(trade)
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"math"
+)
+
+// SellPreview is the sell order that would be posted for a trade, and its
+// projected outcome. Nothing is sent to the exchange.
+type SellPreview struct {
+	Order binanceapi.OrderParameters
+
+	// The price the order is expected to fill at, the last price for
+	// market orders.
+	Price decimal.Decimal
+
+	// The projected commission and profit of the sell, in the quote asset.
+	ProjectedFee    decimal.Decimal
+	ProjectedProfit decimal.Decimal
+
+	// The price at which the trade would sell for its buy cost.
+	BreakEvenPrice decimal.Decimal
+}
+
+// BuyTargets are the exit prices of a buy that has not been placed yet,
+// assuming it fills completely.
+type BuyTargets struct {
+	BreakEvenPrice decimal.Decimal
+
+	// Zero if the limit sell or stop loss is not enabled.
+	LimitSellPrice decimal.Decimal
+	StopLossPrice  decimal.Decimal
+}
+
+func (s *TradeService) PreviewMarketSell(trade *types.Trade) (*SellPreview, error) {
+	var preview *SellPreview
+	err := s.call(trade, func() error {
+		order, err := s.marketSellOrder(trade)
+		if err != nil {
+			return err
+		}
+		price := trade.State.LastPrice
+		if !price.IsPositive() {
+			ticker, err := s.exchange.GetPriceTicker(trade.State.Symbol)
+			if err != nil {
+				return err
+			}
+			price, err = decimal.NewFromFloatChecked(ticker.Price)
+			if err != nil {
+				return err
+			}
+		}
+		preview = s.sellPreview(trade, order, price, false)
+		return nil
+	})
+	return preview, err
+}
+
+func (s *TradeService) PreviewLimitSellByPercent(trade *types.Trade, percent float64) (*SellPreview, error) {
+	var preview *SellPreview
+	err := s.call(trade, func() error {
+		price, err := s.limitSellPriceByPercent(trade, percent)
+		if err != nil {
+			return err
+		}
+		quantity := trade.State.SellableQuantity.Sub(trade.State.SellFillQuantity)
+		order, err := s.limitSellOrder(trade.State.Symbol, quantity, price, "")
+		if err != nil {
+			return err
+		}
+		preview = s.sellPreview(trade, order, price, true)
+		return nil
+	})
+	return preview, err
+}
+
+func (s *TradeService) PreviewLimitSellByPrice(trade *types.Trade, price decimal.Decimal) (*SellPreview, error) {
+	var preview *SellPreview
+	err := s.call(trade, func() error {
+		order, err := s.limitSellOrder(trade.State.Symbol,
+			trade.State.SellableQuantity, price, "")
+		if err != nil {
+			return err
+		}
+		preview = s.sellPreview(trade, order, price, true)
+		return nil
+	})
+	return preview, err
+}
+
+func (s *TradeService) sellPreview(trade *types.Trade, order binanceapi.OrderParameters,
+	price decimal.Decimal, maker bool) *SellPreview {
+	if order.Price > 0 {
+		price = decimal.NewFromFloat(order.Price)
+	}
+	quantity := decimal.NewFromFloat(order.Quantity)
+	proceeds := price.Mul(quantity)
+	fee := proceeds.Mul(s.projectedFee(trade, maker))
+	preview := &SellPreview{
+		Order:          order,
+		Price:          price,
+		ProjectedFee:   fee,
+		BreakEvenPrice: s.breakEvenPrice(trade, maker),
+	}
+	if trade.State.SellableQuantity.IsPositive() {
+		cost := trade.State.BuyCost.Mul(quantity).Div(trade.State.SellableQuantity)
+		preview.ProjectedProfit = proceeds.Sub(fee).Sub(cost)
+	}
+	return preview
+}
+
+// PreviewBuyTargets returns the exit prices of a buy of the quantity at the
+// price with the limit sell and stop loss settings. The commission is
+// projected at the account's taker rate, as though taken from the bought
+// asset.
+func (s *TradeService) PreviewBuyTargets(symbol string, price decimal.Decimal,
+	quantity decimal.Decimal, limitSell types.LimitSellState,
+	stopLoss types.StopLossState) (*BuyTargets, error) {
+	symbolInfo, err := s.binanceExchangeInfo.GetSymbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	trade := types.NewTrade()
+	trade.State.Symbol = symbol
+	trade.DoAddBuyFill(types.OrderFill{
+		Price:            price,
+		Quantity:         quantity,
+		CommissionAsset:  symbolInfo.BaseAsset,
+		CommissionAmount: quantity.Mul(s.CommissionRate(false)),
+	})
+	trade.UpdateSellableQuantity(symbolInfo.StepSize)
+	if !trade.State.SellableQuantity.IsPositive() {
+		return nil, fmt.Errorf("nothing to sell after commission")
+	}
+
+	targets := &BuyTargets{
+		BreakEvenPrice: s.breakEvenPrice(trade, limitSell.Enabled).
+			Round(symbolInfo.TickSize),
+	}
+	if limitSell.Enabled {
+		switch limitSell.Type {
+		case types.LimitSellTypePercent:
+			targets.LimitSellPrice, err = s.limitSellPriceByPercent(trade,
+				limitSell.Percent)
+			if err != nil {
+				return nil, err
+			}
+		case types.LimitSellTypePrice:
+			targets.LimitSellPrice = limitSell.Price.Round(symbolInfo.TickSize)
+		}
+	}
+	if stopLoss.Enabled {
+		trade.State.StopLoss = stopLoss
+		stopPrice, _ := s.stopPrice(trade)
+		targets.StopLossPrice = stopPrice.Round(symbolInfo.TickSize)
+	}
+	return targets, nil
+}
+
+// breakEvenPrice returns the price at which selling the trade returns its
+// buy cost after the projected sell commission.
+func (s *TradeService) breakEvenPrice(trade *types.Trade, maker bool) decimal.Decimal {
+	if !trade.State.SellableQuantity.IsPositive() {
+		return decimal.Zero
+	}
+	fee := s.projectedFee(trade, maker)
+	return trade.State.BuyCost.Div(trade.State.SellableQuantity.
+		Mul(decimal.NewFromInt(1).Sub(fee)))
+}
+
+// stopLossPrice returns the price below which the stop loss at percent
+// triggers, which is when the loss after the projected market sell
+// commission exceeds percent.
+func (s *TradeService) stopLossPrice(trade *types.Trade, percent float64) decimal.Decimal {
+	return s.profitPrice(trade, -math.Abs(percent))
+}
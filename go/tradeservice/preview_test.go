@@ -0,0 +1,51 @@
+package tradeservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+)
+
+func TestPreviewBuyTargets(t *testing.T) {
+	assert := assert.New(t)
+
+	exchangeInfo := binanceex.NewExchangeInfoService()
+	exchangeInfo.Symbols["ETHBTC"] = binanceex.SymbolInfo{
+		BaseAsset:  "ETH",
+		QuoteAsset: "BTC",
+		TickSize:   decimal.RequireFromString("0.000001"),
+		StepSize:   decimal.RequireFromString("0.001"),
+	}
+	service := newTradeService(fakeSymbolStream{}, newFakeExchange(0), exchangeInfo, nil)
+
+	// Without account commission rates the default fee of 0.1% is used.
+	targets, err := service.PreviewBuyTargets("ETHBTC",
+		decimal.RequireFromString("0.01"), decimal.NewFromInt(1),
+		types.LimitSellState{
+			Enabled: true,
+			Type:    types.LimitSellTypePercent,
+			Percent: 10,
+		},
+		types.StopLossState{
+			Enabled: true,
+			Percent: 5,
+		})
+	assert.NoError(err)
+	assert.Equal("0.01002", targets.BreakEvenPrice.String())
+	assert.Equal("0.011022", targets.LimitSellPrice.String())
+	assert.Equal("0.009519", targets.StopLossPrice.String())
+
+	targets, err = service.PreviewBuyTargets("ETHBTC",
+		decimal.RequireFromString("0.01"), decimal.NewFromInt(1),
+		types.LimitSellState{}, types.StopLossState{})
+	assert.NoError(err)
+	assert.True(targets.LimitSellPrice.IsZero())
+	assert.True(targets.StopLossPrice.IsZero())
+
+	_, err = service.PreviewBuyTargets("ETHBTC",
+		decimal.RequireFromString("0.01"), decimal.RequireFromString("0.0001"),
+		types.LimitSellState{}, types.StopLossState{})
+	assert.Error(err)
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/decimal"
+)
+
+// The config keys of how far a manual price may be from the market before
+// it has to be confirmed.
+const (
+	BuyMaxDeviationConfigKey  = "priceGuard.buyMaxDeviationPercent"
+	SellMaxDeviationConfigKey = "priceGuard.sellMaxDeviationPercent"
+)
+
+// The deviation allowed if not configured.
+const DefaultMaxDeviationPercent = 5.0
+
+// PriceDeviation is how far a manual price is from the market, on the side
+// that would cost the trade: above the market for a buy, below it for a
+// sell.
+type PriceDeviation struct {
+	Symbol              string               `json:"symbol"`
+	Side                binanceapi.OrderSide `json:"side"`
+	Price               decimal.Decimal      `json:"price"`
+	LastPrice           decimal.Decimal      `json:"lastPrice"`
+	BidPrice            decimal.Decimal      `json:"bidPrice"`
+	AskPrice            decimal.Decimal      `json:"askPrice"`
+	ReferencePrice      decimal.Decimal      `json:"referencePrice"`
+	DeviationPercent    float64              `json:"deviationPercent"`
+	MaxDeviationPercent float64              `json:"maxDeviationPercent"`
+
+	// The price deviates more than allowed and has to be confirmed.
+	Exceeded bool `json:"exceeded"`
+}
+
+func (d *PriceDeviation) Message() string {
+	side := "above"
+	if d.Side == binanceapi.OrderSideSell {
+		side = "below"
+	}
+	return fmt.Sprintf("%s price %s is %.2f%% %s the market price %s, more than the %.2f%% allowed",
+		d.Side, d.Price, d.DeviationPercent, side, d.ReferencePrice,
+		d.MaxDeviationPercent)
+}
+
+// PercentPriceError is a price the exchange would reject for being outside
+// the PERCENT_PRICE filter of the symbol.
+type PercentPriceError struct {
+	Symbol   string          `json:"symbol"`
+	Price    decimal.Decimal `json:"price"`
+	MinPrice decimal.Decimal `json:"minPrice"`
+	MaxPrice decimal.Decimal `json:"maxPrice"`
+}
+
+func (e *PercentPriceError) Error() string {
+	return fmt.Sprintf("price %s is outside the %s PERCENT_PRICE range of %s to %s",
+		e.Price, e.Symbol, e.MinPrice, e.MaxPrice)
+}
+
+// maxDeviationPercent returns the configured deviation allowed for the side.
+// An unset or empty setting uses DefaultMaxDeviationPercent, 0 has every
+// price worse than the market confirmed and a negative setting turns the
+// check off.
+func maxDeviationPercent(side binanceapi.OrderSide) float64 {
+	key := BuyMaxDeviationConfigKey
+	if side == binanceapi.OrderSideSell {
+		key = SellMaxDeviationConfigKey
+	}
+	if config.GetString(key) == "" {
+		return DefaultMaxDeviationPercent
+	}
+	return config.GetFloat64(key)
+}
+
+// CheckPriceDeviation compares a manually entered price to the last price
+// and the best bid and ask. The market price used is the one most in
+// favour of the price, so only prices that are off by any measure are
+// flagged. A price outside the PERCENT_PRICE filter is returned as a
+// PercentPriceError as the exchange would reject it anyway.
+func (s *TradeService) CheckPriceDeviation(symbol string, side binanceapi.OrderSide,
+	price decimal.Decimal) (*PriceDeviation, error) {
+	priceTicker, err := s.exchange.GetPriceTicker(symbol)
+	if err != nil {
+		return nil, err
+	}
+	bookTicker, err := s.exchange.GetBookTicker(symbol)
+	if err != nil {
+		return nil, err
+	}
+	for _, tickerPrice := range []float64{priceTicker.Price, bookTicker.BidPrice,
+		bookTicker.AskPrice} {
+		if _, err := decimal.NewFromFloatChecked(tickerPrice); err != nil {
+			return nil, err
+		}
+	}
+	deviation := &PriceDeviation{
+		Symbol:              symbol,
+		Side:                side,
+		Price:               price,
+		LastPrice:           decimal.NewFromFloat(priceTicker.Price),
+		BidPrice:            decimal.NewFromFloat(bookTicker.BidPrice),
+		AskPrice:            decimal.NewFromFloat(bookTicker.AskPrice),
+		MaxDeviationPercent: maxDeviationPercent(side),
+	}
+
+	// The filter is against the average price of the last few minutes,
+	// which the last price stands in for.
+	if deviation.LastPrice.IsPositive() {
+		if symbolInfo, err := s.binanceExchangeInfo.GetSymbol(symbol); err == nil &&
+			symbolInfo.MultiplierUp.IsPositive() {
+			minPrice := deviation.LastPrice.Mul(symbolInfo.MultiplierDown)
+			maxPrice := deviation.LastPrice.Mul(symbolInfo.MultiplierUp)
+			if price.LessThan(minPrice) || price.GreaterThan(maxPrice) {
+				return nil, &PercentPriceError{
+					Symbol:   symbol,
+					Price:    price,
+					MinPrice: minPrice,
+					MaxPrice: maxPrice,
+				}
+			}
+		}
+	}
+
+	reference := deviation.LastPrice
+	if side == binanceapi.OrderSideBuy {
+		if deviation.AskPrice.GreaterThan(reference) {
+			reference = deviation.AskPrice
+		}
+	} else if deviation.BidPrice.IsPositive() &&
+		(!reference.IsPositive() || deviation.BidPrice.LessThan(reference)) {
+		reference = deviation.BidPrice
+	}
+	if !reference.IsPositive() {
+		return nil, fmt.Errorf("no market price for %s", symbol)
+	}
+	deviation.ReferencePrice = reference
+
+	difference := price.Sub(reference)
+	if side == binanceapi.OrderSideSell {
+		difference = difference.Neg()
+	}
+	deviation.DeviationPercent = difference.Mul(decimal.NewFromInt(100)).
+		Div(reference).Float64()
+	deviation.Exceeded = deviation.MaxDeviationPercent >= 0 &&
+		deviation.DeviationPercent > deviation.MaxDeviationPercent
+	return deviation, nil
+}
@@ -0,0 +1,75 @@
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"testing"
+)
+
+func TestCheckPriceDeviation(t *testing.T) {
+	assert := assert.New(t)
+
+	exchangeInfo := binanceex.NewExchangeInfoService()
+	exchangeInfo.Symbols["ETHBTC"] = binanceex.SymbolInfo{
+		BaseAsset:      "ETH",
+		QuoteAsset:     "BTC",
+		MultiplierUp:   decimal.NewFromInt(5),
+		MultiplierDown: decimal.RequireFromString("0.2"),
+	}
+	exchange := newFakeExchange(0)
+	exchange.lastPrice = 0.0100
+	exchange.bidPrice = 0.0099
+	exchange.askPrice = 0.0101
+	service := newTradeService(fakeSymbolStream{}, exchange, exchangeInfo, nil)
+
+	// Compared to the ask, the higher of the ask and last price.
+	deviation, err := service.CheckPriceDeviation("ETHBTC", binanceapi.OrderSideBuy,
+		decimal.RequireFromString("0.0106"))
+	assert.Nil(err)
+	assert.Equal("0.0101", deviation.ReferencePrice.String())
+	assert.False(deviation.Exceeded)
+
+	deviation, err = service.CheckPriceDeviation("ETHBTC", binanceapi.OrderSideBuy,
+		decimal.RequireFromString("0.011"))
+	assert.Nil(err)
+	assert.True(deviation.Exceeded)
+
+	// A sell is compared to the bid, the lower of the bid and last price.
+	deviation, err = service.CheckPriceDeviation("ETHBTC", binanceapi.OrderSideSell,
+		decimal.RequireFromString("0.009"))
+	assert.Nil(err)
+	assert.Equal("0.0099", deviation.ReferencePrice.String())
+	assert.True(deviation.Exceeded)
+
+	// A sell above the market is fine.
+	deviation, err = service.CheckPriceDeviation("ETHBTC", binanceapi.OrderSideSell,
+		decimal.RequireFromString("0.012"))
+	assert.Nil(err)
+	assert.False(deviation.Exceeded)
+
+	// The extra zero.
+	_, err = service.CheckPriceDeviation("ETHBTC", binanceapi.OrderSideBuy,
+		decimal.RequireFromString("0.1"))
+	_, ok := err.(*PercentPriceError)
+	assert.True(ok)
+}
+
+func TestMaxDeviationPercent(t *testing.T) {
+	assert := assert.New(t)
+
+	defer config.Set(BuyMaxDeviationConfigKey, "")
+	assert.Equal(DefaultMaxDeviationPercent, maxDeviationPercent(binanceapi.OrderSideBuy))
+
+	config.Set(BuyMaxDeviationConfigKey, "0")
+	assert.Equal(0.0, maxDeviationPercent(binanceapi.OrderSideBuy))
+	assert.Equal(DefaultMaxDeviationPercent, maxDeviationPercent(binanceapi.OrderSideSell))
+
+	config.Set(BuyMaxDeviationConfigKey, "-1")
+	assert.Equal(-1.0, maxDeviationPercent(binanceapi.OrderSideBuy))
+
+	config.Set(BuyMaxDeviationConfigKey, "")
+	assert.Equal(DefaultMaxDeviationPercent, maxDeviationPercent(binanceapi.OrderSideBuy))
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
+	"gitlab.com/crankykernel/maker/go/config"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/log"
+	"strings"
+	"time"
+)
+
+// The config keys of the trading restrictions. The lists are comma
+// separated.
+const (
+	CooldownHoursConfigKey    = "trading.cooldownHours"
+	AllowSymbolsConfigKey     = "trading.allowSymbols"
+	DenySymbolsConfigKey      = "trading.denySymbols"
+	AllowQuoteAssetsConfigKey = "trading.allowQuoteAssets"
+	DenyQuoteAssetsConfigKey  = "trading.denyQuoteAssets"
+)
+
+type RestrictionReason string
+
+const (
+	RestrictionEntriesBlocked       RestrictionReason = "ENTRIES_BLOCKED"
+	RestrictionSymbolNotTrading     RestrictionReason = "SYMBOL_NOT_TRADING"
+	RestrictionSymbolDenied         RestrictionReason = "SYMBOL_DENIED"
+	RestrictionSymbolNotAllowed     RestrictionReason = "SYMBOL_NOT_ALLOWED"
+	RestrictionQuoteAssetDenied     RestrictionReason = "QUOTE_ASSET_DENIED"
+	RestrictionQuoteAssetNotAllowed RestrictionReason = "QUOTE_ASSET_NOT_ALLOWED"
+	RestrictionSymbolCooldown       RestrictionReason = "SYMBOL_COOLDOWN"
+)
+
+// RestrictionError is why a new buy of a symbol is not allowed.
+type RestrictionError struct {
+	Reason  RestrictionReason `json:"reason"`
+	Symbol  string            `json:"symbol"`
+	Message string            `json:"message"`
+
+	// When a cooldown ends.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func (e *RestrictionError) Error() string {
+	return e.Message
+}
+
+// TradingRestrictions limit the symbols new buys can be made on.
+type TradingRestrictions struct {
+	// Hours after a stop loss that a symbol can't be bought again.
+	CooldownHours float64 `json:"cooldownHours"`
+
+	// Only these symbols and quote assets can be bought if set.
+	AllowSymbols     []string `json:"allowSymbols"`
+	AllowQuoteAssets []string `json:"allowQuoteAssets"`
+
+	// These symbols and quote assets can never be bought.
+	DenySymbols     []string `json:"denySymbols"`
+	DenyQuoteAssets []string `json:"denyQuoteAssets"`
+}
+
+// GetTradingRestrictions reads the trading restrictions from the config.
+func GetTradingRestrictions() TradingRestrictions {
+	return TradingRestrictions{
+		CooldownHours:    config.GetFloat64(CooldownHoursConfigKey),
+		AllowSymbols:     ParseAssetList(config.GetString(AllowSymbolsConfigKey)),
+		AllowQuoteAssets: ParseAssetList(config.GetString(AllowQuoteAssetsConfigKey)),
+		DenySymbols:      ParseAssetList(config.GetString(DenySymbolsConfigKey)),
+		DenyQuoteAssets:  ParseAssetList(config.GetString(DenyQuoteAssetsConfigKey)),
+	}
+}
+
+// ParseAssetList splits a comma separated list of symbols or assets,
+// upper casing them and dropping empty entries.
+func ParseAssetList(value string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToUpper(strings.TrimSpace(entry))
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func listContains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// BuyRestriction returns why a new buy of the symbol is not allowed, or nil
+// if it is.
+func (s *TradeService) BuyRestriction(symbol string) *RestrictionError {
+	restriction := func(reason RestrictionReason, format string, args ...interface{}) *RestrictionError {
+		return &RestrictionError{
+			Reason:  reason,
+			Symbol:  symbol,
+			Message: fmt.Sprintf(format, args...),
+		}
+	}
+
+	if blocked := s.EntriesBlocked(); blocked != "" {
+		return restriction(RestrictionEntriesBlocked, "new buys are blocked: %s", blocked)
+	}
+
+	restrictions := GetTradingRestrictions()
+	if listContains(restrictions.DenySymbols, symbol) {
+		return restriction(RestrictionSymbolDenied, "%s is on the symbol deny list", symbol)
+	}
+	if len(restrictions.AllowSymbols) > 0 && !listContains(restrictions.AllowSymbols, symbol) {
+		return restriction(RestrictionSymbolNotAllowed, "%s is not on the symbol allow list", symbol)
+	}
+
+	// Unknown symbols are left to the order checks.
+	if symbolInfo, err := s.binanceExchangeInfo.GetSymbol(symbol); err == nil {
+		if symbolInfo.Status != "" && symbolInfo.Status != "TRADING" {
+			return restriction(RestrictionSymbolNotTrading,
+				"%s is not trading, its exchange status is %s", symbol, symbolInfo.Status)
+		}
+		quoteAsset := symbolInfo.QuoteAsset
+		if listContains(restrictions.DenyQuoteAssets, quoteAsset) {
+			return restriction(RestrictionQuoteAssetDenied,
+				"%s is on the quote asset deny list", quoteAsset)
+		}
+		if len(restrictions.AllowQuoteAssets) > 0 &&
+			!listContains(restrictions.AllowQuoteAssets, quoteAsset) {
+			return restriction(RestrictionQuoteAssetNotAllowed,
+				"%s is not on the quote asset allow list", quoteAsset)
+		}
+	}
+
+	if restrictions.CooldownHours > 0 {
+		s.stopLossLock.Lock()
+		stopLossTime, ok := s.stopLosses[symbol]
+		s.stopLossLock.Unlock()
+		if ok {
+			until := stopLossTime.Add(time.Duration(restrictions.CooldownHours * float64(time.Hour)))
+			if time.Now().Before(until) {
+				err := restriction(RestrictionSymbolCooldown,
+					"%s is cooling down after a stop loss until %s", symbol,
+					until.Format(time.RFC3339))
+				err.Until = &until
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// NotifyRestriction tells the clients a buy was rejected.
+func (s *TradeService) NotifyRestriction(err *RestrictionError) {
+	log.WithFields(log.Fields{
+		"symbol": err.Symbol,
+		"reason": err.Reason,
+	}).Warnf("Buy rejected: %s", err.Message)
+	if s.notificationService == nil {
+		return
+	}
+	notice := clientnotificationservice.NewNotice(clientnotificationservice.LevelWarning,
+		fmt.Sprintf("Buy of %s rejected: %s", err.Symbol, err.Message)).
+		WithData(map[string]interface{}{
+			"symbol": err.Symbol,
+			"reason": err.Reason,
+			"until":  err.Until,
+		})
+	go s.notificationService.Broadcast(notice)
+}
+
+// recordStopLoss starts the cooldown of the symbol.
+func (s *TradeService) recordStopLoss(symbol string, stopLossTime time.Time) {
+	s.stopLossLock.Lock()
+	defer s.stopLossLock.Unlock()
+	if last, ok := s.stopLosses[symbol]; !ok || stopLossTime.After(last) {
+		s.stopLosses[symbol] = stopLossTime
+	}
+}
+
+// LoadCooldowns finds the last stop loss of each symbol from the closed
+// trades, so cooldowns carry on over a restart.
+func (s *TradeService) LoadCooldowns() error {
+	states, err := db.DbQueryTrades(db.TradeQueryOptions{IsClosed: true})
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		if state.StopLoss.Triggered && state.CloseTime != nil {
+			s.recordStopLoss(state.Symbol, *state.CloseTime)
+		}
+	}
+	return nil
+}
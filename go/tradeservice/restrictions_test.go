@@ -0,0 +1,58 @@
+package tradeservice
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/config"
+	"testing"
+	"time"
+)
+
+func TestBuyRestriction(t *testing.T) {
+	assert := assert.New(t)
+
+	exchangeInfo := binanceex.NewExchangeInfoService()
+	exchangeInfo.Symbols["ETHBTC"] = binanceex.SymbolInfo{
+		Status:     "TRADING",
+		BaseAsset:  "ETH",
+		QuoteAsset: "BTC",
+	}
+	exchangeInfo.Symbols["ETHUSDT"] = binanceex.SymbolInfo{
+		Status:     "TRADING",
+		BaseAsset:  "ETH",
+		QuoteAsset: "USDT",
+	}
+	exchangeInfo.Symbols["BCCBTC"] = binanceex.SymbolInfo{
+		Status:     "BREAK",
+		BaseAsset:  "BCC",
+		QuoteAsset: "BTC",
+	}
+	service := newTradeService(fakeSymbolStream{}, newFakeExchange(0), exchangeInfo, nil)
+
+	defer func() {
+		for _, key := range []string{CooldownHoursConfigKey, AllowSymbolsConfigKey,
+			DenySymbolsConfigKey, AllowQuoteAssetsConfigKey, DenyQuoteAssetsConfigKey} {
+			config.Set(key, "")
+		}
+	}()
+
+	assert.Nil(service.BuyRestriction("ETHBTC"))
+	assert.Equal(RestrictionSymbolNotTrading, service.BuyRestriction("BCCBTC").Reason)
+
+	config.Set(DenyQuoteAssetsConfigKey, " usdt ")
+	assert.Equal(RestrictionQuoteAssetDenied, service.BuyRestriction("ETHUSDT").Reason)
+	config.Set(DenyQuoteAssetsConfigKey, "")
+
+	config.Set(AllowSymbolsConfigKey, "LTCBTC,ETHUSDT")
+	assert.Equal(RestrictionSymbolNotAllowed, service.BuyRestriction("ETHBTC").Reason)
+	assert.Nil(service.BuyRestriction("ETHUSDT"))
+	config.Set(AllowSymbolsConfigKey, "")
+
+	config.Set(CooldownHoursConfigKey, "2")
+	service.recordStopLoss("ETHBTC", time.Now().Add(-3*time.Hour))
+	assert.Nil(service.BuyRestriction("ETHBTC"))
+	service.recordStopLoss("ETHBTC", time.Now().Add(-1*time.Hour))
+	restriction := service.BuyRestriction("ETHBTC")
+	assert.Equal(RestrictionSymbolCooldown, restriction.Reason)
+	assert.NotNil(restriction.Until)
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"math"
+)
+
+// Why the stop is where it is.
+const (
+	stopReasonBase      = ""
+	stopReasonTrailing  = "TRAILING"
+	stopReasonBreakEven = "BREAK_EVEN"
+	stopReasonStep      = "STEP"
+)
+
+// profitPrice returns the price at which a market sell of the trade makes
+// the percent profit after the projected commission.
+func (s *TradeService) profitPrice(trade *types.Trade, percent float64) decimal.Decimal {
+	if !trade.State.SellableQuantity.IsPositive() {
+		return decimal.Zero
+	}
+	fee := s.projectedFee(trade, false)
+	return trade.State.BuyCost.Mul(decimal.NewFromFloat(1 + percent/100)).
+		Div(trade.State.SellableQuantity.Mul(decimal.NewFromInt(1).Sub(fee)))
+}
+
+// stopPrice works out the stop loss price of the trade for its mode, raised
+// by the break even and step adjustments the high price has reached. The
+// stop never depends on the current price, only the highest seen, so it
+// doesn't move down.
+func (s *TradeService) stopPrice(trade *types.Trade) (decimal.Decimal, string) {
+	stopLoss := trade.State.StopLoss
+
+	var stop decimal.Decimal
+	reason := stopReasonBase
+	switch stopLoss.Mode {
+	case types.StopLossModePrice:
+		stop = stopLoss.Price
+	case types.StopLossModeTrailing:
+		high := decimal.Max(stopLoss.HighPrice, trade.State.AverageBuyPrice)
+		stop = high.Mul(decimal.NewFromFloat(1 - math.Abs(stopLoss.Percent)/100))
+		reason = stopReasonTrailing
+	default:
+		stop = s.stopLossPrice(trade, stopLoss.Percent)
+	}
+
+	if !stopLoss.HighPrice.IsPositive() {
+		return stop, reason
+	}
+	highProfit := s.calculateProfit(trade, stopLoss.HighPrice)
+
+	if stopLoss.BreakEvenPercent > 0 && highProfit >= stopLoss.BreakEvenPercent {
+		breakEven := s.breakEvenPrice(trade, false)
+		if breakEven.GreaterThan(stop) {
+			stop = breakEven
+			reason = stopReasonBreakEven
+		}
+	}
+
+	if stopLoss.StepPercent > 0 && stopLoss.StepRaisePercent > 0 {
+		steps := math.Floor(highProfit / stopLoss.StepPercent)
+		if steps >= 1 {
+			step := s.profitPrice(trade,
+				steps*stopLoss.StepRaisePercent-math.Abs(stopLoss.Percent))
+			if step.GreaterThan(stop) {
+				stop = step
+				reason = stopReasonStep
+			}
+		}
+	}
+
+	return stop, reason
+}
+
+// updateStopPrice follows the high price and records the stop when an
+// adjustment raises it by at least a tick.
+func (s *TradeService) updateStopPrice(trade *types.Trade, price decimal.Decimal) decimal.Decimal {
+	if price.GreaterThan(trade.State.StopLoss.HighPrice) {
+		s.updatePrices(trade, types.PricesUpdatedEvent{StopLossHighPrice: &price})
+	}
+
+	stop, reason := s.stopPrice(trade)
+	previous := trade.State.StopLoss.StopPrice
+	if reason == stopReasonBase {
+		// The base stop follows the buy cost, it is not a raise.
+		if !stop.Equal(previous) {
+			s.updatePrices(trade, types.PricesUpdatedEvent{StopLossStopPrice: &stop})
+		}
+		return stop
+	}
+	if !stop.GreaterThan(previous) {
+		return stop
+	}
+	if tickSize, err := s.binanceExchangeInfo.GetTickSize(trade.State.Symbol); err == nil &&
+		previous.IsPositive() && stop.Sub(previous).LessThan(tickSize) {
+		return stop
+	}
+
+	log.WithFields(log.Fields{
+		"tradeId": trade.State.TradeID,
+		"symbol":  trade.State.Symbol,
+		"reason":  reason,
+		"from":    previous,
+		"to":      stop,
+		"high":    trade.State.StopLoss.HighPrice,
+	}).Infof("Stop loss raised")
+	s.recordTrigger(trade, types.TriggerStopLossRaised, stop)
+	trade.AddHistoryEntry(types.HistoryTypeStopLossRaised, map[string]interface{}{
+		"reason":    reason,
+		"from":      previous,
+		"to":        stop,
+		"highPrice": trade.State.StopLoss.HighPrice,
+	})
+	db.DbUpdateTrade(trade)
+	s.broadcastTradeUpdate(trade)
+	return stop
+}
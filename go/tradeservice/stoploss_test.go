@@ -0,0 +1,102 @@
+package tradeservice
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"testing"
+)
+
+func TestStopPrice(t *testing.T) {
+	assert := assert.New(t)
+
+	exchangeInfo := binanceex.NewExchangeInfoService()
+	exchangeInfo.Symbols["ETHBTC"] = binanceex.SymbolInfo{
+		BaseAsset:  "ETH",
+		QuoteAsset: "BTC",
+		TickSize:   decimal.RequireFromString("0.000001"),
+		StepSize:   decimal.RequireFromString("0.001"),
+	}
+	service := newTradeService(fakeSymbolStream{}, newFakeExchange(0), exchangeInfo, nil)
+
+	trade := newWatchingTrade("stop-loss", "ETHBTC", 5)
+	trade.State.StopLoss.BreakEvenPercent = 2
+	trade.State.StopLoss.StepPercent = 4
+	trade.State.StopLoss.StepRaisePercent = 3
+
+	stop, reason := service.stopPrice(trade)
+	assert.Equal(stopReasonBase, reason)
+	assert.Equal(service.stopLossPrice(trade, 5).String(), stop.String())
+
+	// Not yet at the break even percent.
+	trade.State.StopLoss.HighPrice = decimal.RequireFromString("0.0101")
+	_, reason = service.stopPrice(trade)
+	assert.Equal(stopReasonBase, reason)
+
+	trade.State.StopLoss.HighPrice = decimal.RequireFromString("0.0103")
+	stop, reason = service.stopPrice(trade)
+	assert.Equal(stopReasonBreakEven, reason)
+	assert.Equal(service.breakEvenPrice(trade, false).String(), stop.String())
+
+	// Two steps of 4% raise the stop from -5% to +1%.
+	trade.State.StopLoss.HighPrice = decimal.RequireFromString("0.0109")
+	stop, reason = service.stopPrice(trade)
+	assert.Equal(stopReasonStep, reason)
+	assert.Equal(service.profitPrice(trade, 1).String(), stop.String())
+
+	trade.State.StopLoss = types.StopLossState{
+		Enabled:   true,
+		Mode:      types.StopLossModeTrailing,
+		Percent:   10,
+		HighPrice: decimal.RequireFromString("0.02"),
+	}
+	stop, reason = service.stopPrice(trade)
+	assert.Equal(stopReasonTrailing, reason)
+	assert.Equal("0.018", stop.String())
+
+	trade.State.StopLoss = types.StopLossState{
+		Enabled: true,
+		Mode:    types.StopLossModePrice,
+		Price:   decimal.RequireFromString("0.0095"),
+	}
+	stop, _ = service.stopPrice(trade)
+	assert.Equal("0.0095", stop.String())
+}
+
+func TestReplayFollowedPrices(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestTradeService(t, newFakeExchange(0))
+	trade := newWatchingTrade("replay-prices", "ETHBTC", 5)
+	trade.State.StopLoss.BreakEvenPercent = 2
+	trade.State.TrailingProfit = types.TrailingProfitState{
+		Enabled:   true,
+		Percent:   3,
+		Deviation: 1,
+	}
+	service.recordCreated(trade)
+
+	for _, price := range []string{"0.0101", "0.0103", "0.0102", "0.0106", "0.0108", "0.0107"} {
+		service.onPrice(trade, decimal.RequireFromString(price))
+	}
+	assert.Equal("0.0108", trade.State.StopLoss.HighPrice.String())
+	assert.True(trade.State.TrailingProfit.Activated)
+	assert.Equal("0.0108", trade.State.TrailingProfit.Price.String())
+	assert.False(trade.State.TrailingProfit.Triggered)
+
+	events, err := db.DbGetTradeEvents(trade.State.TradeID)
+	assert.Nil(err)
+	replayed, err := types.ReplayTradeEvents(events)
+	assert.Nil(err)
+
+	// The history, last price and profit are not recorded as events.
+	replayed.State.History = trade.State.History
+	replayed.State.LastPrice = trade.State.LastPrice
+	replayed.State.ProfitPercent = trade.State.ProfitPercent
+	expected, _ := json.Marshal(trade.State)
+	actual, _ := json.Marshal(replayed.State)
+	assert.Equal(string(expected), string(actual))
+}
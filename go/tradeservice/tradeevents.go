@@ -0,0 +1,218 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/log"
+	"gitlab.com/crankykernel/maker/go/types"
+	"net/http"
+	"time"
+)
+
+func (s *TradeService) ApplyEvent(trade *types.Trade, event types.TradeEvent) {
+	s.call(trade, func() error {
+		s.applyEvent(trade, event)
+		return nil
+	})
+}
+
+// applyEvent applies an event to the trade and appends it to the trade event
+// log. The caller is still responsible for saving the trade state.
+func (s *TradeService) applyEvent(trade *types.Trade, event types.TradeEvent) {
+	event.TradeID = trade.State.TradeID
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if err := trade.ApplyEvent(event); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"type":    event.Type,
+		}).Errorf("Failed to apply trade event")
+		return
+	}
+	if err := db.DbSaveTradeEvent(&event); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"type":    event.Type,
+		}).Errorf("Failed to save trade event")
+	}
+}
+
+// recordCreated records the initial state of a trade as the first event in
+// its log.
+func (s *TradeService) recordCreated(trade *types.Trade) {
+	state := trade.State.Copy()
+	s.applyEvent(trade, types.TradeEvent{
+		Type:    types.TradeEventCreated,
+		Created: &state,
+	})
+}
+
+func (s *TradeService) ChangeStatus(trade *types.Trade, status types.TradeStatus) {
+	s.call(trade, func() error {
+		s.changeStatus(trade, status, time.Now())
+		return nil
+	})
+}
+
+// changeStatus records a status change if allowed from the current status.
+// Closing statuses also set the close time and stop watching the symbol for
+// the trade.
+func (s *TradeService) changeStatus(trade *types.Trade, status types.TradeStatus, timestamp time.Time) {
+	if trade.State.Status == status {
+		return
+	}
+	if !types.CanTransition(trade.State.Status, status) {
+		log.WithFields(log.Fields{
+			"tradeId": trade.State.TradeID,
+			"symbol":  trade.State.Symbol,
+			"from":    trade.State.Status,
+			"to":      status,
+		}).Errorf("Rejected illegal trade status transition")
+		return
+	}
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	wasDone := trade.IsDone()
+	change := &types.StatusChangedEvent{
+		Status: status,
+	}
+	switch status {
+	case types.TradeStatusDone, types.TradeStatusCanceled,
+		types.TradeStatusFailed, types.TradeStatusAbandoned:
+		change.CloseTime = &timestamp
+	}
+	s.applyEvent(trade, types.TradeEvent{
+		Timestamp:     timestamp,
+		Type:          types.TradeEventStatusChanged,
+		StatusChanged: change,
+	})
+	if trade.IsDone() && !wasDone {
+		s.tradeStreamManager.RemoveSymbol(trade.State.Symbol)
+	}
+}
+
+// AddFill records a fill that was not received through an execution report,
+// such as one recovered from the trade history on restore.
+func (s *TradeService) AddFill(trade *types.Trade, side binanceapi.OrderSide, fill types.OrderFill) {
+	s.call(trade, func() error {
+		s.addFill(trade, side, fill)
+		return nil
+	})
+}
+
+func (s *TradeService) addFill(trade *types.Trade, side binanceapi.OrderSide, fill types.OrderFill) {
+	stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithField("symbol", trade.State.Symbol).
+			Error("Failed to get symbol step size.")
+	}
+	s.convertCommission(trade, &fill)
+	s.applyEvent(trade, types.TradeEvent{
+		Type: types.TradeEventFill,
+		Fill: &types.FillEvent{
+			Side:     side,
+			Fill:     fill,
+			StepSize: stepSize,
+		},
+	})
+}
+
+func (s *TradeService) recordSettings(trade *types.Trade, settings types.SettingsChangedEvent) {
+	s.applyEvent(trade, types.TradeEvent{
+		Type:            types.TradeEventSettingsChanged,
+		SettingsChanged: &settings,
+	})
+}
+
+func (s *TradeService) UpdateLimitSell(trade *types.Trade, limitSell types.LimitSellState) {
+	s.call(trade, func() error {
+		s.recordSettings(trade, types.SettingsChangedEvent{
+			LimitSell: &limitSell,
+		})
+		db.DbUpdateTrade(trade)
+		s.broadcastTradeUpdate(trade)
+		return nil
+	})
+}
+
+func (s *TradeService) recordTrigger(trade *types.Trade, trigger types.TriggerType, price decimal.Decimal) {
+	s.applyEvent(trade, types.TradeEvent{
+		Type: types.TradeEventTriggerFired,
+		TriggerFired: &types.TriggerFiredEvent{
+			Trigger:       trigger,
+			Price:         price,
+			ProfitPercent: trade.State.ProfitPercent,
+		},
+	})
+}
+
+// updatePrices records the followed prices of the trade that moved.
+func (s *TradeService) updatePrices(trade *types.Trade, prices types.PricesUpdatedEvent) {
+	s.applyEvent(trade, types.TradeEvent{
+		Type:          types.TradeEventPricesUpdated,
+		PricesUpdated: &prices,
+	})
+	db.DbUpdateTrade(trade)
+}
+
+func (s *TradeService) PostOrder(trade *types.Trade, order binanceapi.OrderParameters) (*http.Response, error) {
+	var response *http.Response
+	err := s.call(trade, func() error {
+		var err error
+		response, err = s.postOrder(trade, order)
+		return err
+	})
+	return response, err
+}
+
+// postOrder posts an order for the trade, recording the order and its outcome
+// in the trade event log. A client order ID is generated if not already set.
+func (s *TradeService) postOrder(trade *types.Trade, order binanceapi.OrderParameters) (*http.Response, error) {
+	if order.NewClientOrderId == "" {
+		clientOrderId, err := s.MakeOrderID()
+		if err != nil {
+			log.WithError(err).Errorf("Failed to generate clientOrderId")
+			return nil, err
+		}
+		order.NewClientOrderId = clientOrderId
+	}
+
+	// Must be registered before posting so the execution report can be
+	// matched to the trade.
+	s.lock.Lock()
+	s.TradesByClientID[order.NewClientOrderId] = trade
+	s.lock.Unlock()
+
+	response, err := s.exchange.PostOrder(order)
+	placed := &types.OrderPlacedEvent{
+		ClientOrderID: order.NewClientOrderId,
+		Order:         &order,
+	}
+	if err != nil {
+		placed.Error = err.Error()
+	}
+	s.applyEvent(trade, types.TradeEvent{
+		Type:        types.TradeEventOrderPlaced,
+		OrderPlaced: placed,
+	})
+	db.DbUpdateTrade(trade)
+	return response, err
+}
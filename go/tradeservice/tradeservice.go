@@ -19,11 +19,12 @@ import (
 	"fmt"
 	"github.com/crankykernel/binanceapi-go"
 	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/clientnotificationservice"
 	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
 	"gitlab.com/crankykernel/maker/go/idgenerator"
 	"gitlab.com/crankykernel/maker/go/log"
 	"gitlab.com/crankykernel/maker/go/types"
-	"gitlab.com/crankykernel/maker/go/util"
 	"math"
 	"sync"
 	"time"
@@ -51,94 +52,233 @@ type TradeService struct {
 	// trade as a key is created for each client ID associated with the trade.
 	TradesByClientID map[string]*types.Trade
 
+	// The worker for each trade by local ID. All changes to a trade are
+	// made on its worker.
+	workers map[string]*tradeWorker
+
+	// Protects the trade and worker maps. Never held while talking to the
+	// exchange.
+	lock sync.Mutex
+
 	idGenerator *idgenerator.IdGenerator
 
-	subscribers map[chan TradeEvent]string
-	lock        sync.Mutex
+	subscribers         map[chan TradeEvent]string
+	blockingSubscribers map[chan TradeEvent]bool
+	subscriberLock      sync.RWMutex
 
-	tradeStreamManager *binanceex.TradeStreamManager
+	tradeStreamManager symbolStream
 	tradeStreamChannel binanceex.TradeStreamChannel
 
+	exchange Exchange
+
 	binanceExchangeInfo *binanceex.ExchangeInfoService
+
+	notificationService *clientnotificationservice.Service
+
+	// The account's commission rates, nil until fetched, and recent prices
+	// used to convert commissions.
+	commissionRates *commissionRates
+	prices          map[string]cachedPrice
+	feeLock         sync.Mutex
+
+	// Recent execution reports for orders not placed by Maker.
+	externalReports []ExternalReport
+	externalLock    sync.Mutex
+
+	// The volume traded on each symbol with open trades, for participation
+	// algos.
+	volumes    map[string]decimal.Decimal
+	volumeLock sync.Mutex
+
+	// Guard rules by ID, and the recent prices of their symbols.
+	guardRules  map[string]*types.GuardRule
+	guardPrices map[string][]guardPrice
+	guardLock   sync.Mutex
+
+	// The last stop loss of each symbol, for the cooldown.
+	stopLosses   map[string]time.Time
+	stopLossLock sync.Mutex
 }
 
-func NewTradeService(binanceStreamManager *binanceex.TradeStreamManager) *TradeService {
-	tradeService := &TradeService{
-		TradesByLocalID:     make(map[string]*types.Trade),
-		TradesByClientID:    make(map[string]*types.Trade),
-		idGenerator:         idgenerator.NewIdGenerator(),
-		subscribers:         make(map[chan TradeEvent]string),
-		tradeStreamManager:  binanceStreamManager,
-		binanceExchangeInfo: binanceex.NewExchangeInfoService(),
-	}
+func NewTradeService(binanceStreamManager *binanceex.TradeStreamManager,
+	notificationService *clientnotificationservice.Service) *TradeService {
+	tradeService := newTradeService(binanceStreamManager, binanceExchange{},
+		binanceex.NewExchangeInfoService(), notificationService)
 
 	if err := tradeService.binanceExchangeInfo.Update(); err != nil {
 		log.WithError(err).
 			Errorf("Failed to update Binance exchange info")
 	}
 
-	tradeService.tradeStreamChannel = tradeService.tradeStreamManager.Subscribe("trade-service")
+	tradeService.tradeStreamChannel = binanceStreamManager.Subscribe("trade-service")
 
 	go tradeService.tradeStreamListener()
+	go tradeService.commissionRatesUpdater()
+	go tradeService.exitPolicyUpdater()
 
 	return tradeService
 }
 
-// Calculate the profit based on the trade being sold at the given price.
-// Returns a percentage value in the range of 0-100.
-func (s *TradeService) CalculateProfit(trade *types.Trade, price float64) float64 {
+func newTradeService(stream symbolStream, exchange Exchange,
+	exchangeInfo *binanceex.ExchangeInfoService,
+	notificationService *clientnotificationservice.Service) *TradeService {
+	return &TradeService{
+		TradesByLocalID:     make(map[string]*types.Trade),
+		TradesByClientID:    make(map[string]*types.Trade),
+		workers:             make(map[string]*tradeWorker),
+		idGenerator:         idgenerator.NewIdGenerator(),
+		subscribers:         make(map[chan TradeEvent]string),
+		blockingSubscribers: make(map[chan TradeEvent]bool),
+		tradeStreamManager:  stream,
+		exchange:            exchange,
+		binanceExchangeInfo: exchangeInfo,
+		notificationService: notificationService,
+		prices:              make(map[string]cachedPrice),
+		volumes:             make(map[string]decimal.Decimal),
+		guardRules:          make(map[string]*types.GuardRule),
+		guardPrices:         make(map[string][]guardPrice),
+		stopLosses:          make(map[string]time.Time),
+	}
+}
+
+// ExchangeInfo returns the exchange info used to round and format order
+// quantities and prices.
+func (s *TradeService) ExchangeInfo() *binanceex.ExchangeInfoService {
+	return s.binanceExchangeInfo
+}
+
+// worker returns the worker for a trade, starting one if the trade does not
+// have one yet.
+func (s *TradeService) worker(trade *types.Trade) *tradeWorker {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	return s.calculateProfit(trade, price)
+	return s.workerLocked(trade)
+}
+
+func (s *TradeService) workerLocked(trade *types.Trade) *tradeWorker {
+	old, ok := s.workers[trade.State.TradeID]
+	if ok && old.trade == trade {
+		return old
+	}
+	worker := newTradeWorker(trade)
+	s.workers[trade.State.TradeID] = worker
+	if ok {
+		// Another copy of the trade replaces the one the old worker has.
+		// The new worker starts once the work queued on the old one has
+		// run so the two never run at the same time.
+		go old.retire()
+		go func() {
+			<-old.finished
+			worker.run()
+		}()
+	} else {
+		go worker.run()
+	}
+	return worker
+}
+
+// call runs fn on the trade's worker and waits for it to complete.
+func (s *TradeService) call(trade *types.Trade, fn func() error) error {
+	return s.worker(trade).call(fn)
+}
+
+// Snapshot returns a copy of the trade state as of the last change made by
+// its worker. Use this instead of reading trade.State directly.
+func (s *TradeService) Snapshot(trade *types.Trade) types.TradeState {
+	return s.worker(trade).getSnapshot()
 }
 
-func (s *TradeService) calculateProfit(trade *types.Trade, price float64) float64 {
-	grossSellCost := price * trade.State.SellableQuantity
-	netSellCost := grossSellCost * (1 - trade.State.Fee)
-	profit := (netSellCost - trade.State.BuyCost) / trade.State.BuyCost * 100
+// Calculate the profit based on the trade being sold at the given price.
+// Returns a percentage value in the range of 0-100.
+func (s *TradeService) CalculateProfit(trade *types.Trade, price decimal.Decimal) float64 {
+	var profit float64
+	s.call(trade, func() error {
+		profit = s.calculateProfit(trade, price)
+		return nil
+	})
 	return profit
 }
 
+func (s *TradeService) calculateProfit(trade *types.Trade, price decimal.Decimal) float64 {
+	if !trade.State.BuyCost.IsPositive() {
+		return 0
+	}
+	grossSellCost := price.Mul(trade.State.SellableQuantity)
+	netSellCost := grossSellCost.Mul(decimal.NewFromInt(1).Sub(s.projectedFee(trade, false)))
+	profit := netSellCost.Sub(trade.State.BuyCost).Mul(decimal.NewFromInt(100)).
+		Div(trade.State.BuyCost)
+	return profit.Float64()
+}
+
 func (s *TradeService) tradeStreamListener() {
 	for {
 		lastTrade := <-s.tradeStreamChannel
-		// Events come externally, must lock.
-		s.lock.Lock()
 		s.onLastTrade(lastTrade)
-		s.lock.Unlock()
 	}
 }
 
+// onLastTrade hands the price to the worker of each trade for the symbol.
 func (s *TradeService) onLastTrade(lastTrade binanceapi.StreamAggTrade) {
-	for _, trade := range s.TradesByLocalID {
+	price, err := decimal.NewFromFloatChecked(lastTrade.Price)
+	if err == nil {
+		_, err = decimal.NewFromFloatChecked(lastTrade.Quantity)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": lastTrade.Symbol,
+		}).Warnf("Dropping trade with an invalid price or quantity")
+		return
+	}
 
-		if trade.IsDone() {
-			continue
+	s.lock.Lock()
+	workers := []*tradeWorker{}
+	for _, worker := range s.workers {
+		if worker.symbol == lastTrade.Symbol {
+			workers = append(workers, worker)
 		}
+	}
+	s.lock.Unlock()
+
+	s.cachePrice(lastTrade.Symbol, price)
+	s.checkGuards(lastTrade.Symbol, price, time.Now())
+	if len(workers) > 0 {
+		s.addVolume(lastTrade.Symbol, decimal.NewFromFloat(lastTrade.Quantity))
+	}
+	for _, worker := range workers {
+		trade := worker.trade
+		worker.offerPrice(price, func(price decimal.Decimal) {
+			s.onPrice(trade, price)
+		})
+	}
+}
 
-		if trade.State.Symbol == lastTrade.Symbol {
+func (s *TradeService) onPrice(trade *types.Trade, price decimal.Decimal) {
+	if trade.IsDone() {
+		return
+	}
 
-			switch trade.State.Status {
-			case types.TradeStatusPendingSell:
-			case types.TradeStatusWatching:
-			default:
-				continue
-			}
+	switch trade.State.Status {
+	case types.TradeStatusPendingBuy:
+		s.checkRunaway(trade, price)
+		return
+	case types.TradeStatusPendingSell:
+	case types.TradeStatusWatching:
+	default:
+		return
+	}
 
-			trade.State.LastPrice = lastTrade.Price
-			trade.State.ProfitPercent = s.calculateProfit(trade, lastTrade.Price)
+	trade.State.LastPrice = price
+	trade.State.ProfitPercent = s.calculateProfit(trade, price)
 
-			if trade.State.StopLoss.Enabled {
-				s.checkStopLoss(trade)
-			}
-			if trade.State.TrailingProfit.Enabled {
-				s.checkTrailingProfit(trade, lastTrade.Price)
-			}
-		}
+	if trade.State.StopLoss.Enabled {
+		s.checkStopLoss(trade, price)
+	}
+	if trade.State.TrailingProfit.Enabled {
+		s.checkTrailingProfit(trade, price)
 	}
 }
 
-func (s *TradeService) checkStopLoss(trade *types.Trade) {
+func (s *TradeService) checkStopLoss(trade *types.Trade, price decimal.Decimal) {
 	switch trade.State.Status {
 	case types.TradeStatusPendingSell:
 	case types.TradeStatusWatching:
@@ -148,20 +288,20 @@ func (s *TradeService) checkStopLoss(trade *types.Trade) {
 	if trade.State.StopLoss.Triggered {
 		return
 	}
-	if trade.State.ProfitPercent < math.Abs(trade.State.StopLoss.Percent)*-1 {
+	stop := s.updateStopPrice(trade, price)
+	if price.LessThan(stop) {
 		log.WithFields(log.Fields{
-			"symbol": trade.State.Symbol,
-			"loss":   trade.State.ProfitPercent,
+			"symbol":    trade.State.Symbol,
+			"loss":      trade.State.ProfitPercent,
+			"stopPrice": stop,
 		}).Infof("Stop Loss: Triggering market sell.")
-		if trade.State.Status == types.TradeStatusPendingSell {
-			s.cancelSell(trade)
-		}
-		trade.State.StopLoss.Triggered = true
-		s.marketSell(trade)
+		s.recordTrigger(trade, types.TriggerStopLoss, trade.State.LastPrice)
+		s.recordStopLoss(trade.State.Symbol, time.Now())
+		s.startExit(trade, types.TriggerStopLoss, trade.State.LastPrice)
 	}
 }
 
-func (s *TradeService) checkTrailingProfit(trade *types.Trade, price float64) {
+func (s *TradeService) checkTrailingProfit(trade *types.Trade, price decimal.Decimal) {
 	switch trade.State.Status {
 	case types.TradeStatusPendingSell:
 	case types.TradeStatusWatching:
@@ -174,15 +314,16 @@ func (s *TradeService) checkTrailingProfit(trade *types.Trade, price float64) {
 	}
 
 	if trade.State.TrailingProfit.Activated {
-		if price > trade.State.TrailingProfit.Price {
-			trade.State.TrailingProfit.Price = price
+		if price.GreaterThan(trade.State.TrailingProfit.Price) {
+			s.updatePrices(trade, types.PricesUpdatedEvent{TrailingProfitPrice: &price})
 			log.WithFields(log.Fields{
 				"symbol":   trade.State.Symbol,
 				"price-hi": price,
 			}).Info("Trailing Stop: Increasing high price.")
 		} else {
-			deviation := (price - trade.State.TrailingProfit.Price) /
-				trade.State.TrailingProfit.Price * 100
+			deviation := price.Sub(trade.State.TrailingProfit.Price).
+				Mul(decimal.NewFromInt(100)).
+				Div(trade.State.TrailingProfit.Price).Float64()
 
 			log.WithFields(log.Fields{
 				"symbol":    trade.State.Symbol,
@@ -195,8 +336,10 @@ func (s *TradeService) checkTrailingProfit(trade *types.Trade, price float64) {
 					"symbol":  trade.State.Symbol,
 					"percent": trade.State.ProfitPercent,
 				}).Infof("Executing trailing profit sell")
-				trade.State.TrailingProfit.Triggered = true
-				s.marketSell(trade)
+				s.recordTrigger(trade, types.TriggerTrailingProfit,
+					trade.State.TrailingProfit.Price)
+				s.startExit(trade, types.TriggerTrailingProfit,
+					trade.State.TrailingProfit.Price)
 			}
 		}
 	} else {
@@ -207,39 +350,66 @@ func (s *TradeService) checkTrailingProfit(trade *types.Trade, price float64) {
 				"trailingProfitPercent":   trade.State.TrailingProfit.Percent,
 				"trailingProfitDeviation": trade.State.TrailingProfit.Deviation,
 			}).Infof("Activating trailing profit")
-			trade.State.TrailingProfit.Activated = true
+			s.recordTrigger(trade, types.TriggerTrailingProfitActivated, price)
+			db.DbUpdateTrade(trade)
 			s.broadcastTradeUpdate(trade)
 		}
 	}
 
 }
 
+// GetAllTrades returns a snapshot of every trade. Changes to the returned
+// trades are not seen by the trade service.
 func (s *TradeService) GetAllTrades() []*types.Trade {
 	s.lock.Lock()
-	defer s.lock.Unlock()
-	trades := []*types.Trade{}
+	workers := []*tradeWorker{}
 	for _, trade := range s.TradesByLocalID {
-		trades = append(trades, trade)
+		workers = append(workers, s.workerLocked(trade))
+	}
+	s.lock.Unlock()
+
+	trades := []*types.Trade{}
+	for _, worker := range workers {
+		trades = append(trades, types.NewTradeWithState(worker.getSnapshot()))
 	}
 	return trades
 }
 
 func (s *TradeService) Subscribe(name string) chan TradeEvent {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	s.subscriberLock.Lock()
+	defer s.subscriberLock.Unlock()
 	channel := make(chan TradeEvent, 3)
 	s.subscribers[channel] = name
 	return channel
 }
 
+// SubscribeBlocking subscribes to trade events without ever dropping one,
+// broadcasting waits for the subscriber instead. The subscriber must keep
+// reading until it unsubscribes.
+func (s *TradeService) SubscribeBlocking(name string) chan TradeEvent {
+	s.subscriberLock.Lock()
+	defer s.subscriberLock.Unlock()
+	channel := make(chan TradeEvent, 256)
+	s.subscribers[channel] = name
+	s.blockingSubscribers[channel] = true
+	return channel
+}
+
 func (s *TradeService) Unsubscribe(channel chan TradeEvent) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	s.subscriberLock.Lock()
+	defer s.subscriberLock.Unlock()
 	delete(s.subscribers, channel)
+	delete(s.blockingSubscribers, channel)
 }
 
 func (s *TradeService) broadcastTradeEvent(tradeEvent TradeEvent) {
+	s.subscriberLock.RLock()
+	defer s.subscriberLock.RUnlock()
 	for channel := range s.subscribers {
+		if s.blockingSubscribers[channel] {
+			channel <- tradeEvent
+			continue
+		}
 		select {
 		case channel <- tradeEvent:
 		default:
@@ -250,9 +420,9 @@ func (s *TradeService) broadcastTradeEvent(tradeEvent TradeEvent) {
 }
 
 func (s *TradeService) BroadcastTradeUpdate(trade *types.Trade) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.broadcastTradeUpdate(trade)
+	s.worker(trade).post(func() {
+		s.broadcastTradeUpdate(trade)
+	})
 }
 
 func (s *TradeService) broadcastTradeUpdate(trade *types.Trade) {
@@ -264,8 +434,6 @@ func (s *TradeService) broadcastTradeUpdate(trade *types.Trade) {
 }
 
 func (s *TradeService) BroadcastTradeArchived(tradeId string) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
 	s.broadcastTradeArchived(tradeId)
 }
 
@@ -288,9 +456,10 @@ func (s *TradeService) findTradeByLocalID(localId string) *types.Trade {
 }
 
 func (s *TradeService) AbandonTrade(trade *types.Trade) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.abandonTrade(trade)
+	s.call(trade, func() error {
+		s.abandonTrade(trade)
+		return nil
+	})
 }
 
 func (s *TradeService) abandonTrade(trade *types.Trade) {
@@ -301,23 +470,25 @@ func (s *TradeService) abandonTrade(trade *types.Trade) {
 }
 
 func (s *TradeService) ArchiveTrade(trade *types.Trade) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	if trade.IsDone() {
-		if err := db.DbArchiveTrade(trade); err != nil {
-			return err
+	err := s.call(trade, func() error {
+		if !trade.IsDone() {
+			return fmt.Errorf("archive not allowed in state %s", trade.State.Status)
 		}
-		s.removeTrade(trade)
-		s.broadcastTradeArchived(trade.State.TradeID)
-		return nil
+		return db.DbArchiveTrade(trade)
+	})
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("archive not allowed in state %s", trade.State.Status)
+	s.RemoveTrade(trade)
+	s.broadcastTradeArchived(trade.State.TradeID)
+	return nil
 }
 
 func (s *TradeService) AddClientOrderId(trade *types.Trade, orderId string) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.addClientOrderId(trade, orderId)
+	s.call(trade, func() error {
+		s.addClientOrderId(trade, orderId)
+		return nil
+	})
 }
 
 func (s *TradeService) addClientOrderId(trade *types.Trade, orderId string) {
@@ -325,48 +496,92 @@ func (s *TradeService) addClientOrderId(trade *types.Trade, orderId string) {
 		"symbol":  trade.State.Symbol,
 		"orderId": trade.State.TradeID,
 	}).Debugf("Adding client order ID to trade")
-	trade.AddClientOrderID(orderId)
+	s.applyEvent(trade, types.TradeEvent{
+		Type: types.TradeEventOrderPlaced,
+		OrderPlaced: &types.OrderPlacedEvent{
+			ClientOrderID: orderId,
+		},
+	})
+	s.lock.Lock()
 	s.TradesByClientID[orderId] = trade
+	s.lock.Unlock()
 	db.DbUpdateTrade(trade)
 }
 
+// UpdateSellableQuantity recalculates the sellable quantity and saves the
+// trade.
 func (s *TradeService) UpdateSellableQuantity(trade *types.Trade) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.updateSellableQuantity(trade)
+	s.call(trade, func() error {
+		s.updateSellableQuantity(trade)
+		return db.DbUpdateTrade(trade)
+	})
 }
 
 func (s *TradeService) updateSellableQuantity(trade *types.Trade) {
 	feeAsset := trade.FeeAsset()
 	if feeAsset == "BNB" {
-		trade.State.SellableQuantity = trade.State.BuyFillQuantity
+		trade.UpdateSellableQuantity(decimal.Zero)
 	} else if feeAsset != "" {
 		stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
 		if err != nil {
 			log.WithError(err).WithField("symbol", trade.State.Symbol).
 				Error("Failed to get symbol step size.")
 		} else {
-			trade.State.SellableQuantity = fixQuantityToStepSize(trade.State.BuyFillQuantity, stepSize)
+			trade.UpdateSellableQuantity(stepSize)
 		}
 	}
 }
 
 func (s *TradeService) RestoreTrade(trade *types.Trade) {
 	s.lock.Lock()
-	defer s.lock.Unlock()
 	s.TradesByLocalID[trade.State.TradeID] = trade
 	for clientOrderId := range trade.State.ClientOrderIDs {
 		s.TradesByClientID[clientOrderId] = trade
 	}
+	s.lock.Unlock()
+	s.call(trade, func() error {
+		s.restoreTrade(trade)
+		return nil
+	})
+}
+
+func (s *TradeService) restoreTrade(trade *types.Trade) {
 	s.updateSellableQuantity(trade)
 	if !trade.IsDone() {
 		s.tradeStreamManager.AddSymbol(trade.State.Symbol)
 	}
+
+	// Resume an exit that was running when the server stopped.
+	if trade.State.Exit != nil && !trade.State.Exit.Complete && !trade.IsDone() &&
+		trade.State.Status != types.TradeStatusExitFailed {
+		go s.runExit(trade)
+	}
+
+	// Resume an algo, it picks up its working child order.
+	if trade.State.Algo.Active() && !trade.IsDone() {
+		go s.runAlgo(trade)
+	}
+
+	// Resume the entry policy of a buy that is still pending.
+	switch trade.State.Status {
+	case types.TradeStatusNew, types.TradeStatusPendingBuy:
+		s.startEntry(trade)
+	}
+
+	// Trades created before the event log existed get their current state
+	// recorded as the starting point for replay.
+	events, err := db.DbGetTradeEvents(trade.State.TradeID)
+	if err != nil {
+		log.WithError(err).WithField("tradeId", trade.State.TradeID).
+			Errorf("Failed to load trade events")
+	} else if len(events) == 0 {
+		s.recordCreated(trade)
+	}
 }
 
+// AddNewTrade adds a trade that is not yet known to the service. The trade
+// must not be modified by the caller after it has been added.
 func (s *TradeService) AddNewTrade(trade *types.Trade) string {
-	s.lock.Lock()
-	defer s.lock.Unlock()
 	if trade.State.TradeID == "" {
 		localId, err := s.idGenerator.GetID(nil)
 		if err != nil {
@@ -375,36 +590,50 @@ func (s *TradeService) AddNewTrade(trade *types.Trade) string {
 		trade.State.TradeID = localId.String()
 	}
 	trade.State.Status = types.TradeStatusNew
+	tradeId := trade.State.TradeID
+	symbol := trade.State.Symbol
 
-	s.TradesByLocalID[trade.State.TradeID] = trade
+	s.lock.Lock()
+	s.TradesByLocalID[tradeId] = trade
 	for clientOrderId := range trade.State.ClientOrderIDs {
 		log.WithFields(log.Fields{
-			"tradeId":       trade.State.TradeID,
+			"tradeId":       tradeId,
 			"clientOrderId": clientOrderId,
 		}).Debugf("Recording clientOrderId for new trade.")
 		s.TradesByClientID[clientOrderId] = trade
 	}
+	worker := s.workerLocked(trade)
+	s.lock.Unlock()
 
-	if err := db.DbSaveTrade(trade); err != nil {
-		log.WithError(err).Errorf("Failed to save trade to database")
-	}
-
-	s.tradeStreamManager.AddSymbol(trade.State.Symbol)
-	s.broadcastTradeUpdate(trade)
+	worker.call(func() error {
+		if err := db.DbSaveTrade(trade); err != nil {
+			log.WithError(err).Errorf("Failed to save trade to database")
+		}
+		s.recordCreated(trade)
+		s.tradeStreamManager.AddSymbol(trade.State.Symbol)
+		s.broadcastTradeUpdate(trade)
+		s.startEntry(trade)
+		return nil
+	})
 
-	lastPrice, err := binanceapi.NewRestClient().GetPriceTicker(trade.State.Symbol)
-	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
-			"symbol": trade.State.Symbol,
-		}).Errorf("Failed to get last price for new trade")
-	} else {
-		if trade.State.LastPrice == 0 {
-			trade.State.LastPrice = lastPrice.Price
-			s.broadcastTradeUpdate(trade)
+	// Fetch the last price off the worker so the buy isn't held up.
+	go func() {
+		lastPrice, err := s.exchange.GetPriceTicker(symbol)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"symbol": symbol,
+			}).Errorf("Failed to get last price for new trade")
+			return
 		}
-	}
+		worker.post(func() {
+			if trade.State.LastPrice.IsZero() {
+				trade.State.LastPrice = decimal.NewFromFloat(lastPrice.Price)
+				s.broadcastTradeUpdate(trade)
+			}
+		})
+	}()
 
-	return trade.State.TradeID
+	return tradeId
 }
 
 func (s *TradeService) RemoveTrade(trade *types.Trade) {
@@ -414,6 +643,10 @@ func (s *TradeService) RemoveTrade(trade *types.Trade) {
 }
 
 func (s *TradeService) removeTrade(trade *types.Trade) {
+	if worker, ok := s.workers[trade.State.TradeID]; ok {
+		worker.stop()
+		delete(s.workers, trade.State.TradeID)
+	}
 	delete(s.TradesByLocalID, trade.State.TradeID)
 	for clientId := range trade.State.ClientOrderIDs {
 		log.WithFields(log.Fields{
@@ -425,10 +658,11 @@ func (s *TradeService) removeTrade(trade *types.Trade) {
 }
 
 func (s *TradeService) FailTrade(trade *types.Trade) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.closeTrade(trade, types.TradeStatusFailed, time.Now())
-	s.broadcastTradeUpdate(trade)
+	s.call(trade, func() error {
+		s.closeTrade(trade, types.TradeStatusFailed, time.Now())
+		s.broadcastTradeUpdate(trade)
+		return nil
+	})
 }
 
 func (s *TradeService) FindTradeForReport(report binanceapi.StreamExecutionReport) *types.Trade {
@@ -454,19 +688,63 @@ func (s *TradeService) findTradeForReport(report binanceapi.StreamExecutionRepor
 	return nil
 }
 
-// Note: Be sure to process reports even after a fill, as sometimes partial
-//       fills will be received after the fill report.
+// OnExecutionReport queues the report to the worker of the trade it belongs
+// to. Reports for a trade are processed in the order received.
 func (s *TradeService) OnExecutionReport(event *binanceex.UserStreamEvent) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
 	report := event.ExecutionReport
 
+	if err := checkReportAmounts(report); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol":  report.Symbol,
+			"orderId": report.OrderID,
+		}).Errorf("Dropping execution report with an invalid amount")
+		return
+	}
+
+	s.lock.Lock()
 	trade := s.findTradeForReport(report)
 	if trade == nil {
-		log.Errorf("Failed to find trade for execution report: %s", log.ToJson(report))
+		s.lock.Unlock()
+		log.WithFields(log.Fields{
+			"symbol":  report.Symbol,
+			"orderId": report.OrderID,
+			"side":    report.Side,
+		}).Infof("Recording execution report for order not placed by Maker")
+		s.recordExternalReport(event.EventTime, report)
 		return
 	}
+	worker := s.workerLocked(trade)
+	s.lock.Unlock()
+
+	worker.post(func() {
+		s.onExecutionReport(trade, event)
+	})
+}
+
+// checkReportAmounts returns an error if an amount of the report can't be
+// held by a decimal. The amounts are converted without checking from here
+// on.
+func checkReportAmounts(report binanceapi.StreamExecutionReport) error {
+	for _, amount := range []float64{
+		report.Price,
+		report.Quantity,
+		report.StopPrice,
+		report.LastExecutedPrice,
+		report.LastExecutedQuantity,
+		report.CumulativeFilledQuantity,
+		report.CommissionAmount,
+	} {
+		if _, err := decimal.NewFromFloatChecked(amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Note: Be sure to process reports even after a fill, as sometimes partial
+//       fills will be received after the fill report.
+func (s *TradeService) onExecutionReport(trade *types.Trade, event *binanceex.UserStreamEvent) {
+	report := event.ExecutionReport
 
 	log.WithFields(log.Fields{
 		"tradeId": trade.State.TradeID,
@@ -479,109 +757,44 @@ func (s *TradeService) OnExecutionReport(event *binanceex.UserStreamEvent) {
 		Fields:    report,
 	})
 
-	_, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
+	stepSize, err := s.binanceExchangeInfo.GetStepSize(trade.State.Symbol)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"symbol": trade.State.Symbol,
 		}).Error("Failed to get Binance symbol information.")
 	}
 
-	switch report.Side {
-	case binanceapi.OrderSideBuy:
-		switch report.CurrentOrderStatus {
-		case binanceapi.OrderStatusNew:
-			trade.State.OpenTime = event.EventTime
-			trade.State.BuyOrder.Quantity = report.Quantity
-			trade.State.BuyOrder.Price = report.Price
-			trade.State.BuyOrderId = report.OrderID
-			if trade.State.Status == types.TradeStatusNew {
-				trade.State.Status = types.TradeStatusPendingBuy
-			}
-			if trade.State.LastBuyStatus == "" {
-				trade.State.LastBuyStatus = report.CurrentOrderStatus
-			}
-		case binanceapi.OrderStatusCanceled:
-			if trade.State.BuyFillQuantity == 0 {
-				trade.State.Status = types.TradeStatusCanceled
-			} else {
-				trade.State.Status = types.TradeStatusWatching
-			}
-			trade.State.LastBuyStatus = report.CurrentOrderStatus
-		case binanceapi.OrderStatusPartiallyFilled:
-			if trade.State.LastBuyStatus != binanceapi.OrderStatusFilled {
-				trade.State.LastBuyStatus = report.CurrentOrderStatus
-			}
-			trade.AddBuyFill(report)
-			s.updateSellableQuantity(trade)
-		case binanceapi.OrderStatusFilled:
-			trade.AddBuyFill(report)
-			s.updateSellableQuantity(trade)
-			trade.State.Status = types.TradeStatusWatching
-			trade.State.LastBuyStatus = report.CurrentOrderStatus
-			s.triggerLimitSell(trade)
-		}
-
-	case binanceapi.OrderSideSell:
-		switch report.CurrentOrderStatus {
-		case binanceapi.OrderStatusNew:
-			if trade.State.Status == types.TradeStatusDone {
-				// Sometimes we get the fill before the new.
-				break
-			}
-			trade.State.SellOrderId = report.OrderID
-			trade.State.Status = types.TradeStatusPendingSell
-			switch trade.State.SellOrder.Status {
-			case binanceapi.OrderStatusPartiallyFilled:
-			case binanceapi.OrderStatusFilled:
-			default:
-				trade.State.SellOrder.Status = report.CurrentOrderStatus
-			}
-			trade.State.SellOrder.Type = report.OrderType
-			trade.State.SellOrder.Quantity = report.Quantity
-			trade.State.SellOrder.Price = report.Price
-		case binanceapi.OrderStatusPartiallyFilled:
-			fill := types.OrderFill{
-				Price:            report.LastExecutedPrice,
-				Quantity:         report.LastExecutedQuantity,
-				CommissionAsset:  report.CommissionAsset,
-				CommissionAmount: report.CommissionAmount,
-			}
-			trade.DoAddSellFill(fill)
-			if trade.State.SellOrder.Status != binanceapi.OrderStatusFilled {
-				trade.State.SellOrder.Status = report.CurrentOrderStatus
-			}
-		case binanceapi.OrderStatusFilled:
-			fill := types.OrderFill{
-				Price:            report.LastExecutedPrice,
-				Quantity:         report.LastExecutedQuantity,
-				CommissionAsset:  report.CommissionAsset,
-				CommissionAmount: report.CommissionAmount,
-			}
-			trade.DoAddSellFill(fill)
-			trade.State.Status = types.TradeStatusDone
-			trade.State.SellOrder.Status = report.CurrentOrderStatus
-		case binanceapi.OrderStatusCanceled:
-			trade.State.Status = types.TradeStatusWatching
-			trade.State.SellOrder.Status = report.CurrentOrderStatus
-		default:
-			log.WithFields(log.Fields{
-				"symbol":             trade.State.Symbol,
-				"currentOrderStatus": report.CurrentOrderStatus,
-				"side":               "sell",
-			}).Errorf("Unknown current order status in execution report")
-			trade.State.SellOrder.Status = report.CurrentOrderStatus
+	wasDone := trade.IsDone()
+	transition, err := trade.OnExecutionReport(event.EventTime, report, stepSize)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"tradeId":     trade.State.TradeID,
+			"symbol":      trade.State.Symbol,
+			"side":        report.Side,
+			"orderStatus": report.CurrentOrderStatus,
+		}).Errorf("Rejected trade status change from execution report")
+	}
+	if transition.Stale {
+		log.WithFields(log.Fields{
+			"tradeId":     trade.State.TradeID,
+			"symbol":      trade.State.Symbol,
+			"orderId":     report.OrderID,
+			"orderStatus": report.CurrentOrderStatus,
+		}).Infof("Execution report received out of order")
+	}
+	for _, tradeEvent := range transition.Events {
+		if tradeEvent.Fill != nil {
+			s.convertCommission(trade, &tradeEvent.Fill.Fill)
 		}
+		s.applyEvent(trade, tradeEvent)
 	}
-
-	switch trade.State.Status {
-	case types.TradeStatusDone:
-		fallthrough
-	case types.TradeStatusCanceled:
-		fallthrough
-	case types.TradeStatusFailed:
-		trade.State.CloseTime = &event.EventTime
+	s.onAlgoReport(trade, report)
+	if trade.IsDone() && !wasDone {
 		s.tradeStreamManager.RemoveSymbol(trade.State.Symbol)
 	}
+	if transition.BuyFilled {
+		s.triggerLimitSell(trade)
+	}
 
 	db.DbUpdateTrade(trade)
 	s.broadcastTradeUpdate(trade)
@@ -600,7 +813,7 @@ func (s *TradeService) triggerLimitSell(trade *types.Trade) {
 			log.WithFields(log.Fields{
 				"tradeId": trade.State.TradeID,
 				"symbol":  trade.State.Symbol,
-			}).Infof("Triggering limit sell at price %f.",
+			}).Infof("Triggering limit sell at price %s.",
 				trade.State.LimitSell.Price)
 			s.limitSellByPrice(trade, trade.State.LimitSell.Price)
 		} else {
@@ -618,122 +831,123 @@ func (s *TradeService) triggerLimitSell(trade *types.Trade) {
 }
 
 func (s *TradeService) CloseTrade(trade *types.Trade, status types.TradeStatus, closeTime time.Time) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.closeTrade(trade, status, closeTime)
+	s.call(trade, func() error {
+		s.closeTrade(trade, status, closeTime)
+		return nil
+	})
 }
 
 func (s *TradeService) closeTrade(trade *types.Trade, status types.TradeStatus, closeTime time.Time) {
-	if closeTime.IsZero() {
-		closeTime = time.Now()
-	}
-	trade.State.Status = status
-	trade.State.CloseTime = &closeTime
-	s.tradeStreamManager.RemoveSymbol(trade.State.Symbol)
+	s.changeStatus(trade, status, closeTime)
 	db.DbUpdateTrade(trade)
 }
 
-func (s *TradeService) MarketSell(trade *types.Trade, locked bool) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.marketSell(trade)
+func (s *TradeService) MarketSell(trade *types.Trade) error {
+	return s.call(trade, func() error {
+		return s.marketSell(trade)
+	})
 }
 
 func (s *TradeService) marketSell(trade *types.Trade) error {
-	quantity := trade.State.SellableQuantity - trade.State.SellFillQuantity
+	if trade.State.Exit != nil && !trade.State.Exit.Complete &&
+		trade.State.Status != types.TradeStatusExitFailed {
+		return fmt.Errorf("exit already in progress")
+	}
+	if trade.State.Algo.Active() {
+		return fmt.Errorf("algo still running")
+	}
 
-	if trade.State.Status == types.TradeStatusPendingSell {
-		log.WithFields(log.Fields{
-			"symbol": trade.State.Symbol,
-		}).Infof("Cancelling pending sell order before market sell")
-		s.cancelSell(trade)
+	if execution := s.exitExecution(trade); execution.Mode != types.ExitExecutionMarket ||
+		execution.DepthChunks {
+		return s.marketSellExit(trade)
 	}
 
-	clientOrderId, err := s.MakeOrderID()
+	order, err := s.marketSellOrder(trade)
 	if err != nil {
-		log.WithError(err).Errorf("Failed to generate order ID")
 		return err
 	}
 
-	s.addClientOrderId(trade, clientOrderId)
+	if trade.State.Status == types.TradeStatusPendingSell {
+		log.WithFields(log.Fields{
+			"symbol": trade.State.Symbol,
+		}).Infof("Cancelling pending sell order before market sell")
+		s.cancelSell(trade)
+	}
 
 	log.WithFields(log.Fields{
 		"symbol":   trade.State.Symbol,
-		"quantity": quantity,
+		"quantity": order.Quantity,
 		"tradeId":  trade.State.TradeID,
 	}).Info("Posting market sell order.")
 
-	order := binanceapi.OrderParameters{
-		Symbol:           trade.State.Symbol,
-		Side:             binanceapi.OrderSideSell,
-		Type:             binanceapi.OrderTypeMarket,
-		Quantity:         quantity,
-		NewClientOrderId: clientOrderId,
-	}
-	_, err = binanceex.GetBinanceRestClient().PostOrder(order)
+	_, err = s.postOrder(trade, order)
 	return err
 }
 
-func (s *TradeService) LimitSellByPercent(trade *types.Trade, percent float64) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.limitSellByPercent(trade, percent)
+// marketSellExit sells the trade with an exit, for slippage protection.
+func (s *TradeService) marketSellExit(trade *types.Trade) error {
+	log.WithFields(log.Fields{
+		"symbol":  trade.State.Symbol,
+		"tradeId": trade.State.TradeID,
+	}).Info("Starting market sell exit.")
+	s.recordTrigger(trade, types.TriggerMarketSell, trade.State.LastPrice)
+	s.startExit(trade, types.TriggerMarketSell, trade.State.LastPrice)
+	s.broadcastTradeUpdate(trade)
+	return nil
 }
 
-func (s *TradeService) limitSellByPercent(trade *types.Trade, percent float64) error {
-	symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+// marketSellOrder builds a market sell of the quantity not sold yet.
+func (s *TradeService) marketSellOrder(trade *types.Trade) (binanceapi.OrderParameters, error) {
+	quantity, err := s.binanceExchangeInfo.QuantityParameter(trade.State.Symbol,
+		trade.State.SellableQuantity.Sub(trade.State.SellFillQuantity))
 	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
-			"symbol": trade.State.Symbol,
-		}).Error("Failed to get info for symbol.")
-		return err
+		return binanceapi.OrderParameters{}, err
 	}
+	return binanceapi.OrderParameters{
+		Symbol:   trade.State.Symbol,
+		Side:     binanceapi.OrderSideSell,
+		Type:     binanceapi.OrderTypeMarket,
+		Quantity: quantity,
+	}, nil
+}
 
-	price := trade.State.BuyCost *
-		(1 + trade.State.Fee) * (1 + (percent / 100)) /
-		trade.State.SellableQuantity
-	price = util.Roundx(price, 1/symbolInfo.TickSize)
-
-	tickSize := symbolInfo.TickSize
-	if price <= trade.State.EffectiveBuyPrice {
-		fixedPrice := price + tickSize
-		log.WithFields(log.Fields{
-			"tickSize":          tickSize,
-			"symbol":            trade.State.Symbol,
-			"price":             price,
-			"effectiveBuyPrice": trade.State.EffectiveBuyPrice,
-			"newPrice":          fixedPrice,
-		}).Warnf("Sell price <= effective buy price, incrementing by tick size.")
-		price = fixedPrice
-	}
+func (s *TradeService) LimitSellByPercent(trade *types.Trade, percent float64) error {
+	return s.call(trade, func() error {
+		return s.limitSellByPercent(trade, percent)
+	})
+}
 
+func (s *TradeService) limitSellByPercent(trade *types.Trade, percent float64) error {
 	clientOrderId, err := s.MakeOrderID()
 	if err != nil {
 		log.WithError(err).Errorf("Failed to generate clientOrderId")
 		return err
 	}
-	s.addClientOrderId(trade, clientOrderId)
+	return s.limitSellByPercentWithID(trade, percent, clientOrderId)
+}
 
-	quantity := trade.State.SellableQuantity - trade.State.SellFillQuantity
+func (s *TradeService) limitSellByPercentWithID(trade *types.Trade, percent float64,
+	clientOrderId string) error {
+	price, err := s.limitSellPriceByPercent(trade, percent)
+	if err != nil {
+		return err
+	}
+
+	quantity := trade.State.SellableQuantity.Sub(trade.State.SellFillQuantity)
 
 	log.WithFields(log.Fields{
-		"price":    fmt.Sprintf("%.8f", price),
+		"price":    price,
 		"symbol":   trade.State.Symbol,
 		"tradeId":  trade.State.TradeID,
 		"quantity": quantity,
 	}).Debugf("Posting limit sell order at percent.")
 
-	order := binanceapi.OrderParameters{
-		Symbol:           trade.State.Symbol,
-		Side:             binanceapi.OrderSideSell,
-		Type:             binanceapi.OrderTypeLimit,
-		TimeInForce:      binanceapi.TimeInForceGTC,
-		Quantity:         quantity,
-		Price:            price,
-		NewClientOrderId: clientOrderId,
+	order, err := s.limitSellOrder(trade.State.Symbol, quantity, price, clientOrderId)
+	if err != nil {
+		return err
 	}
 	s0 := time.Now()
-	_, err = binanceex.GetBinanceRestClient().PostOrder(order)
+	_, err = s.postOrder(trade, order)
 	d := time.Now().Sub(s0)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -756,10 +970,14 @@ func (s *TradeService) limitSellByPercent(trade *types.Trade, percent float64) e
 		"clientOrderId": clientOrderId,
 	})
 
-	trade.State.LimitSell.Enabled = true
-	trade.State.LimitSell.Percent = percent
-	trade.State.LimitSell.Price = price
-	trade.State.LimitSell.Type = types.LimitSellTypePercent
+	s.recordSettings(trade, types.SettingsChangedEvent{
+		LimitSell: &types.LimitSellState{
+			Enabled: true,
+			Type:    types.LimitSellTypePercent,
+			Percent: percent,
+			Price:   price,
+		},
+	})
 
 	db.DbUpdateTrade(trade)
 	s.broadcastTradeUpdate(trade)
@@ -767,37 +985,69 @@ func (s *TradeService) limitSellByPercent(trade *types.Trade, percent float64) e
 	return nil
 }
 
-func (s *TradeService) LimitSellByPrice(trade *types.Trade, price float64) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.limitSellByPrice(trade, price)
+// limitSellPriceByPercent returns the price to sell the trade at for a
+// profit of percent after the projected fees, rounded to the tick size.
+func (s *TradeService) limitSellPriceByPercent(trade *types.Trade, percent float64) (decimal.Decimal, error) {
+	symbolInfo, err := s.binanceExchangeInfo.GetSymbol(trade.State.Symbol)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"symbol": trade.State.Symbol,
+		}).Error("Failed to get info for symbol.")
+		return decimal.Zero, err
+	}
+
+	if !trade.State.SellableQuantity.IsPositive() {
+		return decimal.Zero, fmt.Errorf("nothing to sell")
+	}
+
+	price := trade.State.BuyCost.
+		Mul(decimal.NewFromInt(1).Add(s.projectedFee(trade, true))).
+		Mul(decimal.NewFromFloat(1 + (percent / 100))).
+		Div(trade.State.SellableQuantity)
+	price = price.Round(symbolInfo.TickSize)
+
+	tickSize := symbolInfo.TickSize
+	if price.LessThanOrEqual(trade.State.EffectiveBuyPrice) {
+		fixedPrice := price.Add(tickSize)
+		log.WithFields(log.Fields{
+			"tickSize":          tickSize,
+			"symbol":            trade.State.Symbol,
+			"price":             price,
+			"effectiveBuyPrice": trade.State.EffectiveBuyPrice,
+			"newPrice":          fixedPrice,
+		}).Warnf("Sell price <= effective buy price, incrementing by tick size.")
+		price = fixedPrice
+	}
+
+	return price, nil
 }
 
-func (s *TradeService) limitSellByPrice(trade *types.Trade, price float64) error {
+func (s *TradeService) LimitSellByPrice(trade *types.Trade, price decimal.Decimal) error {
+	return s.call(trade, func() error {
+		return s.limitSellByPrice(trade, price)
+	})
+}
+
+func (s *TradeService) limitSellByPrice(trade *types.Trade, price decimal.Decimal) error {
 	clientOrderId, err := s.MakeOrderID()
 	if err != nil {
 		log.WithError(err).Errorf("Failed to generate clientOrderId")
 		return err
 	}
-	s.addClientOrderId(trade, clientOrderId)
 
 	log.WithFields(log.Fields{
-		"price":    fmt.Sprintf("%.8f", price),
+		"price":    price,
 		"symbol":   trade.State.Symbol,
 		"tradeId":  trade.State.TradeID,
 		"quantity": trade.State.SellableQuantity,
 	}).Debugf("Posting limit sell order at price.")
 
-	order := binanceapi.OrderParameters{
-		Symbol:           trade.State.Symbol,
-		Side:             binanceapi.OrderSideSell,
-		Type:             binanceapi.OrderTypeLimit,
-		TimeInForce:      binanceapi.TimeInForceGTC,
-		Quantity:         trade.State.SellableQuantity,
-		Price:            price,
-		NewClientOrderId: clientOrderId,
+	order, err := s.limitSellOrder(trade.State.Symbol,
+		trade.State.SellableQuantity, price, clientOrderId)
+	if err != nil {
+		return err
 	}
-	_, err = binanceex.GetBinanceRestClient().PostOrder(order)
+	_, err = s.postOrder(trade, order)
 	if err != nil {
 		log.WithFields(log.Fields{}).WithError(err).Error("Failed to send sell order.")
 		return err
@@ -811,24 +1061,77 @@ func (s *TradeService) limitSellByPrice(trade *types.Trade, price float64) error
 	return nil
 }
 
+// limitSellOrder builds a GTC limit sell with the quantity and price
+// formatted to the symbol's step and tick size.
+func (s *TradeService) limitSellOrder(symbol string, quantity decimal.Decimal,
+	price decimal.Decimal, clientOrderId string) (binanceapi.OrderParameters, error) {
+	order := binanceapi.OrderParameters{
+		Symbol:           symbol,
+		Side:             binanceapi.OrderSideSell,
+		Type:             binanceapi.OrderTypeLimit,
+		TimeInForce:      binanceapi.TimeInForceGTC,
+		NewClientOrderId: clientOrderId,
+	}
+	var err error
+	order.Quantity, err = s.binanceExchangeInfo.QuantityParameter(symbol, quantity)
+	if err != nil {
+		return order, err
+	}
+	order.Price, err = s.binanceExchangeInfo.PriceParameter(symbol, price)
+	return order, err
+}
+
 func (s *TradeService) UpdateStopLoss(trade *types.Trade, enable bool, percent float64) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.updateStopLoss(trade, enable, percent)
-	s.broadcastTradeUpdate(trade)
+	s.call(trade, func() error {
+		s.updateStopLoss(trade, enable, percent)
+		return nil
+	})
 }
 
 func (s *TradeService) updateStopLoss(trade *types.Trade, enable bool, percent float64) {
-	trade.SetStopLoss(enable, percent)
+	stopLoss := trade.State.StopLoss
+	stopLoss.Enabled = enable
+	stopLoss.Percent = percent
+	s.updateStopLossSettings(trade, stopLoss)
+}
+
+// UpdateStopLossSettings replaces the stop loss settings of a trade. The
+// high price seen so far is kept, the stop price is worked out again on the
+// next price update.
+func (s *TradeService) UpdateStopLossSettings(trade *types.Trade, settings types.StopLossState) {
+	s.call(trade, func() error {
+		s.updateStopLossSettings(trade, settings)
+		return nil
+	})
+}
+
+func (s *TradeService) updateStopLossSettings(trade *types.Trade, settings types.StopLossState) {
+	stopLoss := settings
+	stopLoss.Triggered = trade.State.StopLoss.Triggered
+	stopLoss.HighPrice = trade.State.StopLoss.HighPrice
+	stopLoss.StopPrice = decimal.Zero
+	s.recordSettings(trade, types.SettingsChangedEvent{
+		StopLoss: &stopLoss,
+	})
 	log.WithFields(log.Fields{
-		"symbol":  trade.State.Symbol,
-		"tradeId": trade.State.TradeID,
-		"enable":  enable,
-		"percent": percent,
+		"symbol":           trade.State.Symbol,
+		"tradeId":          trade.State.TradeID,
+		"enable":           stopLoss.Enabled,
+		"mode":             stopLoss.Mode,
+		"percent":          stopLoss.Percent,
+		"price":            stopLoss.Price,
+		"breakEvenPercent": stopLoss.BreakEvenPercent,
+		"stepPercent":      stopLoss.StepPercent,
+		"stepRaisePercent": stopLoss.StepRaisePercent,
 	}).Infof("Stop loss settings updated")
 	trade.AddHistoryEntry(types.HistoryTypeStopLossUpdate, map[string]interface{}{
-		"enable":  enable,
-		"percent": percent,
+		"enable":           stopLoss.Enabled,
+		"mode":             stopLoss.Mode,
+		"percent":          stopLoss.Percent,
+		"price":            stopLoss.Price,
+		"breakEvenPercent": stopLoss.BreakEvenPercent,
+		"stepPercent":      stopLoss.StepPercent,
+		"stepRaisePercent": stopLoss.StepRaisePercent,
 	})
 	db.DbUpdateTrade(trade)
 	s.broadcastTradeUpdate(trade)
@@ -845,14 +1148,21 @@ func (s *TradeService) MakeOrderID() (string, error) {
 
 func (s *TradeService) UpdateTrailingProfit(trade *types.Trade, enable bool,
 	percent float64, deviation float64) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.updateTrailingProfit(trade, enable, percent, deviation)
+	s.call(trade, func() error {
+		s.updateTrailingProfit(trade, enable, percent, deviation)
+		return nil
+	})
 }
 
 func (s *TradeService) updateTrailingProfit(trade *types.Trade, enable bool,
 	percent float64, deviation float64) {
-	trade.SetTrailingProfit(enable, percent, deviation)
+	trailingProfit := trade.State.TrailingProfit
+	trailingProfit.Enabled = enable
+	trailingProfit.Percent = percent
+	trailingProfit.Deviation = deviation
+	s.recordSettings(trade, types.SettingsChangedEvent{
+		TrailingProfit: &trailingProfit,
+	})
 	log.WithFields(log.Fields{
 		"symbol":    trade.State.Symbol,
 		"tradeId":   trade.State.TradeID,
@@ -870,9 +1180,9 @@ func (s *TradeService) updateTrailingProfit(trade *types.Trade, enable bool,
 }
 
 func (s *TradeService) CancelSell(trade *types.Trade) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.cancelSell(trade)
+	return s.call(trade, func() error {
+		return s.cancelSell(trade)
+	})
 }
 
 func (s *TradeService) cancelSell(trade *types.Trade) error {
@@ -881,14 +1191,18 @@ func (s *TradeService) cancelSell(trade *types.Trade) error {
 		"tradeId": trade.State.TradeID,
 		"orderId": trade.State.SellOrderId,
 	}).Info("Cancelling sell order.")
-	_, err := binanceex.GetBinanceRestClient().CancelOrderById(
+	_, err := s.exchange.CancelOrderById(
 		trade.State.Symbol, trade.State.SellOrderId)
 	if err == nil {
 		trade.AddHistoryEntry(types.HistoryTypeSellCanceled, map[string]interface{}{
 			"sellOrderId": trade.State.SellOrderId,
 			"success":     true,
 		})
-		trade.State.LimitSell.Enabled = false
+		limitSell := trade.State.LimitSell
+		limitSell.Enabled = false
+		s.recordSettings(trade, types.SettingsChangedEvent{
+			LimitSell: &limitSell,
+		})
 	} else {
 		log.WithError(err).WithFields(log.Fields{
 			"symbol":  trade.State.Symbol,
@@ -907,13 +1221,13 @@ func (s *TradeService) cancelSell(trade *types.Trade) error {
 }
 
 func (s *TradeService) CancelBuy(trade *types.Trade) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.cancelBuy(trade)
+	return s.call(trade, func() error {
+		return s.cancelBuy(trade)
+	})
 }
 
 func (s *TradeService) cancelBuy(trade *types.Trade) error {
-	_, err := binanceex.GetBinanceRestClient().CancelOrderById(
+	_, err := s.exchange.CancelOrderById(
 		trade.State.Symbol, trade.State.BuyOrderId)
 	if err != nil {
 		trade.AddHistoryEntry(types.HistoryTypeBuyCanceled, map[string]interface{}{
@@ -928,12 +1242,3 @@ func (s *TradeService) cancelBuy(trade *types.Trade) error {
 	db.DbUpdateTrade(trade)
 	return err
 }
-
-// Return the sellable quantity adjusted for lot size.
-func fixQuantityToStepSize(quantity float64, stepSize float64) float64 {
-	fixedQuantity := util.Roundx(quantity, 1/stepSize)
-	if fixedQuantity > quantity {
-		fixedQuantity = util.Roundx(fixedQuantity-stepSize, 1/stepSize)
-	}
-	return fixedQuantity
-}
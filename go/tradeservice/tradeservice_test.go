@@ -0,0 +1,363 @@
+package tradeservice
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/binanceex"
+	"gitlab.com/crankykernel/maker/go/db"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeExchange answers every request after a fixed delay, like a slow
+// Binance REST API would.
+type fakeExchange struct {
+	latency time.Duration
+
+	// The prices returned by the tickers.
+	lastPrice float64
+	bidPrice  float64
+	askPrice  float64
+
+	// The error returned by cancels, and the order IDs canceled.
+	cancelErr error
+	canceled  []int64
+
+	// The error returned by posts, and the orders posted.
+	postErr error
+	posted  []binanceapi.OrderParameters
+
+	// The orders returned by client order ID, orders not found are NEW. If
+	// set, orderErr is returned instead.
+	orders   map[string]*binanceapi.OrderResponse
+	orderErr error
+
+	// The balances returned with the account.
+	balances []binanceapi.AccountBalance
+
+	lock    sync.Mutex
+	waiters map[string]chan binanceapi.OrderParameters
+}
+
+func newFakeExchange(latency time.Duration) *fakeExchange {
+	return &fakeExchange{
+		latency: latency,
+		orders:  make(map[string]*binanceapi.OrderResponse),
+		waiters: make(map[string]chan binanceapi.OrderParameters),
+	}
+}
+
+// waitForOrder returns a channel that receives the next order posted for
+// the symbol.
+func (e *fakeExchange) waitForOrder(symbol string) chan binanceapi.OrderParameters {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	channel := make(chan binanceapi.OrderParameters, 1)
+	e.waiters[symbol] = channel
+	return channel
+}
+
+func (e *fakeExchange) PostOrder(order binanceapi.OrderParameters) (*http.Response, error) {
+	e.lock.Lock()
+	e.posted = append(e.posted, order)
+	if channel, ok := e.waiters[order.Symbol]; ok {
+		delete(e.waiters, order.Symbol)
+		channel <- order
+	}
+	postErr := e.postErr
+	e.lock.Unlock()
+	time.Sleep(e.latency)
+	if postErr != nil {
+		return nil, postErr
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+	}, nil
+}
+
+func (e *fakeExchange) CancelOrderById(symbol string, orderId int64) (*http.Response, error) {
+	time.Sleep(e.latency)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.canceled = append(e.canceled, orderId)
+	if e.cancelErr != nil {
+		return nil, e.cancelErr
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+	}, nil
+}
+
+// canceledOrders returns the IDs of the orders canceled so far.
+func (e *fakeExchange) canceledOrders() []int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]int64{}, e.canceled...)
+}
+
+// postedOrders returns the orders posted so far.
+func (e *fakeExchange) postedOrders() []binanceapi.OrderParameters {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]binanceapi.OrderParameters{}, e.posted...)
+}
+
+// finishOrder sets the status of the last order posted and what it sold.
+func (e *fakeExchange) finishOrder(status binanceapi.OrderStatus, quantity float64, cost float64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	order := e.posted[len(e.posted)-1]
+	e.orders[order.NewClientOrderId] = &binanceapi.OrderResponse{
+		Symbol:              order.Symbol,
+		Status:              status,
+		ExecutedQty:         quantity,
+		CummulativeQuoteQty: cost,
+	}
+}
+
+func (e *fakeExchange) GetOrderByClientId(symbol string, clientOrderId string) (*binanceapi.OrderResponse, error) {
+	time.Sleep(e.latency)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.orderErr != nil {
+		return nil, e.orderErr
+	}
+	if order, ok := e.orders[clientOrderId]; ok {
+		return order, nil
+	}
+	return &binanceapi.OrderResponse{
+		Symbol: symbol,
+		Status: binanceapi.OrderStatusNew,
+	}, nil
+}
+
+func (e *fakeExchange) GetAccount() (*binanceapi.AccountInfoResponse, error) {
+	time.Sleep(e.latency)
+	return &binanceapi.AccountInfoResponse{Balances: e.balances}, nil
+}
+
+func (e *fakeExchange) GetPriceTicker(symbol string) (*binanceapi.PriceTickerResponse, error) {
+	time.Sleep(e.latency)
+	return &binanceapi.PriceTickerResponse{Symbol: symbol, Price: e.lastPrice}, nil
+}
+
+func (e *fakeExchange) GetBookTicker(symbol string) (*binanceapi.BookTickerResponse, error) {
+	time.Sleep(e.latency)
+	return &binanceapi.BookTickerResponse{
+		Symbol:   symbol,
+		BidPrice: e.bidPrice,
+		AskPrice: e.askPrice,
+	}, nil
+}
+
+func (e *fakeExchange) GetDepth(symbol string, limit int64) (*binanceapi.DepthResponse, error) {
+	time.Sleep(e.latency)
+	return &binanceapi.DepthResponse{}, nil
+}
+
+func (e *fakeExchange) GetMytrades(symbol string, limit int64, fromId int64) ([]binanceapi.MyTradesResponseEntry, error) {
+	time.Sleep(e.latency)
+	return nil, nil
+}
+
+type fakeSymbolStream struct{}
+
+func (fakeSymbolStream) AddSymbol(symbol string)    {}
+func (fakeSymbolStream) RemoveSymbol(symbol string) {}
+
+func newTestTradeService(t testing.TB, exchange Exchange) *TradeService {
+	dir, err := ioutil.TempDir("", "maker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DbOpen(dir)
+	exchangeInfo := binanceex.NewExchangeInfoService()
+	for _, symbol := range []string{"ETHBTC", "LTCBTC"} {
+		exchangeInfo.Symbols[symbol] = binanceex.SymbolInfo{
+			BaseAsset:  strings.TrimSuffix(symbol, "BTC"),
+			QuoteAsset: "BTC",
+			TickSize:   decimal.RequireFromString("0.000001"),
+			StepSize:   decimal.RequireFromString("0.001"),
+		}
+	}
+	return newTradeService(fakeSymbolStream{}, exchange, exchangeInfo, nil)
+}
+
+func newWatchingTrade(id string, symbol string, stopLoss float64) *types.Trade {
+	trade := types.NewTradeWithState(types.TradeState{
+		TradeID:          id,
+		Symbol:           symbol,
+		Status:           types.TradeStatusWatching,
+		OpenTime:         time.Now(),
+		BuyFillQuantity:  decimal.NewFromInt(1),
+		AverageBuyPrice:  decimal.RequireFromString("0.01"),
+		BuyCost:          decimal.RequireFromString("0.01"),
+		SellableQuantity: decimal.NewFromInt(1),
+	})
+	if stopLoss > 0 {
+		trade.State.StopLoss.Enabled = true
+		trade.State.StopLoss.Percent = stopLoss
+	}
+	return trade
+}
+
+// Measures how long a stop loss takes to reach the exchange while other
+// trades are busy with slow order requests.
+func benchmarkStopLoss(b *testing.B, busyTrades int) {
+	exchange := newFakeExchange(50 * time.Millisecond)
+	service := newTestTradeService(b, exchange)
+
+	done := make(chan bool)
+	wg := sync.WaitGroup{}
+	for i := 0; i < busyTrades; i++ {
+		trade := newWatchingTrade(fmt.Sprintf("busy-%d", i), "LTCBTC", 0)
+		service.RestoreTrade(trade)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				service.MarketSell(trade)
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	var total time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		trade := newWatchingTrade(fmt.Sprintf("stop-loss-%d", i), "ETHBTC", 1)
+		service.RestoreTrade(trade)
+		orders := exchange.waitForOrder("ETHBTC")
+		b.StartTimer()
+
+		start := time.Now()
+		service.onLastTrade(binanceapi.StreamAggTrade{
+			Symbol: "ETHBTC",
+			Price:  0.009,
+		})
+		order := <-orders
+		total += time.Since(start)
+
+		b.StopTimer()
+		if order.Side != binanceapi.OrderSideSell {
+			b.Fatalf("expected sell order, got %s", order.Side)
+		}
+		service.RemoveTrade(trade)
+		b.StartTimer()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(total.Microseconds())/float64(b.N), "us/stop-loss")
+
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkStopLossIdle(b *testing.B) {
+	benchmarkStopLoss(b, 0)
+}
+
+func BenchmarkStopLossWithSlowOrders(b *testing.B) {
+	benchmarkStopLoss(b, 10)
+}
+
+// Measures GetAllTrades while trades are busy with slow order requests.
+func BenchmarkGetAllTradesWithSlowOrders(b *testing.B) {
+	exchange := newFakeExchange(50 * time.Millisecond)
+	service := newTestTradeService(b, exchange)
+
+	done := make(chan bool)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		trade := newWatchingTrade(fmt.Sprintf("busy-%d", i), "LTCBTC", 0)
+		service.RestoreTrade(trade)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				service.MarketSell(trade)
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if trades := service.GetAllTrades(); len(trades) != 10 {
+			b.Fatalf("expected 10 trades, got %d", len(trades))
+		}
+	}
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
+
+func TestWorkerReplaced(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestTradeService(t, newFakeExchange(0))
+	trade := newWatchingTrade("replaced", "ETHBTC", 0)
+	old := service.worker(trade)
+
+	release := make(chan bool)
+	order := make(chan string, 2)
+	old.post(func() {
+		<-release
+		order <- "old"
+	})
+
+	// A copy of the trade gets a new worker that waits for the old one.
+	replacement := newWatchingTrade("replaced", "ETHBTC", 0)
+	worker := service.worker(replacement)
+	assert.True(worker != old)
+	assert.True(service.worker(replacement) == worker)
+	worker.post(func() {
+		order <- "new"
+	})
+
+	close(release)
+	assert.Equal("old", <-order)
+	assert.Equal("new", <-order)
+	<-old.finished
+	assert.NotNil(old.call(func() error { return nil }))
+	assert.Nil(service.call(replacement, func() error { return nil }))
+}
+
+func TestSubscribeBlocking(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTradeService(fakeSymbolStream{}, newFakeExchange(0), nil, nil)
+	dropping := service.Subscribe("dropping")
+	blocking := service.SubscribeBlocking("blocking")
+
+	// Many more events than either channel holds.
+	count := 1000
+	go func() {
+		for i := 0; i < count; i++ {
+			service.broadcastTradeArchived(fmt.Sprintf("%d", i))
+		}
+	}()
+	for i := 0; i < count; i++ {
+		assert.Equal(fmt.Sprintf("%d", i), (<-blocking).TradeID)
+	}
+	assert.Equal(cap(dropping), len(dropping))
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tradeservice
+
+import (
+	"fmt"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"gitlab.com/crankykernel/maker/go/types"
+	"sync"
+)
+
+const tradeWorkerMailboxSize = 64
+
+// tradeWorker runs all work for a single trade, one message at a time. Work
+// for different trades runs concurrently so a slow exchange request for one
+// trade does not hold up price processing or requests for the others.
+type tradeWorker struct {
+	trade   *types.Trade
+	tradeId string
+	symbol  string
+	mailbox chan func()
+	done    chan bool
+	once    sync.Once
+
+	// Closed when run returns.
+	finished chan bool
+
+	// The latest price not yet processed. Price updates are coalesced so a
+	// busy worker never has more than one waiting.
+	priceLock    sync.Mutex
+	price        decimal.Decimal
+	pricePending bool
+
+	// A copy of the trade state as of the last message processed, for
+	// readers outside of the worker.
+	snapshotLock sync.RWMutex
+	snapshot     types.TradeState
+}
+
+func newTradeWorker(trade *types.Trade) *tradeWorker {
+	return &tradeWorker{
+		trade:    trade,
+		tradeId:  trade.State.TradeID,
+		symbol:   trade.State.Symbol,
+		mailbox:  make(chan func(), tradeWorkerMailboxSize),
+		done:     make(chan bool),
+		finished: make(chan bool),
+		snapshot: trade.State.Copy(),
+	}
+}
+
+func (w *tradeWorker) run() {
+	defer close(w.finished)
+	for {
+		select {
+		case fn := <-w.mailbox:
+			fn()
+			w.publish()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *tradeWorker) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// retire stops the worker once the work already queued has run.
+func (w *tradeWorker) retire() {
+	w.post(w.stop)
+}
+
+func (w *tradeWorker) publish() {
+	snapshot := w.trade.State.Copy()
+	w.snapshotLock.Lock()
+	w.snapshot = snapshot
+	w.snapshotLock.Unlock()
+}
+
+func (w *tradeWorker) getSnapshot() types.TradeState {
+	w.snapshotLock.RLock()
+	defer w.snapshotLock.RUnlock()
+	return w.snapshot.Copy()
+}
+
+// post queues work without waiting for it to run. Returns false if the
+// worker has been stopped.
+func (w *tradeWorker) post(fn func()) bool {
+	select {
+	case w.mailbox <- fn:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// call runs the work and waits for its result.
+func (w *tradeWorker) call(fn func() error) error {
+	result := make(chan error, 1)
+	if !w.post(func() { result <- fn() }) {
+		return fmt.Errorf("trade %s is no longer active", w.tradeId)
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-w.done:
+		return fmt.Errorf("trade %s is no longer active", w.tradeId)
+	}
+}
+
+// offerPrice queues a price update, replacing any update still waiting.
+func (w *tradeWorker) offerPrice(price decimal.Decimal, fn func(price decimal.Decimal)) {
+	w.priceLock.Lock()
+	w.price = price
+	if w.pricePending {
+		w.priceLock.Unlock()
+		return
+	}
+	w.pricePending = true
+	w.priceLock.Unlock()
+
+	update := func() {
+		w.priceLock.Lock()
+		price := w.price
+		w.pricePending = false
+		w.priceLock.Unlock()
+		fn(price)
+	}
+
+	// Never block the price stream on a busy worker, the next price will
+	// be queued instead.
+	select {
+	case w.mailbox <- update:
+	default:
+		w.priceLock.Lock()
+		w.pricePending = false
+		w.priceLock.Unlock()
+	}
+}
@@ -31,6 +31,57 @@ const (
 	LimitSellTypePrice   LimitSellType = "PRICE"
 )
 
+type StopLossMode string
+
+const (
+	// A percent loss from the buy cost, after fees. The default.
+	StopLossModePercent StopLossMode = "PERCENT"
+
+	// A percent below the highest price since the buy, starting at the
+	// buy price.
+	StopLossModeTrailing StopLossMode = "TRAILING"
+
+	// A fixed price.
+	StopLossModePrice StopLossMode = "PRICE"
+)
+
+type ExitExecutionMode string
+
+const (
+	// A market sell of everything left. The default.
+	ExitExecutionMarket ExitExecutionMode = "MARKET"
+
+	// Limit IOC sells at the best bid less the maximum slippage, repeated
+	// until sold.
+	ExitExecutionLimitIOC ExitExecutionMode = "LIMIT_IOC"
+)
+
+type AlgoType string
+
+const (
+	// Equal slices spread over a duration.
+	AlgoTypeTWAP AlgoType = "TWAP"
+
+	// Limit orders showing only part of the quantity at a time.
+	AlgoTypeIceberg AlgoType = "ICEBERG"
+
+	// A percent of the volume traded on the symbol.
+	AlgoTypeParticipation AlgoType = "PARTICIPATION"
+)
+
+type AlgoStatus string
+
+const (
+	AlgoStatusRunning AlgoStatus = "RUNNING"
+	AlgoStatusPaused  AlgoStatus = "PAUSED"
+
+	// Stopped early, by hand or after failing.
+	AlgoStatusCanceled AlgoStatus = "CANCELED"
+
+	// The whole quantity has been worked.
+	AlgoStatusDone AlgoStatus = "DONE"
+)
+
 type TradeStatus string
 
 const (
@@ -42,4 +93,8 @@ const (
 	TradeStatusDone        TradeStatus = "DONE"
 	TradeStatusCanceled    TradeStatus = "CANCELED"
 	TradeStatusAbandoned   TradeStatus = "ABANDONED"
+
+	// A stop loss or trailing profit exit could not be completed. The
+	// position is still open and needs attention.
+	TradeStatusExitFailed TradeStatus = "EXIT_FAILED"
 )
@@ -0,0 +1,63 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"time"
+)
+
+type GuardAction string
+
+const (
+	// Lower the stop loss of open trades to the rule's stop loss percent,
+	// enabling it if not set.
+	GuardActionTightenStops GuardAction = "TIGHTEN_STOPS"
+
+	// Cancel the buys of trades not yet filled.
+	GuardActionCancelBuys GuardAction = "CANCEL_BUYS"
+
+	// Cancel pending buys and market sell every open trade.
+	GuardActionSellAll GuardAction = "SELL_ALL"
+)
+
+// GuardRule watches the price of a reference symbol and acts on many trades
+// at once when it drops too far within a window. Once fired a rule blocks new
+// buys until it is re-armed.
+type GuardRule struct {
+	ID      string
+	Name    string `json:",omitempty"`
+	Enabled bool
+
+	// Fires when the price of the symbol drops this percent below its high
+	// within the window.
+	Symbol        string
+	DropPercent   float64
+	WindowMinutes float64
+
+	Action GuardAction
+
+	// TIGHTEN_STOPS: the stop loss percent to tighten to.
+	StopLossPercent float64 `json:",omitempty"`
+
+	// Only trades in the quote asset are acted on, all trades if not set.
+	QuoteAsset string `json:",omitempty"`
+
+	// Set when the rule fires, until it is re-armed.
+	Fired      bool
+	FiredTime  *time.Time `json:",omitempty"`
+	FiredPrice decimal.Decimal
+}
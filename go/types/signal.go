@@ -0,0 +1,109 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type SignalAction string
+
+const (
+	// Open a trade on the symbol with the signal's template.
+	SignalActionBuy SignalAction = "BUY"
+
+	// Cancel the pending buys and market sell the open trades on the
+	// symbol.
+	SignalActionSell SignalAction = "SELL"
+
+	// Set the stop loss percent of the trades on the symbol.
+	SignalActionStopLoss SignalAction = "STOP_LOSS"
+)
+
+// Signal is a webhook that alerts from charting tools are sent to, mapped
+// to trade actions.
+type Signal struct {
+	Name    string
+	Enabled bool
+
+	// Verifies the HMAC-SHA256 signature of a payload, or for tools that
+	// can't sign is sent in the payload itself.
+	Secret string
+
+	// Only accept signed payloads.
+	RequireSignature bool
+
+	// The actions payloads may ask for, any action if empty.
+	Actions []SignalAction `json:",omitempty"`
+
+	// The template buys are made with, unless the payload names one.
+	Template string `json:",omitempty"`
+
+	// The most payloads accepted in a minute.
+	RateLimitPerMinute int
+
+	// Only log what each payload would do.
+	DryRun bool
+
+	CreateTime time.Time
+	UpdateTime time.Time
+}
+
+// AllowsAction returns true if payloads to the signal may ask for the
+// action.
+func (s *Signal) AllowsAction(action SignalAction) bool {
+	if len(s.Actions) == 0 {
+		return true
+	}
+	for _, allowed := range s.Actions {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+type SignalStatus string
+
+const (
+	SignalStatusAccepted SignalStatus = "ACCEPTED"
+	SignalStatusRejected SignalStatus = "REJECTED"
+	SignalStatusFailed   SignalStatus = "FAILED"
+)
+
+// SignalLogEntry records a payload received by a signal and what was done
+// with it.
+type SignalLogEntry struct {
+	// Assigned by the database when the entry is saved.
+	ID int64 `json:",omitempty"`
+
+	Signal     string
+	Time       time.Time
+	RemoteAddr string
+	Payload    json.RawMessage
+
+	// Only set once the payload is authenticated and its nonce is fresh.
+	Nonce string `json:",omitempty"`
+
+	Action SignalAction `json:",omitempty"`
+	Symbol string       `json:",omitempty"`
+	DryRun bool
+
+	Status SignalStatus
+	Error  string      `json:",omitempty"`
+	Result interface{} `json:",omitempty"`
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// TradeTemplate is a named set of buy settings, such as the price source,
+// sizing, exits and entry policies, that buys can start from.
+type TradeTemplate struct {
+	Name        string
+	Description string `json:",omitempty"`
+
+	// The fields of a buy request the template sets, in the form they are
+	// sent in a buy request.
+	Settings json.RawMessage
+
+	CreateTime time.Time
+	UpdateTime time.Time
+}
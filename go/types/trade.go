@@ -17,17 +17,21 @@ package types
 
 import (
 	"github.com/crankykernel/binanceapi-go"
-	"math"
+	"gitlab.com/crankykernel/maker/go/decimal"
 	"time"
 )
 
-const TRADE_STATE_VERSION = 1
+const TRADE_STATE_VERSION = 2
 
-const DEFAULT_FEE = float64(0.001)
-const BNB_FEE = float64(0.00075)
+var DEFAULT_FEE = decimal.RequireFromString("0.001")
+var BNB_FEE = decimal.RequireFromString("0.00075")
 
 type Trade struct {
 	State TradeState
+
+	// The latest execution report seen for each order of the trade, used
+	// to detect reports received out of order.
+	reportSequences map[int64]reportSequence
 }
 
 func NewTrade() *Trade {
@@ -93,7 +97,7 @@ func (t *Trade) SetLimitSellByPercent(percent float64) {
 	t.State.LimitSell.Percent = percent
 }
 
-func (t *Trade) SetLimitSellByPrice(price float64) {
+func (t *Trade) SetLimitSellByPrice(price decimal.Decimal) {
 	t.State.LimitSell.Enabled = true
 	t.State.LimitSell.Type = LimitSellTypePrice
 	t.State.LimitSell.Price = price
@@ -111,13 +115,38 @@ func (t *Trade) SetTrailingProfit(enable bool, percent float64, deviation float6
 }
 
 func (t *Trade) AddBuyFill(report binanceapi.StreamExecutionReport) {
-	fill := OrderFill{
-		Price:            report.LastExecutedPrice,
-		Quantity:         report.LastExecutedQuantity,
-		CommissionAmount: report.CommissionAmount,
+	t.DoAddBuyFill(NewOrderFillFromReport(report))
+}
+
+// NewOrderFillFromReport returns the fill for the last execution of an
+// execution report.
+func NewOrderFillFromReport(report binanceapi.StreamExecutionReport) OrderFill {
+	return OrderFill{
+		Price:            decimal.NewFromFloat(report.LastExecutedPrice),
+		Quantity:         decimal.NewFromFloat(report.LastExecutedQuantity),
+		CommissionAmount: decimal.NewFromFloat(report.CommissionAmount),
 		CommissionAsset:  report.CommissionAsset,
+		OrderID:          report.OrderID,
+		TradeID:          report.TradeID,
+	}
+}
+
+// HasFill returns true if the fill of the exchange trade is already recorded,
+// such as one looked up after its execution report was missed.
+func (t *Trade) HasFill(side binanceapi.OrderSide, orderId int64, tradeId int64) bool {
+	if tradeId <= 0 {
+		return false
 	}
-	t.DoAddBuyFill(fill)
+	fills := t.State.BuySideFills
+	if side == binanceapi.OrderSideSell {
+		fills = t.State.SellSideFills
+	}
+	for _, fill := range fills {
+		if fill.OrderID == orderId && fill.TradeID == tradeId {
+			return true
+		}
+	}
+	return false
 }
 
 func (t *Trade) DoAddBuyFill(fill OrderFill) {
@@ -135,63 +164,106 @@ func (t *Trade) AddClientOrderID(clientOrderID string) {
 }
 
 func (t *Trade) UpdateSellState() {
-	quantity := float64(0)
-	totalPrice := float64(0)
-	cost := float64(0)
+	quantity := decimal.Zero
+	totalPrice := decimal.Zero
+	cost := decimal.Zero
 
 	for _, fill := range t.State.SellSideFills {
-		quantity += fill.Quantity
-		totalPrice += fill.Price * fill.Quantity
-		if fill.CommissionAsset == "BNB" {
-			cost += (fill.Price * fill.Quantity) * (1 - BNB_FEE)
-		} else {
-			cost += (fill.Price * fill.Quantity) - fill.CommissionAmount
-		}
+		price := fill.Price.Mul(fill.Quantity)
+		quantity = quantity.Add(fill.Quantity)
+		totalPrice = totalPrice.Add(price)
+		cost = cost.Add(price.Sub(fill.QuoteCommission(binanceapi.OrderSideSell)))
 	}
 
-	if quantity > 0 {
-		t.State.AverageSellPrice = round8(totalPrice / quantity)
-		t.State.SellFillQuantity = round8(quantity)
-		t.State.SellCost = round8(cost)
-		t.State.Profit = t.State.SellCost - t.State.BuyCost
-		t.State.ProfitPercent = t.State.Profit / t.State.BuyCost * 100
-		t.State.Profit = round8(t.State.Profit)
-		t.State.ProfitPercent = round8(t.State.ProfitPercent)
+	if quantity.IsPositive() {
+		t.State.AverageSellPrice = totalPrice.Div(quantity)
+		t.State.SellFillQuantity = quantity
+		t.State.SellCost = cost
+		t.State.Profit = t.State.SellCost.Sub(t.State.BuyCost)
+		if t.State.BuyCost.IsPositive() {
+			t.State.ProfitPercent = t.State.Profit.Mul(decimal.NewFromInt(100)).
+				Div(t.State.BuyCost).Float64()
+		}
 	}
+	t.updateFees()
 }
 
 func (t *Trade) UpdateBuyState() {
-	var cost float64 = 0
-	var totalPrice float64 = 0
-	var quantity float64 = 0
+	cost := decimal.Zero
+	totalPrice := decimal.Zero
+	quantity := decimal.Zero
 
-	lastFee := float64(0)
+	lastFee := decimal.Zero
 
 	for _, fill := range t.State.BuySideFills {
-		quantity += fill.Quantity
-		totalPrice += fill.Price * fill.Quantity
+		price := fill.Price.Mul(fill.Quantity)
+		quantity = quantity.Add(fill.Quantity)
+		totalPrice = totalPrice.Add(price)
 		if fill.CommissionAsset == "BNB" {
-			cost += (fill.Price * fill.Quantity) * (1 + BNB_FEE)
-			lastFee = BNB_FEE
+			cost = cost.Add(price.Add(fill.QuoteCommission(binanceapi.OrderSideBuy)))
 		} else {
-			cost += (fill.Price * fill.Quantity)
-			lastFee = DEFAULT_FEE
-			quantity = quantity - fill.CommissionAmount
+			// The commission was taken from the bought asset.
+			cost = cost.Add(price)
+			quantity = quantity.Sub(fill.CommissionAmount)
+		}
+		if price.IsPositive() {
+			lastFee = fill.QuoteCommission(binanceapi.OrderSideBuy).Div(price)
 		}
 	}
 
-	if quantity > 0 {
-		t.State.AverageBuyPrice = round8(totalPrice / quantity)
-		t.State.BuyFillQuantity = round8(quantity)
-		t.State.BuyCost = round8(cost)
-		t.State.EffectiveBuyPrice = round8(cost / quantity)
+	if quantity.IsPositive() {
+		t.State.AverageBuyPrice = totalPrice.Div(quantity)
+		t.State.BuyFillQuantity = quantity
+		t.State.BuyCost = cost
+		t.State.EffectiveBuyPrice = cost.Div(quantity)
 
-		// Use the fee from the most recent fee as the effective fee used for
-		// calculation in profit and losses.
+		// Use the fee rate of the most recent fill as the effective fee used
+		// for calculation in profit and losses.
 		t.State.Fee = lastFee
 	}
+	t.updateFees()
+}
+
+func (t *Trade) updateFees() {
+	feeQuote := decimal.Zero
+	feeBNB := decimal.Zero
+	for _, fill := range t.State.BuySideFills {
+		feeQuote = feeQuote.Add(fill.QuoteCommission(binanceapi.OrderSideBuy))
+		feeBNB = feeBNB.Add(fill.CommissionBNB)
+	}
+	for _, fill := range t.State.SellSideFills {
+		feeQuote = feeQuote.Add(fill.QuoteCommission(binanceapi.OrderSideSell))
+		feeBNB = feeBNB.Add(fill.CommissionBNB)
+	}
+	t.State.FeeQuote = feeQuote
+	t.State.FeeBNB = feeBNB
 }
 
-func round8(val float64) float64 {
-	return math.Round(val*100000000) / 100000000
+// QuoteCommission returns the commission of the fill in the quote asset.
+// Fills recorded before commissions were converted are estimated: a
+// commission in BNB at the BNB fee rate, otherwise as taken from the bought
+// asset on a buy and the quote asset on a sell.
+func (f OrderFill) QuoteCommission(side binanceapi.OrderSide) decimal.Decimal {
+	if !f.CommissionQuote.IsZero() || f.CommissionAmount.IsZero() {
+		return f.CommissionQuote
+	}
+	if f.CommissionAsset == "BNB" {
+		return f.Price.Mul(f.Quantity).Mul(BNB_FEE)
+	}
+	if side == binanceapi.OrderSideBuy {
+		return f.CommissionAmount.Mul(f.Price)
+	}
+	return f.CommissionAmount
+}
+
+// UpdateSellableQuantity sets the sellable quantity from the buy fill
+// quantity. When the fee was taken from the bought asset the quantity must be
+// rounded down to the lot step size.
+func (t *Trade) UpdateSellableQuantity(stepSize decimal.Decimal) {
+	feeAsset := t.FeeAsset()
+	if feeAsset == "BNB" {
+		t.State.SellableQuantity = t.State.BuyFillQuantity
+	} else if feeAsset != "" && stepSize.IsPositive() {
+		t.State.SellableQuantity = t.State.BuyFillQuantity.RoundDown(stepSize)
+	}
 }
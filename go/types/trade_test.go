@@ -0,0 +1,113 @@
+package types
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"testing"
+)
+
+func TestUpdateSellableQuantity(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name     string
+		fills    []OrderFill
+		stepSize string
+		sellable string
+	}{
+		{
+			name: "commission in base asset",
+			fills: []OrderFill{
+				{Quantity: decimal.RequireFromString("0.1"), CommissionAmount: decimal.RequireFromString("0.0001")},
+				{Quantity: decimal.RequireFromString("0.2"), CommissionAmount: decimal.RequireFromString("0.0002")},
+			},
+			stepSize: "0.001",
+			sellable: "0.299",
+		},
+		{
+			name: "exact multiple of step size",
+			fills: []OrderFill{
+				{Quantity: decimal.RequireFromString("1.1"), CommissionAmount: decimal.RequireFromString("0.1")},
+			},
+			stepSize: "0.1",
+			sellable: "1",
+		},
+		{
+			name: "commission in bnb",
+			fills: []OrderFill{
+				{Quantity: decimal.RequireFromString("0.123456"), CommissionAsset: "BNB"},
+			},
+			stepSize: "0.001",
+			sellable: "0.123456",
+		},
+	}
+
+	for _, test := range tests {
+		trade := NewTrade()
+		for _, fill := range test.fills {
+			fill.Price = decimal.RequireFromString("0.01")
+			if fill.CommissionAsset == "" {
+				fill.CommissionAsset = "ETH"
+			}
+			trade.DoAddBuyFill(fill)
+		}
+		trade.UpdateSellableQuantity(decimal.RequireFromString(test.stepSize))
+		assert.Equal(test.sellable, trade.State.SellableQuantity.String(), test.name)
+	}
+}
+
+func TestFeeAccounting(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+
+	// 0.05% paid in BNB at a VIP tier, BNB at 0.002 BTC.
+	trade.DoAddBuyFill(OrderFill{
+		Price:            decimal.RequireFromString("0.01"),
+		Quantity:         decimal.RequireFromString("10"),
+		CommissionAsset:  "BNB",
+		CommissionAmount: decimal.RequireFromString("0.025"),
+		CommissionQuote:  decimal.RequireFromString("0.00005"),
+		CommissionBNB:    decimal.RequireFromString("0.025"),
+	})
+	assert.Equal("0.10005", trade.State.BuyCost.String())
+	assert.Equal("0.0005", trade.State.Fee.String())
+
+	// Sell commission paid in the quote asset.
+	trade.DoAddSellFill(OrderFill{
+		Price:            decimal.RequireFromString("0.011"),
+		Quantity:         decimal.RequireFromString("10"),
+		CommissionAsset:  "BTC",
+		CommissionAmount: decimal.RequireFromString("0.00011"),
+		CommissionQuote:  decimal.RequireFromString("0.00011"),
+		CommissionBNB:    decimal.RequireFromString("0.055"),
+	})
+	assert.Equal("0.10989", trade.State.SellCost.String())
+	assert.Equal("0.00984", trade.State.Profit.String())
+	assert.Equal("0.00016", trade.State.FeeQuote.String())
+	assert.Equal("0.08", trade.State.FeeBNB.String())
+}
+
+func TestMetadataChanged(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+	tags := NormalizeTags([]string{" breakout", "", "signal:tv", "breakout"})
+	assert.Equal([]string{"breakout", "signal:tv"}, tags)
+
+	err := trade.ApplyEvent(TradeEvent{
+		Type: TradeEventMetadataChanged,
+		MetadataChanged: &MetadataChangedEvent{
+			Tags:  tags,
+			Notes: "late entry",
+		},
+	})
+	assert.Nil(err)
+	assert.Equal(tags, trade.State.Tags)
+	assert.Equal("late entry", trade.State.Notes)
+
+	// The copy doesn't share the tags.
+	state := trade.State.Copy()
+	state.Tags[0] = "scalp"
+	assert.Equal("breakout", trade.State.Tags[0])
+}
@@ -0,0 +1,353 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"time"
+)
+
+type TradeEventType string
+
+const (
+	// The trade was created. The event holds the initial state.
+	TradeEventCreated TradeEventType = "CREATED"
+
+	// An order was sent to the exchange for this trade.
+	TradeEventOrderPlaced TradeEventType = "ORDER_PLACED"
+
+	// The exchange reported a change to an order of this trade.
+	TradeEventOrderUpdate TradeEventType = "ORDER_UPDATE"
+
+	// An order of this trade was filled, fully or partially.
+	TradeEventFill TradeEventType = "FILL"
+
+	// The status of the trade changed.
+	TradeEventStatusChanged TradeEventType = "STATUS_CHANGED"
+
+	// The stop loss, limit sell or trailing profit settings changed.
+	TradeEventSettingsChanged TradeEventType = "SETTINGS_CHANGED"
+
+	// A stop loss or trailing profit trigger fired.
+	TradeEventTriggerFired TradeEventType = "TRIGGER_FIRED"
+
+	// The high price followed by the stop loss or trailing profit, or the
+	// stop loss price, moved.
+	TradeEventPricesUpdated TradeEventType = "PRICES_UPDATED"
+
+	// The progress of a stop loss or trailing profit exit changed.
+	TradeEventExitUpdated TradeEventType = "EXIT_UPDATED"
+
+	// The entry policy of a pending buy, or its progress, changed.
+	TradeEventEntryUpdated TradeEventType = "ENTRY_UPDATED"
+
+	// The time based exit policy, or its progress, changed.
+	TradeEventExitPolicyUpdated TradeEventType = "EXIT_POLICY_UPDATED"
+
+	// An execution algorithm was set, or its progress changed.
+	TradeEventAlgoUpdated TradeEventType = "ALGO_UPDATED"
+
+	// The tags or notes of the trade changed.
+	TradeEventMetadataChanged TradeEventType = "METADATA_CHANGED"
+)
+
+type TriggerType string
+
+const (
+	TriggerStopLoss                TriggerType = "STOP_LOSS"
+	TriggerTrailingProfitActivated TriggerType = "TRAILING_PROFIT_ACTIVATED"
+	TriggerTrailingProfit          TriggerType = "TRAILING_PROFIT"
+	TriggerStopLossRaised          TriggerType = "STOP_LOSS_RAISED"
+	TriggerMaxHold                 TriggerType = "MAX_HOLD"
+	TriggerSellAt                  TriggerType = "SELL_AT"
+	TriggerMarketSell              TriggerType = "MARKET_SELL"
+)
+
+type OrderPlacedEvent struct {
+	ClientOrderID string
+	Order         *binanceapi.OrderParameters `json:",omitempty"`
+
+	// Set if the exchange rejected the order.
+	Error string `json:",omitempty"`
+}
+
+type OrderUpdateEvent struct {
+	Side binanceapi.OrderSide
+
+	// Order details. Only set when the exchange acknowledges a new order.
+	OrderID  int64  `json:",omitempty"`
+	Type     string `json:",omitempty"`
+	Price    decimal.Decimal
+	Quantity decimal.Decimal
+
+	// The order status to record for the trade.
+	Status binanceapi.OrderStatus
+}
+
+type FillEvent struct {
+	Side binanceapi.OrderSide
+	Fill OrderFill
+
+	// The lot step size at the time of the fill, used to derive the
+	// sellable quantity from buy fills.
+	StepSize decimal.Decimal
+}
+
+type StatusChangedEvent struct {
+	Status    TradeStatus
+	CloseTime *time.Time `json:",omitempty"`
+}
+
+type SettingsChangedEvent struct {
+	StopLoss       *StopLossState       `json:",omitempty"`
+	LimitSell      *LimitSellState      `json:",omitempty"`
+	TrailingProfit *TrailingProfitState `json:",omitempty"`
+	ExitExecution  *ExitExecutionState  `json:",omitempty"`
+}
+
+// MetadataChangedEvent holds the new tags and notes of a trade.
+type MetadataChangedEvent struct {
+	Tags  []string `json:",omitempty"`
+	Notes string   `json:",omitempty"`
+}
+
+type TriggerFiredEvent struct {
+	Trigger       TriggerType
+	Price         decimal.Decimal
+	ProfitPercent float64
+}
+
+// PricesUpdatedEvent holds the followed prices that moved, the others are
+// nil.
+type PricesUpdatedEvent struct {
+	StopLossHighPrice   *decimal.Decimal `json:",omitempty"`
+	StopLossStopPrice   *decimal.Decimal `json:",omitempty"`
+	TrailingProfitPrice *decimal.Decimal `json:",omitempty"`
+}
+
+// TradeEvent is a single state transition of a trade. Events are recorded in
+// an append-only log and the trade state can be rebuilt by applying them in
+// order. Exactly one of the payload fields is set, matching the Type.
+type TradeEvent struct {
+	// Assigned by the database when the event is saved.
+	Sequence int64 `json:",omitempty"`
+
+	TradeID   string
+	Timestamp time.Time
+	Type      TradeEventType
+
+	Created         *TradeState           `json:",omitempty"`
+	OrderPlaced     *OrderPlacedEvent     `json:",omitempty"`
+	OrderUpdate     *OrderUpdateEvent     `json:",omitempty"`
+	Fill            *FillEvent            `json:",omitempty"`
+	StatusChanged   *StatusChangedEvent   `json:",omitempty"`
+	SettingsChanged *SettingsChangedEvent `json:",omitempty"`
+	TriggerFired    *TriggerFiredEvent    `json:",omitempty"`
+	PricesUpdated   *PricesUpdatedEvent   `json:",omitempty"`
+	ExitUpdated     *ExitState            `json:",omitempty"`
+	EntryUpdated    *EntryState           `json:",omitempty"`
+
+	ExitPolicyUpdated *ExitPolicyState      `json:",omitempty"`
+	AlgoUpdated       *AlgoState            `json:",omitempty"`
+	MetadataChanged   *MetadataChangedEvent `json:",omitempty"`
+}
+
+// ApplyEvent applies a single event to the trade state.
+func (t *Trade) ApplyEvent(event TradeEvent) error {
+	switch event.Type {
+	case TradeEventCreated:
+		if event.Created == nil {
+			break
+		}
+		state := event.Created.Copy()
+		if state.ClientOrderIDs == nil {
+			state.ClientOrderIDs = make(map[string]bool)
+		}
+		t.State = state
+		return nil
+	case TradeEventOrderPlaced:
+		if event.OrderPlaced == nil {
+			break
+		}
+		t.AddClientOrderID(event.OrderPlaced.ClientOrderID)
+		return nil
+	case TradeEventOrderUpdate:
+		update := event.OrderUpdate
+		if update == nil {
+			break
+		}
+		switch update.Side {
+		case binanceapi.OrderSideBuy:
+			if update.OrderID != 0 {
+				// A replacement for a chasing buy is only for what is
+				// left, the trade keeps its open time and quantity.
+				if t.State.BuyOrderId == 0 {
+					t.State.OpenTime = event.Timestamp
+					// An algo buy keeps its parent quantity.
+					if t.State.Algo == nil {
+						t.State.BuyOrder.Quantity = update.Quantity
+					}
+				}
+				t.State.BuyOrderId = update.OrderID
+				t.State.BuyOrder.Price = update.Price
+				if update.Type != "" {
+					t.State.BuyOrder.Type = binanceapi.OrderType(update.Type)
+				}
+			}
+			t.State.LastBuyStatus = update.Status
+		case binanceapi.OrderSideSell:
+			if update.OrderID != 0 {
+				t.State.SellOrderId = update.OrderID
+				t.State.SellOrder.Type = update.Type
+				t.State.SellOrder.Quantity = update.Quantity
+				t.State.SellOrder.Price = update.Price
+			}
+			t.State.SellOrder.Status = update.Status
+		}
+		return nil
+	case TradeEventFill:
+		fill := event.Fill
+		if fill == nil {
+			break
+		}
+		switch fill.Side {
+		case binanceapi.OrderSideBuy:
+			t.DoAddBuyFill(fill.Fill)
+			t.UpdateSellableQuantity(fill.StepSize)
+		case binanceapi.OrderSideSell:
+			t.DoAddSellFill(fill.Fill)
+		}
+		return nil
+	case TradeEventStatusChanged:
+		if event.StatusChanged == nil {
+			break
+		}
+		t.State.Status = event.StatusChanged.Status
+		if event.StatusChanged.CloseTime != nil {
+			closeTime := *event.StatusChanged.CloseTime
+			t.State.CloseTime = &closeTime
+		}
+		return nil
+	case TradeEventSettingsChanged:
+		settings := event.SettingsChanged
+		if settings == nil {
+			break
+		}
+		if settings.StopLoss != nil {
+			t.State.StopLoss = *settings.StopLoss
+		}
+		if settings.LimitSell != nil {
+			t.State.LimitSell = *settings.LimitSell
+		}
+		if settings.TrailingProfit != nil {
+			t.State.TrailingProfit = *settings.TrailingProfit
+		}
+		if settings.ExitExecution != nil {
+			t.State.ExitExecution = *settings.ExitExecution
+		}
+		return nil
+	case TradeEventTriggerFired:
+		trigger := event.TriggerFired
+		if trigger == nil {
+			break
+		}
+		switch trigger.Trigger {
+		case TriggerStopLoss:
+			t.State.StopLoss.Triggered = true
+		case TriggerStopLossRaised:
+			t.State.StopLoss.StopPrice = trigger.Price
+		case TriggerTrailingProfitActivated:
+			t.State.TrailingProfit.Activated = true
+			t.State.TrailingProfit.Price = trigger.Price
+		case TriggerTrailingProfit:
+			t.State.TrailingProfit.Triggered = true
+			t.State.TrailingProfit.Price = trigger.Price
+		}
+		return nil
+	case TradeEventPricesUpdated:
+		prices := event.PricesUpdated
+		if prices == nil {
+			break
+		}
+		if prices.StopLossHighPrice != nil {
+			t.State.StopLoss.HighPrice = *prices.StopLossHighPrice
+		}
+		if prices.StopLossStopPrice != nil {
+			t.State.StopLoss.StopPrice = *prices.StopLossStopPrice
+		}
+		if prices.TrailingProfitPrice != nil {
+			t.State.TrailingProfit.Price = *prices.TrailingProfitPrice
+		}
+		return nil
+	case TradeEventExitUpdated:
+		if event.ExitUpdated == nil {
+			break
+		}
+		exit := *event.ExitUpdated
+		t.State.Exit = &exit
+		return nil
+	case TradeEventAlgoUpdated:
+		if event.AlgoUpdated == nil {
+			break
+		}
+		algo := *event.AlgoUpdated
+		t.State.Algo = &algo
+		return nil
+	case TradeEventEntryUpdated:
+		if event.EntryUpdated == nil {
+			break
+		}
+		t.State.Entry = *event.EntryUpdated
+		return nil
+	case TradeEventExitPolicyUpdated:
+		if event.ExitPolicyUpdated == nil {
+			break
+		}
+		t.State.ExitPolicy = *event.ExitPolicyUpdated
+		return nil
+	case TradeEventMetadataChanged:
+		if event.MetadataChanged == nil {
+			break
+		}
+		t.State.Tags = append([]string(nil), event.MetadataChanged.Tags...)
+		t.State.Notes = event.MetadataChanged.Notes
+		return nil
+	default:
+		return fmt.Errorf("unknown trade event type: %s", event.Type)
+	}
+	return fmt.Errorf("trade event %s has no payload", event.Type)
+}
+
+// ReplayTradeEvents rebuilds a trade by applying the events in order. The
+// first event must be the creation event.
+func ReplayTradeEvents(events []TradeEvent) (*Trade, error) {
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events")
+	}
+	if events[0].Type != TradeEventCreated {
+		return nil, fmt.Errorf("first event is %s, not %s",
+			events[0].Type, TradeEventCreated)
+	}
+	trade := &Trade{}
+	for _, event := range events {
+		if err := trade.ApplyEvent(event); err != nil {
+			return nil, fmt.Errorf("event %d: %v", event.Sequence, err)
+		}
+	}
+	return trade, nil
+}
@@ -15,6 +15,10 @@
 
 package types
 
+import (
+	"gitlab.com/crankykernel/maker/go/decimal"
+)
+
 func TradeStateV0ToTradeStateV1(old TradeStateV0) TradeState {
 	state := TradeState{}
 	state.Version = TRADE_STATE_VERSION
@@ -23,29 +27,50 @@ func TradeStateV0ToTradeStateV1(old TradeStateV0) TradeState {
 	state.OpenTime = old.OpenTime
 	state.CloseTime = old.CloseTime
 	state.Status = old.Status
-	state.Fee = old.Fee
+	state.Fee = decimal.NewFromFloat(old.Fee)
 	state.BuyOrderId = old.BuyOrderId
 	state.ClientOrderIDs = old.ClientOrderIDs
-	state.BuyOrder = old.BuyOrder
+	state.BuyOrder.Quantity = decimal.NewFromFloat(old.BuyOrder.Quantity)
+	state.BuyOrder.Price = decimal.NewFromFloat(old.BuyOrder.Price)
 	state.BuySideFills = old.BuySideFills
-	state.BuyFillQuantity = old.BuyFillQuantity
-	state.AverageBuyPrice = old.AverageBuyPrice
-	state.BuyCost = old.BuyCost
-	state.EffectiveBuyPrice = old.EffectiveBuyPrice
+	state.BuyFillQuantity = decimal.NewFromFloat(old.BuyFillQuantity)
+	state.AverageBuyPrice = decimal.NewFromFloat(old.AverageBuyPrice)
+	state.BuyCost = decimal.NewFromFloat(old.BuyCost)
+	state.EffectiveBuyPrice = decimal.NewFromFloat(old.EffectiveBuyPrice)
 	state.SellOrderId = old.SellOrderId
 	state.SellSideFills = old.SellSideFills
-	state.SellFillQuantity = old.SellFillQuantity
-	state.AverageSellPrice = old.AverageSellPrice
-	state.SellCost = old.SellCost
-	state.StopLoss = old.StopLoss
+	state.SellFillQuantity = decimal.NewFromFloat(old.SellFillQuantity)
+	state.AverageSellPrice = decimal.NewFromFloat(old.AverageSellPrice)
+	state.SellCost = decimal.NewFromFloat(old.SellCost)
+	state.StopLoss.Enabled = old.StopLoss.Enabled
+	state.StopLoss.Percent = old.StopLoss.Percent
+	state.StopLoss.Triggered = old.StopLoss.Triggered
 	state.LimitSell.Enabled = old.LimitSell.Enabled
 	state.LimitSell.Type = LimitSellTypePercent
 	state.LimitSell.Percent = old.LimitSell.Percent
-	state.TrailingProfit = old.TrailingProfit
-	state.Profit = old.Profit
+	state.TrailingProfit.Enabled = old.TrailingProfit.Enabled
+	state.TrailingProfit.Percent = old.TrailingProfit.Percent
+	state.TrailingProfit.Deviation = old.TrailingProfit.Deviation
+	state.TrailingProfit.Activated = old.TrailingProfit.Activated
+	state.TrailingProfit.Price = decimal.NewFromFloat(old.TrailingProfit.Price)
+	state.TrailingProfit.Triggered = old.TrailingProfit.Triggered
+	state.Profit = decimal.NewFromFloat(old.Profit)
 	state.ProfitPercent = old.ProfitPercent
 	state.LastBuyStatus = old.LastBuyStatus
-	state.SellOrder = old.SellOrder
-	state.LastPrice = old.LastPrice
+	state.SellOrder.Status = old.SellOrder.Status
+	state.SellOrder.Type = old.SellOrder.Type
+	state.SellOrder.Quantity = decimal.NewFromFloat(old.SellOrder.Quantity)
+	state.SellOrder.Price = decimal.NewFromFloat(old.SellOrder.Price)
+	state.LastPrice = decimal.NewFromFloat(old.LastPrice)
 	return state
 }
+
+// TradeStateV1ToTradeStateV2 migrates a trade state saved with float
+// amounts. The amounts have already been rounded to 8 decimal places when
+// decoded, the derived buy and sell values are recalculated from the fills so
+// they no longer carry float rounding errors.
+func TradeStateV1ToTradeStateV2(state TradeState) TradeState {
+	trade := NewTradeWithState(state)
+	trade.State.Version = TRADE_STATE_VERSION
+	return trade.State
+}
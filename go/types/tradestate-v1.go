@@ -17,14 +17,26 @@ package types
 
 import (
 	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"strings"
 	"time"
 )
 
 type OrderFill struct {
-	Price            float64
-	Quantity         float64
+	Price            decimal.Decimal
+	Quantity         decimal.Decimal
 	CommissionAsset  string
-	CommissionAmount float64
+	CommissionAmount decimal.Decimal
+
+	// The commission converted to the quote asset and to BNB at the time of
+	// the fill. Zero if it could not be converted.
+	CommissionQuote decimal.Decimal
+	CommissionBNB   decimal.Decimal
+
+	// The exchange order and trade the fill is from. Zero for fills
+	// recorded before these were kept.
+	OrderID int64 `json:",omitempty"`
+	TradeID int64 `json:",omitempty"`
 }
 
 type HistoryType string
@@ -37,6 +49,21 @@ const (
 	HistoryTypeSellCanceled         HistoryType = "SELL_CANCELED"
 	HistoryTypeTrailingProfitUpdate HistoryType = "TRAILING_PROFIT_UPDATE"
 	HistoryTypeStopLossUpdate       HistoryType = "STOP_LOSS_UPDATE"
+	HistoryTypeStopLossRaised       HistoryType = "STOP_LOSS_RAISED"
+	HistoryTypeExitAttempt          HistoryType = "EXIT_ATTEMPT"
+	HistoryTypeExitFailed           HistoryType = "EXIT_FAILED"
+	HistoryTypeAdopted              HistoryType = "ADOPTED"
+	HistoryTypeImported             HistoryType = "IMPORTED"
+	HistoryTypeBuyRepriced          HistoryType = "BUY_REPRICED"
+	HistoryTypeSellRepriced         HistoryType = "SELL_REPRICED"
+	HistoryTypeExitPolicyUpdate     HistoryType = "EXIT_POLICY_UPDATE"
+	HistoryTypeExitExecutionUpdate  HistoryType = "EXIT_EXECUTION_UPDATE"
+	HistoryTypeExitComplete         HistoryType = "EXIT_COMPLETE"
+	HistoryTypeAlgoStarted          HistoryType = "ALGO_STARTED"
+	HistoryTypeAlgoChild            HistoryType = "ALGO_CHILD"
+	HistoryTypeAlgoUpdate           HistoryType = "ALGO_UPDATE"
+	HistoryTypeAlgoFinished         HistoryType = "ALGO_FINISHED"
+	HistoryTypeMetadataUpdate       HistoryType = "METADATA_UPDATE"
 )
 
 type HistoryEntry struct {
@@ -45,6 +72,235 @@ type HistoryEntry struct {
 	Fields    interface{}
 }
 
+type StopLossState struct {
+	Enabled   bool
+	Percent   float64
+	Triggered bool
+
+	// PERCENT if not set. Price is the stop price for PRICE mode.
+	Mode  StopLossMode `json:",omitempty"`
+	Price decimal.Decimal
+
+	// Raise the stop to break even, after fees, once the profit has
+	// reached this percent.
+	BreakEvenPercent float64 `json:",omitempty"`
+
+	// Raise the stop by StepRaisePercent of profit for every StepPercent
+	// of profit reached. Only for PERCENT mode.
+	StepPercent      float64 `json:",omitempty"`
+	StepRaisePercent float64 `json:",omitempty"`
+
+	// The highest price since the buy, and the stop price it currently
+	// works out to.
+	HighPrice decimal.Decimal
+	StopPrice decimal.Decimal
+}
+
+type LimitSellState struct {
+	Enabled bool
+	Type    LimitSellType
+	Percent float64
+	Price   decimal.Decimal
+}
+
+type TrailingProfitState struct {
+	Enabled   bool
+	Percent   float64
+	Deviation float64
+	Activated bool
+	Price     decimal.Decimal
+	Triggered bool
+}
+
+// ExitState tracks a stop loss, trailing profit or market sell exit until
+// the position has been sold.
+type ExitState struct {
+	Trigger   TriggerType
+	StartTime time.Time
+	Attempts  int
+
+	// The price that fired the trigger, and how the exit is executed.
+	TriggerPrice decimal.Decimal
+	Execution    ExitExecutionState
+
+	// The client order ID of the last exit order posted.
+	ClientOrderID string `json:",omitempty"`
+
+	// The number of limit IOC sells posted.
+	LimitAttempts int `json:",omitempty"`
+
+	// What the exit orders have sold, taken from the orders as they finish
+	// so the next order doesn't depend on fills not reported yet. The sell
+	// fill quantity from before the exit is not included.
+	StartSellQuantity decimal.Decimal
+	SoldQuantity      decimal.Decimal
+	SoldCost          decimal.Decimal
+
+	// The average price sold at and how far below the trigger price it
+	// was, in percent, once the exit is complete.
+	AveragePrice    decimal.Decimal
+	SlippagePercent float64 `json:",omitempty"`
+	Complete        bool    `json:",omitempty"`
+
+	LastError string `json:",omitempty"`
+}
+
+// InParts returns true if the exit may sell the position over several
+// orders, so a filled order doesn't finish the trade.
+func (e *ExitState) InParts() bool {
+	return !e.Complete && (e.Execution.Mode == ExitExecutionLimitIOC ||
+		e.Execution.DepthChunks)
+}
+
+// AlgoState is an execution algorithm working a parent order of the trade
+// as a series of child orders, one at a time.
+type AlgoState struct {
+	Type   AlgoType
+	Side   binanceapi.OrderSide
+	Status AlgoStatus
+
+	// The parent order. Children are limit orders at the price, or market
+	// orders if there is no price.
+	Quantity decimal.Decimal
+	Price    decimal.Decimal
+
+	// TWAP: the number of equal slices spread over the duration.
+	DurationMinutes float64 `json:",omitempty"`
+	Slices          int     `json:",omitempty"`
+
+	// ICEBERG: the quantity shown by each child.
+	VisibleQuantity decimal.Decimal
+
+	// PARTICIPATION: the percent of the traded volume to take.
+	ParticipationPercent float64 `json:",omitempty"`
+
+	StartTime     time.Time
+	NextChildTime time.Time
+
+	// What the finished children filled, and how many there have been.
+	Filled   decimal.Decimal
+	Children int
+
+	// The child order being worked, what it has filled, and when it was
+	// last heard of.
+	ChildClientOrderID string `json:",omitempty"`
+	ChildOrderID       int64  `json:",omitempty"`
+	ChildFilled        decimal.Decimal
+	ChildTime          time.Time
+
+	// Consecutive child orders that failed, and the last error.
+	Failures  int    `json:",omitempty"`
+	LastError string `json:",omitempty"`
+
+	// Why the algo was canceled.
+	Reason string `json:",omitempty"`
+
+	// Set once stopped and the last child is finished.
+	Finished bool `json:",omitempty"`
+}
+
+// Active returns true while the algo has work to do or a child order to see
+// through.
+func (a *AlgoState) Active() bool {
+	return a != nil && !a.Finished
+}
+
+// ExitExecutionState is how the exit orders of a trade are placed. The
+// configured default is used if Mode is not set.
+type ExitExecutionState struct {
+	Mode ExitExecutionMode `json:",omitempty"`
+
+	// How far below the best bid a limit IOC sell may fill, in percent.
+	MaxSlippagePercent float64 `json:",omitempty"`
+
+	// Market sell what is left after this many limit IOC sells, 0 for
+	// never.
+	MarketAfterAttempts int `json:",omitempty"`
+
+	// Only sell what the visible bids within the slippage can take in
+	// each order.
+	DepthChunks bool `json:",omitempty"`
+}
+
+// EntryState is the policy for a buy order that has not filled yet. Any
+// quantity already bought is kept when the buy is canceled or replaced.
+type EntryState struct {
+	// Cancel the buy if it has not filled this many minutes after it was
+	// placed.
+	ExpireMinutes float64 `json:",omitempty"`
+
+	// Cancel the buy if the price rises more than this percent above the
+	// buy order price.
+	RunawayPercent float64 `json:",omitempty"`
+
+	// Replace the buy at the best bid every ChaseSeconds while the bid is
+	// above the order price, never going above MaxPrice.
+	Chase        bool  `json:",omitempty"`
+	ChaseSeconds int64 `json:",omitempty"`
+	MaxPrice     decimal.Decimal
+
+	// Why the buy was canceled by the policy, set once the cancel has been
+	// sent.
+	CancelReason string `json:",omitempty"`
+
+	// When the last cancel for the policy failed, so it is not retried on
+	// every price update.
+	CancelFailed *time.Time `json:",omitempty"`
+
+	// The number of times the buy has been replaced and when it was last
+	// replaced.
+	Reprices    int        `json:",omitempty"`
+	LastReprice *time.Time `json:",omitempty"`
+
+	// The last buy order canceled to be replaced. Reports for it, or any
+	// earlier order, only contribute their fills.
+	ReplacedOrderID int64 `json:",omitempty"`
+
+	// The client order ID of the replacement order, and the number of buy
+	// fills recorded before it was placed.
+	ClientOrderID string `json:",omitempty"`
+	BuyFills      int    `json:",omitempty"`
+}
+
+// Enabled returns true if any entry policy is set.
+func (e EntryState) Enabled() bool {
+	return e.ExpireMinutes > 0 || e.RunawayPercent > 0 || e.Chase
+}
+
+// ExitPolicyState is the time based exit policy of a trade. Times are from
+// the open time of the trade.
+type ExitPolicyState struct {
+	// Market sell once the trade has been held this many hours.
+	MaxHoldHours float64 `json:",omitempty"`
+
+	// Market sell once any of these times is reached.
+	SellAt []time.Time `json:",omitempty"`
+
+	// Lower the limit sell percent by DecayPercent every DecayHours,
+	// starting DecayAfterHours after the trade opened, from
+	// DecayFromPercent down to break even.
+	DecayPercent     float64 `json:",omitempty"`
+	DecayHours       float64 `json:",omitempty"`
+	DecayAfterHours  float64 `json:",omitempty"`
+	DecayFromPercent float64 `json:",omitempty"`
+
+	// The number of decay steps applied to the limit sell.
+	Decays int `json:",omitempty"`
+
+	// The last sell order canceled to be replaced. Reports for it, or any
+	// earlier sell order, only contribute their fills.
+	ReplacedOrderID int64 `json:",omitempty"`
+
+	// The client order ID of the replacement order.
+	ClientOrderID string `json:",omitempty"`
+}
+
+// Enabled returns true if any exit policy is set.
+func (p ExitPolicyState) Enabled() bool {
+	return p.MaxHoldHours > 0 || len(p.SellAt) > 0 ||
+		(p.DecayPercent > 0 && p.DecayHours > 0)
+}
+
 type TradeState struct {
 	Version int64
 
@@ -57,64 +313,75 @@ type TradeState struct {
 	OpenTime  time.Time
 	CloseTime *time.Time `json:",omitempty"`
 	Status    TradeStatus
-	Fee       float64
+
+	// The commission rate paid on the most recent buy fill.
+	Fee decimal.Decimal
+
+	// The total commission paid for the buy and sell, in the quote asset
+	// and in BNB.
+	FeeQuote decimal.Decimal
+	FeeBNB   decimal.Decimal
 
 	BuyOrderId int64
 
 	ClientOrderIDs map[string]bool
 
 	BuyOrder struct {
-		Quantity float64
-		Price    float64
+		Quantity decimal.Decimal
+		Price    decimal.Decimal
+
+		// The order type, time in force and, for stop limit and take
+		// profit limit entries, the stop price. Empty on trades from
+		// before entry order types were supported, which are all GTC
+		// limit orders.
+		Type        binanceapi.OrderType   `json:",omitempty"`
+		TimeInForce binanceapi.TimeInForce `json:",omitempty"`
+		StopPrice   decimal.Decimal
 	}
 
+	Entry EntryState
+
 	BuySideFills    []OrderFill `json:",omitempty"`
-	BuyFillQuantity float64
+	BuyFillQuantity decimal.Decimal
 
 	// The amount that can be sold. This is the quantity adjusted to any lot
 	// size limitation like Binance's step size.
-	SellableQuantity float64
+	SellableQuantity decimal.Decimal
 
 	// The average buy price per unit not accounting for fees.
-	AverageBuyPrice float64
+	AverageBuyPrice decimal.Decimal
 
 	// The total cost of the buy, including fees.
-	BuyCost float64
+	BuyCost decimal.Decimal
 
 	// The buy price per unit accounting for fees.
-	EffectiveBuyPrice float64
+	EffectiveBuyPrice decimal.Decimal
 
 	SellOrderId int64
 
 	SellSideFills    []OrderFill `json:",omitempty"`
-	SellFillQuantity float64
-	AverageSellPrice float64
-	SellCost         float64
-
-	StopLoss struct {
-		Enabled   bool
-		Percent   float64
-		Triggered bool
-	}
+	SellFillQuantity decimal.Decimal
+	AverageSellPrice decimal.Decimal
+	SellCost         decimal.Decimal
 
-	LimitSell struct {
-		Enabled bool
-		Type    LimitSellType
-		Percent float64
-		Price   float64
-	}
+	StopLoss StopLossState
 
-	TrailingProfit struct {
-		Enabled   bool
-		Percent   float64
-		Deviation float64
-		Activated bool
-		Price     float64
-		Triggered bool
-	}
+	LimitSell LimitSellState
+
+	TrailingProfit TrailingProfitState
+
+	// Set while a stop loss or trailing profit exit is in progress.
+	Exit *ExitState `json:",omitempty"`
+
+	ExitPolicy ExitPolicyState
+
+	ExitExecution ExitExecutionState
+
+	// Set if the trade's buy or a sell is worked by an execution algorithm.
+	Algo *AlgoState `json:",omitempty"`
 
 	// The profit in units of the quote asset.
-	Profit float64
+	Profit decimal.Decimal
 
 	// The profit as a percentage (0-100).
 	ProfitPercent float64
@@ -124,13 +391,25 @@ type TradeState struct {
 	SellOrder struct {
 		Status   binanceapi.OrderStatus
 		Type     string
-		Quantity float64
-		Price    float64
+		Quantity decimal.Decimal
+		Price    decimal.Decimal
 	}
 
 	// The last known price for this symbol. Use to estimate profit. Source may
 	// not always be the last price, but could also be the last best bid or ask.
-	LastPrice float64
+	LastPrice decimal.Decimal
+
+	// Set on trades imported from the exchange trade history rather than
+	// made by Maker.
+	Imported bool `json:",omitempty"`
+
+	// The name of the template the buy was made from.
+	Template string `json:",omitempty"`
+
+	// User labels, such as the strategy, setup or signal source, and free
+	// text notes.
+	Tags  []string `json:",omitempty"`
+	Notes string   `json:",omitempty"`
 }
 
 func (t *TradeState) Copy() TradeState {
@@ -150,5 +429,46 @@ func (t *TradeState) Copy() TradeState {
 	t0.SellSideFills = make([]OrderFill, len(t.SellSideFills))
 	copy(t0.SellSideFills, t.SellSideFills)
 
+	if t.Exit != nil {
+		exit := *t.Exit
+		t0.Exit = &exit
+	}
+
+	if t.Algo != nil {
+		algo := *t.Algo
+		t0.Algo = &algo
+	}
+
+	if t.ExitPolicy.SellAt != nil {
+		t0.ExitPolicy.SellAt = make([]time.Time, len(t.ExitPolicy.SellAt))
+		copy(t0.ExitPolicy.SellAt, t.ExitPolicy.SellAt)
+	}
+
+	if t.Entry.LastReprice != nil {
+		lastReprice := *t.Entry.LastReprice
+		t0.Entry.LastReprice = &lastReprice
+	}
+
+	if t.Tags != nil {
+		t0.Tags = make([]string, len(t.Tags))
+		copy(t0.Tags, t.Tags)
+	}
+
 	return t0
 }
+
+// NormalizeTags trims the tags and drops empty and repeated tags, keeping
+// the order they were given in.
+func NormalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
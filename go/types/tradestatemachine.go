@@ -0,0 +1,388 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package types
+
+import (
+	"fmt"
+	"github.com/crankykernel/binanceapi-go"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"time"
+)
+
+// The allowed trade status transitions. The closing statuses DONE, CANCELED,
+// FAILED and ABANDONED are final.
+var tradeStatusTransitions = map[TradeStatus][]TradeStatus{
+	TradeStatusNew: {
+		TradeStatusPendingBuy,
+		// The buy may fill before the new order report is received.
+		TradeStatusWatching,
+		TradeStatusCanceled,
+		TradeStatusFailed,
+		TradeStatusAbandoned,
+	},
+	TradeStatusPendingBuy: {
+		TradeStatusWatching,
+		// What is filled of a pending buy may be sold before the buy
+		// finishes.
+		TradeStatusPendingSell,
+		TradeStatusCanceled,
+		TradeStatusFailed,
+		TradeStatusAbandoned,
+	},
+	TradeStatusWatching: {
+		TradeStatusPendingSell,
+		// A market sell may fill before the new order report is received.
+		TradeStatusDone,
+		TradeStatusExitFailed,
+		TradeStatusAbandoned,
+	},
+	TradeStatusPendingSell: {
+		TradeStatusWatching,
+		TradeStatusDone,
+		TradeStatusExitFailed,
+		TradeStatusAbandoned,
+	},
+	// Leaves EXIT_FAILED when a sell is placed or fills, or the trade is
+	// abandoned.
+	TradeStatusExitFailed: {
+		TradeStatusPendingSell,
+		TradeStatusDone,
+		TradeStatusAbandoned,
+	},
+}
+
+// algoActive returns true while an execution algorithm is working the side
+// for the trade.
+func (t *Trade) algoActive(side binanceapi.OrderSide) bool {
+	return t.State.Algo.Active() && t.State.Algo.Side == side
+}
+
+// sellingInParts returns true if the position is being sold over several
+// orders, so a filled sell doesn't finish the trade.
+func (t *Trade) sellingInParts() bool {
+	return (t.State.Exit != nil && t.State.Exit.InParts()) ||
+		t.algoActive(binanceapi.OrderSideSell)
+}
+
+// CanTransition returns true if a trade may change from one status to the
+// other.
+func CanTransition(from TradeStatus, to TradeStatus) bool {
+	for _, status := range tradeStatusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+type IllegalTransitionError struct {
+	From TradeStatus
+	To   TradeStatus
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("illegal trade status transition from %s to %s", e.From, e.To)
+}
+
+// The position of an execution report in the life of an order. Reports are
+// ordered by exchange transaction time, then by order status as a new order
+// and its fill often share the same transaction time.
+type reportSequence struct {
+	transactionTime int64
+	rank            int
+}
+
+func newReportSequence(report binanceapi.StreamExecutionReport) reportSequence {
+	sequence := reportSequence{
+		transactionTime: report.TransactionTimeMillis,
+	}
+	switch report.CurrentOrderStatus {
+	case binanceapi.OrderStatusNew:
+		sequence.rank = 0
+	case binanceapi.OrderStatusPartiallyFilled:
+		sequence.rank = 1
+	default:
+		sequence.rank = 2
+	}
+	return sequence
+}
+
+func (s reportSequence) before(other reportSequence) bool {
+	if s.transactionTime != other.transactionTime {
+		return s.transactionTime < other.transactionTime
+	}
+	return s.rank < other.rank
+}
+
+// sequenceReport records the report as the latest for its order, returning
+// true if a later report for the order has already been seen.
+func (t *Trade) sequenceReport(report binanceapi.StreamExecutionReport) bool {
+	if t.reportSequences == nil {
+		t.reportSequences = make(map[int64]reportSequence)
+	}
+	sequence := newReportSequence(report)
+	if last, ok := t.reportSequences[report.OrderID]; ok && sequence.before(last) {
+		return true
+	}
+	t.reportSequences[report.OrderID] = sequence
+	return false
+}
+
+// ReportTransition is the outcome of an execution report for a trade.
+type ReportTransition struct {
+	// The events to apply to the trade, in order.
+	Events []TradeEvent
+
+	// The report was older than one already seen for the same order. Its
+	// fill, if any, is still applied but it does not change any status.
+	Stale bool
+
+	// The report completed the buy, the trade is now ready to sell.
+	BuyFilled bool
+}
+
+// OnExecutionReport works out the events an execution report produces for
+// the trade. The trade itself is not modified other than to record the
+// report's place in the order sequence. An IllegalTransitionError is returned
+// along with the remaining events if the report would move the trade into a
+// status not allowed from the current one.
+func (t *Trade) OnExecutionReport(timestamp time.Time,
+	report binanceapi.StreamExecutionReport, stepSize decimal.Decimal) (ReportTransition, error) {
+	result := ReportTransition{
+		Stale: t.sequenceReport(report),
+	}
+
+	addEvent := func(event TradeEvent) {
+		event.TradeID = t.State.TradeID
+		event.Timestamp = timestamp
+		result.Events = append(result.Events, event)
+	}
+
+	orderUpdate := func(status binanceapi.OrderStatus, details bool) {
+		update := &OrderUpdateEvent{
+			Side:   report.Side,
+			Status: status,
+		}
+		if details {
+			update.OrderID = report.OrderID
+			update.Type = report.OrderType
+			update.Price = decimal.NewFromFloat(report.Price)
+			update.Quantity = decimal.NewFromFloat(report.Quantity)
+		}
+		addEvent(TradeEvent{
+			Type:        TradeEventOrderUpdate,
+			OrderUpdate: update,
+		})
+	}
+
+	// Returns false if the fill has already been recorded.
+	fill := func() bool {
+		if t.HasFill(report.Side, report.OrderID, report.TradeID) {
+			// Already recorded from the trade history.
+			return false
+		}
+		addEvent(TradeEvent{
+			Type: TradeEventFill,
+			Fill: &FillEvent{
+				Side:     report.Side,
+				Fill:     NewOrderFillFromReport(report),
+				StepSize: stepSize,
+			},
+		})
+		return true
+	}
+
+	from := t.State.Status
+	to := from
+
+	switch report.Side {
+	case binanceapi.OrderSideBuy:
+		// Reports for a buy order canceled to be replaced by a chasing
+		// entry only contribute their fills, the replacement order carries
+		// on with the trade.
+		current := report.OrderID > t.State.Entry.ReplacedOrderID
+
+		// The child orders of an algo buy leave the trade pending until
+		// the algo is finished.
+		algoBuy := t.algoActive(binanceapi.OrderSideBuy)
+
+		switch report.CurrentOrderStatus {
+		case binanceapi.OrderStatusNew:
+			if !current {
+				break
+			}
+			// Always record the order details, they may be needed to cancel
+			// the order even if its fills have already been seen.
+			lastBuyStatus := t.State.LastBuyStatus
+			if lastBuyStatus == "" || !result.Stale {
+				lastBuyStatus = report.CurrentOrderStatus
+			}
+			orderUpdate(lastBuyStatus, true)
+			if !result.Stale && from == TradeStatusNew {
+				to = TradeStatusPendingBuy
+			}
+		case binanceapi.OrderStatusPartiallyFilled:
+			fill()
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+				if from == TradeStatusNew {
+					to = TradeStatusPendingBuy
+				}
+			}
+		case binanceapi.OrderStatusFilled:
+			fill()
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+				if from == TradeStatusNew || from == TradeStatusPendingBuy {
+					if algoBuy {
+						to = TradeStatusPendingBuy
+					} else {
+						to = TradeStatusWatching
+						result.BuyFilled = true
+					}
+				}
+			}
+		case binanceapi.OrderStatusCanceled:
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+				if from == TradeStatusNew || from == TradeStatusPendingBuy {
+					if algoBuy {
+						to = TradeStatusPendingBuy
+					} else if t.State.BuyFillQuantity.IsZero() {
+						to = TradeStatusCanceled
+					} else {
+						to = TradeStatusWatching
+					}
+				}
+			}
+		case binanceapi.OrderStatusExpired, binanceapi.OrderStatusRejected:
+			// IOC and FOK orders expire with whatever they could fill, as
+			// can market orders when the book runs out. What was filled is
+			// managed like a completed buy.
+			if report.LastExecutedQuantity > 0 {
+				fill()
+			}
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+				if from == TradeStatusNew || from == TradeStatusPendingBuy {
+					if algoBuy {
+						to = TradeStatusPendingBuy
+					} else if !t.State.BuyFillQuantity.IsZero() ||
+						report.LastExecutedQuantity > 0 {
+						to = TradeStatusWatching
+						result.BuyFilled = true
+					} else if report.CurrentOrderStatus == binanceapi.OrderStatusRejected {
+						to = TradeStatusFailed
+					} else {
+						to = TradeStatusCanceled
+					}
+				}
+			}
+		default:
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+			}
+		}
+
+	case binanceapi.OrderSideSell:
+		// Reports for a sell order that has since been replaced, such as
+		// the cancel of a limit sell replaced by a market sell, only
+		// contribute their fills. Binance order IDs increase over time.
+		current := report.OrderID >= t.State.SellOrderId &&
+			report.OrderID > t.State.ExitPolicy.ReplacedOrderID
+
+		switch report.CurrentOrderStatus {
+		case binanceapi.OrderStatusNew:
+			if !current {
+				break
+			}
+			// If the fill was seen first, record the order details but
+			// keep the status from the fill.
+			status := report.CurrentOrderStatus
+			if result.Stale {
+				status = t.State.SellOrder.Status
+			}
+			orderUpdate(status, true)
+			if !result.Stale && !t.IsDone() {
+				to = TradeStatusPendingSell
+			}
+		case binanceapi.OrderStatusPartiallyFilled:
+			fill()
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+				if from == TradeStatusWatching || from == TradeStatusExitFailed ||
+					from == TradeStatusPendingBuy {
+					to = TradeStatusPendingSell
+				}
+			}
+		case binanceapi.OrderStatusFilled:
+			sold := t.State.SellFillQuantity
+			if fill() {
+				sold = sold.Add(decimal.NewFromFloat(report.LastExecutedQuantity))
+			}
+			if !result.Stale {
+				orderUpdate(report.CurrentOrderStatus, false)
+				to = TradeStatusDone
+				if t.sellingInParts() && sold.LessThan(t.State.SellableQuantity) {
+					// Only part of an exit or algo sell, the rest is
+					// still to be sold.
+					to = from
+					if from == TradeStatusPendingSell {
+						to = TradeStatusWatching
+					}
+				}
+			}
+		case binanceapi.OrderStatusCanceled, binanceapi.OrderStatusExpired,
+			binanceapi.OrderStatusRejected:
+			if report.LastExecutedQuantity > 0 {
+				fill()
+			}
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+				if from == TradeStatusPendingSell {
+					to = TradeStatusWatching
+				}
+			}
+		default:
+			if !result.Stale && current {
+				orderUpdate(report.CurrentOrderStatus, false)
+			}
+		}
+	}
+
+	if to == from {
+		return result, nil
+	}
+
+	if !CanTransition(from, to) {
+		result.BuyFilled = false
+		return result, &IllegalTransitionError{From: from, To: to}
+	}
+
+	change := &StatusChangedEvent{
+		Status: to,
+	}
+	if to == TradeStatusDone || to == TradeStatusCanceled || to == TradeStatusFailed {
+		closeTime := timestamp
+		change.CloseTime = &closeTime
+	}
+	addEvent(TradeEvent{
+		Type:          TradeEventStatusChanged,
+		StatusChanged: change,
+	})
+
+	return result, nil
+}
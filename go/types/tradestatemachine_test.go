@@ -0,0 +1,563 @@
+package types
+
+import (
+	"github.com/crankykernel/binanceapi-go"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/crankykernel/maker/go/decimal"
+	"testing"
+	"time"
+)
+
+const (
+	buy  = binanceapi.OrderSideBuy
+	sell = binanceapi.OrderSideSell
+)
+
+type testReport struct {
+	side            binanceapi.OrderSide
+	status          binanceapi.OrderStatus
+	orderId         int64
+	transactionTime int64
+	quantity        float64
+}
+
+func (r testReport) executionReport() binanceapi.StreamExecutionReport {
+	report := binanceapi.StreamExecutionReport{
+		Symbol:                "ETHBTC",
+		Side:                  r.side,
+		OrderType:             "LIMIT",
+		Quantity:              1,
+		Price:                 0.03,
+		CurrentOrderStatus:    r.status,
+		OrderID:               r.orderId,
+		TransactionTimeMillis: r.transactionTime,
+	}
+	if r.quantity > 0 {
+		report.LastExecutedQuantity = r.quantity
+		report.LastExecutedPrice = 0.03
+		report.CommissionAsset = "BNB"
+		report.CommissionAmount = 0.0001
+	}
+	return report
+}
+
+func TestCanTransition(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(CanTransition(TradeStatusNew, TradeStatusPendingBuy))
+	assert.True(CanTransition(TradeStatusNew, TradeStatusWatching))
+	assert.True(CanTransition(TradeStatusPendingSell, TradeStatusWatching))
+	assert.True(CanTransition(TradeStatusWatching, TradeStatusAbandoned))
+	assert.False(CanTransition(TradeStatusNew, TradeStatusDone))
+	assert.True(CanTransition(TradeStatusPendingBuy, TradeStatusPendingSell))
+	assert.False(CanTransition(TradeStatusPendingBuy, TradeStatusDone))
+	assert.False(CanTransition(TradeStatusWatching, TradeStatusPendingBuy))
+
+	for _, status := range []TradeStatus{
+		TradeStatusDone,
+		TradeStatusCanceled,
+		TradeStatusFailed,
+		TradeStatusAbandoned,
+	} {
+		for _, to := range []TradeStatus{
+			TradeStatusNew,
+			TradeStatusPendingBuy,
+			TradeStatusWatching,
+			TradeStatusPendingSell,
+			TradeStatusDone,
+		} {
+			assert.False(CanTransition(status, to), "%s -> %s", status, to)
+		}
+	}
+}
+
+func TestTradeOnExecutionReport(t *testing.T) {
+	tests := []struct {
+		name        string
+		reports     []testReport
+		status      TradeStatus
+		sellOrderId int64
+		buyFilled   int
+		stale       int
+		illegal     int
+
+		// The buy order replaced by a chasing entry.
+		replacedOrderId int64
+	}{
+		{
+			name: "buy and limit sell in order",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{sell, binanceapi.OrderStatusNew, 2, 300, 0},
+				{sell, binanceapi.OrderStatusFilled, 2, 400, 1},
+			},
+			status:      TradeStatusDone,
+			sellOrderId: 2,
+			buyFilled:   1,
+		},
+		{
+			name: "buy fill before new",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusFilled, 1, 100, 1},
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+			},
+			status:    TradeStatusWatching,
+			buyFilled: 1,
+			stale:     1,
+		},
+		{
+			name: "partial buy then cancel",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusPartiallyFilled, 1, 200, 0.5},
+				{buy, binanceapi.OrderStatusCanceled, 1, 300, 0},
+			},
+			status: TradeStatusWatching,
+		},
+		{
+			name: "partial buy before new",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusPartiallyFilled, 1, 200, 0.5},
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+			},
+			status: TradeStatusPendingBuy,
+			stale:  1,
+		},
+		{
+			name: "buy canceled without fill",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusCanceled, 1, 200, 0},
+			},
+			status: TradeStatusCanceled,
+		},
+		{
+			name: "ioc buy partially filled then expired",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusPartiallyFilled, 1, 100, 0.5},
+				{buy, binanceapi.OrderStatusExpired, 1, 100, 0},
+			},
+			status:    TradeStatusWatching,
+			buyFilled: 1,
+		},
+		{
+			name: "ioc buy expired without fill",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusExpired, 1, 100, 0},
+			},
+			status: TradeStatusCanceled,
+		},
+		{
+			name: "buy rejected",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusRejected, 1, 100, 0},
+			},
+			status: TradeStatusFailed,
+		},
+		{
+			name: "sell expired",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{sell, binanceapi.OrderStatusNew, 2, 300, 0},
+				{sell, binanceapi.OrderStatusExpired, 2, 400, 0},
+			},
+			status:      TradeStatusWatching,
+			sellOrderId: 2,
+			buyFilled:   1,
+		},
+		{
+			name: "sell cancel before new",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{sell, binanceapi.OrderStatusCanceled, 2, 400, 0},
+				{sell, binanceapi.OrderStatusNew, 2, 300, 0},
+			},
+			status:      TradeStatusWatching,
+			sellOrderId: 2,
+			buyFilled:   1,
+			stale:       1,
+		},
+		{
+			name: "market sell fill before new",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{sell, binanceapi.OrderStatusFilled, 2, 300, 1},
+				{sell, binanceapi.OrderStatusNew, 2, 300, 0},
+			},
+			status:      TradeStatusDone,
+			sellOrderId: 2,
+			buyFilled:   1,
+			stale:       1,
+		},
+		{
+			name: "limit sell replaced by market sell",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{sell, binanceapi.OrderStatusNew, 2, 300, 0},
+				{sell, binanceapi.OrderStatusNew, 3, 500, 0},
+				{sell, binanceapi.OrderStatusCanceled, 2, 400, 0},
+			},
+			status:      TradeStatusPendingSell,
+			sellOrderId: 3,
+			buyFilled:   1,
+		},
+		{
+			name: "partial sells then fill",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{sell, binanceapi.OrderStatusNew, 2, 300, 0},
+				{sell, binanceapi.OrderStatusPartiallyFilled, 2, 400, 0.25},
+				{sell, binanceapi.OrderStatusPartiallyFilled, 2, 400, 0.25},
+				{sell, binanceapi.OrderStatusFilled, 2, 500, 0.5},
+			},
+			status:      TradeStatusDone,
+			sellOrderId: 2,
+			buyFilled:   1,
+		},
+		{
+			name: "duplicate buy fill report",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 0},
+			},
+			status:    TradeStatusWatching,
+			buyFilled: 1,
+		},
+		{
+			name: "sell fill without buy",
+			reports: []testReport{
+				{sell, binanceapi.OrderStatusFilled, 2, 100, 1},
+			},
+			status:      TradeStatusNew,
+			sellOrderId: 0,
+			illegal:     1,
+		},
+		{
+			name: "buy replaced by chasing entry",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusPartiallyFilled, 1, 100, 0.5},
+				{buy, binanceapi.OrderStatusCanceled, 1, 200, 0},
+				{buy, binanceapi.OrderStatusNew, 2, 300, 0},
+				{buy, binanceapi.OrderStatusFilled, 2, 400, 0.5},
+			},
+			status:          TradeStatusWatching,
+			buyFilled:       1,
+			replacedOrderId: 1,
+		},
+		{
+			name: "buy new after done",
+			reports: []testReport{
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+				{buy, binanceapi.OrderStatusFilled, 1, 200, 1},
+				{sell, binanceapi.OrderStatusNew, 2, 300, 0},
+				{sell, binanceapi.OrderStatusFilled, 2, 400, 1},
+				{buy, binanceapi.OrderStatusNew, 1, 100, 0},
+			},
+			status:      TradeStatusDone,
+			sellOrderId: 2,
+			buyFilled:   1,
+			stale:       1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			trade := NewTrade()
+			trade.State.TradeID = "test"
+			trade.State.Symbol = "ETHBTC"
+			trade.State.Entry.ReplacedOrderID = test.replacedOrderId
+
+			buyFilled, stale, illegal := 0, 0, 0
+			for _, r := range test.reports {
+				transition, err := trade.OnExecutionReport(time.Now(), r.executionReport(),
+					decimal.RequireFromString("0.001"))
+				if err != nil {
+					_, ok := err.(*IllegalTransitionError)
+					assert.True(ok, "unexpected error: %v", err)
+					illegal++
+				}
+				if transition.BuyFilled {
+					buyFilled++
+				}
+				if transition.Stale {
+					stale++
+				}
+				for _, event := range transition.Events {
+					assert.Nil(trade.ApplyEvent(event))
+				}
+			}
+
+			assert.Equal(test.status, trade.State.Status)
+			assert.Equal(test.sellOrderId, trade.State.SellOrderId)
+			assert.Equal(test.buyFilled, buyFilled)
+			assert.Equal(test.stale, stale)
+			assert.Equal(test.illegal, illegal)
+			if trade.IsDone() {
+				assert.NotNil(trade.State.CloseTime)
+			}
+			if test.status == TradeStatusDone {
+				assert.Equal(trade.State.BuyFillQuantity,
+					trade.State.SellFillQuantity)
+			}
+		})
+	}
+}
+
+func TestSellReplacedByExitPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+	trade.State.TradeID = "test"
+	trade.State.Symbol = "ETHBTC"
+
+	apply := func(r testReport) {
+		transition, err := trade.OnExecutionReport(time.Now(), r.executionReport(),
+			decimal.RequireFromString("0.001"))
+		assert.Nil(err)
+		for _, event := range transition.Events {
+			assert.Nil(trade.ApplyEvent(event))
+		}
+	}
+
+	apply(testReport{buy, binanceapi.OrderStatusNew, 1, 100, 0})
+	apply(testReport{buy, binanceapi.OrderStatusFilled, 1, 200, 1})
+	apply(testReport{sell, binanceapi.OrderStatusNew, 2, 300, 0})
+	assert.Equal(TradeStatusPendingSell, trade.State.Status)
+
+	// The cancel of the replaced order doesn't return the trade to
+	// watching.
+	trade.State.ExitPolicy.ReplacedOrderID = 2
+	apply(testReport{sell, binanceapi.OrderStatusCanceled, 2, 400, 0})
+	assert.Equal(TradeStatusPendingSell, trade.State.Status)
+
+	apply(testReport{sell, binanceapi.OrderStatusNew, 3, 500, 0})
+	assert.Equal(int64(3), trade.State.SellOrderId)
+	apply(testReport{sell, binanceapi.OrderStatusFilled, 3, 600, 1})
+	assert.Equal(TradeStatusDone, trade.State.Status)
+}
+
+func TestExitSoldInParts(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+	trade.State.TradeID = "test"
+	trade.State.Symbol = "ETHBTC"
+
+	apply := func(r testReport) {
+		transition, err := trade.OnExecutionReport(time.Now(), r.executionReport(),
+			decimal.RequireFromString("0.001"))
+		assert.Nil(err)
+		for _, event := range transition.Events {
+			assert.Nil(trade.ApplyEvent(event))
+		}
+	}
+
+	apply(testReport{buy, binanceapi.OrderStatusNew, 1, 100, 0})
+	apply(testReport{buy, binanceapi.OrderStatusFilled, 1, 200, 1})
+	trade.State.SellableQuantity = decimal.NewFromInt(1)
+	trade.State.Exit = &ExitState{
+		Trigger: TriggerStopLoss,
+		Execution: ExitExecutionState{
+			Mode: ExitExecutionLimitIOC,
+		},
+	}
+
+	// The first part filling leaves the trade watching for the next.
+	apply(testReport{sell, binanceapi.OrderStatusNew, 2, 300, 0})
+	apply(testReport{sell, binanceapi.OrderStatusFilled, 2, 400, 0.4})
+	assert.Equal(TradeStatusWatching, trade.State.Status)
+
+	apply(testReport{sell, binanceapi.OrderStatusNew, 3, 500, 0})
+	apply(testReport{sell, binanceapi.OrderStatusFilled, 3, 600, 0.6})
+	assert.Equal(TradeStatusDone, trade.State.Status)
+}
+
+func TestExitPartRecordedFillNotCounted(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+	trade.State.TradeID = "test"
+	trade.State.Symbol = "ETHBTC"
+	stepSize := decimal.RequireFromString("0.001")
+
+	apply := func(report binanceapi.StreamExecutionReport) {
+		transition, err := trade.OnExecutionReport(time.Now(), report, stepSize)
+		assert.Nil(err)
+		for _, event := range transition.Events {
+			assert.Nil(trade.ApplyEvent(event))
+		}
+	}
+
+	apply(testReport{buy, binanceapi.OrderStatusNew, 1, 100, 0}.executionReport())
+	apply(testReport{buy, binanceapi.OrderStatusFilled, 1, 200, 1}.executionReport())
+	trade.State.SellableQuantity = decimal.RequireFromString("0.8")
+	trade.State.Exit = &ExitState{
+		Trigger: TriggerStopLoss,
+		Execution: ExitExecutionState{
+			Mode: ExitExecutionLimitIOC,
+		},
+	}
+	apply(testReport{sell, binanceapi.OrderStatusNew, 2, 300, 0}.executionReport())
+
+	// The fill of the first part was looked up in the trade history
+	// before its report was received.
+	assert.Nil(trade.ApplyEvent(TradeEvent{
+		Type: TradeEventFill,
+		Fill: &FillEvent{
+			Side: sell,
+			Fill: OrderFill{
+				Price:    decimal.RequireFromString("0.03"),
+				Quantity: decimal.RequireFromString("0.4"),
+				OrderID:  2,
+				TradeID:  7,
+			},
+			StepSize: stepSize,
+		},
+	}))
+
+	report := testReport{sell, binanceapi.OrderStatusFilled, 2, 400, 0.4}.executionReport()
+	report.TradeID = 7
+	apply(report)
+	assert.Equal(TradeStatusWatching, trade.State.Status)
+	assert.Equal("0.4", trade.State.SellFillQuantity.String())
+
+	// The same report received again is not counted either.
+	apply(report)
+	assert.Equal(TradeStatusWatching, trade.State.Status)
+	assert.Equal("0.4", trade.State.SellFillQuantity.String())
+	assert.Len(trade.State.SellSideFills, 1)
+}
+
+func TestSellWhileBuyPending(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+	trade.State.TradeID = "test"
+	trade.State.Symbol = "ETHBTC"
+
+	apply := func(r testReport) ReportTransition {
+		transition, err := trade.OnExecutionReport(time.Now(), r.executionReport(),
+			decimal.RequireFromString("0.001"))
+		assert.Nil(err)
+		for _, event := range transition.Events {
+			assert.Nil(trade.ApplyEvent(event))
+		}
+		return transition
+	}
+
+	apply(testReport{buy, binanceapi.OrderStatusNew, 1, 100, 0})
+	apply(testReport{buy, binanceapi.OrderStatusPartiallyFilled, 1, 200, 0.5})
+	assert.Equal(TradeStatusPendingBuy, trade.State.Status)
+
+	// Selling what has been bought so far.
+	apply(testReport{sell, binanceapi.OrderStatusNew, 2, 300, 0})
+	assert.Equal(TradeStatusPendingSell, trade.State.Status)
+	assert.Equal(int64(2), trade.State.SellOrderId)
+
+	// The buy finishing does not place another sell.
+	transition := apply(testReport{buy, binanceapi.OrderStatusFilled, 1, 400, 0.5})
+	assert.False(transition.BuyFilled)
+	assert.Equal(TradeStatusPendingSell, trade.State.Status)
+	assert.Equal("1", trade.State.BuyFillQuantity.String())
+}
+
+func TestAlgoBuyChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+	trade.State.TradeID = "test"
+	trade.State.Symbol = "ETHBTC"
+	trade.State.BuyOrder.Quantity = decimal.NewFromInt(2)
+	trade.State.Algo = &AlgoState{
+		Type:     AlgoTypeTWAP,
+		Side:     binanceapi.OrderSideBuy,
+		Status:   AlgoStatusRunning,
+		Quantity: decimal.NewFromInt(2),
+	}
+
+	apply := func(r testReport) {
+		transition, err := trade.OnExecutionReport(time.Now(), r.executionReport(),
+			decimal.RequireFromString("0.001"))
+		assert.Nil(err)
+		assert.False(transition.BuyFilled)
+		for _, event := range transition.Events {
+			assert.Nil(trade.ApplyEvent(event))
+		}
+	}
+
+	// Each child filling leaves the buy pending for the algo to finish.
+	apply(testReport{buy, binanceapi.OrderStatusNew, 1, 100, 0})
+	apply(testReport{buy, binanceapi.OrderStatusFilled, 1, 200, 1})
+	assert.Equal(TradeStatusPendingBuy, trade.State.Status)
+	apply(testReport{buy, binanceapi.OrderStatusNew, 2, 300, 0})
+	apply(testReport{buy, binanceapi.OrderStatusFilled, 2, 400, 1})
+	assert.Equal(TradeStatusPendingBuy, trade.State.Status)
+	assert.Equal("2", trade.State.BuyFillQuantity.String())
+	assert.Equal("2", trade.State.BuyOrder.Quantity.String())
+	assert.Equal(int64(2), trade.State.BuyOrderId)
+}
+
+func TestReportOfRecordedFillSkipped(t *testing.T) {
+	assert := assert.New(t)
+
+	trade := NewTrade()
+	trade.State.TradeID = "test"
+	trade.State.Symbol = "ETHBTC"
+	trade.State.Algo = &AlgoState{
+		Type:     AlgoTypeTWAP,
+		Side:     binanceapi.OrderSideBuy,
+		Status:   AlgoStatusRunning,
+		Quantity: decimal.NewFromInt(2),
+	}
+	stepSize := decimal.RequireFromString("0.001")
+
+	// The fill was looked up in the trade history after its report was
+	// missed.
+	assert.Nil(trade.ApplyEvent(TradeEvent{
+		Type: TradeEventFill,
+		Fill: &FillEvent{
+			Side: buy,
+			Fill: OrderFill{
+				Price:    decimal.RequireFromString("0.03"),
+				Quantity: decimal.NewFromInt(1),
+				OrderID:  1,
+				TradeID:  7,
+			},
+			StepSize: stepSize,
+		},
+	}))
+	assert.True(trade.HasFill(buy, 1, 7))
+	assert.False(trade.HasFill(buy, 1, 8))
+	assert.False(trade.HasFill(sell, 1, 7))
+
+	report := testReport{buy, binanceapi.OrderStatusFilled, 1, 200, 1}.executionReport()
+	report.TradeID = 7
+	transition, err := trade.OnExecutionReport(time.Now(), report, stepSize)
+	assert.Nil(err)
+	for _, event := range transition.Events {
+		assert.Nil(event.Fill)
+		assert.Nil(trade.ApplyEvent(event))
+	}
+	assert.Equal("1", trade.State.BuyFillQuantity.String())
+	assert.Len(trade.State.BuySideFills, 1)
+
+	// A fill of another exchange trade of the order is still recorded.
+	report.TradeID = 8
+	transition, err = trade.OnExecutionReport(time.Now(), report, stepSize)
+	assert.Nil(err)
+	for _, event := range transition.Events {
+		assert.Nil(trade.ApplyEvent(event))
+	}
+	assert.Equal("2", trade.State.BuyFillQuantity.String())
+}
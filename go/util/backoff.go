@@ -0,0 +1,57 @@
+// Copyright (C) 2019 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially increasing delays with random jitter. It is
+// not safe for concurrent use.
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt uint
+}
+
+func NewBackoff(min time.Duration, max time.Duration) *Backoff {
+	return &Backoff{
+		Min: min,
+		Max: max,
+	}
+}
+
+// Next returns the delay to wait before the next attempt. The delay doubles
+// with each call up to Max, and a random jitter of up to half the delay is
+// subtracted so multiple clients do not retry in lock step.
+func (b *Backoff) Next() time.Duration {
+	delay := b.Min << b.attempt
+	if delay <= 0 || delay > b.Max {
+		delay = b.Max
+	} else {
+		b.attempt++
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
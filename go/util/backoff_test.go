@@ -0,0 +1,36 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff := NewBackoff(time.Second, 10*time.Second)
+
+	// Doubles from the minimum up to the maximum, less up to half in
+	// jitter.
+	for _, delay := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		delay *= time.Second
+		next := backoff.Next()
+		assert.True(next >= delay/2 && next <= delay,
+			"%v not within half of %v", next, delay)
+	}
+
+	backoff.Reset()
+	next := backoff.Next()
+	assert.True(next >= time.Second/2 && next <= time.Second)
+}
+
+func TestBackoffStaysAtMax(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff := NewBackoff(time.Second, time.Minute)
+	for i := 0; i < 100; i++ {
+		next := backoff.Next()
+		assert.True(next > 0 && next <= time.Minute, "%v out of bounds", next)
+	}
+}
@@ -115,7 +115,18 @@ export class MakerService {
     }
 
     private handleNotification(notice: any) {
+        if (notice.alert) {
+            // Alerts stay up until closed by the user.
+            this.toastr.error(notice.message,
+                    notice.level == "critical" ? "Critical" : "Alert", {
+                closeButton: true,
+                disableTimeOut: true,
+                tapToDismiss: false,
+            });
+            return;
+        }
         switch (notice.level) {
+            case "critical":
             case "error":
                 this.toastr.error(notice.message, "Error", {
                     closeButton: true,
@@ -276,6 +287,7 @@ export enum TradeStatus {
     DONE = "DONE",
     CANCELED = "CANCELED",
     ABANDONED = "ABANDONED",
+    EXIT_FAILED = "EXIT_FAILED",
 }
 
 export interface TradeState {
@@ -285,9 +297,65 @@ export interface TradeState {
     OpenTime: string; // ISO format.
     CloseTime: string; // ISO format.
     Fee: number;
+    FeeQuote: number;
+    FeeBNB: number;
     BuyOrder: {
         Price: number;
         Quantity: number;
+        Type?: string;
+        TimeInForce?: string;
+        StopPrice?: number;
+    };
+    Entry?: {
+        ExpireMinutes?: number;
+        RunawayPercent?: number;
+        Chase?: boolean;
+        ChaseSeconds?: number;
+        MaxPrice: number;
+        CancelReason?: string;
+        Reprices?: number;
+        LastReprice?: string; // ISO format.
+    };
+    ExitPolicy?: {
+        MaxHoldHours?: number;
+        SellAt?: string[]; // ISO format.
+        DecayPercent?: number;
+        DecayHours?: number;
+        DecayAfterHours?: number;
+        DecayFromPercent?: number;
+        Decays?: number;
+    };
+    ExitExecution?: {
+        Mode?: string;
+        MaxSlippagePercent?: number;
+        MarketAfterAttempts?: number;
+        DepthChunks?: boolean;
+    };
+    Exit?: {
+        Trigger: string;
+        TriggerPrice: number;
+        Attempts: number;
+        AveragePrice: number;
+        SlippagePercent?: number;
+        Complete?: boolean;
+        LastError?: string;
+    };
+    Algo?: {
+        Type: string; // TWAP, ICEBERG or PARTICIPATION.
+        Side: string;
+        Status: string;
+        Quantity: number;
+        Price: number;
+        DurationMinutes?: number;
+        Slices?: number;
+        VisibleQuantity: number;
+        ParticipationPercent?: number;
+        Filled: number;
+        ChildFilled: number;
+        Children: number;
+        LastError?: string;
+        Reason?: string;
+        Finished?: boolean;
     };
     BuyFillQuantity: number;
     AverageBuyPrice: number;
@@ -299,6 +367,13 @@ export interface TradeState {
         Enabled: boolean;
         Percent: number;
         Triggered: boolean;
+        Mode?: string;
+        Price?: number;
+        BreakEvenPercent?: number;
+        StepPercent?: number;
+        StepRaisePercent?: number;
+        HighPrice?: number;
+        StopPrice?: number;
     };
     TrailingProfit: {
         Enabled: boolean;
@@ -313,6 +388,7 @@ export interface TradeState {
     LastBuyStatus: string;
     LastSellstatus: string;
     LastPrice?: number;
+    Imported?: boolean;
     SellOrder: {
         Type: string;
         Status: string;
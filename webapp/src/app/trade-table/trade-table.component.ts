@@ -203,6 +203,7 @@ export function canSell(trade: AppTradeState): boolean {
         case TradeStatus.PENDING_BUY:
         case TradeStatus.WATCHING:
         case TradeStatus.PENDING_SELL:
+        case TradeStatus.EXIT_FAILED:
             return true;
         default:
             return false;
@@ -216,6 +217,7 @@ export function canMarketSell(trade: AppTradeState): boolean {
     switch (trade.Status) {
         case TradeStatus.WATCHING:
         case TradeStatus.PENDING_SELL:
+        case TradeStatus.EXIT_FAILED:
             return true;
         default:
             return false;
@@ -257,6 +259,8 @@ export function getRowClass(trade: AppTradeState): string {
         case TradeStatus.FAILED:
         case TradeStatus.ABANDONED:
             return "table-secondary";
+        case TradeStatus.EXIT_FAILED:
+            return "bg-danger";
         case TradeStatus.DONE:
             if (trade.ProfitPercent > 0) {
                 return "bg-success";